@@ -89,3 +89,66 @@ func TestTrackerClientScrape(t *testing.T) {
 		t.Errorf("invalid scrape stats")
 	}
 }
+
+func TestParseAnnounceResponse_SkipsBadPeers(t *testing.T) {
+	body := []byte("d8:intervali900e5:peersl" +
+		"d7:peer id20:-PC0001-1234567890122:ip9:127.0.0.14:porti6881ee" +
+		"d2:ip9:127.0.0.14:port3:abce" +
+		"i42e" +
+		"d2:ip8:10.0.0.24:porti6882eeee")
+
+	c := NewTrackerClient("-PC0001-123456789012", 6881)
+	resp, err := c.parseAnnounceResponse(body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if resp.Interval != 900 {
+		t.Errorf("interval = %d, want 900", resp.Interval)
+	}
+	want := []Peer{
+		{PeerID: "-PC0001-123456789012", IP: "127.0.0.1", Port: 6881},
+		{IP: "10.0.0.2", Port: 6882},
+	}
+	if len(resp.Peers) != len(want) {
+		t.Fatalf("peers = %+v, want %+v", resp.Peers, want)
+	}
+	for i := range want {
+		if resp.Peers[i] != want[i] {
+			t.Errorf("peer %d = %+v, want %+v", i, resp.Peers[i], want[i])
+		}
+	}
+}
+
+func TestParseAnnounceResponse_MalformedPeers(t *testing.T) {
+	c := NewTrackerClient("-PC0001-123456789012", 6881)
+	if _, err := c.parseAnnounceResponse([]byte("d8:intervali900e5:peersi5ee")); err == nil {
+		t.Error("an integer peer list was not reported")
+	}
+}
+
+func TestParseAnnounceResponse_Failure(t *testing.T) {
+	c := NewTrackerClient("-PC0001-123456789012", 6881)
+	if _, err := c.parseAnnounceResponse([]byte("d14:failure reason9:not founde")); err == nil {
+		t.Error("failure reason not reported")
+	}
+}
+
+func TestParseAnnounceResponse_Compact(t *testing.T) {
+	// two peers and a stray byte
+	body := []byte("d8:intervali900e5:peers13:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2\xffe")
+
+	c := NewTrackerClient("-PC0001-123456789012", 6881)
+	resp, err := c.parseAnnounceResponse(body)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []Peer{{IP: "127.0.0.1", Port: 6881}, {IP: "10.0.0.2", Port: 6882}}
+	if len(resp.Peers) != len(want) {
+		t.Fatalf("peers = %+v, want %+v", resp.Peers, want)
+	}
+	for i := range want {
+		if resp.Peers[i] != want[i] {
+			t.Errorf("peer %d = %+v, want %+v", i, resp.Peers[i], want[i])
+		}
+	}
+}
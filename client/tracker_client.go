@@ -1,9 +1,10 @@
 package client
 
 import (
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -12,6 +13,15 @@ import (
 	"github.com/pixperk/pixtorrent/meta"
 )
 
+// trackerDecoderOptions bounds what we accept from a tracker. A few hundred
+// peers fit in well under a megabyte; anything beyond these limits is
+// either broken or hostile.
+var trackerDecoderOptions = meta.DecoderOptions{
+	MaxStringLength: 1 << 20,
+	MaxDepth:        8,
+	MaxSize:         4 << 20,
+}
+
 type TrackerClient struct {
 	client     *http.Client
 	peerID     string
@@ -26,9 +36,15 @@ type AnnounceResponse struct {
 }
 
 type Peer struct {
-	PeerID string
-	IP     string
-	Port   int
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+type announceResponse struct {
+	FailureReason string          `bencode:"failure reason,omitempty"`
+	Interval      int             `bencode:"interval"`
+	Peers         meta.RawMessage `bencode:"peers,omitempty"`
 }
 
 func NewTrackerClient(peerID string, port int) *TrackerClient {
@@ -56,18 +72,12 @@ func (tc *TrackerClient) Announce(trackerURL string, infoHash [20]byte, left int
 		return nil, fmt.Errorf("tracker returned status %d", resp.StatusCode)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readTrackerBody(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	decoder := meta.NewDecoder(bytes.NewReader(body))
-	decoded, err := decoder.Decode()
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
-	}
-
-	return tc.parseAnnounceResponse(decoded)
+	return tc.parseAnnounceResponse(body)
 }
 
 func (tc *TrackerClient) buildAnnounceURL(trackerURL string, infoHash [20]byte, left int64, event string) (string, error) {
@@ -98,65 +108,69 @@ func (tc *TrackerClient) buildAnnounceURL(trackerURL string, infoHash [20]byte,
 	return u.String(), nil
 }
 
-func (tc *TrackerClient) parseAnnounceResponse(decoded meta.Node) (*AnnounceResponse, error) {
-	dict, ok := decoded.(meta.BDict)
-	if !ok {
-		return nil, fmt.Errorf("expected dictionary response")
+func (tc *TrackerClient) parseAnnounceResponse(body []byte) (*AnnounceResponse, error) {
+	var raw announceResponse
+	if err := meta.UnmarshalWithOptions(body, &raw, trackerDecoderOptions); err != nil {
+		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
 	}
 
-	if failureReason, exists := dict["failure reason"]; exists {
-		if reasonStr, ok := failureReason.(meta.BString); ok {
-			return nil, fmt.Errorf("tracker error: %s", string(reasonStr))
-		}
+	if raw.FailureReason != "" {
+		return nil, fmt.Errorf("tracker error: %s", raw.FailureReason)
 	}
 
-	response := &AnnounceResponse{}
+	response := &AnnounceResponse{Interval: raw.Interval}
 
-	// Parse interval
-	if intervalNode, exists := dict["interval"]; exists {
-		if interval, ok := intervalNode.(meta.BInt); ok {
-			response.Interval = int(interval)
+	if len(raw.Peers) == 0 {
+		return response, nil
+	}
+
+	// most public trackers answer in compact form (BEP 23) whatever we ask
+	if raw.Peers[0] != 'l' {
+		var compact []byte
+		if err := meta.UnmarshalWithOptions(raw.Peers, &compact, trackerDecoderOptions); err != nil {
+			return nil, fmt.Errorf("failed to decode compact peers: %w", err)
 		}
+		response.Peers = parseCompactPeers(compact)
+		return response, nil
 	}
 
-	// Parse peers list
-	if peersNode, exists := dict["peers"]; exists {
-		if peersList, ok := peersNode.(meta.BList); ok {
-			for _, peerNode := range peersList {
-				if peerDict, ok := peerNode.(meta.BDict); ok {
-					peer := Peer{}
-
-					if peerIDNode, exists := peerDict["peer id"]; exists {
-						if peerID, ok := peerIDNode.(meta.BString); ok {
-							peer.PeerID = string(peerID)
-						}
-					}
-
-					if ipNode, exists := peerDict["ip"]; exists {
-						if ip, ok := ipNode.(meta.BString); ok {
-							peer.IP = string(ip)
-						}
-					}
-
-					if portNode, exists := peerDict["port"]; exists {
-						if port, ok := portNode.(meta.BInt); ok {
-							peer.Port = int(port)
-						}
-					}
-
-					response.Peers = append(response.Peers, peer)
-				}
-			}
+	// a malformed entry costs only that peer, not the whole response
+	var entries []meta.RawMessage
+	if err := meta.UnmarshalWithOptions(raw.Peers, &entries, trackerDecoderOptions); err != nil {
+		return nil, fmt.Errorf("failed to decode peers: %w", err)
+	}
+	for _, entry := range entries {
+		var peer Peer
+		if err := meta.UnmarshalWithOptions(entry, &peer, trackerDecoderOptions); err != nil {
+			continue
 		}
+		response.Peers = append(response.Peers, peer)
 	}
 
 	return response, nil
 }
 
+// parseCompactPeers decodes 6-byte entries of IPv4 address and port. A
+// trailing partial entry is ignored.
+func parseCompactPeers(compact []byte) []Peer {
+	var peers []Peer
+	for i := 0; i+6 <= len(compact); i += 6 {
+		peers = append(peers, Peer{
+			IP:   net.IP(compact[i : i+4]).String(),
+			Port: int(binary.BigEndian.Uint16(compact[i+4 : i+6])),
+		})
+	}
+	return peers
+}
+
 type ScrapeResponse struct {
-	Complete   int
-	Incomplete int
-	Downloaded int
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+	Downloaded int `bencode:"downloaded"`
+}
+
+type scrapeResponse struct {
+	Files map[string]ScrapeResponse `bencode:"files"`
 }
 
 func (tc *TrackerClient) Scrape(trackerURL string, infoHash [20]byte) (*ScrapeResponse, error) {
@@ -175,45 +189,36 @@ func (tc *TrackerClient) Scrape(trackerURL string, infoHash [20]byte) (*ScrapeRe
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readTrackerBody(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	decoder := meta.NewDecoder(bytes.NewReader(body))
-	decoded, err := decoder.Decode()
-	if err != nil {
+	var raw scrapeResponse
+	if err := meta.UnmarshalWithOptions(body, &raw, trackerDecoderOptions); err != nil {
 		return nil, err
 	}
-
-	dict, ok := decoded.(meta.BDict)
-	if !ok {
-		return nil, fmt.Errorf("invalid scrape response")
-	}
-	files, ok := dict["files"].(meta.BDict)
-	if !ok {
+	if raw.Files == nil {
 		return nil, fmt.Errorf("missing files in scrape response")
 	}
-	for _, v := range files {
-		stats, ok := v.(meta.BDict)
-		if !ok {
-			continue
-		}
-		response := &ScrapeResponse{}
-		if complete, ok := stats["complete"].(meta.BInt); ok {
-			response.Complete = int(complete)
-		}
-		if incomplete, ok := stats["incomplete"].(meta.BInt); ok {
-			response.Incomplete = int(incomplete)
-		}
-		if downloaded, ok := stats["downloaded"].(meta.BInt); ok {
-			response.Downloaded = int(downloaded)
-		}
-		return response, nil
+	for _, stats := range raw.Files {
+		response := stats
+		return &response, nil
 	}
 	return nil, fmt.Errorf("no stats found")
 }
 
+func readTrackerBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, trackerDecoderOptions.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > trackerDecoderOptions.MaxSize {
+		return nil, fmt.Errorf("tracker response exceeds %d bytes", trackerDecoderOptions.MaxSize)
+	}
+	return body, nil
+}
+
 func (tc *TrackerClient) UpdateStats(uploaded, downloaded int64) {
 	tc.uploaded = uploaded
 	tc.downloaded = downloaded
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pixperk/pixtorrent/dht"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dhtEnabled   bool
+	dhtPort      int
+	dhtBootstrap []string
+	dhtState     string
+)
+
+// dhtNode is the process's DHT node, shared by every server it runs and
+// closed on exit.
+var dhtNode *dht.Server
+
+func addDHTFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&dhtEnabled, "dht", false, "Find peers on the mainline DHT too, so the tracker is not needed")
+	cmd.Flags().IntVar(&dhtPort, "dht-port", 6881, "UDP port of the DHT node")
+	cmd.Flags().StringSliceVar(&dhtBootstrap, "dht-bootstrap", dht.DefaultBootstrapNodes, "DHT nodes to join through (host:port)")
+	cmd.Flags().StringVar(&dhtState, "dht-state", "", "File keeping the DHT routing table (default <dir>/.pixtorrent/dht.dat)")
+}
+
+// startDHT starts the DHT node when --dht is given, keeping its state
+// under dir. It returns nil when the DHT is disabled and the running node
+// when one was started before.
+func startDHT(dir string) (*dht.Server, error) {
+	if !dhtEnabled || dhtNode != nil {
+		return dhtNode, nil
+	}
+
+	state := dhtState
+	if state == "" {
+		state = dht.DefaultStateFile(dir)
+	}
+	node, err := dht.New(dht.Config{
+		Addr:           fmt.Sprintf("0.0.0.0:%d", dhtPort),
+		BootstrapNodes: dhtBootstrap,
+		StateFile:      state,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := node.Start(); err != nil {
+		return nil, err
+	}
+	// an empty table fills as other nodes find us
+	if err := node.Bootstrap(); err != nil {
+		fmt.Printf("[DHT] bootstrap failed: %v\n", err)
+	}
+	dhtNode = node
+	return node, nil
+}
+
+// closeDHT saves the DHT routing table and stops the node.
+func closeDHT() {
+	if dhtNode == nil {
+		return
+	}
+	if err := dhtNode.Close(); err != nil {
+		fmt.Printf("failed to save DHT state: %v\n", err)
+	}
+}
+
+// printDHT shows the DHT node in the Network section.
+func printDHT(node *dht.Server) {
+	if node == nil {
+		PrintStatus("DHT", "disabled", Yellow)
+		return
+	}
+	PrintKeyValue("DHT", fmt.Sprintf("udp port %d, %d nodes", node.Port(), node.NumNodes()))
+}
@@ -3,11 +3,16 @@ package cmd
 import (
 	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/pixperk/pixtorrent/meta"
 	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
 	torrentserver "github.com/pixperk/pixtorrent/torrent_server"
 	"github.com/spf13/cobra"
 )
@@ -20,29 +25,63 @@ var (
 	downloadPieces     int
 	downloadFormat     string
 	downloadPieceHash  string
+	downloadRecheck    bool
+	downloadPieceSize  int64
+	downloadLength     int64
+	downloadQueueSize  int
+	downloadOnly       []string
+	downloadSequential bool
+	downloadServePort  int
+	downloadProtocol   string
 )
 
 var downloadCmd = &cobra.Command{
-	Use:   "download",
+	Use:   "download [file.torrent | magnet-link]",
 	Short: "Download a file from the network",
-	Long:  `Connect to peers and download a file by its info hash.`,
-	RunE:  runDownload,
+	Long: `Connect to peers and download a file by its info hash.
+
+When a .torrent file is given, the info hash, piece hashes and trackers are
+taken from it and the content is written with the torrent's file layout.
+
+A magnet link works the same way once the torrent's metadata has been fetched
+from peers that support it.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runDownload,
 }
 
 func init() {
-	downloadCmd.Flags().StringVarP(&downloadInfoHash, "hash", "i", "", "Info hash of the file (40 hex chars, required)")
+	downloadCmd.Flags().StringVarP(&downloadInfoHash, "hash", "i", "", "Info hash of the file (40 hex chars, required without a .torrent)")
 	downloadCmd.Flags().StringVarP(&downloadPort, "port", "p", "0", "Port to listen on (0 for random)")
 	downloadCmd.Flags().StringVarP(&downloadTracker, "tracker", "t", "http://localhost:8080", "Tracker URL")
 	downloadCmd.Flags().StringVarP(&downloadOutput, "output", "o", "downloads", "Output directory")
-	downloadCmd.Flags().IntVarP(&downloadPieces, "pieces", "n", 1, "Expected number of pieces")
+	downloadCmd.Flags().IntVarP(&downloadPieces, "pieces", "n", 1, "Number of pieces; derived from --length and checked against it if given")
 	downloadCmd.Flags().StringVarP(&downloadFormat, "format", "f", "bin", "Output file format/extension")
 	downloadCmd.Flags().StringVarP(&downloadPieceHash, "piece-hashes", "H", "", "Piece hashes (hex string, 40 chars per piece)")
+	downloadCmd.Flags().Int64VarP(&downloadPieceSize, "piece-size", "s", 16384, "Piece size in bytes (without a .torrent)")
+	downloadCmd.Flags().Int64VarP(&downloadLength, "length", "l", 0, "Total size in bytes (required without a .torrent)")
+	downloadCmd.Flags().IntVarP(&downloadQueueSize, "queue", "q", torrentserver.DefaultRequestQueueSize, "Outstanding block requests per peer")
+	downloadCmd.Flags().BoolVar(&downloadRecheck, "recheck", false, "Hash existing data in the output directory before downloading (with a .torrent)")
+	downloadCmd.Flags().BoolVar(&downloadSequential, "sequential", false, "Fetch pieces in order instead of rarest first, e.g. to play media while it downloads")
+	downloadCmd.Flags().IntVar(&downloadServePort, "serve-port", 0, "Serve the torrent's files over HTTP on 127.0.0.1 at this port while downloading (0 disables)")
+	downloadCmd.Flags().StringSliceVar(&downloadOnly, "only", nil, "Download only these files of the torrent, by path inside it (e.g. sub/b.txt); others are skipped")
+	downloadCmd.Flags().StringVar(&downloadProtocol, "protocol", "", "Wire protocol, bittorrent or pixtorrent (default bittorrent with a .torrent, else pixtorrent)")
+	addDHTFlags(downloadCmd)
+	addLSDFlags(downloadCmd)
 
-	downloadCmd.MarkFlagRequired("hash")
 	rootCmd.AddCommand(downloadCmd)
 }
 
 func runDownload(cmd *cobra.Command, args []string) error {
+	if len(args) == 1 {
+		if strings.HasPrefix(args[0], "magnet:") {
+			return runDownloadMagnet(cmd, args[0])
+		}
+		return runDownloadTorrent(cmd, args[0])
+	}
+	if downloadInfoHash == "" {
+		return fmt.Errorf("either a .torrent file or --hash is required")
+	}
+
 	if len(downloadInfoHash) != 40 {
 		return fmt.Errorf("info hash must be 40 hex characters")
 	}
@@ -63,12 +102,44 @@ func runDownload(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// blocks are requested by offset, so the size of the last piece must
+	// be known; a piece count alone does not give it
+	if downloadLength <= 0 {
+		if cmd.Flags().Changed("pieces") {
+			return fmt.Errorf("--length is required without a .torrent; -n is derived from it (the seeder prints both)")
+		}
+		return fmt.Errorf("--length is required without a .torrent")
+	}
+	if downloadPieceSize <= 0 {
+		return fmt.Errorf("piece size must be positive")
+	}
+	numPieces := int((downloadLength + downloadPieceSize - 1) / downloadPieceSize)
+	if cmd.Flags().Changed("pieces") && downloadPieces != numPieces {
+		return fmt.Errorf("%d pieces of %d bytes cannot hold %d bytes", downloadPieces, downloadPieceSize, downloadLength)
+	}
+	downloadPieces = numPieces
+
 	var pm *p2p.PieceManager
 	if len(pieceHashes) > 0 {
 		pm = p2p.NewPieceManagerWithHashes(downloadPieces, pieceHashes)
 	} else {
 		pm = p2p.NewPieceManager(downloadPieces)
 	}
+	pm.SetLayout(downloadPieceSize, downloadLength)
+
+	protocol, err := wireProtocol(downloadProtocol, false)
+	if err != nil {
+		return err
+	}
+
+	node, err := startDHT(downloadOutput)
+	if err != nil {
+		return err
+	}
+	local, err := startLSD()
+	if err != nil {
+		return err
+	}
 
 	listenAddr := fmt.Sprintf("0.0.0.0:%s", downloadPort)
 
@@ -77,6 +148,7 @@ func runDownload(cmd *cobra.Command, args []string) error {
 		InfoHash:   infoHash,
 		Handshake:  p2p.DefaultHandshakeFunc,
 		Decoder:    &p2p.BinaryDecoder{},
+		Protocol:   protocol,
 	}
 
 	server := torrentserver.NewTorrentServer(torrentserver.TorrentServerOpts{
@@ -84,6 +156,9 @@ func runDownload(cmd *cobra.Command, args []string) error {
 		TrackerUrl:       downloadTracker,
 		RootDir:          downloadOutput,
 		FileFormat:       downloadFormat,
+		RequestQueueSize: downloadQueueSize,
+		DHT:              node,
+		LSD:              local,
 	}, pm)
 
 	PrintLogoSmall()
@@ -91,7 +166,8 @@ func runDownload(cmd *cobra.Command, args []string) error {
 
 	PrintSection("Target")
 	PrintKeyValueHighlight("InfoHash", downloadInfoHash)
-	PrintKeyValue("Pieces", fmt.Sprintf("%d", downloadPieces))
+	PrintKeyValue("Size", FormatBytes(downloadLength))
+	PrintKeyValue("Pieces", fmt.Sprintf("%d x %s", downloadPieces, FormatBytes(downloadPieceSize)))
 
 	PrintSection("Output")
 	PrintKeyValue("Directory", downloadOutput+"/")
@@ -99,6 +175,9 @@ func runDownload(cmd *cobra.Command, args []string) error {
 
 	PrintSection("Network")
 	PrintKeyValue("Tracker", downloadTracker)
+	PrintKeyValue("Protocol", protocol.Name)
+	printDHT(node)
+	printLSD(local)
 	if len(pieceHashes) > 0 {
 		PrintStatus("Verify", "enabled", Green)
 	} else {
@@ -108,6 +187,264 @@ func runDownload(cmd *cobra.Command, args []string) error {
 	PrintDivider()
 	PrintInfo("Connecting to peers...")
 
+	return startServer(server)
+}
+
+func runDownloadTorrent(cmd *cobra.Command, path string) error {
+	torrent, err := loadTorrent(path)
+	if err != nil {
+		return err
+	}
+	return downloadTorrent(cmd, torrent, "Torrent", path)
+}
+
+// downloadTorrent downloads the content a torrent describes; source names
+// where the torrent came from.
+func downloadTorrent(cmd *cobra.Command, torrent *meta.Torrent, sourceKind, source string) error {
+	infoHash, err := torrent.InfoHash()
+	if err != nil {
+		return fmt.Errorf("failed to compute info hash: %w", err)
+	}
+	trackers := downloadTrackers(cmd, torrent.Trackers())
+
+	info := torrent.Info
+	contentPath, err := storage.ContentPath(downloadOutput, &info)
+	if err != nil {
+		return err
+	}
+	store, err := storage.New(contentPath, &info)
+	if err != nil {
+		return err
+	}
+	pm := p2p.NewPieceManagerWithStorage(info.NumPieces(), info.Pieces, store)
+	pm.SetLayout(info.PieceLength, info.TotalLength())
+
+	opts, err := downloadServerOpts(infoHash, trackers)
+	if err != nil {
+		return err
+	}
+	opts.Torrent = torrent
+	server := torrentserver.NewTorrentServer(opts, pm)
+
+	if err := showDownload(server, torrent, sourceKind, source); err != nil {
+		return err
+	}
+	PrintDivider()
+	PrintInfo("Connecting to peers...")
+
+	return startServer(server)
+}
+
+// downloadTrackers puts an explicit --tracker before the torrent's own
+// trackers, and falls back to it when there are none.
+func downloadTrackers(cmd *cobra.Command, trackers []string) []string {
+	if cmd.Flags().Changed("tracker") || len(trackers) == 0 {
+		return append([]string{downloadTracker}, trackers...)
+	}
+	return trackers
+}
+
+// downloadServerOpts sets up a server downloading by torrent or magnet
+// link into --output.
+func downloadServerOpts(infoHash [20]byte, trackers []string) (torrentserver.TorrentServerOpts, error) {
+	protocol, err := wireProtocol(downloadProtocol, true)
+	if err != nil {
+		return torrentserver.TorrentServerOpts{}, err
+	}
+	node, err := startDHT(downloadOutput)
+	if err != nil {
+		return torrentserver.TorrentServerOpts{}, err
+	}
+	local, err := startLSD()
+	if err != nil {
+		return torrentserver.TorrentServerOpts{}, err
+	}
+
+	return torrentserver.TorrentServerOpts{
+		TCPTransportOpts: p2p.TCPTransportOpts{
+			ListenAddr: fmt.Sprintf("0.0.0.0:%s", downloadPort),
+			InfoHash:   infoHash,
+			Handshake:  p2p.DefaultHandshakeFunc,
+			Decoder:    &p2p.BinaryDecoder{},
+			Protocol:   protocol,
+		},
+		TrackerUrls:      trackers,
+		RootDir:          downloadOutput,
+		ResumeFile:       torrentserver.DefaultResumeFile(downloadOutput, infoHash),
+		Recheck:          downloadRecheck,
+		RequestQueueSize: downloadQueueSize,
+		Sequential:       downloadSequential,
+		DHT:              node,
+		LSD:              local,
+	}, nil
+}
+
+// showDownload applies --only, prints what is about to be downloaded and
+// starts serving it over HTTP if asked to.
+func showDownload(server *torrentserver.TorrentServer, torrent *meta.Torrent, sourceKind, source string) error {
+	info := torrent.Info
+	selected, err := selectFiles(server, &info, downloadOnly)
+	if err != nil {
+		return err
+	}
+
+	PrintLogoSmall()
+	PrintHeader("DOWNLOADING")
+
+	PrintSection("Target")
+	PrintKeyValue(sourceKind, source)
+	PrintKeyValue("Name", info.Name)
+	PrintKeyValueHighlight("InfoHash", fmt.Sprintf("%x", server.TCPTransportOpts.InfoHash))
+	PrintKeyValue("Size", FormatBytes(info.TotalLength()))
+	if len(info.Files) > 0 {
+		PrintKeyValue("Files", fmt.Sprintf("%d", len(info.Files)))
+	}
+	for _, path := range selected {
+		PrintKeyValue("Only", path)
+	}
+	PrintKeyValue("Pieces", fmt.Sprintf("%d x %s", info.NumPieces(), FormatBytes(info.PieceLength)))
+
+	PrintSection("Output")
+	PrintKeyValue("Directory", downloadOutput+"/")
+
+	PrintSection("Network")
+	for i, tracker := range server.TrackerUrls {
+		PrintKeyValue(fmt.Sprintf("Tracker %d", i), tracker)
+	}
+	PrintKeyValue("Protocol", server.TCPTransportOpts.Protocol.Name)
+	printDHT(server.DHT)
+	printLSD(server.LSD)
+	PrintStatus("Verify", "enabled", Green)
+
+	if downloadServePort > 0 {
+		urls, err := serveHTTP(server, downloadServePort)
+		if err != nil {
+			return err
+		}
+		PrintSection("Streaming")
+		for _, u := range urls {
+			PrintKeyValue("URL", u)
+		}
+	}
+	return nil
+}
+
+// runDownloadMagnet fetches the torrent's metadata from peers and then
+// downloads it like a .torrent file, on the same server and connections.
+func runDownloadMagnet(cmd *cobra.Command, uri string) error {
+	magnet, err := meta.ParseMagnet(uri)
+	if err != nil {
+		return err
+	}
+	trackers := downloadTrackers(cmd, magnet.Trackers)
+
+	opts, err := downloadServerOpts(magnet.InfoHash, trackers)
+	if err != nil {
+		return err
+	}
+	var server *torrentserver.TorrentServer
+	opts.FetchMetadata = true
+	opts.OnMetadata = func(torrent *meta.Torrent) error {
+		if err := showDownload(server, torrent, "Magnet", uri); err != nil {
+			return err
+		}
+		PrintDivider()
+		PrintInfo("Downloading from the peers found so far...")
+		return nil
+	}
+	server = torrentserver.NewTorrentServer(opts, p2p.NewPieceManager(0))
+
+	PrintHeader("FETCHING METADATA")
+	PrintSection("Target")
+	if magnet.Name != "" {
+		PrintKeyValue("Name", magnet.Name)
+	}
+	PrintKeyValueHighlight("InfoHash", fmt.Sprintf("%x", magnet.InfoHash))
+	PrintSection("Network")
+	for i, tracker := range trackers {
+		PrintKeyValue(fmt.Sprintf("Tracker %d", i), tracker)
+	}
+	PrintKeyValue("Protocol", opts.TCPTransportOpts.Protocol.Name)
+	printDHT(opts.DHT)
+	printLSD(opts.LSD)
+	PrintDivider()
+	PrintInfo("Asking peers for the torrent's metadata...")
+
+	return startServer(server)
+}
+
+func loadTorrent(path string) (*meta.Torrent, error) {
+	torrent, err := meta.ParseTorrentFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return torrent, nil
+}
+
+// wireProtocol resolves --protocol. Real torrents speak standard
+// BitTorrent unless told otherwise, so other clients can join; the
+// hash-only modes keep the original protocol.
+func wireProtocol(name string, withTorrent bool) (*p2p.Protocol, error) {
+	if name != "" {
+		return p2p.ParseProtocol(name)
+	}
+	if withTorrent {
+		return p2p.BitTorrentProtocol, nil
+	}
+	return p2p.PixTorrentProtocol, nil
+}
+
+// selectFiles skips every file of the torrent not named in only and
+// returns the names it matched. An empty list selects everything.
+func selectFiles(server *torrentserver.TorrentServer, info *meta.InfoDict, only []string) ([]string, error) {
+	if len(only) == 0 {
+		return nil, nil
+	}
+	if len(info.Files) == 0 {
+		return nil, fmt.Errorf("--only needs a multi-file torrent")
+	}
+
+	wanted := make(map[string]bool)
+	for _, path := range only {
+		wanted[path] = true
+	}
+
+	var selected []string
+	for i, file := range info.Files {
+		path := strings.Join(file.Path, "/")
+		if wanted[path] {
+			selected = append(selected, path)
+			delete(wanted, path)
+			continue
+		}
+		if err := server.SetFilePriority(i, p2p.PrioritySkip); err != nil {
+			return nil, err
+		}
+	}
+	for path := range wanted {
+		return nil, fmt.Errorf("no file %q in the torrent", path)
+	}
+	return selected, nil
+}
+
+// serveHTTP exposes the server's files on 127.0.0.1:port and returns
+// their URLs.
+func serveHTTP(server *torrentserver.TorrentServer, port int) ([]string, error) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for HTTP on %s: %w", addr, err)
+	}
+	go func() {
+		if err := http.Serve(ln, server); err != nil {
+			fmt.Printf("HTTP server stopped: %v\n", err)
+		}
+	}()
+	return server.FileURLs("http://" + addr), nil
+}
+
+// startServer runs the server until it stops or the process is interrupted.
+func startServer(server *torrentserver.TorrentServer) error {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
@@ -115,8 +452,12 @@ func runDownload(cmd *cobra.Command, args []string) error {
 		<-sigCh
 		fmt.Println("\nShutting down...")
 		server.Stop()
+		closeDHT()
+		closeLSD()
 		os.Exit(0)
 	}()
 
+	defer closeDHT()
+	defer closeLSD()
 	return server.Start()
 }
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/pixperk/pixtorrent/lsd"
+	"github.com/spf13/cobra"
+)
+
+var lsdEnabled bool
+
+// lsdService is the process's local service discovery, shared by every
+// server it runs and closed on exit.
+var lsdService *lsd.Service
+
+func addLSDFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&lsdEnabled, "lsd", false, "Find peers on the local network by multicast (BEP 14)")
+}
+
+// startLSD joins the LSD multicast groups when --lsd is given. It returns
+// nil when LSD is disabled and the running service when one was started
+// before.
+func startLSD() (*lsd.Service, error) {
+	if !lsdEnabled || lsdService != nil {
+		return lsdService, nil
+	}
+
+	service := lsd.New(lsd.Config{})
+	if err := service.Start(); err != nil {
+		return nil, err
+	}
+	lsdService = service
+	return service, nil
+}
+
+// closeLSD stops local service discovery.
+func closeLSD() {
+	if lsdService != nil {
+		lsdService.Close()
+	}
+}
+
+// printLSD shows local service discovery in the Network section.
+func printLSD(service *lsd.Service) {
+	if service == nil {
+		PrintStatus("LSD", "disabled", Yellow)
+		return
+	}
+	PrintStatus("LSD", "enabled", Green)
+}
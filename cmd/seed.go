@@ -3,12 +3,13 @@ package cmd
 import (
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"syscall"
 
+	"github.com/pixperk/pixtorrent/meta"
 	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
 	torrentserver "github.com/pixperk/pixtorrent/torrent_server"
 	"github.com/spf13/cobra"
 )
@@ -18,54 +19,82 @@ var (
 	seedPort      string
 	seedTracker   string
 	seedPieceSize int
+	seedTorrent   string
+	seedData      string
+	seedProtocol  string
 )
 
 var seedCmd = &cobra.Command{
 	Use:   "seed",
 	Short: "Seed a file to the network",
-	Long:  `Start seeding a file, making it available for other peers to download.`,
-	RunE:  runSeed,
+	Long: `Start seeding a file, making it available for other peers to download.
+
+With --torrent, the content described by an existing .torrent file is seeded
+from --data: either the directory holding the torrent's top-level file or
+folder, or that file or folder itself. Every piece is verified first.`,
+	RunE: runSeed,
 }
 
 func init() {
-	seedCmd.Flags().StringVarP(&seedFile, "file", "f", "", "File to seed (required)")
+	seedCmd.Flags().StringVarP(&seedFile, "file", "f", "", "File to seed (required without --torrent)")
 	seedCmd.Flags().StringVarP(&seedPort, "port", "p", "0", "Port to listen on (0 for random)")
 	seedCmd.Flags().StringVarP(&seedTracker, "tracker", "t", "http://localhost:8080", "Tracker URL")
 	seedCmd.Flags().IntVarP(&seedPieceSize, "piece-size", "s", 16384, "Piece size in bytes")
+	seedCmd.Flags().StringVar(&seedTorrent, "torrent", "", "Seed the content of this .torrent file")
+	seedCmd.Flags().StringVarP(&seedData, "data", "d", ".", "Where the torrent's content lives (with --torrent)")
+	seedCmd.Flags().StringVar(&seedProtocol, "protocol", "", "Wire protocol, bittorrent or pixtorrent (default bittorrent with --torrent, else pixtorrent)")
+
+	addDHTFlags(seedCmd)
+	addLSDFlags(seedCmd)
 
-	seedCmd.MarkFlagRequired("file")
+	seedCmd.MarkFlagsMutuallyExclusive("file", "torrent")
 	rootCmd.AddCommand(seedCmd)
 }
 
 func runSeed(cmd *cobra.Command, args []string) error {
-	data, err := os.ReadFile(seedFile)
+	if seedTorrent != "" {
+		return runSeedTorrent(cmd)
+	}
+	if seedFile == "" {
+		return fmt.Errorf("either --file or --torrent is required")
+	}
+
+	stat, err := os.Stat(seedFile)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
+	size := stat.Size()
 
-	infoHash := sha1.Sum(data)
-	numPieces := (len(data) + seedPieceSize - 1) / seedPieceSize
+	// the file stays on disk; pieces are hashed and served straight from it
+	store, err := storage.New(seedFile, &meta.InfoDict{
+		Name:        filepath.Base(seedFile),
+		Length:      size,
+		PieceLength: int64(seedPieceSize),
+	})
+	if err != nil {
+		return err
+	}
+
+	infoHash, err := hashFile(seedFile)
+	if err != nil {
+		return err
+	}
+	numPieces := store.NumPieces()
 
 	pieceHashes := make([]byte, numPieces*20)
 	for i := 0; i < numPieces; i++ {
-		start := i * seedPieceSize
-		end := start + seedPieceSize
-		if end > len(data) {
-			end = len(data)
+		piece, err := store.ReadPiece(i)
+		if err != nil {
+			return err
 		}
-		hash := sha1.Sum(data[start:end])
+		hash := sha1.Sum(piece)
 		copy(pieceHashes[i*20:(i+1)*20], hash[:])
 	}
 
-	pm := p2p.NewPieceManagerWithHashes(numPieces, pieceHashes)
-
+	pm := p2p.NewPieceManagerWithStorage(numPieces, pieceHashes, store)
+	pm.SetLayout(int64(seedPieceSize), size)
 	for i := 0; i < numPieces; i++ {
-		start := i * seedPieceSize
-		end := start + seedPieceSize
-		if end > len(data) {
-			end = len(data)
-		}
-		pm.AddPiece(i, data[start:end])
+		pm.MarkPiece(i)
 	}
 
 	listenAddr := fmt.Sprintf("0.0.0.0:%s", seedPort)
@@ -74,11 +103,25 @@ func runSeed(cmd *cobra.Command, args []string) error {
 		ext = ext[1:]
 	}
 
+	protocol, err := wireProtocol(seedProtocol, false)
+	if err != nil {
+		return err
+	}
+	node, err := startDHT("downloads")
+	if err != nil {
+		return err
+	}
+	local, err := startLSD()
+	if err != nil {
+		return err
+	}
+
 	tcpOpts := p2p.TCPTransportOpts{
 		ListenAddr: listenAddr,
 		InfoHash:   infoHash,
 		Handshake:  p2p.DefaultHandshakeFunc,
 		Decoder:    &p2p.BinaryDecoder{},
+		Protocol:   protocol,
 	}
 
 	server := torrentserver.NewTorrentServer(torrentserver.TorrentServerOpts{
@@ -86,6 +129,8 @@ func runSeed(cmd *cobra.Command, args []string) error {
 		TrackerUrl:       seedTracker,
 		RootDir:          "downloads",
 		FileFormat:       ext,
+		DHT:              node,
+		LSD:              local,
 	}, pm)
 
 	pieceHashHex := fmt.Sprintf("%x", pieceHashes)
@@ -95,15 +140,18 @@ func runSeed(cmd *cobra.Command, args []string) error {
 
 	PrintSection("File Info")
 	PrintKeyValue("File", seedFile)
-	PrintKeyValue("Size", FormatBytes(int64(len(data))))
+	PrintKeyValue("Size", FormatBytes(size))
 	PrintKeyValue("Pieces", fmt.Sprintf("%d x %s", numPieces, FormatBytes(int64(seedPieceSize))))
 
 	PrintSection("Network")
 	PrintKeyValueHighlight("InfoHash", fmt.Sprintf("%x", infoHash))
 	PrintKeyValue("Tracker", seedTracker)
+	PrintKeyValue("Protocol", protocol.Name)
+	printDHT(node)
+	printLSD(local)
 
 	PrintSection("Commands")
-	downloadCmd := fmt.Sprintf("pixtorrent download -i %x -n %d -f %s -t %s -H %s", infoHash, numPieces, ext, seedTracker, pieceHashHex)
+	downloadCmd := fmt.Sprintf("pixtorrent download -i %x -l %d -s %d -f %s -t %s -H %s", infoHash, size, seedPieceSize, ext, seedTracker, pieceHashHex)
 	connectCmd := fmt.Sprintf("pixtorrent connect -i %x -n %d -t %s", infoHash, numPieces, seedTracker)
 	PrintKeyValue("Download", "")
 	PrintCommand(downloadCmd)
@@ -113,15 +161,147 @@ func runSeed(cmd *cobra.Command, args []string) error {
 	PrintDivider()
 	PrintInfo("Waiting for peers...")
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	return startServer(server)
+}
+
+func runSeedTorrent(cmd *cobra.Command) error {
+	torrent, err := loadTorrent(seedTorrent)
+	if err != nil {
+		return err
+	}
+
+	infoHash, err := torrent.InfoHash()
+	if err != nil {
+		return fmt.Errorf("failed to compute info hash: %w", err)
+	}
 
-	go func() {
-		<-sigCh
-		fmt.Println("\nShutting down...")
-		server.Stop()
-		os.Exit(0)
-	}()
+	info := torrent.Info
+	store, err := openTorrentData(&info, seedData)
+	if err != nil {
+		return err
+	}
+
+	numPieces := info.NumPieces()
+	pm := p2p.NewPieceManagerWithStorage(numPieces, info.Pieces, store)
+	pm.SetLayout(info.PieceLength, info.TotalLength())
+	if valid := pm.Recheck(0, nil); valid != numPieces {
+		return fmt.Errorf("%d of %d pieces do not match the torrent, is --data pointing at the right content?", numPieces-valid, numPieces)
+	}
+
+	trackers := torrent.Trackers()
+	if cmd.Flags().Changed("tracker") || len(trackers) == 0 {
+		trackers = append([]string{seedTracker}, trackers...)
+	}
 
-	return server.Start()
+	protocol, err := wireProtocol(seedProtocol, true)
+	if err != nil {
+		return err
+	}
+	node, err := startDHT("downloads")
+	if err != nil {
+		return err
+	}
+	local, err := startLSD()
+	if err != nil {
+		return err
+	}
+
+	tcpOpts := p2p.TCPTransportOpts{
+		ListenAddr: fmt.Sprintf("0.0.0.0:%s", seedPort),
+		InfoHash:   infoHash,
+		Handshake:  p2p.DefaultHandshakeFunc,
+		Decoder:    &p2p.BinaryDecoder{},
+		Protocol:   protocol,
+	}
+
+	server := torrentserver.NewTorrentServer(torrentserver.TorrentServerOpts{
+		TCPTransportOpts: tcpOpts,
+		TrackerUrls:      trackers,
+		RootDir:          "downloads",
+		Torrent:          torrent,
+		DHT:              node,
+		LSD:              local,
+	}, pm)
+
+	PrintLogoSmall()
+	PrintHeader("SEEDING")
+
+	PrintSection("Torrent Info")
+	PrintKeyValue("Torrent", seedTorrent)
+	PrintKeyValue("Name", info.Name)
+	PrintKeyValue("Size", FormatBytes(info.TotalLength()))
+	if len(info.Files) > 0 {
+		PrintKeyValue("Files", fmt.Sprintf("%d", len(info.Files)))
+	}
+	PrintKeyValue("Pieces", fmt.Sprintf("%d x %s", numPieces, FormatBytes(info.PieceLength)))
+	PrintStatus("Verified", "all pieces", Green)
+
+	PrintSection("Network")
+	PrintKeyValueHighlight("InfoHash", fmt.Sprintf("%x", infoHash))
+	for i, tracker := range trackers {
+		PrintKeyValue(fmt.Sprintf("Tracker %d", i), tracker)
+	}
+	PrintKeyValue("Protocol", protocol.Name)
+	printDHT(node)
+	printLSD(local)
+
+	PrintSection("Commands")
+	PrintKeyValue("Download", "")
+	PrintCommand(fmt.Sprintf("pixtorrent download %s", seedTorrent))
+	magnet := &meta.Magnet{InfoHash: infoHash, Name: info.Name, Trackers: trackers}
+	PrintKeyValue("Magnet", "")
+	PrintCommand(fmt.Sprintf("pixtorrent download %q", magnet.String()))
+
+	PrintDivider()
+	PrintInfo("Waiting for peers...")
+
+	return startServer(server)
+}
+
+// torrentContentPath resolves where a torrent's content is: data may be
+// the directory containing info.Name or the file or folder itself.
+func torrentContentPath(info *meta.InfoDict, data string) string {
+	if contentPath, err := storage.ContentPath(data, info); err == nil {
+		if _, err := os.Stat(contentPath); err == nil {
+			return contentPath
+		}
+	}
+	return data
+}
+
+// openTorrentData opens the torrent's content at data and checks that every
+// file is present with the right size.
+func openTorrentData(info *meta.InfoDict, data string) (*storage.Storage, error) {
+	store, err := storage.New(torrentContentPath(info, data), info)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range store.Files() {
+		stat, err := os.Stat(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("missing content: %w", err)
+		}
+		if stat.Size() != file.Length {
+			return nil, fmt.Errorf("%s is %d bytes, torrent expects %d", file.Path, stat.Size(), file.Length)
+		}
+	}
+	return store, nil
+}
+
+// hashFile is the SHA-1 of a whole file, read in a stream.
+func hashFile(path string) ([20]byte, error) {
+	var sum [20]byte
+
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, fmt.Errorf("failed to read file: %w", err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
 }
@@ -145,3 +145,14 @@ func FormatBytes(bytes int64) string {
 	}
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
+
+// PrintProgress redraws a single progress line; print a newline once done.
+func PrintProgress(label string, done, total int) {
+	const width = 30
+	filled := 0
+	if total > 0 {
+		filled = done * width / total
+	}
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+	fmt.Printf("\r  %s%-12s%s %s%s%s %d/%d", Dim, label, Reset, Cyan, bar, Reset, done, total)
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyData    string
+	verifyWorkers int
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <file.torrent>",
+	Short: "Hash existing data against a .torrent",
+	Long: `Hash every piece of the content on disk against the piece hashes in a
+.torrent file and report how much of it is present and intact.
+
+--data is the directory holding the torrent's top-level file or folder, or
+that file or folder itself. Missing files count as missing pieces.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVerify,
+}
+
+func init() {
+	verifyCmd.Flags().StringVarP(&verifyData, "data", "d", ".", "Where the torrent's content lives")
+	verifyCmd.Flags().IntVarP(&verifyWorkers, "workers", "j", 0, "Hashing goroutines (0 for one per CPU)")
+
+	rootCmd.AddCommand(verifyCmd)
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	torrent, err := loadTorrent(args[0])
+	if err != nil {
+		return err
+	}
+	info := torrent.Info
+
+	path := torrentContentPath(&info, verifyData)
+	store, err := storage.New(path, &info)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	numPieces := info.NumPieces()
+	pm := p2p.NewPieceManagerWithStorage(numPieces, info.Pieces, store)
+
+	PrintLogoSmall()
+	PrintHeader("VERIFY")
+
+	PrintSection("Content")
+	PrintKeyValue("Name", info.Name)
+	PrintKeyValue("Path", path)
+	PrintKeyValue("Size", FormatBytes(info.TotalLength()))
+	PrintKeyValue("Pieces", fmt.Sprintf("%d x %s", numPieces, FormatBytes(info.PieceLength)))
+	fmt.Println()
+
+	var mu sync.Mutex
+	start := time.Now()
+	valid := pm.Recheck(verifyWorkers, func(done, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		PrintProgress("Hashing", done, total)
+	})
+	elapsed := time.Since(start)
+	fmt.Println()
+
+	PrintSection("Result")
+	PrintKeyValue("Valid", fmt.Sprintf("%d / %d pieces", valid, numPieces))
+	PrintKeyValue("Hashed in", elapsed.Round(time.Millisecond).String())
+	if valid < numPieces {
+		PrintKeyValue("Bad pieces", summarizePieces(pm, numPieces))
+		PrintWarning(fmt.Sprintf("%d pieces missing or corrupt", numPieces-valid))
+		return nil
+	}
+
+	PrintSuccess("All pieces verified")
+	return nil
+}
+
+// summarizePieces lists the pieces that failed as ranges, e.g. "0-3, 7".
+func summarizePieces(pm *p2p.PieceManager, numPieces int) string {
+	var ranges []string
+	for i := 0; i < numPieces; i++ {
+		if pm.HasPiece(i) {
+			continue
+		}
+		j := i
+		for j+1 < numPieces && !pm.HasPiece(j+1) {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprintf("%d", i))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", i, j))
+		}
+		i = j
+	}
+
+	const maxRanges = 10
+	if len(ranges) > maxRanges {
+		return strings.Join(ranges[:maxRanges], ", ") + fmt.Sprintf(" and %d more", len(ranges)-maxRanges)
+	}
+	return strings.Join(ranges, ", ")
+}
@@ -0,0 +1,544 @@
+// Package dht is a node of the mainline DHT (BEP 5): a Kademlia network
+// over UDP in which BitTorrent peers find each other by info hash without
+// a tracker.
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+// DefaultBootstrapNodes are well-known routers of the public DHT.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+const (
+	defaultQueryTimeout = 5 * time.Second
+
+	// refreshInterval is how often the neighbourhood of our own ID is
+	// looked up again, which keeps the table filled and fresh.
+	refreshInterval = 15 * time.Minute
+
+	// saveInterval is how often the routing table is written to disk,
+	// besides on Close.
+	saveInterval = 5 * time.Minute
+)
+
+// ErrClosed is returned for queries on a closed Server.
+var ErrClosed = errors.New("dht: server closed")
+
+// Config configures a Server.
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881".
+	Addr string
+
+	// BootstrapNodes are host:port addresses of nodes to join through
+	// when the routing table is empty.
+	BootstrapNodes []string
+
+	// StateFile keeps our ID and the routing table across restarts.
+	// Empty disables it.
+	StateFile string
+
+	// QueryTimeout is how long to wait for a response; 0 means 5s.
+	QueryTimeout time.Duration
+}
+
+// DefaultStateFile is where the routing table lives under dir.
+func DefaultStateFile(dir string) string {
+	return filepath.Join(dir, ".pixtorrent", "dht.dat")
+}
+
+// Server is a DHT node. It answers other nodes' queries and finds and
+// announces peers for info hashes.
+type Server struct {
+	cfg   Config
+	id    ID
+	conn  *net.UDPConn
+	table *table
+	peers *peerStore
+	toks  *tokens
+
+	mu      sync.Mutex
+	pending map[string]*transaction
+	nextTx  uint16
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// transaction is a query waiting for its response.
+type transaction struct {
+	addr netip.AddrPort
+	done chan *message
+}
+
+// New creates a server with the ID and nodes saved in cfg.StateFile, or a
+// random ID.
+func New(cfg Config) (*Server, error) {
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = defaultQueryTimeout
+	}
+
+	s := &Server{
+		cfg:     cfg,
+		id:      RandomID(),
+		peers:   newPeerStore(),
+		toks:    newTokens(time.Now()),
+		pending: make(map[string]*transaction),
+		quit:    make(chan struct{}),
+	}
+	saved, err := loadState(cfg.StateFile)
+	if err != nil {
+		fmt.Printf("[DHT] ignoring state file %s: %v\n", cfg.StateFile, err)
+	}
+	if saved != nil {
+		s.id = saved.id
+	}
+	s.table = newTable(s.id)
+	if saved != nil {
+		for _, n := range saved.nodes {
+			s.table.add(n)
+		}
+	}
+	return s, nil
+}
+
+// Start listens on cfg.Addr and begins serving queries.
+func (s *Server) Start() error {
+	addr, err := net.ResolveUDPAddr("udp4", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("dht: invalid address %q: %w", s.cfg.Addr, err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("dht: %w", err)
+	}
+	s.conn = conn
+
+	go s.readLoop()
+	go s.maintain()
+	return nil
+}
+
+// Close stops the server and saves its routing table.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		err = s.save()
+	})
+	return err
+}
+
+// ID is our node ID.
+func (s *Server) ID() ID {
+	return s.id
+}
+
+// Addr is the address the server listens on.
+func (s *Server) Addr() netip.AddrPort {
+	if s.conn == nil {
+		return netip.AddrPort{}
+	}
+	return s.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Port is the UDP port the server listens on.
+func (s *Server) Port() int {
+	return int(s.Addr().Port())
+}
+
+// NumNodes is how many nodes the routing table holds.
+func (s *Server) NumNodes() int {
+	return s.table.len()
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		var msg message
+		if err := meta.UnmarshalWithOptions(buf[:n], &msg, krpcDecoderOptions); err != nil {
+			continue
+		}
+		switch msg.Y {
+		case "q":
+			s.handleQuery(from, &msg)
+		case "r", "e":
+			s.handleResponse(from, &msg)
+		}
+	}
+}
+
+// maintain rotates tokens, expires peers, refreshes the table and saves
+// it until the server closes.
+func (s *Server) maintain() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	lastRefresh, lastSave := time.Now(), time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.toks.rotate(now)
+			s.peers.expire(now)
+			if now.Sub(lastRefresh) >= refreshInterval {
+				lastRefresh = now
+				go s.lookup(s.id, "find_node")
+			}
+			if now.Sub(lastSave) >= saveInterval {
+				lastSave = now
+				if err := s.save(); err != nil {
+					fmt.Printf("[DHT] failed to save state: %v\n", err)
+				}
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) send(addr netip.AddrPort, msg *message) error {
+	data, err := meta.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDPAddrPort(data, addr)
+	return err
+}
+
+// query sends a query and waits for its response. Nodes that answer are
+// recorded in the routing table; nodes that do not are marked failed.
+func (s *Server) query(addr netip.AddrPort, q string, a *args) (*reply, error) {
+	if s.conn == nil {
+		return nil, fmt.Errorf("dht: server not started")
+	}
+	a.ID = string(s.id[:])
+
+	tx := &transaction{addr: addr, done: make(chan *message, 1)}
+	s.mu.Lock()
+	s.nextTx++
+	t := string(binary.BigEndian.AppendUint16(nil, s.nextTx))
+	s.pending[t] = tx
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(addr, &message{T: t, Y: "q", Q: q, A: a}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.cfg.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-tx.done:
+		if msg.Y == "e" {
+			return nil, parseError(msg.E)
+		}
+		id, ok := idFromString(msg.R.ID)
+		if !ok {
+			return nil, fmt.Errorf("dht: response from %s has a bad node ID", addr)
+		}
+		if stale := s.table.seen(node{ID: id, Addr: addr}, time.Now()); stale != nil {
+			go s.checkStale(stale)
+		}
+		return msg.R, nil
+	case <-timer.C:
+		s.table.failed(addr)
+		return nil, fmt.Errorf("dht: %s %s timed out", q, addr)
+	case <-s.quit:
+		return nil, ErrClosed
+	}
+}
+
+// checkStale pings a questionable node so that it is dropped, making room,
+// if it no longer answers.
+func (s *Server) checkStale(c *contact) {
+	for i := 0; i < maxFailures; i++ {
+		if _, err := s.query(c.Addr, "ping", &args{}); err == nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handleResponse(from netip.AddrPort, msg *message) {
+	if msg.Y == "r" && msg.R == nil {
+		return
+	}
+
+	s.mu.Lock()
+	tx := s.pending[msg.T]
+	s.mu.Unlock()
+
+	// only the node we asked may answer
+	if tx == nil || tx.addr != from {
+		return
+	}
+	select {
+	case tx.done <- msg:
+	default:
+	}
+}
+
+// Ping asks a node for its ID.
+func (s *Server) Ping(addr string) (ID, error) {
+	ap, err := resolve(addr)
+	if err != nil {
+		return ID{}, err
+	}
+	r, err := s.query(ap, "ping", &args{})
+	if err != nil {
+		return ID{}, err
+	}
+	id, _ := idFromString(r.ID)
+	return id, nil
+}
+
+func resolve(addr string) (netip.AddrPort, error) {
+	ua, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ap := ua.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+// Bootstrap joins the network: it asks the bootstrap nodes and any nodes
+// loaded from disk for the nodes nearest to us, then looks up our own ID
+// to fill the table. It fails if no node answered.
+func (s *Server) Bootstrap() error {
+	var addrs []netip.AddrPort
+	for _, addr := range s.cfg.BootstrapNodes {
+		ap, err := resolve(addr)
+		if err != nil {
+			fmt.Printf("[DHT] bootstrap node %s: %v\n", addr, err)
+			continue
+		}
+		addrs = append(addrs, ap)
+	}
+	for _, n := range s.table.nodes() {
+		addrs = append(addrs, n.Addr)
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+			r, err := s.query(addr, "find_node", &args{Target: string(s.id[:])})
+			if err != nil {
+				return
+			}
+			for _, n := range decodeNodes(r.Nodes) {
+				s.table.add(n)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	s.lookup(s.id, "find_node")
+	if s.table.len() == 0 {
+		return fmt.Errorf("dht: no node answered")
+	}
+	fmt.Printf("[DHT] bootstrapped with %d nodes\n", s.table.len())
+	return nil
+}
+
+// GetPeers looks up peers for an info hash.
+func (s *Server) GetPeers(infoHash [20]byte) ([]string, error) {
+	res := s.lookup(infoHash, "get_peers")
+	if len(res.responders) == 0 {
+		return nil, fmt.Errorf("dht: no node answered")
+	}
+	return res.peers, nil
+}
+
+// Announce looks up peers for an info hash and tells the nodes nearest to
+// it that we accept connections for it on port. It returns the peers the
+// lookup found.
+func (s *Server) Announce(infoHash [20]byte, port int) ([]string, error) {
+	res := s.lookup(infoHash, "get_peers")
+	if len(res.responders) == 0 {
+		return nil, fmt.Errorf("dht: no node answered")
+	}
+
+	announced := 0
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, r := range res.responders {
+		if r.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(r responder) {
+			defer wg.Done()
+			_, err := s.query(r.Addr, "announce_peer", &args{
+				InfoHash: string(infoHash[:]),
+				Port:     port,
+				Token:    r.token,
+			})
+			if err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if announced == 0 {
+		return res.peers, fmt.Errorf("dht: no node accepted the announce")
+	}
+	return res.peers, nil
+}
+
+func (s *Server) handleQuery(from netip.AddrPort, msg *message) {
+	if msg.A == nil {
+		s.sendError(from, msg.T, &Error{ErrProtocol, "missing arguments"})
+		return
+	}
+	id, ok := idFromString(msg.A.ID)
+	if !ok {
+		s.sendError(from, msg.T, &Error{ErrProtocol, "invalid id"})
+		return
+	}
+
+	r := &reply{ID: string(s.id[:])}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		target, ok := idFromString(msg.A.Target)
+		if !ok {
+			s.sendError(from, msg.T, &Error{ErrProtocol, "invalid target"})
+			return
+		}
+		r.Nodes = encodeNodes(s.table.closest(target, K))
+	case "get_peers":
+		infoHash, ok := idFromString(msg.A.InfoHash)
+		if !ok {
+			s.sendError(from, msg.T, &Error{ErrProtocol, "invalid info_hash"})
+			return
+		}
+		r.Token = s.toks.token(from.Addr())
+		for _, addr := range s.peers.get(infoHash, maxValues, time.Now()) {
+			r.Values = append(r.Values, compactAddr(addr))
+		}
+		r.Nodes = encodeNodes(s.table.closest(infoHash, K))
+	case "announce_peer":
+		infoHash, ok := idFromString(msg.A.InfoHash)
+		if !ok {
+			s.sendError(from, msg.T, &Error{ErrProtocol, "invalid info_hash"})
+			return
+		}
+		if !s.toks.valid(msg.A.Token, from.Addr()) {
+			s.sendError(from, msg.T, &Error{ErrProtocol, "bad token"})
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = int(from.Port())
+		}
+		if port <= 0 || port > 65535 {
+			s.sendError(from, msg.T, &Error{ErrProtocol, "invalid port"})
+			return
+		}
+		s.peers.add(infoHash, netip.AddrPortFrom(from.Addr(), uint16(port)), time.Now())
+	default:
+		s.sendError(from, msg.T, &Error{ErrMethod, "method unknown"})
+		return
+	}
+
+	if stale := s.table.seen(node{ID: id, Addr: from}, time.Now()); stale != nil {
+		go s.checkStale(stale)
+	}
+	s.send(from, &message{T: msg.T, Y: "r", R: r})
+}
+
+func (s *Server) sendError(to netip.AddrPort, t string, e *Error) {
+	s.send(to, &message{T: t, Y: "e", E: e.list()})
+}
+
+// state is what the state file holds.
+type state struct {
+	id    ID
+	nodes []node
+}
+
+type stateFile struct {
+	ID    []byte `bencode:"id,required"`
+	Nodes []byte `bencode:"nodes"`
+}
+
+func loadState(path string) (*state, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f stateFile
+	if err := meta.Unmarshal(raw, &f); err != nil {
+		return nil, err
+	}
+	id, ok := idFromString(string(f.ID))
+	if !ok {
+		return nil, fmt.Errorf("invalid node ID")
+	}
+	return &state{id: id, nodes: decodeNodes(string(f.Nodes))}, nil
+}
+
+// save writes our ID and the routing table to the state file.
+func (s *Server) save() error {
+	if s.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := meta.Marshal(&stateFile{
+		ID:    s.id[:],
+		Nodes: []byte(encodeNodes(s.table.nodes())),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.cfg.StateFile), 0o755); err != nil {
+		return err
+	}
+	tmp := s.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cfg.StateFile)
+}
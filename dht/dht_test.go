@@ -0,0 +1,223 @@
+package dht
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startNodes starts n nodes on loopback, every one bootstrapping through
+// the first.
+func startNodes(t *testing.T, n int) []*Server {
+	t.Helper()
+
+	var nodes []*Server
+	for i := 0; i < n; i++ {
+		cfg := Config{Addr: "127.0.0.1:0", QueryTimeout: 500 * time.Millisecond}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if err := s.Start(); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		nodes = append(nodes, s)
+	}
+	for _, s := range nodes[1:] {
+		if err := s.Bootstrap(); err != nil {
+			t.Fatalf("Bootstrap: %v", err)
+		}
+	}
+	return nodes
+}
+
+func TestPing(t *testing.T) {
+	nodes := startNodes(t, 2)
+
+	id, err := nodes[1].Ping(nodes[0].Addr().String())
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if id != nodes[0].ID() {
+		t.Errorf("Ping returned %s, want %s", id, nodes[0].ID())
+	}
+}
+
+func TestBootstrap_FillsTables(t *testing.T) {
+	nodes := startNodes(t, 8)
+
+	if got := nodes[0].NumNodes(); got != len(nodes)-1 {
+		t.Errorf("first node knows %d nodes, want %d", got, len(nodes)-1)
+	}
+	for i, s := range nodes[1:] {
+		if s.NumNodes() < 2 {
+			t.Errorf("node %d knows only %d nodes", i+1, s.NumNodes())
+		}
+	}
+}
+
+func TestBootstrap_NoNodes(t *testing.T) {
+	s, err := New(Config{Addr: "127.0.0.1:0", QueryTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Bootstrap(); err == nil {
+		t.Error("Bootstrap succeeded without any node to join through")
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startNodes(t, 10)
+	infoHash := RandomID()
+
+	if _, err := nodes[3].Announce(infoHash, 7000); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if _, err := nodes[5].Announce(infoHash, 7001); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+
+	peers, err := nodes[8].GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("GetPeers: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, p := range peers {
+		found[p] = true
+	}
+	for _, want := range []string{"127.0.0.1:7000", "127.0.0.1:7001"} {
+		if !found[want] {
+			t.Errorf("GetPeers = %v, missing %s", peers, want)
+		}
+	}
+
+	// an info hash nobody announced has no peers
+	peers, err = nodes[8].GetPeers(RandomID())
+	if err != nil {
+		t.Fatalf("GetPeers: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("GetPeers for an unknown hash = %v", peers)
+	}
+}
+
+func TestAnnouncePeer_ImpliedPort(t *testing.T) {
+	nodes := startNodes(t, 2)
+	infoHash := RandomID()
+
+	r, err := nodes[1].query(nodes[0].Addr(), "get_peers", &args{InfoHash: string(infoHash[:])})
+	if err != nil {
+		t.Fatalf("get_peers: %v", err)
+	}
+	_, err = nodes[1].query(nodes[0].Addr(), "announce_peer", &args{
+		InfoHash:    string(infoHash[:]),
+		Port:        1,
+		ImpliedPort: 1,
+		Token:       r.Token,
+	})
+	if err != nil {
+		t.Fatalf("announce_peer: %v", err)
+	}
+
+	peers, _ := nodes[1].GetPeers(infoHash)
+	if len(peers) != 1 || peers[0] != nodes[1].Addr().String() {
+		t.Errorf("GetPeers = %v, want the announcing node's own address %s", peers, nodes[1].Addr())
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	nodes := startNodes(t, 2)
+	infoHash := RandomID()
+
+	tests := []struct {
+		name string
+		q    string
+		a    *args
+		code int
+	}{
+		{"bad token", "announce_peer", &args{InfoHash: string(infoHash[:]), Port: 7000, Token: "forged"}, ErrProtocol},
+		{"short info hash", "get_peers", &args{InfoHash: "short"}, ErrProtocol},
+		{"missing target", "find_node", &args{}, ErrProtocol},
+		{"unknown method", "vote", &args{}, ErrMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := nodes[1].query(nodes[0].Addr(), tt.q, tt.a)
+			var krpcErr *Error
+			if !errors.As(err, &krpcErr) {
+				t.Fatalf("got %v, want a KRPC error", err)
+			}
+			if krpcErr.Code != tt.code {
+				t.Errorf("code = %d, want %d", krpcErr.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestQuery_Timeout(t *testing.T) {
+	nodes := startNodes(t, 2)
+	dead := nodes[1].Addr()
+	nodes[1].Close()
+
+	start := time.Now()
+	if _, err := nodes[0].Ping(dead.String()); err == nil {
+		t.Fatal("Ping of a closed node succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Ping took %s to time out", elapsed)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	nodes := startNodes(t, 4)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	s, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: []string{nodes[0].Addr().String()},
+		StateFile:      path,
+		QueryTimeout:   500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := s.Bootstrap(); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	known := s.NumNodes()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// the saved table is enough to join again without bootstrap nodes
+	again, err := New(Config{Addr: "127.0.0.1:0", StateFile: path, QueryTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer again.Close()
+	if again.ID() != s.ID() {
+		t.Errorf("ID = %s after reload, want %s", again.ID(), s.ID())
+	}
+	if again.NumNodes() != known {
+		t.Errorf("%d nodes after reload, want %d", again.NumNodes(), known)
+	}
+	if err := again.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := again.Bootstrap(); err != nil {
+		t.Errorf("Bootstrap from saved nodes: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+)
+
+// ID is a node ID or an info hash; both live in the same 160-bit space.
+type ID [20]byte
+
+// RandomID returns a random ID.
+func RandomID() ID {
+	var id ID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// xor is the Kademlia distance between two IDs.
+func (id ID) xor(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to id than b is.
+func (id ID) closer(a, b ID) bool {
+	for i := range id {
+		da, db := id[i]^a[i], id[i]^b[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefix is how many leading bits two IDs share, 160 if they are
+// equal.
+func commonPrefix(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// idFromString converts a 20-byte KRPC string to an ID.
+func idFromString(s string) (ID, bool) {
+	var id ID
+	if len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+// KRPC error codes (BEP 5).
+const (
+	ErrGeneric  = 201
+	ErrServer   = 202
+	ErrProtocol = 203
+	ErrMethod   = 204
+)
+
+// krpcDecoderOptions bounds incoming datagrams. A KRPC message fits in
+// one UDP packet, and none of ours nests deeper than a list inside a dict
+// inside a dict.
+var krpcDecoderOptions = meta.DecoderOptions{
+	MaxStringLength: maxPacketSize,
+	MaxDepth:        4,
+	MaxSize:         maxPacketSize,
+}
+
+// maxPacketSize is the largest datagram read.
+const maxPacketSize = 64 * 1024
+
+// message is a KRPC message: a query (y = "q") with arguments, a response
+// ("r") or an error ("e"), matched up by the transaction ID t.
+type message struct {
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+	Q string `bencode:"q,omitempty"`
+	A *args  `bencode:"a,omitempty"`
+	R *reply `bencode:"r,omitempty"`
+	E []any  `bencode:"e,omitempty"` // [code, message]
+}
+
+type args struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+}
+
+type reply struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // compact node info
+	Values []string `bencode:"values,omitempty"` // compact peer info
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// Error is a KRPC error, sent by a node that could not answer a query.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func (e *Error) list() []any {
+	return []any{e.Code, e.Message}
+}
+
+// parseError reads the "e" list of an error message.
+func parseError(e []any) *Error {
+	err := &Error{Code: ErrGeneric}
+	if len(e) > 0 {
+		if code, ok := e[0].(meta.BInt); ok {
+			err.Code = int(code)
+		}
+	}
+	if len(e) > 1 {
+		if msg, ok := e[1].(meta.BString); ok {
+			err.Message = string(msg)
+		}
+	}
+	return err
+}
+
+// node is a DHT node as found in compact node info.
+type node struct {
+	ID   ID
+	Addr netip.AddrPort
+}
+
+// compactNodeSize is the length of one IPv4 entry of compact node info:
+// the ID, then the address as compact peer info.
+const compactNodeSize = 20 + 6
+
+func encodeNodes(nodes []node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, n := range nodes {
+		if !n.Addr.Addr().Unmap().Is4() {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = appendCompactAddr(buf, n.Addr)
+	}
+	return string(buf)
+}
+
+// decodeNodes parses compact node info, skipping entries with port 0.
+func decodeNodes(s string) []node {
+	var nodes []node
+	for i := 0; i+compactNodeSize <= len(s); i += compactNodeSize {
+		var n node
+		copy(n.ID[:], s[i:i+20])
+		addr, ok := parseCompactAddr(s[i+20 : i+compactNodeSize])
+		if !ok {
+			continue
+		}
+		n.Addr = addr
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func appendCompactAddr(buf []byte, addr netip.AddrPort) []byte {
+	buf = append(buf, addr.Addr().Unmap().AsSlice()...)
+	return binary.BigEndian.AppendUint16(buf, addr.Port())
+}
+
+// parseCompactAddr reads a 6 byte compact IPv4 address.
+func parseCompactAddr(s string) (netip.AddrPort, bool) {
+	if len(s) != 6 {
+		return netip.AddrPort{}, false
+	}
+	ip := netip.AddrFrom4([4]byte{s[0], s[1], s[2], s[3]})
+	port := binary.BigEndian.Uint16([]byte(s[4:6]))
+	if port == 0 {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip, port), true
+}
+
+func compactAddr(addr netip.AddrPort) string {
+	return string(appendCompactAddr(nil, addr))
+}
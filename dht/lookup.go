@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// alpha is how many queries a lookup keeps in flight.
+	alpha = 3
+
+	// maxLookupQueries bounds the queries of one lookup.
+	maxLookupQueries = 200
+)
+
+// responder is a node that answered a lookup, with the token it gave for
+// announcing.
+type responder struct {
+	node
+	token string
+}
+
+type lookupResult struct {
+	responders []responder // nearest to the target first, at most K
+	peers      []string    // found by get_peers, deduplicated
+}
+
+// lookup walks towards target, querying the nearest nodes it knows with q
+// ("find_node" or "get_peers") and learning nearer ones from their
+// answers, until the K nearest nodes it has heard of have all been asked.
+func (s *Server) lookup(target ID, q string) *lookupResult {
+	type candidate struct {
+		node
+		queried bool
+	}
+
+	var (
+		mu         sync.Mutex
+		candidates []*candidate
+		known      = make(map[netip.AddrPort]bool)
+		responders []responder
+		peers      []string
+		seenPeers  = make(map[string]bool)
+	)
+	addCandidates := func(nodes []node) {
+		for _, n := range nodes {
+			if n.ID == s.id || known[n.Addr] {
+				continue
+			}
+			known[n.Addr] = true
+			candidates = append(candidates, &candidate{node: n})
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return target.closer(candidates[i].ID, candidates[j].ID)
+		})
+	}
+	addCandidates(s.table.closest(target, K))
+	if q == "get_peers" {
+		// peers announced to us count as found
+		for _, addr := range s.peers.get(target, maxValues, time.Now()) {
+			seenPeers[addr.String()] = true
+			peers = append(peers, addr.String())
+		}
+	}
+
+	a := &args{}
+	if q == "get_peers" {
+		a.InfoHash = string(target[:])
+	} else {
+		a.Target = string(target[:])
+	}
+
+	queries := 0
+	for queries < maxLookupQueries {
+		// the next round asks the nearest unasked candidates among the
+		// K nearest
+		mu.Lock()
+		var round []*candidate
+		for i := 0; i < len(candidates) && i < K && len(round) < alpha; i++ {
+			if c := candidates[i]; !c.queried {
+				c.queried = true
+				round = append(round, c)
+			}
+		}
+		mu.Unlock()
+		if len(round) == 0 {
+			break
+		}
+		queries += len(round)
+
+		var wg sync.WaitGroup
+		for _, c := range round {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+				qa := *a
+				r, err := s.query(c.Addr, q, &qa)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					// a node that does not answer is no candidate
+					for i, other := range candidates {
+						if other == c {
+							candidates = append(candidates[:i], candidates[i+1:]...)
+							break
+						}
+					}
+					return
+				}
+				if id, ok := idFromString(r.ID); ok {
+					c.ID = id
+				}
+				responders = append(responders, responder{node: c.node, token: r.Token})
+				for _, v := range r.Values {
+					addr, ok := parseCompactAddr(v)
+					if !ok {
+						continue
+					}
+					if p := addr.String(); !seenPeers[p] {
+						seenPeers[p] = true
+						peers = append(peers, p)
+					}
+				}
+				addCandidates(decodeNodes(r.Nodes))
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	sort.Slice(responders, func(i, j int) bool {
+		return target.closer(responders[i].ID, responders[j].ID)
+	})
+	if len(responders) > K {
+		responders = responders[:K]
+	}
+	return &lookupResult{responders: responders, peers: peers}
+}
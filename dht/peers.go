@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// peerTTL is how long an announced peer is handed out without
+	// announcing again.
+	peerTTL = 30 * time.Minute
+
+	// maxPeersPerHash and maxInfoHashes bound what announces can make us
+	// store.
+	maxPeersPerHash = 1000
+	maxInfoHashes   = 10000
+
+	// maxValues is how many peers one get_peers response carries, which
+	// keeps it in a single packet.
+	maxValues = 50
+
+	// tokenRotation is how often the token secret changes. Tokens stay
+	// valid for one rotation after that, so up to twice this long.
+	tokenRotation = 5 * time.Minute
+)
+
+// peerStore keeps the peers announced to us, per info hash.
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[ID]map[netip.AddrPort]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[ID]map[netip.AddrPort]time.Time)}
+}
+
+func (ps *peerStore) add(infoHash ID, addr netip.AddrPort, now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peers := ps.peers[infoHash]
+	if peers == nil {
+		if len(ps.peers) >= maxInfoHashes {
+			return
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		ps.peers[infoHash] = peers
+	}
+	if _, ok := peers[addr]; !ok && len(peers) >= maxPeersPerHash {
+		return
+	}
+	peers[addr] = now
+}
+
+// get returns up to n live peers for an info hash.
+func (ps *peerStore) get(infoHash ID, n int, now time.Time) []netip.AddrPort {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var addrs []netip.AddrPort
+	for addr, at := range ps.peers[infoHash] {
+		if len(addrs) == n {
+			break
+		}
+		if now.Sub(at) < peerTTL {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// expire drops peers that have not announced within peerTTL.
+func (ps *peerStore) expire(now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for infoHash, peers := range ps.peers {
+		for addr, at := range peers {
+			if now.Sub(at) >= peerTTL {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(ps.peers, infoHash)
+		}
+	}
+}
+
+// tokens hands out the tokens get_peers responses carry and checks the
+// ones announce_peer queries bring back. A token is a hash of the
+// querying node's IP and a secret that rotates every tokenRotation; the
+// previous secret is still accepted.
+type tokens struct {
+	mu        sync.Mutex
+	secret    [20]byte
+	previous  [20]byte
+	rotatedAt time.Time
+}
+
+func newTokens(now time.Time) *tokens {
+	t := &tokens{rotatedAt: now}
+	randomSecret(&t.secret)
+	t.previous = t.secret
+	return t
+}
+
+func randomSecret(s *[20]byte) {
+	if _, err := rand.Read(s[:]); err != nil {
+		panic(err)
+	}
+}
+
+// rotate replaces the secret if it is due.
+func (t *tokens) rotate(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.rotatedAt) < tokenRotation {
+		return
+	}
+	t.previous = t.secret
+	randomSecret(&t.secret)
+	t.rotatedAt = now
+}
+
+func tokenFor(secret [20]byte, ip netip.Addr) string {
+	h := sha1.New()
+	h.Write(ip.Unmap().AsSlice())
+	h.Write(secret[:])
+	return string(h.Sum(nil)[:8])
+}
+
+func (t *tokens) token(ip netip.Addr) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return tokenFor(t.secret, ip)
+}
+
+func (t *tokens) valid(token string, ip netip.Addr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, secret := range [][20]byte{t.secret, t.previous} {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tokenFor(secret, ip))) == 1 {
+			return true
+		}
+	}
+	return false
+}
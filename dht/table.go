@@ -0,0 +1,164 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the bucket size and how many nodes a lookup converges on.
+	K = 8
+
+	// maxFailures is how many queries in a row a node may leave
+	// unanswered before it is dropped.
+	maxFailures = 3
+
+	// questionableAfter is how long a node may go unheard from before it
+	// must answer a ping to keep its place in a full bucket.
+	questionableAfter = 15 * time.Minute
+)
+
+type contact struct {
+	node
+	lastSeen time.Time
+	failures int
+}
+
+// table is the routing table: bucket i holds up to K nodes whose IDs share
+// exactly i leading bits with ours, most recently seen last. Buckets far
+// from us cover most of the ID space yet fill up just as fast, so we know
+// many nodes near us and a few everywhere else.
+type table struct {
+	mu      sync.Mutex
+	self    ID
+	buckets [160][]*contact
+}
+
+func newTable(self ID) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucket(id ID) int {
+	return commonPrefix(t.self, id)
+}
+
+// seen records that a node answered us or queried us. It returns the
+// bucket's least recently seen node when there was no room for a new one
+// and that node is questionable, so the caller can ping it: if the ping
+// fails, there is room next time.
+func (t *table) seen(n node, now time.Time) (stale *contact) {
+	if n.ID == t.self || !n.Addr.IsValid() {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.bucket(n.ID)
+	b := t.buckets[i]
+	for j, c := range b {
+		if c.ID == n.ID {
+			c.Addr = n.Addr
+			c.lastSeen = now
+			c.failures = 0
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), c)
+			return nil
+		}
+	}
+
+	c := &contact{node: n, lastSeen: now}
+	if len(b) < K {
+		t.buckets[i] = append(b, c)
+		return nil
+	}
+	for j, old := range b {
+		if old.failures >= maxFailures {
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), c)
+			return nil
+		}
+	}
+	if oldest := b[0]; now.Sub(oldest.lastSeen) >= questionableAfter {
+		copied := *oldest
+		return &copied
+	}
+	return nil
+}
+
+// add inserts a node we have not heard from ourselves, e.g. one loaded
+// from disk, if its bucket has room.
+func (t *table) add(n node) {
+	if n.ID == t.self || !n.Addr.IsValid() {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.bucket(n.ID)
+	for _, c := range t.buckets[i] {
+		if c.ID == n.ID {
+			return
+		}
+	}
+	if len(t.buckets[i]) < K {
+		t.buckets[i] = append([]*contact{{node: n}}, t.buckets[i]...)
+	}
+}
+
+// failed records an unanswered query. Nodes that fail maxFailures times
+// in a row are dropped.
+func (t *table) failed(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, b := range t.buckets {
+		for j, c := range b {
+			if c.Addr != addr {
+				continue
+			}
+			c.failures++
+			if c.failures >= maxFailures {
+				t.buckets[i] = append(b[:j:j], b[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n nodes nearest to target, nearest first.
+func (t *table) closest(target ID, n int) []node {
+	nodes := t.nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return target.closer(nodes[i].ID, nodes[j].ID)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+func (t *table) nodes() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []node
+	for _, b := range t.buckets {
+		for _, c := range b {
+			nodes = append(nodes, c.node)
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return n
+}
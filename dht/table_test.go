@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// idWithPrefix returns an ID sharing exactly prefix leading bits with
+// self. A non-zero tail varies the last byte, so prefix must be below 152
+// then.
+func idWithPrefix(self ID, prefix int, tail byte) ID {
+	id := self
+	id[prefix/8] ^= 0x80 >> (prefix % 8)
+	id[19] ^= tail
+	return id
+}
+
+func testAddr(i int) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881)
+}
+
+func TestCommonPrefix(t *testing.T) {
+	self := RandomID()
+	for _, prefix := range []int{0, 1, 7, 8, 100, 159} {
+		if got := commonPrefix(self, idWithPrefix(self, prefix, 0)); got != prefix {
+			t.Errorf("commonPrefix = %d, want %d", got, prefix)
+		}
+	}
+	if got := commonPrefix(self, self); got != 160 {
+		t.Errorf("commonPrefix of equal IDs = %d, want 160", got)
+	}
+}
+
+func TestTable_BucketFull(t *testing.T) {
+	self := RandomID()
+	tbl := newTable(self)
+	now := time.Now()
+
+	for i := 0; i < K; i++ {
+		if stale := tbl.seen(node{ID: idWithPrefix(self, 0, byte(i+1)), Addr: testAddr(i)}, now); stale != nil {
+			t.Fatalf("node %d: bucket reported full", i)
+		}
+	}
+
+	// a full bucket of fresh nodes turns newcomers away
+	extra := node{ID: idWithPrefix(self, 0, 0xff), Addr: testAddr(100)}
+	if stale := tbl.seen(extra, now); stale != nil {
+		t.Errorf("fresh node reported stale")
+	}
+	if tbl.len() != K {
+		t.Errorf("len = %d, want %d", tbl.len(), K)
+	}
+
+	// once the oldest node is questionable, it is handed out for a ping
+	later := now.Add(questionableAfter)
+	stale := tbl.seen(extra, later)
+	if stale == nil || stale.Addr != testAddr(0) {
+		t.Fatalf("stale = %v, want the least recently seen node", stale)
+	}
+
+	// and when it stops answering, the newcomer takes its place
+	for i := 0; i < maxFailures; i++ {
+		tbl.failed(stale.Addr)
+	}
+	tbl.seen(extra, later)
+	for _, n := range tbl.nodes() {
+		if n.Addr == testAddr(0) {
+			t.Error("failed node still in the table")
+		}
+	}
+	if tbl.len() != K {
+		t.Errorf("len = %d, want %d", tbl.len(), K)
+	}
+}
+
+func TestTable_Closest(t *testing.T) {
+	self := RandomID()
+	tbl := newTable(self)
+	for i := 0; i < 50; i++ {
+		tbl.seen(node{ID: RandomID(), Addr: testAddr(i)}, time.Now())
+	}
+
+	target := RandomID()
+	got := tbl.closest(target, K)
+	if len(got) != K {
+		t.Fatalf("closest returned %d nodes, want %d", len(got), K)
+	}
+	for i := 1; i < len(got); i++ {
+		if target.closer(got[i].ID, got[i-1].ID) {
+			t.Errorf("closest not sorted at %d", i)
+		}
+	}
+	furthest := got[len(got)-1].ID
+	for _, n := range tbl.nodes() {
+		inResult := false
+		for _, g := range got {
+			inResult = inResult || g.ID == n.ID
+		}
+		if !inResult && target.closer(n.ID, furthest) {
+			t.Errorf("node %s is closer than the results but was left out", n.ID)
+		}
+	}
+}
+
+func TestNodesRoundTrip(t *testing.T) {
+	nodes := []node{
+		{ID: RandomID(), Addr: testAddr(1)},
+		{ID: RandomID(), Addr: testAddr(2)},
+	}
+	got := decodeNodes(encodeNodes(nodes))
+	if len(got) != len(nodes) {
+		t.Fatalf("decoded %d nodes, want %d", len(got), len(nodes))
+	}
+	for i := range nodes {
+		if got[i] != nodes[i] {
+			t.Errorf("node %d = %v, want %v", i, got[i], nodes[i])
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	now := time.Now()
+	toks := newTokens(now)
+	ip := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+
+	token := toks.token(ip)
+	if !toks.valid(token, ip) {
+		t.Error("fresh token rejected")
+	}
+	if toks.valid(token, other) {
+		t.Error("token accepted from another IP")
+	}
+
+	// a token survives one rotation but not two
+	toks.rotate(now.Add(tokenRotation))
+	if !toks.valid(token, ip) {
+		t.Error("token rejected after one rotation")
+	}
+	toks.rotate(now.Add(2 * tokenRotation))
+	if toks.valid(token, ip) {
+		t.Error("token accepted after two rotations")
+	}
+}
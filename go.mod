@@ -5,7 +5,6 @@ go 1.21.4
 toolchain go1.22.2
 
 require (
-	github.com/jackpal/bencode-go v1.0.2
 	github.com/redis/go-redis/v9 v9.14.0
 	github.com/spf13/cobra v1.10.1
 )
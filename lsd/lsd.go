@@ -0,0 +1,299 @@
+// Package lsd is local service discovery (BEP 14): peers announce the info
+// hashes they share on a LAN multicast group, so peers on the same network
+// find each other without a tracker.
+package lsd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The multicast groups of BEP 14.
+var (
+	IPv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	IPv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+const (
+	// defaultInterval is how often every torrent is announced again.
+	// BEP 14 asks for no more than one announce per torrent a minute.
+	defaultInterval = 5 * time.Minute
+
+	maxPacketSize = 2048
+
+	// peerQueue is how many discovered peers wait for a torrent to take
+	// them before more are dropped.
+	peerQueue = 32
+)
+
+// Conn carries announces to and from one multicast group. A UDP socket
+// joined to the group is one; tests can use anything that hands a packet
+// written to the group to every member.
+type Conn interface {
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+	Close() error
+}
+
+// Group is a multicast group announces go to.
+type Group struct {
+	Addr *net.UDPAddr
+
+	// Conn is joined to Addr. Nil makes Start join it on the default
+	// multicast interface.
+	Conn Conn
+}
+
+// Config configures a Service.
+type Config struct {
+	// Groups to announce on; empty means IPv4Group and IPv6Group.
+	Groups []Group
+
+	// Interval is how often every torrent is announced again; 0 means 5
+	// minutes.
+	Interval time.Duration
+}
+
+// Service announces the torrents added to it on the LAN and hands out the
+// peers announcing them.
+type Service struct {
+	cfg    Config
+	groups []Group
+	cookie string
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+
+	kick      chan struct{}
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+type torrent struct {
+	port      int
+	peers     chan string
+	announced time.Time
+}
+
+// New creates a service; Start joins its groups.
+func New(cfg Config) *Service {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if len(cfg.Groups) == 0 {
+		cfg.Groups = []Group{{Addr: IPv4Group}, {Addr: IPv6Group}}
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &Service{
+		cfg:      cfg,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]*torrent),
+		kick:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start joins the groups and begins announcing and listening. A group
+// that cannot be joined, such as IPv6 on a host without it, is skipped
+// as long as another one works.
+func (s *Service) Start() error {
+	for _, g := range s.cfg.Groups {
+		if g.Conn == nil {
+			conn, err := joinGroup(g.Addr)
+			if err != nil {
+				fmt.Printf("[LSD] cannot join %s: %v\n", g.Addr, err)
+				continue
+			}
+			g.Conn = conn
+		}
+		s.groups = append(s.groups, g)
+	}
+	if len(s.groups) == 0 {
+		return errors.New("lsd: no multicast group could be joined")
+	}
+
+	for _, g := range s.groups {
+		go s.readLoop(g)
+	}
+	go s.announceLoop()
+	return nil
+}
+
+// Close stops the service and closes the channels handed out by Add.
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		for _, g := range s.groups {
+			g.Conn.Close()
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for ih, t := range s.torrents {
+			close(t.peers)
+			delete(s.torrents, ih)
+		}
+	})
+	return nil
+}
+
+// Add announces that we accept peers for infoHash on port, right away and
+// then every Interval. The channel returned carries the addresses of
+// peers announcing the same info hash until Remove or Close.
+func (s *Service) Add(infoHash [20]byte, port int) <-chan string {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		t = &torrent{peers: make(chan string, peerQueue)}
+		s.torrents[infoHash] = t
+	}
+	if t.port != port {
+		t.port = port
+		t.announced = time.Time{}
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return t.peers
+}
+
+// Remove stops announcing infoHash and closes its channel.
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.torrents[infoHash]; ok {
+		close(t.peers)
+		delete(s.torrents, infoHash)
+	}
+}
+
+func (s *Service) readLoop(g Group) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := g.Conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			continue
+		}
+
+		a, err := parseAnnounce(buf[:n])
+		if err != nil || a.cookie == s.cookie {
+			continue
+		}
+		host, _, err := net.SplitHostPort(from.String())
+		if err != nil {
+			continue
+		}
+		s.found(a.infoHashes, net.JoinHostPort(host, strconv.Itoa(a.port)))
+	}
+}
+
+// found hands a peer to the torrents it announced that we have.
+func (s *Service) found(infoHashes [][20]byte, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ih := range infoHashes {
+		t, ok := s.torrents[ih]
+		if !ok {
+			continue
+		}
+		select {
+		case t.peers <- addr:
+		default:
+		}
+	}
+}
+
+// announceLoop announces new torrents when they are added and every
+// torrent again once Interval has passed since its last announce.
+func (s *Service) announceLoop() {
+	ticker := time.NewTicker(s.cfg.Interval / 5)
+	defer ticker.Stop()
+
+	for {
+		s.announceDue(time.Now())
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Service) announceDue(now time.Time) {
+	s.mu.Lock()
+	byPort := make(map[int][][20]byte)
+	for ih, t := range s.torrents {
+		if now.Sub(t.announced) >= s.cfg.Interval {
+			t.announced = now
+			byPort[t.port] = append(byPort[t.port], ih)
+		}
+	}
+	s.mu.Unlock()
+
+	for port, hashes := range byPort {
+		for len(hashes) > 0 {
+			n := min(len(hashes), maxHashesPerAnnounce)
+			for _, g := range s.groups {
+				a := &announce{host: g.Addr.String(), port: port, infoHashes: hashes[:n], cookie: s.cookie}
+				if _, err := g.Conn.WriteTo(a.marshal(), g.Addr); err != nil {
+					fmt.Printf("[LSD] announce to %s failed: %v\n", g.Addr, err)
+				}
+			}
+			hashes = hashes[n:]
+		}
+	}
+}
+
+// multicastConn receives on a socket joined to a group and sends from a
+// plain one: the joined socket has multicast loopback turned off, which
+// would hide peers running on the same host from each other.
+type multicastConn struct {
+	*net.UDPConn
+	send *net.UDPConn
+}
+
+func joinGroup(group *net.UDPAddr) (*multicastConn, error) {
+	network := "udp6"
+	if group.IP.To4() != nil {
+		network = "udp4"
+	}
+	recv, err := net.ListenMulticastUDP(network, nil, group)
+	if err != nil {
+		return nil, err
+	}
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		recv.Close()
+		return nil, err
+	}
+	return &multicastConn{UDPConn: recv, send: send}, nil
+}
+
+func (c *multicastConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.send.WriteTo(p, addr)
+}
+
+func (c *multicastConn) Close() error {
+	c.send.Close()
+	return c.UDPConn.Close()
+}
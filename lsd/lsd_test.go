@@ -0,0 +1,217 @@
+package lsd
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hub stands in for a multicast group: a packet written by one member is
+// delivered to every member, the sender included.
+type hub struct {
+	mu      sync.Mutex
+	members []*hubConn
+}
+
+type hubConn struct {
+	hub     *hub
+	addr    *net.UDPAddr
+	packets chan hubPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+type hubPacket struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+func (h *hub) join(ip string) *hubConn {
+	c := &hubConn{
+		hub:     h,
+		addr:    &net.UDPAddr{IP: net.ParseIP(ip), Port: 6771},
+		packets: make(chan hubPacket, 256),
+		closed:  make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.members = append(h.members, c)
+	h.mu.Unlock()
+	return c
+}
+
+func (c *hubConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.packets:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *hubConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	for _, m := range c.hub.members {
+		select {
+		case m.packets <- hubPacket{from: c.addr, data: append([]byte(nil), p...)}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (c *hubConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func startService(t *testing.T, h *hub, ip string, interval time.Duration) *Service {
+	t.Helper()
+	s := New(Config{
+		Groups:   []Group{{Addr: IPv4Group, Conn: h.join(ip)}},
+		Interval: interval,
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func expectPeer(t *testing.T, peers <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-peers:
+		if got != want {
+			t.Errorf("peer = %s, want %s", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no peer found, want %s", want)
+	}
+}
+
+func expectNoPeer(t *testing.T, peers <-chan string) {
+	t.Helper()
+	select {
+	case got, ok := <-peers:
+		if ok {
+			t.Errorf("unexpected peer %s", got)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAdd_FindsPeerAnnouncingLater(t *testing.T) {
+	h := &hub{}
+	a := startService(t, h, "192.168.1.10", time.Hour)
+	b := startService(t, h, "192.168.1.11", time.Hour)
+	ih := [20]byte{1, 2, 3}
+
+	peersA := a.Add(ih, 7000)
+	time.Sleep(50 * time.Millisecond)
+	peersB := b.Add(ih, 7001)
+
+	// b's announce on being added reaches a; a announced before b had the
+	// torrent, so b hears of nobody until a announces again
+	expectPeer(t, peersA, "192.168.1.11:7001")
+	expectNoPeer(t, peersB)
+}
+
+func TestAnnounce_Periodic(t *testing.T) {
+	h := &hub{}
+	a := startService(t, h, "192.168.1.10", 50*time.Millisecond)
+	b := startService(t, h, "192.168.1.11", time.Hour)
+	ih := [20]byte{1, 2, 3}
+
+	a.Add(ih, 7000)
+	time.Sleep(20 * time.Millisecond)
+	peersB := b.Add(ih, 7001)
+
+	expectPeer(t, peersB, "192.168.1.10:7000")
+}
+
+func TestAnnounce_IgnoresOtherTorrentsAndOwn(t *testing.T) {
+	h := &hub{}
+	a := startService(t, h, "192.168.1.10", time.Hour)
+	b := startService(t, h, "192.168.1.11", time.Hour)
+
+	peersA := a.Add([20]byte{1}, 7000)
+	b.Add([20]byte{2}, 7001)
+
+	// a hears its own announce and b's, but b shares another torrent
+	expectNoPeer(t, peersA)
+}
+
+func TestAnnounce_ManyTorrents(t *testing.T) {
+	h := &hub{}
+	a := startService(t, h, "192.168.1.10", time.Hour)
+	b := startService(t, h, "192.168.1.11", time.Hour)
+
+	var chans []<-chan string
+	for i := 0; i < 2*maxHashesPerAnnounce+1; i++ {
+		chans = append(chans, a.Add([20]byte{byte(i)}, 7000))
+	}
+	// b's torrents all go out at once, over several announces
+	for i := range chans {
+		b.mu.Lock()
+		b.torrents[[20]byte{byte(i)}] = &torrent{port: 7001, peers: make(chan string, peerQueue)}
+		b.mu.Unlock()
+	}
+	b.announceDue(time.Now())
+
+	for _, peers := range chans {
+		expectPeer(t, peers, "192.168.1.11:7001")
+	}
+}
+
+func TestRemove_ClosesChannel(t *testing.T) {
+	h := &hub{}
+	a := startService(t, h, "192.168.1.10", time.Hour)
+	ih := [20]byte{1}
+
+	peers := a.Add(ih, 7000)
+	a.Remove(ih)
+	if _, ok := <-peers; ok {
+		t.Error("channel still open after Remove")
+	}
+}
+
+func TestParseAnnounce(t *testing.T) {
+	ih := [20]byte{0xab, 0xcd}
+	a := &announce{host: IPv4Group.String(), port: 6881, infoHashes: [][20]byte{ih, {1}}, cookie: "c00k1e"}
+
+	got, err := parseAnnounce(a.marshal())
+	if err != nil {
+		t.Fatalf("parseAnnounce: %v", err)
+	}
+	if got.host != "239.192.152.143:6771" || got.port != 6881 || got.cookie != "c00k1e" {
+		t.Errorf("got host %q port %d cookie %q", got.host, got.port, got.cookie)
+	}
+	if len(got.infoHashes) != 2 || got.infoHashes[0] != ih {
+		t.Errorf("info hashes = %x", got.infoHashes)
+	}
+
+	// what other clients send: header names in any case, uppercase hex
+	raw := "BT-SEARCH * HTTP/1.1\r\nHost: [ff15::efc0:988f]:6771\r\nport: 51413\r\n" +
+		"infohash: ABCD000000000000000000000000000000000000\r\nInfohash: nothex\r\n\r\n\r\n"
+	got, err = parseAnnounce([]byte(raw))
+	if err != nil {
+		t.Fatalf("parseAnnounce: %v", err)
+	}
+	if got.port != 51413 || len(got.infoHashes) != 1 || got.infoHashes[0] != ih {
+		t.Errorf("got port %d, info hashes %x", got.port, got.infoHashes)
+	}
+
+	bad := []string{
+		"M-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abcd\r\n\r\n",
+		"",
+	}
+	for _, msg := range bad {
+		if _, err := parseAnnounce([]byte(msg)); err == nil {
+			t.Errorf("parseAnnounce(%q) succeeded", msg)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	searchLine = "BT-SEARCH * HTTP/1.1"
+
+	// maxHashesPerAnnounce keeps an announce well inside one Ethernet
+	// frame; more info hashes are spread over several announces.
+	maxHashesPerAnnounce = 20
+)
+
+// announce is a BT-SEARCH message: a peer listening on port has the
+// torrents with these info hashes.
+type announce struct {
+	host       string // the multicast group, as host:port
+	port       int
+	infoHashes [][20]byte
+	cookie     string // set by the sender to recognise its own announces
+}
+
+func (a *announce) marshal() []byte {
+	var b strings.Builder
+	b.WriteString(searchLine + "\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", a.host)
+	fmt.Fprintf(&b, "Port: %d\r\n", a.port)
+	for _, ih := range a.infoHashes {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", hex.EncodeToString(ih[:]))
+	}
+	if a.cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", a.cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return []byte(b.String())
+}
+
+// parseAnnounce reads a BT-SEARCH message. Malformed info hashes are
+// skipped; a message without a valid one is an error.
+func parseAnnounce(data []byte) (*announce, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if line != searchLine {
+		return nil, fmt.Errorf("lsd: not a BT-SEARCH message: %q", line)
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, fmt.Errorf("lsd: bad header: %w", err)
+	}
+
+	port, err := strconv.Atoi(header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("lsd: bad port %q", header.Get("Port"))
+	}
+	a := &announce{
+		host:   header.Get("Host"),
+		port:   port,
+		cookie: header.Get("Cookie"),
+	}
+	for _, v := range header.Values("Infohash") {
+		var ih [20]byte
+		if b, err := hex.DecodeString(strings.TrimSpace(v)); err == nil && len(b) == len(ih) {
+			copy(ih[:], b)
+			a.infoHashes = append(a.infoHashes, ih)
+		}
+	}
+	if len(a.infoHashes) == 0 {
+		return nil, errors.New("lsd: no info hash")
+	}
+	return a, nil
+}
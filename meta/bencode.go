@@ -1,8 +1,11 @@
 package meta
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 )
 
 type Node any
@@ -12,8 +15,64 @@ type BString string
 type BList []Node
 type BDict map[string]Node
 
+// DecoderOptions controls how strictly input is validated and how much of
+// it the decoder is willing to buffer. Zero values mean "no limit", so the
+// zero DecoderOptions reproduces the lenient default behaviour.
+type DecoderOptions struct {
+	// Strict rejects anything that is not in canonical form: integers
+	// with leading zeros or "-0", string lengths with leading zeros,
+	// unsorted or duplicate dict keys and trailing data after the value.
+	Strict bool
+
+	MaxStringLength int64 // longest single string accepted
+	MaxDepth        int   // deepest nesting of lists and dicts
+	MaxSize         int64 // total bytes consumed for one value
+}
+
+// SyntaxError reports malformed or non-canonical input.
+type SyntaxError struct {
+	Offset int64 // byte offset at which the problem was detected
+	Msg    string
+	Err    error // underlying error, e.g. io.ErrUnexpectedEOF
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// LimitError reports input that exceeds one of the DecoderOptions limits.
+type LimitError struct {
+	Offset int64
+	Limit  string // "string length", "depth" or "size"
+	Max    int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("bencode: %s limit of %d exceeded at offset %d", e.Limit, e.Max, e.Offset)
+}
+
+// maxIntDigits bounds how many bytes we buffer for an integer or a string
+// length before giving up; int64 needs at most 20 including the sign.
+const maxIntDigits = 32
+
+// readChunk is the largest allocation made up front for a string. Longer
+// strings grow as data actually arrives, so a bogus length prefix on a
+// short input cannot force a huge allocation.
+const readChunk = 64 * 1024
+
 type Decode struct {
-	r io.Reader
+	r     io.Reader
+	pos   int64
+	depth int
+	opts  DecoderOptions
+
+	// capture, when set, receives a copy of every byte consumed so that
+	// raw values can be handed out without re-encoding them.
+	capture *bytes.Buffer
 }
 
 func NewDecoder(r io.Reader) *Decode {
@@ -22,6 +81,13 @@ func NewDecoder(r io.Reader) *Decode {
 	}
 }
 
+func NewDecoderWithOptions(r io.Reader, opts DecoderOptions) *Decode {
+	return &Decode{
+		r:    r,
+		opts: opts,
+	}
+}
+
 /* integers → i<number>e
 
 example: i42e → 42
@@ -40,102 +106,240 @@ example: d3:bar4:spam3:fooi42ee → { "bar": "spam", "foo": 42 } */
 
 func (d *Decode) Decode() (Node, error) {
 	//peek the first byte
-	var b [1]byte
-	if _, err := d.r.Read(b[:]); err != nil {
+	b, err := d.readByte()
+	if err != nil {
 		return nil, err
 	}
-	switch b[0] {
+	return d.parseValue(b)
+}
+
+// Offset returns the number of bytes consumed from the underlying reader.
+func (d *Decode) Offset() int64 {
+	return d.pos
+}
+
+func (d *Decode) syntaxError(format string, args ...any) error {
+	return &SyntaxError{Offset: d.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *Decode) checkSize(n int64) error {
+	if d.opts.MaxSize > 0 && d.pos+n > d.opts.MaxSize {
+		return &LimitError{Offset: d.pos, Limit: "size", Max: d.opts.MaxSize}
+	}
+	return nil
+}
+
+// readByte returns io.EOF untouched so callers can tell an empty input from
+// a truncated one; use next inside a value.
+func (d *Decode) readByte() (byte, error) {
+	if err := d.checkSize(1); err != nil {
+		return 0, err
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(d.r, b[:]); err != nil {
+		return 0, err
+	}
+	d.pos++
+	if d.capture != nil {
+		d.capture.WriteByte(b[0])
+	}
+	return b[0], nil
+}
+
+func (d *Decode) next() (byte, error) {
+	b, err := d.readByte()
+	if errors.Is(err, io.EOF) {
+		return 0, &SyntaxError{Offset: d.pos, Msg: "unexpected EOF", Err: io.ErrUnexpectedEOF}
+	}
+	return b, err
+}
+
+func (d *Decode) readFull(buf []byte) error {
+	n, err := io.ReadFull(d.r, buf)
+	d.pos += int64(n)
+	if d.capture != nil {
+		d.capture.Write(buf[:n])
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &SyntaxError{Offset: d.pos, Msg: "unexpected EOF", Err: io.ErrUnexpectedEOF}
+	}
+	return err
+}
+
+func (d *Decode) enter() error {
+	d.depth++
+	if d.opts.MaxDepth > 0 && d.depth > d.opts.MaxDepth {
+		return &LimitError{Offset: d.pos, Limit: "depth", Max: int64(d.opts.MaxDepth)}
+	}
+	return nil
+}
+
+func (d *Decode) leave() {
+	d.depth--
+}
+
+// checkEnd rejects trailing bytes after a complete top-level value when
+// running in strict mode.
+func (d *Decode) checkEnd() error {
+	if !d.opts.Strict {
+		return nil
+	}
+	if _, err := d.readByte(); err == nil {
+		return d.syntaxError("trailing data after value")
+	} else if !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// checkKeyOrder enforces the canonical ordering of dict keys in strict
+// mode: every key must sort strictly after the previous one.
+func (d *Decode) checkKeyOrder(prev, key string, first bool) error {
+	if !d.opts.Strict || first {
+		return nil
+	}
+	if key == prev {
+		return d.syntaxError("duplicate dict key %q", key)
+	}
+	if key < prev {
+		return d.syntaxError("dict key %q out of order after %q", key, prev)
+	}
+	return nil
+}
+
+func (d *Decode) parseValue(first byte) (Node, error) {
+	switch first {
 	case 'i':
 		return d.parseInt()
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-		return d.parseString(b[0])
+		return d.parseString(first)
 	case 'l':
 		return d.parseList()
 	case 'd':
 		return d.parseDict()
 	default:
-		return nil, fmt.Errorf("unsupported bencode type: %c", b[0])
+		return nil, d.syntaxError("unsupported bencode type: %c", first)
 	}
-
 }
 
-func (d *Decode) parseInt() (BInt, error) {
-	var numStr string
-	var char [1]byte
+// readNumber collects the digits of an integer or string length up to the
+// terminator byte.
+func (d *Decode) readNumber(first []byte, term byte) ([]byte, error) {
+	num := first
 	for {
-		if _, err := d.r.Read(char[:]); err != nil {
-			return 0, err
+		char, err := d.next()
+		if err != nil {
+			return nil, err
 		}
-		if char[0] == 'e' {
-			break
+		if char == term {
+			return num, nil
 		}
-		numStr += string(char[0])
+		if len(num) >= maxIntDigits {
+			return nil, d.syntaxError("number too long")
+		}
+		num = append(num, char)
 	}
-	var i int
-	if _, err := fmt.Sscanf(numStr, "%d", &i); err != nil {
+}
+
+func (d *Decode) parseInt() (BInt, error) {
+	num, err := d.readNumber(nil, 'e')
+	if err != nil {
 		return 0, err
 	}
+
+	digits := num
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return 0, d.syntaxError("empty integer")
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, d.syntaxError("invalid integer %q", num)
+		}
+	}
+	if d.opts.Strict {
+		if len(digits) > 1 && digits[0] == '0' {
+			return 0, d.syntaxError("integer %q has leading zeros", num)
+		}
+		if num[0] == '-' && digits[0] == '0' {
+			return 0, d.syntaxError("negative zero")
+		}
+	}
+
+	i, err := strconv.ParseInt(string(num), 10, strconv.IntSize)
+	if err != nil {
+		return 0, d.syntaxError("integer %q out of range", num)
+	}
 	return BInt(i), nil
 }
 
 func (d *Decode) parseString(firstDigit byte) (BString, error) {
+	lengthStr, err := d.readNumber([]byte{firstDigit}, ':')
+	if err != nil {
+		return "", err
+	}
 
-	lengthStr := string(firstDigit)
-	var char [1]byte
-
-	for {
-		if _, err := d.r.Read(char[:]); err != nil {
-			return "", err
-		}
-		if char[0] == ':' {
-			break
-		}
-		lengthStr += string(char[0])
+	if d.opts.Strict && len(lengthStr) > 1 && lengthStr[0] == '0' {
+		return "", d.syntaxError("string length %q has leading zeros", lengthStr)
+	}
+	length, err := strconv.ParseInt(string(lengthStr), 10, 64)
+	if err != nil || length < 0 {
+		return "", d.syntaxError("invalid string length %q", lengthStr)
 	}
 
-	var length int
-	if _, err := fmt.Sscanf(lengthStr, "%d", &length); err != nil {
+	if d.opts.MaxStringLength > 0 && length > d.opts.MaxStringLength {
+		return "", &LimitError{Offset: d.pos, Limit: "string length", Max: d.opts.MaxStringLength}
+	}
+	if err := d.checkSize(length); err != nil {
 		return "", err
 	}
 
-	content := make([]byte, length)
-	if _, err := io.ReadFull(d.r, content); err != nil {
-		return "", err
+	if length <= readChunk {
+		content := make([]byte, length)
+		if err := d.readFull(content); err != nil {
+			return "", err
+		}
+		return BString(content), nil
 	}
 
-	return BString(content), nil
+	var content bytes.Buffer
+	chunk := make([]byte, readChunk)
+	for remaining := length; remaining > 0; {
+		n := int64(len(chunk))
+		if remaining < n {
+			n = remaining
+		}
+		if err := d.readFull(chunk[:n]); err != nil {
+			return "", err
+		}
+		content.Write(chunk[:n])
+		remaining -= n
+	}
+	return BString(content.Bytes()), nil
 }
 
 func (d *Decode) parseList() (BList, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
 	var list BList
 
 	for {
 
-		var firstByte [1]byte
-		if _, err := d.r.Read(firstByte[:]); err != nil {
+		firstByte, err := d.next()
+		if err != nil {
 			return nil, err
 		}
 
-		if firstByte[0] == 'e' {
+		if firstByte == 'e' {
 			break
 		}
 
-		var val Node
-		var err error
-
-		switch firstByte[0] {
-		case 'i':
-			val, err = d.parseInt()
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-			val, err = d.parseString(firstByte[0])
-		case 'l':
-			val, err = d.parseList()
-		case 'd':
-			val, err = d.parseDict()
-		default:
-			return nil, fmt.Errorf("unsupported bencode type in list: %c", firstByte[0])
-		}
-
+		val, err := d.parseValue(firstByte)
 		if err != nil {
 			return nil, err
 		}
@@ -147,32 +351,39 @@ func (d *Decode) parseList() (BList, error) {
 }
 
 func (d *Decode) parseDict() (BDict, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
 	dict := make(BDict)
+	var prev string
 
 	for {
 
-		var firstByte [1]byte
-		if _, err := d.r.Read(firstByte[:]); err != nil {
+		firstByte, err := d.next()
+		if err != nil {
 			return nil, err
 		}
 
-		if firstByte[0] == 'e' {
+		if firstByte == 'e' {
 			break
 		}
 
-		var key string
-		switch firstByte[0] {
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-			keyStr, err := d.parseString(firstByte[0])
-			if err != nil {
-				return nil, err
-			}
-			key = string(keyStr)
-		default:
-			return nil, fmt.Errorf("dictionary keys must be strings, got: %c", firstByte[0])
+		key, err := d.parseKey(firstByte)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.checkKeyOrder(prev, key, len(dict) == 0); err != nil {
+			return nil, err
 		}
+		prev = key
 
-		value, err := d.Decode()
+		valueByte, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.parseValue(valueByte)
 		if err != nil {
 			return nil, err
 		}
@@ -182,3 +393,16 @@ func (d *Decode) parseDict() (BDict, error) {
 
 	return dict, nil
 }
+
+func (d *Decode) parseKey(first byte) (string, error) {
+	switch first {
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		key, err := d.parseString(first)
+		if err != nil {
+			return "", err
+		}
+		return string(key), nil
+	default:
+		return "", d.syntaxError("dictionary keys must be strings, got: %c", first)
+	}
+}
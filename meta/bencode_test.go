@@ -1,7 +1,9 @@
 package meta
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 )
@@ -125,3 +127,83 @@ func TestBencodeErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestBencodeStrict(t *testing.T) {
+	strict := DecoderOptions{Strict: true}
+
+	strictTests := []struct {
+		name   string
+		input  string
+		offset int64
+	}{
+		{"leading zero integer", "i042e", 5},
+		{"negative zero", "i-0e", 4},
+		{"empty integer", "ie", 2},
+		{"leading zero length", "04:spam", 3},
+		{"unsorted keys", "d3:fooi1e3:bari2ee", 14},
+		{"duplicate keys", "d3:fooi1e3:fooi2ee", 14},
+		{"trailing data", "i1ei2e", 4},
+	}
+
+	for _, tt := range strictTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var node Node
+			err := UnmarshalWithOptions([]byte(tt.input), &node, strict)
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Expected *SyntaxError for %q, got %v", tt.input, err)
+			}
+			if syntaxErr.Offset != tt.offset {
+				t.Errorf("Expected offset %d, got %d (%v)", tt.offset, syntaxErr.Offset, err)
+			}
+		})
+	}
+
+	// the same inputs minus the empty integer are tolerated in lenient mode
+	for _, input := range []string{"i042e", "i-0e", "04:spam", "d3:fooi1e3:bari2ee"} {
+		if _, err := NewDecoder(strings.NewReader(input)).Decode(); err != nil {
+			t.Errorf("Lenient decoder rejected %q: %v", input, err)
+		}
+	}
+
+	// canonical input passes strict mode
+	var node Node
+	if err := UnmarshalWithOptions([]byte("d3:bari2e3:fooli-1ei0eee"), &node, strict); err != nil {
+		t.Errorf("Strict decoder rejected canonical input: %v", err)
+	}
+}
+
+func TestBencodeLimits(t *testing.T) {
+	limitTests := []struct {
+		name  string
+		input string
+		opts  DecoderOptions
+		limit string
+	}{
+		{"string length", "10:0123456789", DecoderOptions{MaxStringLength: 4}, "string length"},
+		{"huge length prefix", "99999999999:x", DecoderOptions{MaxSize: 1 << 20}, "size"},
+		{"depth", "llllleeeee", DecoderOptions{MaxDepth: 3}, "depth"},
+		{"total size", "l4:spam4:spam4:spame", DecoderOptions{MaxSize: 10}, "size"},
+	}
+
+	for _, tt := range limitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoderWithOptions(strings.NewReader(tt.input), tt.opts).Decode()
+
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("Expected *LimitError, got %v", err)
+			}
+			if limitErr.Limit != tt.limit {
+				t.Errorf("Expected %s limit, got %s", tt.limit, limitErr.Limit)
+			}
+		})
+	}
+
+	// a bogus length without limits fails on EOF instead of allocating it all
+	_, err := NewDecoder(strings.NewReader("99999999999:x")).Decode()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+}
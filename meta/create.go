@@ -0,0 +1,286 @@
+package meta
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 8 * 1024 * 1024
+
+	// targetPieceCount is what AutoPieceLength aims for: enough pieces to
+	// spread a download across peers, few enough to keep the info dict
+	// (20 bytes per piece) small.
+	targetPieceCount = 1500
+)
+
+type CreateOptions struct {
+	PieceLength  int64      // 0 picks one with AutoPieceLength
+	AnnounceList [][]string // tiers of tracker URLs; the first URL is also the announce
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // zero means now
+	Private      bool
+	WebSeeds     []string
+	Source       string
+	Workers      int // hashing goroutines, 0 means one per CPU
+}
+
+// AutoPieceLength picks a power-of-two piece length for a torrent of the
+// given total size, clamped to [MinPieceLength, MaxPieceLength].
+func AutoPieceLength(totalLength int64) int64 {
+	pieceLength := int64(MinPieceLength)
+	for pieceLength < MaxPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// CreateTorrent builds a torrent for a single file or a directory tree.
+// Directories become multi-file torrents named after the directory, with
+// files in lexical path order. Pieces are hashed in parallel.
+func CreateTorrent(root string, opts CreateOptions) (*Torrent, error) {
+	root = filepath.Clean(root)
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", root, err)
+	}
+
+	info := InfoDict{
+		Name:   filepath.Base(root),
+		Source: opts.Source,
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	var paths []string
+	if stat.IsDir() {
+		info.Files, paths, err = collectFiles(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Files) == 0 {
+			return nil, fmt.Errorf("directory %s contains no files", root)
+		}
+	} else {
+		info.Length = stat.Size()
+		paths = []string{root}
+	}
+
+	totalLength := info.TotalLength()
+	if totalLength == 0 {
+		return nil, fmt.Errorf("cannot create a torrent of empty content")
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = AutoPieceLength(totalLength)
+	}
+	if info.PieceLength < MinPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length must be a power of two of at least %d bytes, got %d", MinPieceLength, info.PieceLength)
+	}
+
+	info.Pieces, err = hashPieces(paths, info.fileLengths(), info.PieceLength, opts.Workers)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent := &Torrent{
+		Info:      info,
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+		URLList:   opts.WebSeeds,
+	}
+
+	for _, tier := range opts.AnnounceList {
+		if len(tier) > 0 {
+			torrent.AnnounceList = append(torrent.AnnounceList, tier)
+		}
+	}
+	if len(torrent.AnnounceList) > 0 {
+		torrent.Announce = torrent.AnnounceList[0][0]
+	}
+	// a single tracker needs no announce-list
+	if len(torrent.AnnounceList) == 1 && len(torrent.AnnounceList[0]) == 1 {
+		torrent.AnnounceList = nil
+	}
+
+	created := opts.CreationDate
+	if created.IsZero() {
+		created = time.Now()
+	}
+	torrent.CreationDate = created.Unix()
+
+	return torrent, nil
+}
+
+func collectFiles(root string) ([]FileInfo, []string, error) {
+	var files []FileInfo
+	var paths []string
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// symlinks and other special files are not content
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, FileInfo{
+			Length: fi.Size(),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+	return files, paths, nil
+}
+
+func hashPieces(paths []string, lengths []int64, pieceLength int64, workers int) ([]byte, error) {
+	content, err := openContent(paths, lengths)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	numPieces := int((content.size + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, numPieces*sha1.Size)
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > numPieces {
+		workers = numPieces
+	}
+
+	indices := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for idx := range indices {
+				off := int64(idx) * pieceLength
+				n := pieceLength
+				if off+n > content.size {
+					n = content.size - off
+				}
+				if _, err := content.ReadAt(buf[:n], off); err != nil {
+					errs <- fmt.Errorf("failed to read piece %d: %w", idx, err)
+					return
+				}
+				hash := sha1.Sum(buf[:n])
+				copy(pieces[idx*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+	var firstErr error
+	for idx := 0; idx < numPieces && firstErr == nil; idx++ {
+		select {
+		case indices <- idx:
+		case firstErr = <-errs:
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if firstErr == nil {
+		select {
+		case firstErr = <-errs:
+		default:
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return pieces, nil
+}
+
+// content presents a list of files as one contiguous byte range, which is
+// how pieces see them.
+type content struct {
+	files   []*os.File
+	offsets []int64 // start of each file within the content
+	size    int64
+}
+
+func openContent(paths []string, lengths []int64) (*content, error) {
+	c := &content{}
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		c.files = append(c.files, f)
+		c.offsets = append(c.offsets, c.size)
+		c.size += lengths[i]
+	}
+	return c, nil
+}
+
+func (c *content) ReadAt(p []byte, off int64) (int, error) {
+	// first file whose range ends after off
+	i := sort.Search(len(c.files), func(i int) bool {
+		return c.offsets[i]+c.fileLength(i) > off
+	})
+
+	read := 0
+	for ; i < len(c.files) && read < len(p); i++ {
+		fileOff := off + int64(read) - c.offsets[i]
+		want := c.fileLength(i) - fileOff
+		if want > int64(len(p)-read) {
+			want = int64(len(p) - read)
+		}
+		n, err := c.files[i].ReadAt(p[read:read+int(want)], fileOff)
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.ErrUnexpectedEOF
+	}
+	return read, nil
+}
+
+func (c *content) fileLength(i int) int64 {
+	if i+1 < len(c.offsets) {
+		return c.offsets[i+1] - c.offsets[i]
+	}
+	return c.size - c.offsets[i]
+}
+
+func (c *content) Close() error {
+	for _, f := range c.files {
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package meta
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAutoPieceLength(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected int64
+	}{
+		{1, MinPieceLength},
+		{10 * 1024 * 1024, MinPieceLength},
+		{100 * 1024 * 1024, 128 * 1024},
+		{4 * 1024 * 1024 * 1024, 4 * 1024 * 1024},
+		{1 << 50, MaxPieceLength},
+	}
+
+	for _, tt := range tests {
+		if got := AutoPieceLength(tt.size); got != tt.expected {
+			t.Errorf("AutoPieceLength(%d): expected %d, got %d", tt.size, tt.expected, got)
+		}
+	}
+}
+
+func TestCreateTorrent_SingleFile(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("pixtorrent"), 5000) // 50000 bytes, 4 pieces
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := CreateTorrent(path, CreateOptions{
+		PieceLength:  MinPieceLength,
+		AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"http://c/announce"}},
+		Comment:      "hello",
+		Private:      true,
+		WebSeeds:     []string{"http://seed/data.bin"},
+		Source:       "TEST",
+		CreationDate: time.Unix(1700000000, 0),
+		Workers:      3,
+	})
+	if err != nil {
+		t.Fatalf("CreateTorrent failed: %v", err)
+	}
+
+	if torrent.Info.Name != "data.bin" || torrent.Info.Length != int64(len(data)) {
+		t.Errorf("Unexpected info: name %q length %d", torrent.Info.Name, torrent.Info.Length)
+	}
+	if torrent.Info.NumPieces() != 4 {
+		t.Fatalf("Expected 4 pieces, got %d", torrent.Info.NumPieces())
+	}
+	for i := 0; i < 4; i++ {
+		end := (i + 1) * MinPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[i*MinPieceLength : end])
+		if !bytes.Equal(torrent.Info.Pieces[i*20:(i+1)*20], hash[:]) {
+			t.Errorf("Piece %d hash mismatch", i)
+		}
+	}
+	if torrent.Announce != "http://a/announce" {
+		t.Errorf("Expected first tracker as announce, got %q", torrent.Announce)
+	}
+
+	// write it out and read it back
+	encoded, err := torrent.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	parsed, err := ParseTorrent(encoded)
+	if err != nil {
+		t.Fatalf("ParseTorrent failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed.Info, torrent.Info) {
+		t.Errorf("Info mismatch after round trip:\n%+v\n%+v", parsed.Info, torrent.Info)
+	}
+	if !reflect.DeepEqual(parsed.AnnounceList, torrent.AnnounceList) || !reflect.DeepEqual(parsed.URLList, torrent.URLList) {
+		t.Errorf("Trackers mismatch after round trip: %v %v", parsed.AnnounceList, parsed.URLList)
+	}
+	if parsed.Comment != "hello" || parsed.CreationDate != 1700000000 || parsed.Info.Private != 1 || parsed.Info.Source != "TEST" {
+		t.Errorf("Optional fields lost: %+v", parsed)
+	}
+
+	h1, _ := torrent.InfoHash()
+	h2, _ := parsed.InfoHash()
+	if h1 != h2 {
+		t.Errorf("Info hash changed after round trip: %x vs %x", h1, h2)
+	}
+}
+
+func TestCreateTorrent_Directory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "album")
+	files := map[string][]byte{
+		"a.txt":         bytes.Repeat([]byte{'a'}, 10000),
+		"sub/b.txt":     bytes.Repeat([]byte{'b'}, 30000),
+		"sub/deep/c.go": []byte("package c\n"),
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	torrent, err := CreateTorrent(root, CreateOptions{AnnounceList: [][]string{{"http://t/announce"}}})
+	if err != nil {
+		t.Fatalf("CreateTorrent failed: %v", err)
+	}
+
+	expected := []FileInfo{
+		{Length: 10000, Path: []string{"a.txt"}},
+		{Length: 30000, Path: []string{"sub", "b.txt"}},
+		{Length: 10, Path: []string{"sub", "deep", "c.go"}},
+	}
+	if torrent.Info.Name != "album" || !reflect.DeepEqual(torrent.Info.Files, expected) {
+		t.Fatalf("Unexpected layout: %q %+v", torrent.Info.Name, torrent.Info.Files)
+	}
+	if torrent.AnnounceList != nil {
+		t.Errorf("Single tracker should not produce an announce-list, got %v", torrent.AnnounceList)
+	}
+
+	// pieces span file boundaries: hash the concatenation
+	all := append(append(append([]byte{}, files["a.txt"]...), files["sub/b.txt"]...), files["sub/deep/c.go"]...)
+	for i := 0; i < torrent.Info.NumPieces(); i++ {
+		start := i * int(torrent.Info.PieceLength)
+		end := start + int(torrent.Info.PieceLength)
+		if end > len(all) {
+			end = len(all)
+		}
+		hash := sha1.Sum(all[start:end])
+		if !bytes.Equal(torrent.Info.Pieces[i*20:(i+1)*20], hash[:]) {
+			t.Errorf("Piece %d hash mismatch", i)
+		}
+	}
+}
+
+func TestCreateTorrent_NoTrackers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte{'x'}, 20000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := CreateTorrent(path, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTorrent failed: %v", err)
+	}
+	data, err := torrent.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	parsed, err := ParseTorrent(data)
+	if err != nil {
+		t.Fatalf("ParseTorrent rejected a torrent created without trackers: %v", err)
+	}
+
+	if len(parsed.Trackers()) != 0 {
+		t.Errorf("Expected no trackers, got %v", parsed.Trackers())
+	}
+	want, _ := torrent.InfoHash()
+	if got, _ := parsed.InfoHash(); got != want {
+		t.Errorf("Info hash mismatch after round trip")
+	}
+	if !reflect.DeepEqual(parsed.Info, torrent.Info) {
+		t.Errorf("Info mismatch after round trip: %+v", parsed.Info)
+	}
+}
+
+func TestCreateTorrent_Errors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := CreateTorrent(dir, CreateOptions{}); err == nil {
+		t.Error("Expected error for empty directory")
+	}
+	if _, err := CreateTorrent(filepath.Join(dir, "missing"), CreateOptions{}); err == nil {
+		t.Error("Expected error for missing path")
+	}
+
+	path := filepath.Join(dir, "f")
+	os.WriteFile(path, []byte("x"), 0644)
+	if _, err := CreateTorrent(path, CreateOptions{PieceLength: 20000}); err == nil {
+		t.Error("Expected error for non power of two piece length")
+	}
+}
@@ -0,0 +1,98 @@
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w: w,
+	}
+}
+
+// Encode returns the canonical bencoding of n.
+func Encode(n Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode writes n in canonical form: integers without leading zeros and
+// dictionary keys sorted as raw byte strings. Besides the B* node types it
+// accepts plain strings, byte slices and ints so callers can build dicts
+// without wrapping every value; anything else goes through Marshal rules.
+func (e *Encoder) Encode(n Node) error {
+	e.buf = e.buf[:0]
+	if err := e.encode(n); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *Encoder) encode(n Node) error {
+	switch v := n.(type) {
+	case BInt:
+		e.writeInt(int64(v))
+	case int:
+		e.writeInt(int64(v))
+	case int64:
+		e.writeInt(v)
+	case BString:
+		e.writeString(string(v))
+	case string:
+		e.writeString(v)
+	case []byte:
+		e.writeString(string(v))
+	case BList:
+		e.buf = append(e.buf, 'l')
+		for _, item := range v {
+			if err := e.encode(item); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case BDict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		e.buf = append(e.buf, 'd')
+		for _, k := range keys {
+			e.writeString(k)
+			if err := e.encode(v[k]); err != nil {
+				return fmt.Errorf("dict key %q: %w", k, err)
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	default:
+		return e.marshal(reflect.ValueOf(n))
+	}
+	return nil
+}
+
+func (e *Encoder) writeInt(i int64) {
+	e.buf = append(e.buf, 'i')
+	e.buf = strconv.AppendInt(e.buf, i, 10)
+	e.buf = append(e.buf, 'e')
+}
+
+func (e *Encoder) writeString(s string) {
+	e.buf = strconv.AppendInt(e.buf, int64(len(s)), 10)
+	e.buf = append(e.buf, ':')
+	e.buf = append(e.buf, s...)
+}
@@ -0,0 +1,81 @@
+package meta
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBencodeEncoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    Node
+		expected string
+	}{
+		{"positive integer", BInt(42), "i42e"},
+		{"negative integer", BInt(-13), "i-13e"},
+		{"zero", BInt(0), "i0e"},
+		{"plain int64", int64(1 << 40), "i1099511627776e"},
+		{"simple string", BString("spam"), "4:spam"},
+		{"empty string", BString(""), "0:"},
+		{"binary string", []byte{0x00, 0xff}, "2:\x00\xff"},
+		{"empty list", BList{}, "le"},
+		{"mixed list", BList{BString("spam"), BInt(42)}, "l4:spami42ee"},
+		{"empty dict", BDict{}, "de"},
+		{"sorted dict keys", BDict{"foo": BInt(42), "bar": BString("spam")}, "d3:bar4:spam3:fooi42ee"},
+		{"keys sorted as bytes", BDict{"b": BInt(1), "B": BInt(2), "a b": BInt(3)}, "d1:Bi2e3:a bi3e1:bi1ee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Encode(tt.input)
+			if err != nil {
+				t.Fatalf("Failed to encode %v: %v", tt.input, err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBencodeRoundTrip(t *testing.T) {
+	inputs := []string{
+		"i42e",
+		"i-13e",
+		"4:spam",
+		"0:",
+		"le",
+		"ll4:spamei42ee",
+		"de",
+		"d3:bar4:spam3:fooi42ee",
+		"d4:infod6:lengthi1024e4:name8:test.txt12:piece lengthi32768e6:pieces20:12345678901234567890ee",
+		"d5:filesld6:lengthi1e4:pathl1:a1:beeee",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			node, err := NewDecoder(strings.NewReader(input)).Decode()
+			if err != nil {
+				t.Fatalf("Failed to decode %q: %v", input, err)
+			}
+
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(node); err != nil {
+				t.Fatalf("Failed to encode %v: %v", node, err)
+			}
+			if buf.String() != input {
+				t.Errorf("Round trip mismatch: expected %q, got %q", input, buf.String())
+			}
+		})
+	}
+}
+
+func TestBencodeEncoderErrors(t *testing.T) {
+	if _, err := Encode(3.14); err == nil {
+		t.Error("Expected error for float value")
+	}
+	if _, err := Encode(BDict{"bad": BList{BInt(1), 2.5}}); err == nil {
+		t.Error("Expected error for nested unsupported value")
+	}
+}
@@ -0,0 +1,102 @@
+package meta
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Magnet is what a magnet link says about a torrent: enough to find peers
+// and fetch the info dict from them (BEP 9).
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string   // dn, a display name until the info dict arrives
+	Trackers []string // tr, in the order given
+}
+
+const btihPrefix = "urn:btih:"
+
+// ParseMagnet reads a magnet URI of the form
+// magnet:?xt=urn:btih:<hash>&dn=<name>&tr=<tracker>... The hash may be 40
+// hex or 32 base32 characters, and tr may be repeated.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %q", uri)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+
+	m := &Magnet{Name: params.Get("dn")}
+	found := false
+	for _, xt := range params["xt"] {
+		if len(xt) < len(btihPrefix) || !strings.EqualFold(xt[:len(btihPrefix)], btihPrefix) {
+			continue // another hash scheme, e.g. btmh
+		}
+		if m.InfoHash, err = decodeInfoHash(xt[len(btihPrefix):]); err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link has no xt=urn:btih: info hash")
+	}
+
+	seen := make(map[string]bool)
+	for _, tr := range params["tr"] {
+		if tr != "" && !seen[tr] {
+			seen[tr] = true
+			m.Trackers = append(m.Trackers, tr)
+		}
+	}
+	return m, nil
+}
+
+func decodeInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	var decoded []byte
+	var err error
+	switch len(s) {
+	case 40:
+		decoded, err = hex.DecodeString(s)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("info hash %q must be 40 hex or 32 base32 characters", s)
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid info hash %q: %w", s, err)
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// String returns the magnet URI, with the hash in hex.
+func (m *Magnet) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "magnet:?xt=%s%x", btihPrefix, m.InfoHash)
+	if m.Name != "" {
+		b.WriteString("&dn=" + url.QueryEscape(m.Name))
+	}
+	for _, tr := range m.Trackers {
+		b.WriteString("&tr=" + url.QueryEscape(tr))
+	}
+	return b.String()
+}
+
+// Magnet returns a magnet link for the torrent.
+func (t *Torrent) Magnet() (*Magnet, error) {
+	hash, err := t.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+	return &Magnet{InfoHash: hash, Name: t.Info.Name, Trackers: t.Trackers()}, nil
+}
@@ -0,0 +1,116 @@
+package meta
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	const hexHash = "46c2e7956bf657cbd7d3ab9f4a72ce543b58a4e8"
+	want, _ := hex.DecodeString(hexHash)
+
+	tests := []struct {
+		name     string
+		uri      string
+		dn       string
+		trackers []string
+	}{
+		{"hex", "magnet:?xt=urn:btih:" + hexHash, "", nil},
+		{"upper hex", "magnet:?xt=urn:btih:" + strings.ToUpper(hexHash), "", nil},
+		{"base32", "magnet:?xt=urn:btih:I3BOPFLL6ZL4XV6TVOPUU4WOKQ5VRJHI", "", nil},
+		{"lower base32", "magnet:?xt=urn:btih:i3bopfll6zl4xv6tvopuu4wokq5vrjhi", "", nil},
+		{
+			"name and trackers",
+			"magnet:?xt=urn:btih:" + hexHash + "&dn=My+Album&tr=http%3A%2F%2Fa.example%2Fannounce&tr=udp://b.example:80&tr=http%3A%2F%2Fa.example%2Fannounce",
+			"My Album",
+			[]string{"http://a.example/announce", "udp://b.example:80"},
+		},
+		{"other xt first", "magnet:?xt=urn:btmh:1220abcd&xt=urn:btih:" + hexHash, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseMagnet(tt.uri)
+			if err != nil {
+				t.Fatalf("ParseMagnet failed: %v", err)
+			}
+			if string(m.InfoHash[:]) != string(want) {
+				t.Errorf("Expected hash %s, got %x", hexHash, m.InfoHash)
+			}
+			if m.Name != tt.dn {
+				t.Errorf("Expected name %q, got %q", tt.dn, m.Name)
+			}
+			if strings.Join(m.Trackers, " ") != strings.Join(tt.trackers, " ") {
+				t.Errorf("Expected trackers %v, got %v", tt.trackers, m.Trackers)
+			}
+		})
+	}
+}
+
+func TestParseMagnet_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		expected string
+	}{
+		{"not magnet", "http://example.com/?xt=urn:btih:46c2e7956bf657cbd7d3ab9f4a72ce543b58a4e8", "not a magnet link"},
+		{"no xt", "magnet:?dn=foo", "no xt=urn:btih"},
+		{"short hash", "magnet:?xt=urn:btih:46c2e795", "40 hex or 32 base32"},
+		{"bad hex", "magnet:?xt=urn:btih:zzc2e7956bf657cbd7d3ab9f4a72ce543b58a4e8", "invalid info hash"},
+		{"bad base32", "magnet:?xt=urn:btih:1111111111111111111111111111111!", "invalid info hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseMagnet(tt.uri)
+			if err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestMagnet_RoundTrip(t *testing.T) {
+	m := &Magnet{Name: "a b&c", Trackers: []string{"http://t.example/announce?x=1", "udp://u.example:6969"}}
+	copy(m.InfoHash[:], "0123456789abcdefghij")
+
+	parsed, err := ParseMagnet(m.String())
+	if err != nil {
+		t.Fatalf("ParseMagnet(%q) failed: %v", m.String(), err)
+	}
+	if parsed.InfoHash != m.InfoHash || parsed.Name != m.Name || strings.Join(parsed.Trackers, " ") != strings.Join(m.Trackers, " ") {
+		t.Errorf("Round trip changed the magnet: %+v -> %+v", m, parsed)
+	}
+}
+
+func TestNewTorrentFromInfo(t *testing.T) {
+	// keys we do not model must still count towards the hash
+	raw := []byte("d6:lengthi5e6:md5sum3:abc4:name1:x12:piece lengthi16384e6:pieces20:01234567890123456789e")
+
+	torrent, err := NewTorrentFromInfo(raw, []string{"http://a/announce", "http://b/announce"})
+	if err != nil {
+		t.Fatalf("NewTorrentFromInfo failed: %v", err)
+	}
+	if torrent.Info.Name != "x" || torrent.Info.Length != 5 || torrent.Info.NumPieces() != 1 {
+		t.Errorf("Unexpected info: %+v", torrent.Info)
+	}
+	if got := torrent.Trackers(); strings.Join(got, " ") != "http://a/announce http://b/announce" {
+		t.Errorf("Unexpected trackers %v", got)
+	}
+
+	if hash, _ := torrent.InfoHash(); hash != sha1.Sum(raw) {
+		t.Errorf("Info hash not taken over the raw bytes")
+	}
+
+	if _, err := NewTorrentFromInfo([]byte("le"), nil); err == nil {
+		t.Error("Expected an error for a non-dictionary info")
+	}
+	if _, err := NewTorrentFromInfo([]byte("d4:name1:xe"), nil); err == nil {
+		t.Error("Expected an error for an incomplete info dict")
+	}
+}
@@ -0,0 +1,551 @@
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RawMessage is a raw bencoded value. When unmarshalling it receives the
+// exact bytes of the value as they appeared in the input; when marshalling
+// it is written out verbatim.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// UnmarshalTypeError describes a bencode value that cannot be stored in the
+// Go value it was destined for.
+type UnmarshalTypeError struct {
+	Field string       // dict key the value was found under, if any
+	Value string       // bencode kind: "integer", "string", "list" or "dictionary"
+	Type  reflect.Type // Go type it could not be assigned to
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("cannot unmarshal bencode %s into Go value of type %s", e.Value, e.Type)
+	}
+	return fmt.Sprintf("%s field must be %s, got %s", e.Field, expectedKind(e.Type), e.Value)
+}
+
+func expectedKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Bool:
+		return "an integer"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "a string"
+		}
+		return "a list"
+	case reflect.Struct, reflect.Map:
+		return "a dictionary"
+	}
+	return "a " + t.String()
+}
+
+func kindOf(first byte) string {
+	switch first {
+	case 'i':
+		return "integer"
+	case 'l':
+		return "list"
+	case 'd':
+		return "dictionary"
+	}
+	return "string"
+}
+
+// structField describes how one struct field maps onto a dict key. It is
+// built from tags of the form `bencode:"piece length,omitempty"`. The
+// options are omitempty (skip zero values when marshalling) and required
+// (fail unmarshalling when the key is absent).
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	required  bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]structField
+
+// cachedFields returns the fields of t sorted by key. Fields of embedded
+// structs are promoted, and a field at a shallower depth hides a deeper one
+// with the same key, mirroring Go's own selector rules.
+func cachedFields(t reflect.Type) []structField {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]structField)
+	}
+
+	byName := make(map[string]structField)
+	depth := make(map[string]int)
+	collectFields(t, nil, byName, depth)
+
+	fields := make([]structField, 0, len(byName))
+	for _, f := range byName {
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.([]structField)
+}
+
+func collectFields(t reflect.Type, parent []int, byName map[string]structField, depth map[string]int) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, hasTag := sf.Tag.Lookup("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		index := append(append([]int{}, parent...), i)
+
+		if sf.Anonymous && !hasTag && sf.Type.Kind() == reflect.Struct {
+			collectFields(sf.Type, index, byName, depth)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+
+		if d, exists := depth[name]; exists && d <= len(index) {
+			continue
+		}
+		depth[name] = len(index)
+		byName[name] = structField{
+			name:      name,
+			index:     index,
+			omitEmpty: hasOption(opts, "omitempty"),
+			required:  hasOption(opts, "required"),
+		}
+	}
+}
+
+func hasOption(opts, want string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Marshal returns the canonical bencoding of v. Structs are encoded as
+// dicts using their bencode tags, maps must have string keys, []byte and
+// byte arrays become strings, and bools become i0e/i1e.
+func Marshal(v any) ([]byte, error) {
+	e := &Encoder{}
+	if err := e.marshal(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (e *Encoder) marshal(v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("cannot marshal nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("cannot marshal empty RawMessage")
+		}
+		e.buf = append(e.buf, v.Bytes()...)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return fmt.Errorf("cannot marshal nil %s", v.Type())
+		}
+		if v.Kind() == reflect.Interface {
+			return e.encode(v.Elem().Interface())
+		}
+		return e.marshal(v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.buf = append(e.buf, 'i')
+		e.buf = strconv.AppendUint(e.buf, v.Uint(), 10)
+		e.buf = append(e.buf, 'e')
+	case reflect.Bool:
+		if v.Bool() {
+			e.writeInt(1)
+		} else {
+			e.writeInt(0)
+		}
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice {
+				e.writeString(string(v.Bytes()))
+			} else {
+				b := make([]byte, v.Len())
+				reflect.Copy(reflect.ValueOf(b), v)
+				e.writeString(string(b))
+			}
+			return nil
+		}
+		e.buf = append(e.buf, 'l')
+		for i := 0; i < v.Len(); i++ {
+			if err := e.marshal(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot marshal map with %s keys", v.Type().Key())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+
+		e.buf = append(e.buf, 'd')
+		for _, k := range keys {
+			e.writeString(k)
+			if err := e.marshal(v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))); err != nil {
+				return fmt.Errorf("dict key %q: %w", k, err)
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case reflect.Struct:
+		e.buf = append(e.buf, 'd')
+		for _, f := range cachedFields(v.Type()) {
+			fv := v.FieldByIndex(f.index)
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			e.writeString(f.name)
+			if err := e.marshal(fv); err != nil {
+				return fmt.Errorf("field %q: %w", f.name, err)
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	default:
+		return fmt.Errorf("unsupported bencode type: %s", v.Type())
+	}
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Unmarshal decodes the bencoded data into the value pointed to by v.
+// Dict keys without a matching struct field are skipped.
+func Unmarshal(data []byte, v any) error {
+	return UnmarshalWithOptions(data, v, DecoderOptions{})
+}
+
+// UnmarshalWithOptions is Unmarshal with validation and resource limits;
+// use it for anything that arrives from the network.
+func UnmarshalWithOptions(data []byte, v any, opts DecoderOptions) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("unmarshal target must be a non-nil pointer, got %T", v)
+	}
+
+	d := NewDecoderWithOptions(bytes.NewReader(data), opts)
+	first, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	if err := d.unmarshal(first, rv.Elem(), ""); err != nil {
+		return err
+	}
+	return d.checkEnd()
+}
+
+// UnmarshalPrefix decodes the bencoded value at the start of data into v
+// and returns how many bytes it took, for messages where raw data follows
+// a bencoded header.
+func UnmarshalPrefix(data []byte, v any, opts DecoderOptions) (int, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return 0, fmt.Errorf("unmarshal target must be a non-nil pointer, got %T", v)
+	}
+
+	d := NewDecoderWithOptions(bytes.NewReader(data), opts)
+	first, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if err := d.unmarshal(first, rv.Elem(), ""); err != nil {
+		return 0, err
+	}
+	return int(d.Offset()), nil
+}
+
+func (d *Decode) unmarshal(first byte, v reflect.Value, key string) error {
+	if v.Type() == rawMessageType {
+		return d.unmarshalRaw(first, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.unmarshal(first, v.Elem(), key)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return &UnmarshalTypeError{Field: key, Value: kindOf(first), Type: v.Type()}
+		}
+		node, err := d.parseValue(first)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(node))
+		return nil
+	}
+
+	switch first {
+	case 'i':
+		return d.unmarshalInt(v, key)
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return d.unmarshalString(first, v, key)
+	case 'l':
+		return d.unmarshalList(v, key)
+	case 'd':
+		return d.unmarshalDict(v, key)
+	default:
+		return d.syntaxError("unsupported bencode type: %c", first)
+	}
+}
+
+func (d *Decode) unmarshalRaw(first byte, v reflect.Value) error {
+	outer := d.capture
+	buf := &bytes.Buffer{}
+	buf.WriteByte(first)
+	d.capture = buf
+	_, err := d.parseValue(first)
+	d.capture = outer
+	if outer != nil {
+		outer.Write(buf.Bytes()[1:])
+	}
+	if err != nil {
+		return err
+	}
+	v.SetBytes(buf.Bytes())
+	return nil
+}
+
+func (d *Decode) unmarshalInt(v reflect.Value, key string) error {
+	n, err := d.parseInt()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(int64(n)) {
+			return fmt.Errorf("%s: integer %d overflows %s", key, n, v.Type())
+		}
+		v.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return fmt.Errorf("%s: integer %d overflows %s", key, n, v.Type())
+		}
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	default:
+		return &UnmarshalTypeError{Field: key, Value: "integer", Type: v.Type()}
+	}
+	return nil
+}
+
+func (d *Decode) unmarshalString(first byte, v reflect.Value, key string) error {
+	s, err := d.parseString(first)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes([]byte(s))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return fmt.Errorf("%s: string of length %d does not fit %s", key, len(s), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf([]byte(s)))
+	default:
+		return &UnmarshalTypeError{Field: key, Value: "string", Type: v.Type()}
+	}
+	return nil
+}
+
+func (d *Decode) unmarshalList(v reflect.Value, key string) error {
+	isList := (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.Uint8
+	if !isList {
+		return &UnmarshalTypeError{Field: key, Value: "list", Type: v.Type()}
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+
+	for i := 0; ; i++ {
+		first, err := d.next()
+		if err != nil {
+			return err
+		}
+		if first == 'e' {
+			break
+		}
+
+		if v.Kind() == reflect.Array {
+			if i >= v.Len() {
+				return fmt.Errorf("%s: list has more than %d elements", key, v.Len())
+			}
+			if err := d.unmarshal(first, v.Index(i), key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := d.unmarshal(first, elem, key); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+	return nil
+}
+
+func (d *Decode) unmarshalDict(v reflect.Value, key string) error {
+	isDict := (v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String) || v.Kind() == reflect.Struct
+	if !isDict {
+		return &UnmarshalTypeError{Field: key, Value: "dictionary", Type: v.Type()}
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	if v.Kind() == reflect.Struct {
+		return d.unmarshalStruct(v)
+	}
+
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	var prev string
+	for i := 0; ; i++ {
+		first, err := d.next()
+		if err != nil {
+			return err
+		}
+		if first == 'e' {
+			return nil
+		}
+		k, err := d.parseKey(first)
+		if err != nil {
+			return err
+		}
+		if err := d.checkKeyOrder(prev, k, i == 0); err != nil {
+			return err
+		}
+		prev = k
+
+		first, err = d.next()
+		if err != nil {
+			return err
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := d.unmarshal(first, elem, k); err != nil {
+			return err
+		}
+		v.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+	}
+}
+
+func (d *Decode) unmarshalStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	seen := make([]bool, len(fields))
+
+	var prev string
+	for n := 0; ; n++ {
+		first, err := d.next()
+		if err != nil {
+			return err
+		}
+		if first == 'e' {
+			break
+		}
+		k, err := d.parseKey(first)
+		if err != nil {
+			return err
+		}
+		if err := d.checkKeyOrder(prev, k, n == 0); err != nil {
+			return err
+		}
+		prev = k
+
+		first, err = d.next()
+		if err != nil {
+			return err
+		}
+
+		i := sort.Search(len(fields), func(i int) bool { return fields[i].name >= k })
+		if i == len(fields) || fields[i].name != k {
+			if _, err := d.parseValue(first); err != nil {
+				return err
+			}
+			continue
+		}
+
+		seen[i] = true
+		if err := d.unmarshal(first, v.FieldByIndex(fields[i].index), k); err != nil {
+			return err
+		}
+	}
+
+	for i, f := range fields {
+		if f.required && !seen[i] {
+			return fmt.Errorf("missing required %s field", f.name)
+		}
+	}
+	return nil
+}
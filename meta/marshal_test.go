@@ -0,0 +1,204 @@
+package meta
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length,required"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Private     bool       `bencode:"private,omitempty"`
+	Extra       RawMessage `bencode:"extra,omitempty"`
+	Ignored     string     `bencode:"-"`
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    any
+		expected string
+	}{
+		{"int", 42, "i42e"},
+		{"uint", uint16(7), "i7e"},
+		{"bool", true, "i1e"},
+		{"string", "spam", "4:spam"},
+		{"bytes", []byte("ab"), "2:ab"},
+		{"byte array", [2]byte{'h', 'i'}, "2:hi"},
+		{"list", []int{1, 2}, "li1ei2ee"},
+		{"map sorted", map[string]int{"b": 2, "a": 1}, "d1:ai1e1:bi2ee"},
+		{"node", BDict{"x": BList{BInt(1)}}, "d1:xli1eee"},
+		{"raw", RawMessage("i5e"), "i5e"},
+		{
+			"struct sorted with omitempty",
+			testInfo{Name: "a", PieceLength: 16, Pieces: []byte("xx"), Ignored: "nope"},
+			"d4:name1:a12:piece lengthi16e6:pieces2:xxe",
+		},
+		{
+			"struct nested",
+			testInfo{Name: "a", Files: []testFile{{Length: 1, Path: []string{"d", "f"}}}, Private: true, Extra: RawMessage("le")},
+			"d5:extrale5:filesld6:lengthi1e4:pathl1:d1:feee4:name1:a12:piece lengthi0e6:pieces0:7:privatei1ee",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.input)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	input := "d5:extrad1:ai1ee5:filesld6:lengthi1e4:pathl1:d1:feee4:name1:a7:unknownli1ei2ee12:piece lengthi16e6:pieces2:xx7:privatei1ee"
+
+	var info testInfo
+	if err := Unmarshal([]byte(input), &info); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	expected := testInfo{
+		Name:        "a",
+		PieceLength: 16,
+		Pieces:      []byte("xx"),
+		Files:       []testFile{{Length: 1, Path: []string{"d", "f"}}},
+		Private:     true,
+		Extra:       RawMessage("d1:ai1ee"),
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+
+	// marshalling the result back must reproduce the input minus unknown keys
+	out, err := Marshal(info)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if strings.Contains(string(out), "unknown") {
+		t.Errorf("Unknown key leaked into output: %q", out)
+	}
+	var again testInfo
+	if err := Unmarshal(out, &again); err != nil || !reflect.DeepEqual(again, info) {
+		t.Errorf("Round trip mismatch: %+v, err %v", again, err)
+	}
+}
+
+func TestUnmarshalContainers(t *testing.T) {
+	var m map[string][]int
+	if err := Unmarshal([]byte("d1:ali1ei2ee1:blee"), &m); err != nil {
+		t.Fatalf("Unmarshal map failed: %v", err)
+	}
+	if len(m) != 2 || len(m["a"]) != 2 || m["a"][1] != 2 {
+		t.Errorf("Unexpected map: %v", m)
+	}
+
+	var id [4]byte
+	if err := Unmarshal([]byte("4:abcd"), &id); err != nil || string(id[:]) != "abcd" {
+		t.Errorf("Unexpected array: %q, err %v", id, err)
+	}
+
+	var node Node
+	if err := Unmarshal([]byte("l4:spami42ee"), &node); err != nil {
+		t.Fatalf("Unmarshal node failed: %v", err)
+	}
+	if !reflect.DeepEqual(node, BList{BString("spam"), BInt(42)}) {
+		t.Errorf("Unexpected node: %#v", node)
+	}
+
+	var p *testFile
+	if err := Unmarshal([]byte("d6:lengthi3ee"), &p); err != nil || p == nil || p.Length != 3 {
+		t.Errorf("Unexpected pointer result: %+v, err %v", p, err)
+	}
+}
+
+func TestUnmarshalEmbedded(t *testing.T) {
+	type inner struct {
+		Name string   `bencode:"name"`
+		Info testInfo `bencode:"info"`
+		Tags []string `bencode:"tags"`
+	}
+	var outer struct {
+		inner
+		Info RawMessage `bencode:"info"`
+	}
+
+	input := "d4:infod4:name1:xe4:name3:top4:tagsl1:aee"
+	if err := Unmarshal([]byte(input), &outer); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if outer.Name != "top" || len(outer.Tags) != 1 {
+		t.Errorf("Promoted fields not filled: %+v", outer.inner)
+	}
+	if !bytes.Equal(outer.Info, []byte("d4:name1:xe")) {
+		t.Errorf("Shallow field should win, got raw %q", outer.Info)
+	}
+	if outer.inner.Info.Name != "" {
+		t.Errorf("Hidden field should stay empty, got %q", outer.inner.Info.Name)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	errorTests := []struct {
+		name     string
+		input    string
+		target   any
+		expected string
+	}{
+		{"top level type", "i1e", &testInfo{}, "cannot unmarshal bencode integer"},
+		{"field type", "d4:nameli1eee", &testInfo{}, "name field must be a string, got list"},
+		{"missing required", "d4:pathlee", &testFile{}, "missing required length field"},
+		{"overflow", "i300e", new(uint8), "overflows"},
+		{"array length", "3:abc", new([4]byte), "does not fit"},
+		{"truncated", "d4:name", &testInfo{}, "EOF"},
+		{"not a pointer", "i1e", testInfo{}, "non-nil pointer"},
+	}
+
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal([]byte(tt.input), tt.target)
+			if err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got: %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalPrefix(t *testing.T) {
+	var header struct {
+		Type  int `bencode:"msg_type"`
+		Piece int `bencode:"piece"`
+	}
+	data := []byte("d8:msg_typei1e5:piecei2eeRAW DATA")
+
+	n, err := UnmarshalPrefix(data, &header, DecoderOptions{})
+	if err != nil {
+		t.Fatalf("UnmarshalPrefix failed: %v", err)
+	}
+	if header.Type != 1 || header.Piece != 2 {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	if string(data[n:]) != "RAW DATA" {
+		t.Errorf("Expected the rest to be RAW DATA, got %q", data[n:])
+	}
+
+	if _, err := UnmarshalPrefix([]byte("d8:msg_typei1e"), &header, DecoderOptions{}); err == nil {
+		t.Error("Expected an error for a truncated header")
+	}
+}
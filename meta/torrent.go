@@ -1,34 +1,42 @@
 package meta
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
 type Torrent struct {
-	Announce     string
-	AnnounceList [][]string
-	Info         InfoDict
-	CreationDate int64
-	CreatedBy    string
-	Comment      string
-	Encoding     string
+	Announce     string     `bencode:"announce,omitempty"` // empty for trackerless torrents
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Info         InfoDict   `bencode:"info,required"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	Encoding     string     `bencode:"encoding,omitempty"`
+	URLList      []string   `bencode:"-"` // BEP 19 web seeds
+
+	// rawInfo holds the info dict exactly as it appeared in the parsed
+	// file. The info hash must be taken over these bytes, since keys we do
+	// not model (md5sum, source, padding attrs, ...) are part of it.
+	rawInfo []byte
 }
 
 type InfoDict struct {
-	Name        string
-	Length      int64      // single-file mode
-	Files       []FileInfo // multi-file mode
-	PieceLength int64
-	Pieces      []byte
-	Private     int64
+	Name        string     `bencode:"name,required"`
+	Length      int64      `bencode:"length,omitempty"` // single-file mode
+	Files       []FileInfo `bencode:"files,omitempty"`  // multi-file mode
+	PieceLength int64      `bencode:"piece length,required"`
+	Pieces      []byte     `bencode:"pieces,required"`
+	Private     int64      `bencode:"private,omitempty"`
+	Source      string     `bencode:"source,omitempty"`
 }
 
 type FileInfo struct {
-	Length int64
-	Path   []string
+	Length int64    `bencode:"length,required"`
+	Path   []string `bencode:"path,required"`
 }
 
 func ParseTorrentFile(filename string) (*Torrent, error) {
@@ -39,264 +47,276 @@ func ParseTorrentFile(filename string) (*Torrent, error) {
 	return ParseTorrent(data)
 }
 
+// torrentFile is the on-disk layout of a .torrent. The info dict is kept
+// raw so that reading and writing never disturb the bytes it hashes to.
+type torrentFile struct {
+	Torrent
+	Info    RawMessage `bencode:"info,required"`
+	URLList RawMessage `bencode:"url-list,omitempty"`
+}
+
+// optionalFields are informational only, so one of an unexpected type is
+// dropped rather than failing the whole torrent.
+type optionalFields struct {
+	AnnounceList RawMessage `bencode:"announce-list,omitempty"`
+	CreationDate RawMessage `bencode:"creation date,omitempty"`
+	CreatedBy    RawMessage `bencode:"created by,omitempty"`
+	Comment      RawMessage `bencode:"comment,omitempty"`
+	Encoding     RawMessage `bencode:"encoding,omitempty"`
+}
+
 func ParseTorrent(data []byte) (*Torrent, error) {
-	decoder := NewDecoder(bytes.NewReader(data))
-	node, err := decoder.Decode()
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode bencode: %w", err)
+	var file struct {
+		torrentFile
+		optionalFields
 	}
-
-	dict, ok := node.(BDict)
-	if !ok {
-		return nil, fmt.Errorf("torrent file must be a dictionary, got %T", node)
+	if err := Unmarshal(data, &file); err != nil {
+		var typeErr *UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field == "" {
+			return nil, fmt.Errorf("torrent file must be a dictionary, got %s", typeErr.Value)
+		}
+		if isDecodeError(err) {
+			return nil, fmt.Errorf("failed to decode bencode: %w", err)
+		}
+		return nil, err
 	}
 
-	torrent := &Torrent{}
+	if file.Info[0] != 'd' {
+		return nil, fmt.Errorf("info field must be a dictionary, got %s", kindOf(file.Info[0]))
+	}
 
-	if announceNode, exists := dict["announce"]; exists {
-		if announce, ok := announceNode.(BString); ok {
-			torrent.Announce = string(announce)
-		} else {
-			return nil, fmt.Errorf("announce field must be a string, got %T", announceNode)
-		}
-	} else {
-		return nil, fmt.Errorf("missing required announce field")
+	torrent := &file.Torrent
+	if err := Unmarshal(file.Info, &torrent.Info); err != nil {
+		return nil, fmt.Errorf("failed to parse info dict: %w", err)
+	}
+	if err := torrent.Info.validate(); err != nil {
+		return nil, fmt.Errorf("failed to parse info dict: %w", err)
 	}
+	torrent.rawInfo = file.Info
 
-	if infoNode, exists := dict["info"]; exists {
-		if infoDict, ok := infoNode.(BDict); ok {
-			info, err := parseInfoDict(infoDict)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse info dict: %w", err)
+	// url-list is a single string in many torrents and a list in others
+	if len(file.URLList) > 0 {
+		if file.URLList[0] == 'l' {
+			if err := Unmarshal(file.URLList, &torrent.URLList); err != nil {
+				return nil, fmt.Errorf("failed to parse url-list: %w", err)
 			}
-			torrent.Info = *info
 		} else {
-			return nil, fmt.Errorf("info field must be a dictionary, got %T", infoNode)
+			var url string
+			if err := Unmarshal(file.URLList, &url); err != nil {
+				return nil, fmt.Errorf("failed to parse url-list: %w", err)
+			}
+			torrent.URLList = []string{url}
 		}
-	} else {
-		return nil, fmt.Errorf("missing required info field")
 	}
 
-	parseOptionalString(dict, "comment", &torrent.Comment)
-	parseOptionalString(dict, "created by", &torrent.CreatedBy)
-	parseOptionalString(dict, "encoding", &torrent.Encoding)
-	parseOptionalInt(dict, "creation date", &torrent.CreationDate)
-
-	if announceListNode, exists := dict["announce-list"]; exists {
-		if announceList, ok := announceListNode.(BList); ok {
-			torrent.AnnounceList = parseAnnounceList(announceList)
-		}
-	}
+	opt := &file.optionalFields
+	decodeOptional(opt.CreationDate, &torrent.CreationDate)
+	decodeOptional(opt.CreatedBy, &torrent.CreatedBy)
+	decodeOptional(opt.Comment, &torrent.Comment)
+	decodeOptional(opt.Encoding, &torrent.Encoding)
+	torrent.AnnounceList = parseAnnounceList(opt.AnnounceList)
 
 	return torrent, nil
 }
 
-func (t *Torrent) InfoHash() ([20]byte, error) {
-	return calculateInfoHash(t.Info)
-}
-
-func calculateInfoHash(info InfoDict) ([20]byte, error) {
-
-	encoded, err := encodeBencodeInfoDict(info)
-	if err != nil {
-		return [20]byte{}, fmt.Errorf("failed to encode info dict: %w", err)
+// decodeOptional decodes raw into v, leaving v untouched if raw is absent
+// or of another type.
+func decodeOptional(raw RawMessage, v any) {
+	if len(raw) > 0 {
+		_ = Unmarshal(raw, v)
 	}
-
-	// Calculate SHA1 hash
-	hash := sha1.Sum(encoded)
-	return hash, nil
 }
 
-func encodeBencodeInfoDict(info InfoDict) ([]byte, error) {
-	var buf bytes.Buffer
-
-	// Start dictionary
-	buf.WriteString("d")
-
-	if len(info.Files) > 0 {
-		buf.WriteString(fmt.Sprintf("%d:files", len("files")))
-		buf.WriteString("l")
-		for _, file := range info.Files {
-			buf.WriteString("d")
-			// length
-			buf.WriteString(fmt.Sprintf("%d:length", len("length")))
-			buf.WriteString(fmt.Sprintf("i%de", file.Length))
-			// path
-			buf.WriteString(fmt.Sprintf("%d:path", len("path")))
-			buf.WriteString("l")
-			for _, component := range file.Path {
-				buf.WriteString(fmt.Sprintf("%d:%s", len(component), component))
+// parseAnnounceList keeps the trackers that are strings, dropping tiers
+// left empty.
+func parseAnnounceList(raw RawMessage) [][]string {
+	var tiers []RawMessage
+	decodeOptional(raw, &tiers)
+
+	var result [][]string
+	for _, rawTier := range tiers {
+		var entries []RawMessage
+		decodeOptional(rawTier, &entries)
+
+		var tier []string
+		for _, entry := range entries {
+			var tracker string
+			if Unmarshal(entry, &tracker) == nil {
+				tier = append(tier, tracker)
 			}
-			buf.WriteString("e") // end path list
-			buf.WriteString("e") // end file dict
 		}
-		buf.WriteString("e") // end files list
+		if len(tier) > 0 {
+			result = append(result, tier)
+		}
 	}
+	return result
+}
 
-	//length field (for single-file torrents)
-	if info.Length > 0 {
-		buf.WriteString(fmt.Sprintf("%d:length", len("length")))
-		buf.WriteString(fmt.Sprintf("i%de", info.Length))
+// NewTorrentFromInfo builds a torrent around a bencoded info dict, such as
+// one fetched from peers for a magnet link, announcing to trackers in
+// order. The info hash is taken over raw as given.
+func NewTorrentFromInfo(raw []byte, trackers []string) (*Torrent, error) {
+	if len(raw) == 0 || raw[0] != 'd' {
+		return nil, fmt.Errorf("info dict must be a dictionary")
 	}
 
-	//name field (required)
-	buf.WriteString(fmt.Sprintf("%d:name", len("name")))
-	buf.WriteString(fmt.Sprintf("%d:%s", len(info.Name), info.Name))
-
-	//piece length field (required)
-	buf.WriteString(fmt.Sprintf("%d:piece length", len("piece length")))
-	buf.WriteString(fmt.Sprintf("i%de", info.PieceLength))
-
-	//pieces field (required)
-	buf.WriteString(fmt.Sprintf("%d:pieces", len("pieces")))
-	buf.WriteString(fmt.Sprintf("%d:", len(info.Pieces)))
-	buf.Write(info.Pieces)
-
-	//private field (if present)
-	if info.Private > 0 {
-		buf.WriteString(fmt.Sprintf("%d:private", len("private")))
-		buf.WriteString(fmt.Sprintf("i%de", info.Private))
+	torrent := &Torrent{}
+	if err := Unmarshal(raw, &torrent.Info); err != nil {
+		return nil, fmt.Errorf("failed to parse info dict: %w", err)
 	}
+	if err := torrent.Info.validate(); err != nil {
+		return nil, fmt.Errorf("failed to parse info dict: %w", err)
+	}
+	torrent.rawInfo = append([]byte(nil), raw...)
 
-	//end dictionary
-	buf.WriteString("e")
-
-	return buf.Bytes(), nil
+	if len(trackers) > 0 {
+		torrent.Announce = trackers[0]
+		for _, tr := range trackers {
+			torrent.AnnounceList = append(torrent.AnnounceList, []string{tr})
+		}
+	}
+	return torrent, nil
 }
 
-func parseInfoDict(dict BDict) (*InfoDict, error) {
-	info := &InfoDict{}
-
-	if nameNode, exists := dict["name"]; exists {
-		if name, ok := nameNode.(BString); ok {
-			info.Name = string(name)
-		} else {
-			return nil, fmt.Errorf("name field must be a string, got %T", nameNode)
-		}
-	} else {
-		return nil, fmt.Errorf("missing required name field in info dict")
+// Bytes returns the bencoded .torrent file.
+func (t *Torrent) Bytes() ([]byte, error) {
+	raw, err := t.RawInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode info dict: %w", err)
 	}
 
-	if pieceLengthNode, exists := dict["piece length"]; exists {
-		if pieceLength, ok := pieceLengthNode.(BInt); ok {
-			info.PieceLength = int64(pieceLength)
-		} else {
-			return nil, fmt.Errorf("piece length field must be an integer, got %T", pieceLengthNode)
+	file := torrentFile{Torrent: *t, Info: raw}
+	if len(t.URLList) > 0 {
+		if file.URLList, err = Marshal(t.URLList); err != nil {
+			return nil, fmt.Errorf("failed to encode url-list: %w", err)
 		}
-	} else {
-		return nil, fmt.Errorf("missing required piece length field in info dict")
 	}
+	return Marshal(file)
+}
 
-	if piecesNode, exists := dict["pieces"]; exists {
-		if pieces, ok := piecesNode.(BString); ok {
-			info.Pieces = []byte(pieces)
-		} else {
-			return nil, fmt.Errorf("pieces field must be a string, got %T", piecesNode)
-		}
-	} else {
-		return nil, fmt.Errorf("missing required pieces field in info dict")
+// Write writes the bencoded .torrent file to w.
+func (t *Torrent) Write(w io.Writer) error {
+	data, err := t.Bytes()
+	if err != nil {
+		return err
 	}
+	_, err = w.Write(data)
+	return err
+}
 
-	if lengthNode, exists := dict["length"]; exists {
-		// Single-file mode
-		if length, ok := lengthNode.(BInt); ok {
-			info.Length = int64(length)
-		} else {
-			return nil, fmt.Errorf("length field must be an integer, got %T", lengthNode)
-		}
-	} else if filesNode, exists := dict["files"]; exists {
-		// Multi-file mode
-		if filesList, ok := filesNode.(BList); ok {
-			files, err := parseFileList(filesList)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse files list: %w", err)
-			}
-			info.Files = files
-		} else {
-			return nil, fmt.Errorf("files field must be a list, got %T", filesNode)
-		}
-	} else {
-		return nil, fmt.Errorf("info dict must have either length (single-file) or files (multi-file) field")
+func (t *Torrent) WriteFile(filename string) error {
+	data, err := t.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write torrent file: %w", err)
 	}
+	return nil
+}
 
-	parseOptionalInt(dict, "private", &info.Private)
+// isDecodeError tells malformed input apart from well-formed bencode that
+// simply does not describe a valid torrent.
+func isDecodeError(err error) bool {
+	var syntaxErr *SyntaxError
+	var limitErr *LimitError
+	return errors.Is(err, io.EOF) || errors.As(err, &syntaxErr) || errors.As(err, &limitErr)
+}
 
-	return info, nil
+// RawInfo returns the bencoded info dict. For parsed torrents these are the
+// original bytes from the file; for torrents built in memory the info dict
+// is encoded from the struct.
+func (t *Torrent) RawInfo() ([]byte, error) {
+	if t.rawInfo != nil {
+		return t.rawInfo, nil
+	}
+	return encodeBencodeInfoDict(t.Info)
 }
 
-func parseFileList(filesList BList) ([]FileInfo, error) {
-	files := make([]FileInfo, len(filesList))
+func (t *Torrent) InfoHash() ([20]byte, error) {
+	raw, err := t.RawInfo()
+	if err != nil {
+		return [20]byte{}, fmt.Errorf("failed to encode info dict: %w", err)
+	}
+	return sha1.Sum(raw), nil
+}
 
-	for i, fileNode := range filesList {
-		fileDict, ok := fileNode.(BDict)
-		if !ok {
-			return nil, fmt.Errorf("file entry %d must be a dictionary, got %T", i, fileNode)
-		}
+func encodeBencodeInfoDict(info InfoDict) ([]byte, error) {
+	return Marshal(info)
+}
 
-		if lengthNode, exists := fileDict["length"]; exists {
-			if length, ok := lengthNode.(BInt); ok {
-				files[i].Length = int64(length)
-			} else {
-				return nil, fmt.Errorf("file %d length field must be an integer, got %T", i, lengthNode)
-			}
-		} else {
-			return nil, fmt.Errorf("file %d missing required length field", i)
+// Trackers returns every announce URL in tier order without duplicates.
+// The announce-list takes precedence over announce when present (BEP 12).
+func (t *Torrent) Trackers() []string {
+	seen := make(map[string]bool)
+	var trackers []string
+	add := func(url string) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			trackers = append(trackers, url)
 		}
+	}
 
-		if pathNode, exists := fileDict["path"]; exists {
-			if pathList, ok := pathNode.(BList); ok {
-				path := make([]string, len(pathList))
-				for j, pathComponent := range pathList {
-					if pathStr, ok := pathComponent.(BString); ok {
-						path[j] = string(pathStr)
-					} else {
-						return nil, fmt.Errorf("file %d path component %d must be a string, got %T", i, j, pathComponent)
-					}
-				}
-				files[i].Path = path
-			} else {
-				return nil, fmt.Errorf("file %d path field must be a list, got %T", i, pathNode)
-			}
-		} else {
-			return nil, fmt.Errorf("file %d missing required path field", i)
+	for _, tier := range t.AnnounceList {
+		for _, url := range tier {
+			add(url)
 		}
 	}
-
-	return files, nil
+	add(t.Announce)
+	return trackers
 }
 
-func parseAnnounceList(announceList BList) [][]string {
-	result := make([][]string, 0, len(announceList))
-
-	for _, tierNode := range announceList {
-		if tierList, ok := tierNode.(BList); ok {
-			tier := make([]string, 0, len(tierList))
-			for _, trackerNode := range tierList {
-				if tracker, ok := trackerNode.(BString); ok {
-					tier = append(tier, string(tracker))
-				}
-			}
-			if len(tier) > 0 {
-				result = append(result, tier)
-			}
-		}
+// TotalLength is the size of the torrent's content: Length in single-file
+// mode, the sum of all file lengths in multi-file mode.
+func (info *InfoDict) TotalLength() int64 {
+	if len(info.Files) == 0 {
+		return info.Length
 	}
+	var total int64
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	return total
+}
 
-	return result
+func (info *InfoDict) NumPieces() int {
+	return len(info.Pieces) / sha1.Size
 }
 
-func parseOptionalString(dict BDict, key string, target *string) {
-	if node, exists := dict[key]; exists {
-		if str, ok := node.(BString); ok {
-			*target = string(str)
-		}
+func (info *InfoDict) fileLengths() []int64 {
+	if len(info.Files) == 0 {
+		return []int64{info.Length}
+	}
+	lengths := make([]int64, len(info.Files))
+	for i, f := range info.Files {
+		lengths[i] = f.Length
 	}
+	return lengths
 }
 
-func parseOptionalInt(dict BDict, key string, target *int64) {
-	if node, exists := dict[key]; exists {
-		if i, ok := node.(BInt); ok {
-			*target = int64(i)
+// validate checks that the pieces cover the content exactly, so the piece
+// layout and the file layout built from it agree.
+func (info *InfoDict) validate() error {
+	if info.Length == 0 && len(info.Files) == 0 {
+		return fmt.Errorf("info dict must have either length (single-file) or files (multi-file) field")
+	}
+	if info.Length < 0 {
+		return fmt.Errorf("length %d is negative", info.Length)
+	}
+	for _, f := range info.Files {
+		if f.Length < 0 {
+			return fmt.Errorf("file %v has negative length %d", f.Path, f.Length)
 		}
 	}
+	if info.PieceLength <= 0 {
+		return fmt.Errorf("piece length %d is not positive", info.PieceLength)
+	}
+	if len(info.Pieces)%sha1.Size != 0 {
+		return fmt.Errorf("pieces field is %d bytes, not a multiple of %d", len(info.Pieces), sha1.Size)
+	}
+	total := info.TotalLength()
+	if want := (total + info.PieceLength - 1) / info.PieceLength; int64(info.NumPieces()) != want {
+		return fmt.Errorf("%d piece hashes for %d bytes in pieces of %d, want %d", info.NumPieces(), total, info.PieceLength, want)
+	}
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -174,7 +175,7 @@ func TestParseTorrent_ErrorCases(t *testing.T) {
 	}{
 		{"not dictionary", "i42e", "torrent file must be a dictionary"},
 		{"empty data", "", "failed to decode bencode"},
-		{"missing announce", "de", "missing required announce field"},
+		{"empty dictionary", "de", "missing required info field"},
 		{"announce not string", fmt.Sprintf("d%s%se", calculateBencodeStringLength("announce"), "i42e"), "announce field must be a string"},
 		{"missing info", fmt.Sprintf("d%s%se", calculateBencodeStringLength("announce"), calculateBencodeStringLength("http://example.com")), "missing required info field"},
 		{"info not dict", fmt.Sprintf("d%s%s%s%se", calculateBencodeStringLength("announce"), calculateBencodeStringLength("http://example.com"), calculateBencodeStringLength("info"), "i42e"), "info field must be a dictionary"},
@@ -203,6 +204,21 @@ func TestParseTorrent_InfoDictErrors(t *testing.T) {
 		{"missing piece length", fmt.Sprintf("d%s%se", calculateBencodeStringLength("name"), calculateBencodeStringLength("test")), "missing required piece length field"},
 		{"missing pieces", fmt.Sprintf("d%s%s%s%se", calculateBencodeStringLength("name"), calculateBencodeStringLength("test"), calculateBencodeStringLength("piece length"), "i32768e"), "missing required pieces field"},
 		{"missing length and files", fmt.Sprintf("d%s%s%s%s%s%se", calculateBencodeStringLength("name"), calculateBencodeStringLength("test"), calculateBencodeStringLength("piece length"), "i32768e", calculateBencodeStringLength("pieces"), calculateBencodeStringLength("12345678901234567890")), "info dict must have either length"},
+		{"negative length", layoutInfo("i-1e", 32768, 0), "length -1 is negative"},
+		{"negative file length", fmt.Sprintf("d%s%s%s%s%s%s%s%se",
+			calculateBencodeStringLength("files"), "ld"+calculateBencodeStringLength("length")+"i-5e"+calculateBencodeStringLength("path")+"l"+calculateBencodeStringLength("a")+"eee",
+			calculateBencodeStringLength("name"), calculateBencodeStringLength("test"),
+			calculateBencodeStringLength("piece length"), "i32768e",
+			calculateBencodeStringLength("pieces"), calculateBencodeStringLength("12345678901234567890")), "negative length -5"},
+		{"zero piece length", layoutInfo("i1024e", 0, 1), "piece length 0 is not positive"},
+		{"negative piece length", layoutInfo("i1024e", -16, 1), "piece length -16 is not positive"},
+		{"pieces not whole hashes", fmt.Sprintf("d%s%s%s%s%s%s%s%se",
+			calculateBencodeStringLength("length"), "i1024e",
+			calculateBencodeStringLength("name"), calculateBencodeStringLength("test"),
+			calculateBencodeStringLength("piece length"), "i32768e",
+			calculateBencodeStringLength("pieces"), calculateBencodeStringLength("123456789012345678901")), "not a multiple of 20"},
+		{"too few hashes", layoutInfo("i40000e", 16384, 2), "2 piece hashes for 40000 bytes"},
+		{"too many hashes", layoutInfo("i1024e", 16384, 2), "2 piece hashes for 1024 bytes"},
 	}
 
 	for _, test := range infoErrorTests {
@@ -222,6 +238,43 @@ func TestParseTorrent_InfoDictErrors(t *testing.T) {
 	}
 }
 
+func TestParseTorrent_MalformedOptionalFields(t *testing.T) {
+	// keys in bencode order; each optional field has the wrong type, and
+	// announce-list mixes trackers with junk
+	data := fmt.Sprintf("d%s%s%s%s%s%s%s%s%s%s%s%se",
+		calculateBencodeStringLength("announce"), calculateBencodeStringLength("http://a.example.com"),
+		calculateBencodeStringLength("announce-list"), "ll"+calculateBencodeStringLength("http://b.example.com")+"i7ee"+"i3e"+"li9eee",
+		calculateBencodeStringLength("comment"), "i42e",
+		calculateBencodeStringLength("created by"), "le",
+		calculateBencodeStringLength("creation date"), calculateBencodeStringLength("yesterday"),
+		calculateBencodeStringLength("info"), layoutInfo("i1024e", 16384, 1))
+
+	torrent, err := ParseTorrent([]byte(data))
+	if err != nil {
+		t.Fatalf("ParseTorrent: %v", err)
+	}
+	if torrent.Announce != "http://a.example.com" {
+		t.Errorf("announce = %q", torrent.Announce)
+	}
+	if want := [][]string{{"http://b.example.com"}}; !reflect.DeepEqual(torrent.AnnounceList, want) {
+		t.Errorf("announce-list = %v, want %v", torrent.AnnounceList, want)
+	}
+	if torrent.Comment != "" || torrent.CreatedBy != "" || torrent.CreationDate != 0 {
+		t.Errorf("malformed fields kept: comment %q, created by %q, creation date %d",
+			torrent.Comment, torrent.CreatedBy, torrent.CreationDate)
+	}
+}
+
+// layoutInfo is a single-file info dict with the given bencoded length
+// and hashes pieces of pieceLength bytes.
+func layoutInfo(length string, pieceLength int64, hashes int) string {
+	return fmt.Sprintf("d%s%s%s%s%s%s%s%se",
+		calculateBencodeStringLength("length"), length,
+		calculateBencodeStringLength("name"), calculateBencodeStringLength("test"),
+		calculateBencodeStringLength("piece length"), calculateBencodeIntLength(pieceLength),
+		calculateBencodeStringLength("pieces"), calculateBencodeStringLength(strings.Repeat("x", 20*hashes)))
+}
+
 func TestTorrent_InfoHash(t *testing.T) {
 	t.Run("single file torrent", func(t *testing.T) {
 		// Create a torrent with known data
@@ -330,3 +383,85 @@ func TestTorrent_InfoHash(t *testing.T) {
 		}
 	})
 }
+
+func TestTorrent_InfoHashUsesRawInfo(t *testing.T) {
+	// Keys the InfoDict struct does not model, in non-canonical order,
+	// must still be covered by the info hash.
+	infoDict := "d4:name8:test.txt6:lengthi1024e6:md5sum32:0123456789abcdef0123456789abcdef" +
+		"12:piece lengthi32768e6:pieces20:012345678901234567896:source3:pixe"
+	data := []byte(fmt.Sprintf("d%s%s%s%se",
+		calculateBencodeStringLength("announce"), calculateBencodeStringLength("http://example.com"),
+		calculateBencodeStringLength("info"), infoDict))
+
+	torrent, err := ParseTorrent(data)
+	if err != nil {
+		t.Fatalf("ParseTorrent failed: %v", err)
+	}
+
+	raw, err := torrent.RawInfo()
+	if err != nil {
+		t.Fatalf("RawInfo failed: %v", err)
+	}
+	if string(raw) != infoDict {
+		t.Errorf("RawInfo mismatch:\nGot:      %s\nExpected: %s", raw, infoDict)
+	}
+
+	hash, err := torrent.InfoHash()
+	if err != nil {
+		t.Fatalf("InfoHash failed: %v", err)
+	}
+	if expected := sha1.Sum([]byte(infoDict)); hash != expected {
+		t.Errorf("Hash mismatch:\nGot:      %x\nExpected: %x", hash, expected)
+	}
+
+	reencoded, _ := (&Torrent{Info: torrent.Info}).InfoHash()
+	if reencoded == hash {
+		t.Error("Re-encoded info dict should differ from the original when unknown keys are present")
+	}
+}
+
+func TestTorrent_Trackers(t *testing.T) {
+	torrent := &Torrent{
+		Announce: "http://b/announce",
+		AnnounceList: [][]string{
+			{"http://a/announce", "http://b/announce"},
+			{"http://c/announce", "http://a/announce"},
+		},
+	}
+	expected := []string{"http://a/announce", "http://b/announce", "http://c/announce"}
+	if got := torrent.Trackers(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Trackers mismatch:\nGot:      %v\nExpected: %v", got, expected)
+	}
+
+	single := &Torrent{Announce: "http://only/announce"}
+	if got := single.Trackers(); !reflect.DeepEqual(got, []string{"http://only/announce"}) {
+		t.Errorf("Expected only the announce URL, got %v", got)
+	}
+}
+
+func TestParseTorrent_Trackerless(t *testing.T) {
+	// a torrent found on the DHT carries no announce at all
+	raw := []byte("d6:lengthi5e4:name1:x12:piece lengthi16384e6:pieces20:01234567890123456789e")
+	torrent, err := NewTorrentFromInfo(raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := torrent.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	if strings.Contains(string(data), "announce") {
+		t.Errorf("Trackerless torrent written with an announce: %s", data)
+	}
+
+	parsed, err := ParseTorrent(data)
+	if err != nil {
+		t.Fatalf("ParseTorrent failed on a trackerless torrent: %v", err)
+	}
+	if parsed.Announce != "" || len(parsed.Trackers()) != 0 {
+		t.Errorf("Unexpected trackers %v", parsed.Trackers())
+	}
+	if hash, _ := parsed.InfoHash(); hash != sha1.Sum(raw) {
+		t.Errorf("Info hash changed in the round trip")
+	}
+}
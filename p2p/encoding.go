@@ -6,10 +6,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+
+	"github.com/pixperk/pixtorrent/meta"
 )
 
 const MaxMessageLength = 16 * 1024 * 1024
 
+// BencodeLimits bounds bencoded payloads carried inside peer messages. A
+// single frame can never legitimately hold more than MaxMessageLength, and
+// peers have no business nesting deeper than a handful of levels.
+var BencodeLimits = meta.DecoderOptions{
+	MaxStringLength: MaxMessageLength,
+	MaxDepth:        16,
+	MaxSize:         MaxMessageLength,
+}
+
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+// The extension protocol (BEP 10) is advertised with bit 0x10 of the
+// sixth reserved byte of the handshake.
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+)
+
+// ExtendedHandshakeID is the extended message ID of the extended
+// handshake itself. Other IDs are chosen by whoever receives the messages
+// and announced in the "m" dictionary of their handshake.
+const ExtendedHandshakeID = 0
+
+// SupportsExtensions reports whether the peer's handshake advertised the
+// extension protocol.
+func SupportsExtensions(peer Peer) bool {
+	return peer.Reserved()[extensionByte]&extensionBit != 0
+}
+
+// Extended carries a message of the extension protocol. After
+// UnmarshalBinary, Payload shares memory with the data it was decoded
+// from.
+type Extended struct {
+	ExtID   byte
+	Payload []byte
+}
+
+func (*Extended) ID() byte { return MsgExtended }
+
+func (m *Extended) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 2+len(m.Payload))
+	buf[0] = m.ID()
+	buf[1] = m.ExtID
+	copy(buf[2:], m.Payload)
+	return buf, nil
+}
+
+func (m *Extended) UnmarshalBinary(data []byte) error {
+	if err := checkID(m, data); err != nil {
+		return err
+	}
+	if len(data) < 2 {
+		return fmt.Errorf("%s: missing extended message ID", msgName(m.ID()))
+	}
+	m.ExtID = data[1]
+	m.Payload = data[2:]
+	return nil
+}
+
+// ExtendedHandshake is the bencoded dictionary exchanged as extended
+// message 0. M maps the names of the extensions the sender supports to
+// the IDs it wants their messages sent with; 0 disables one again in a
+// later handshake.
+type ExtendedHandshake struct {
+	M      map[string]int `bencode:"m"`
+	V      string         `bencode:"v,omitempty"`      // client name and version
+	P      int            `bencode:"p,omitempty"`      // TCP listen port
+	Reqq   int            `bencode:"reqq,omitempty"`   // requests the sender queues
+	YourIP []byte         `bencode:"yourip,omitempty"` // receiver's IP as the sender sees it
+
+	// MetadataSize is the length of the info dict the sender can serve
+	// over ut_metadata (BEP 9).
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+}
+
+// Message encodes the handshake as an extended message.
+func (hs *ExtendedHandshake) Message() (*Extended, error) {
+	payload, err := meta.Marshal(hs)
+	if err != nil {
+		return nil, err
+	}
+	return &Extended{ExtID: ExtendedHandshakeID, Payload: payload}, nil
+}
+
+// ParseExtendedHandshake decodes a handshake's payload within
+// BencodeLimits.
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	hs := &ExtendedHandshake{}
+	if err := meta.UnmarshalWithOptions(payload, hs, BencodeLimits); err != nil {
+		return nil, fmt.Errorf("bad extended handshake: %w", err)
+	}
+	return hs, nil
+}
+
+// CompactIP returns the 4 or 16 byte form of ip used for "yourip".
+func CompactIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
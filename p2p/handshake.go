@@ -13,8 +13,12 @@ func NOPHandshakeFunc(Peer, [20]byte, [20]byte, bool) error { return nil }
 
 // Handshake structure:
 // <pstrlen><pstr><reserved><info_hash><peer_id>
+//
+// The pstr is that of the peer's protocol, so both sides must speak the
+// same one.
 func DefaultHandshakeFunc(peer Peer, infoHash [20]byte, localID [20]byte, outbound bool) error {
-	hs := buildHandshake(infoHash, localID)
+	protocol := protocolOf(peer)
+	hs := buildHandshake(protocol.Name, infoHash, localID)
 	resp := make([]byte, len(hs))
 
 	if outbound {
@@ -33,13 +37,20 @@ func DefaultHandshakeFunc(peer Peer, infoHash [20]byte, localID [20]byte, outbou
 		}
 	}
 
-	// validate protocol
+	// validate protocol; resp only has room for a pstr as long as ours
 	pstrlen := int(resp[0])
+	if pstrlen != len(protocol.Name) {
+		return fmt.Errorf("unexpected protocol string length %d, want %d", pstrlen, len(protocol.Name))
+	}
 	pstr := string(resp[1 : 1+pstrlen])
-	if pstr != "piXTorrent protocol" {
+	if pstr != protocol.Name {
 		return fmt.Errorf("unexpected protocol: %s", pstr)
 	}
 
+	var reserved [8]byte
+	copy(reserved[:], resp[1+pstrlen:1+pstrlen+8])
+	peer.SetReserved(reserved)
+
 	receivedInfoHash := resp[1+pstrlen+8 : 1+pstrlen+8+20]
 	if !bytes.Equal(receivedInfoHash, infoHash[:]) {
 		return fmt.Errorf("infohash mismatch: expected %s got %s",
@@ -60,13 +71,13 @@ func DefaultHandshakeFunc(peer Peer, infoHash [20]byte, localID [20]byte, outbou
 	return nil
 }
 
-func buildHandshake(infoHash [20]byte, localPeerID [20]byte) []byte {
-	pstr := "piXTorrent protocol"
+func buildHandshake(pstr string, infoHash [20]byte, localPeerID [20]byte) []byte {
 	buf := make([]byte, 49+len(pstr)) // 1 + pstrlen + 8 + 20 + 20
 
 	buf[0] = byte(len(pstr))
 	copy(buf[1:], []byte(pstr))
-	// reserved 8 bytes already zero
+	// reserved bytes: only the extension protocol is advertised
+	buf[1+len(pstr)+extensionByte] |= extensionBit
 	copy(buf[1+len(pstr)+8:], infoHash[:])
 	copy(buf[1+len(pstr)+8+20:], localPeerID[:])
 
@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// handshakePair runs DefaultHandshakeFunc on both ends of a pipe and
+// returns both peers and their errors, outbound first.
+func handshakePair(t *testing.T, outHash, inHash [20]byte) (*TCPPeer, *TCPPeer, error, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	out := NewTCPPeerWithProtocol(c1, true, BitTorrentProtocol)
+	in := NewTCPPeerWithProtocol(c2, false, BitTorrentProtocol)
+	t.Cleanup(func() { out.Close(); in.Close() })
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- DefaultHandshakeFunc(in, inHash, [20]byte{'i'}, false)
+	}()
+	outErr := DefaultHandshakeFunc(out, outHash, [20]byte{'o'}, true)
+	if outErr != nil {
+		// unblock the other side if it is still writing
+		out.Close()
+	}
+	return out, in, outErr, <-errs
+}
+
+func TestHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	out, in, outErr, inErr := handshakePair(t, infoHash, infoHash)
+	if outErr != nil || inErr != nil {
+		t.Fatalf("handshake failed: %v, %v", outErr, inErr)
+	}
+	if out.ID() != [20]byte{'i'} || in.ID() != [20]byte{'o'} {
+		t.Errorf("peer IDs = %q, %q", out.ID(), in.ID())
+	}
+	if !SupportsExtensions(out) || !SupportsExtensions(in) {
+		t.Error("extension bit not exchanged")
+	}
+}
+
+func TestHandshake_InfoHashMismatch(t *testing.T) {
+	_, _, outErr, _ := handshakePair(t, [20]byte{1}, [20]byte{2})
+	if outErr == nil || !strings.Contains(outErr.Error(), "infohash mismatch") {
+		t.Errorf("got %v, want an info hash mismatch", outErr)
+	}
+}
+
+func TestHandshake_BadProtocolLength(t *testing.T) {
+	infoHash := [20]byte{1}
+	for _, pstrlen := range []byte{0, 5, 20, 255} {
+		c1, c2 := net.Pipe()
+		peer := NewTCPPeerWithProtocol(c1, false, BitTorrentProtocol)
+
+		// as long as a real handshake, but claiming another pstr length
+		hs := buildHandshake(BitTorrentProtocol.Name, infoHash, [20]byte{'r'})
+		hs[0] = pstrlen
+		go func() {
+			c2.Write(hs)
+			io.Copy(io.Discard, c2)
+		}()
+
+		err := DefaultHandshakeFunc(peer, infoHash, [20]byte{'l'}, false)
+		if err == nil {
+			t.Errorf("pstrlen %d: handshake succeeded", pstrlen)
+		}
+		peer.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,290 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+// ErrUnknownMessage is returned by ParseMessage for IDs it has no type for.
+var ErrUnknownMessage = errors.New("unknown message")
+
+// Message is a peer wire message. Its binary form is what one frame
+// carries: the Msg* ID followed by the payload. UnmarshalBinary accepts
+// exactly what MarshalBinary produces and rejects anything of the wrong
+// length or ID.
+type Message interface {
+	ID() byte
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(data []byte) error
+}
+
+type (
+	Choke         struct{}
+	Unchoke       struct{}
+	Interested    struct{}
+	NotInterested struct{}
+)
+
+// Have announces that the sender now has a piece.
+type Have struct {
+	Index int
+}
+
+// Bitfield lists the pieces the sender has, one bit per piece with the
+// high bit of the first byte for piece 0.
+type Bitfield struct {
+	Bits []byte
+}
+
+// Request asks for a block.
+type Request struct {
+	BlockRequest
+}
+
+// Cancel withdraws an earlier Request.
+type Cancel struct {
+	BlockRequest
+}
+
+// Piece carries a block. After UnmarshalBinary, Block shares memory with
+// the data it was decoded from.
+//
+// To send a block straight from disk, Regions names where it lies instead
+// of Block holding it; TCPPeer then streams it with sendfile.
+type Piece struct {
+	Index   int
+	Begin   int
+	Block   []byte
+	Regions []storage.Region
+}
+
+// Len is the length of the block.
+func (m *Piece) Len() int {
+	if m.Regions == nil {
+		return len(m.Block)
+	}
+	n := int64(0)
+	for _, r := range m.Regions {
+		n += r.Length
+	}
+	return int(n)
+}
+
+func (*Choke) ID() byte         { return MsgChoke }
+func (*Unchoke) ID() byte       { return MsgUnchoke }
+func (*Interested) ID() byte    { return MsgInterested }
+func (*NotInterested) ID() byte { return MsgNotInterested }
+func (*Have) ID() byte          { return MsgHave }
+func (*Bitfield) ID() byte      { return MsgBitfield }
+func (*Request) ID() byte       { return MsgRequest }
+func (*Cancel) ID() byte        { return MsgCancel }
+func (*Piece) ID() byte         { return MsgPiece }
+
+func (m *Choke) MarshalBinary() ([]byte, error)         { return []byte{m.ID()}, nil }
+func (m *Unchoke) MarshalBinary() ([]byte, error)       { return []byte{m.ID()}, nil }
+func (m *Interested) MarshalBinary() ([]byte, error)    { return []byte{m.ID()}, nil }
+func (m *NotInterested) MarshalBinary() ([]byte, error) { return []byte{m.ID()}, nil }
+
+func (m *Choke) UnmarshalBinary(data []byte) error         { return checkLength(m, data, 0) }
+func (m *Unchoke) UnmarshalBinary(data []byte) error       { return checkLength(m, data, 0) }
+func (m *Interested) UnmarshalBinary(data []byte) error    { return checkLength(m, data, 0) }
+func (m *NotInterested) UnmarshalBinary(data []byte) error { return checkLength(m, data, 0) }
+
+func (m *Have) MarshalBinary() ([]byte, error) {
+	return marshalInts(m, m.Index)
+}
+
+func (m *Have) UnmarshalBinary(data []byte) error {
+	if err := checkLength(m, data, 4); err != nil {
+		return err
+	}
+	m.Index = int(binary.BigEndian.Uint32(data[1:5]))
+	return nil
+}
+
+func (m *Bitfield) MarshalBinary() ([]byte, error) {
+	return append([]byte{m.ID()}, m.Bits...), nil
+}
+
+func (m *Bitfield) UnmarshalBinary(data []byte) error {
+	if err := checkID(m, data); err != nil {
+		return err
+	}
+	m.Bits = data[1:]
+	return nil
+}
+
+func (m *Request) MarshalBinary() ([]byte, error) {
+	return marshalInts(m, m.Index, m.Begin, m.Length)
+}
+
+func (m *Request) UnmarshalBinary(data []byte) error {
+	return unmarshalBlockRequest(m, data, &m.BlockRequest)
+}
+
+func (m *Cancel) MarshalBinary() ([]byte, error) {
+	return marshalInts(m, m.Index, m.Begin, m.Length)
+}
+
+func (m *Cancel) UnmarshalBinary(data []byte) error {
+	return unmarshalBlockRequest(m, data, &m.BlockRequest)
+}
+
+func (m *Piece) MarshalBinary() ([]byte, error) {
+	head, err := marshalInts(m, m.Index, m.Begin)
+	if err != nil {
+		return nil, err
+	}
+	if m.Regions == nil {
+		return append(head, m.Block...), nil
+	}
+
+	buf := make([]byte, len(head), len(head)+m.Len())
+	copy(buf, head)
+	for _, r := range m.Regions {
+		if buf, err = appendRegion(buf, r); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendRegion(buf []byte, r storage.Region) ([]byte, error) {
+	f, err := os.Open(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	n := len(buf)
+	buf = buf[:n+int(r.Length)]
+	if _, err := f.ReadAt(buf[n:], r.Offset); err != nil {
+		return nil, fmt.Errorf("%s: %w", r.Path, err)
+	}
+	return buf, nil
+}
+
+func (m *Piece) UnmarshalBinary(data []byte) error {
+	if err := checkID(m, data); err != nil {
+		return err
+	}
+	if len(data) < 9 {
+		return fmt.Errorf("%s: %d bytes is too short for index and begin", msgName(m.ID()), len(data)-1)
+	}
+	m.Index = int(binary.BigEndian.Uint32(data[1:5]))
+	m.Begin = int(binary.BigEndian.Uint32(data[5:9]))
+	m.Block = data[9:]
+	return nil
+}
+
+// ParseMessage decodes one frame's payload. A keep-alive, which has no
+// payload, gives a nil Message and no error.
+func ParseMessage(payload []byte) (Message, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	var msg Message
+	switch payload[0] {
+	case MsgChoke:
+		msg = &Choke{}
+	case MsgUnchoke:
+		msg = &Unchoke{}
+	case MsgInterested:
+		msg = &Interested{}
+	case MsgNotInterested:
+		msg = &NotInterested{}
+	case MsgHave:
+		msg = &Have{}
+	case MsgBitfield:
+		msg = &Bitfield{}
+	case MsgRequest:
+		msg = &Request{}
+	case MsgPiece:
+		msg = &Piece{}
+	case MsgCancel:
+		msg = &Cancel{}
+	case MsgExtended:
+		msg = &Extended{}
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownMessage, payload[0])
+	}
+
+	if err := msg.UnmarshalBinary(payload); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+var msgNames = map[byte]string{
+	MsgChoke:         "choke",
+	MsgUnchoke:       "unchoke",
+	MsgInterested:    "interested",
+	MsgNotInterested: "not interested",
+	MsgHave:          "have",
+	MsgBitfield:      "bitfield",
+	MsgRequest:       "request",
+	MsgPiece:         "piece",
+	MsgCancel:        "cancel",
+	MsgExtended:      "extended",
+}
+
+func msgName(id byte) string {
+	if name, ok := msgNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("message %d", id)
+}
+
+func checkID(m Message, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%s: empty message", msgName(m.ID()))
+	}
+	if data[0] != m.ID() {
+		return fmt.Errorf("%s: got %s", msgName(m.ID()), msgName(data[0]))
+	}
+	return nil
+}
+
+// checkLength checks the ID and that the payload after it is exactly n
+// bytes.
+func checkLength(m Message, data []byte, n int) error {
+	if err := checkID(m, data); err != nil {
+		return err
+	}
+	if len(data)-1 != n {
+		return fmt.Errorf("%s: payload is %d bytes, want %d", msgName(m.ID()), len(data)-1, n)
+	}
+	return nil
+}
+
+// marshalInts encodes the ID followed by each value as a big-endian
+// uint32.
+func marshalInts(m Message, values ...int) ([]byte, error) {
+	buf := make([]byte, 1+4*len(values))
+	buf[0] = m.ID()
+	for i, v := range values {
+		if v < 0 || int64(v) > math.MaxUint32 {
+			return nil, fmt.Errorf("%s: value %d does not fit in 32 bits", msgName(m.ID()), v)
+		}
+		binary.BigEndian.PutUint32(buf[1+4*i:], uint32(v))
+	}
+	return buf, nil
+}
+
+// unmarshalBlockRequest decodes the <index><begin><length> layout shared
+// by request and cancel.
+func unmarshalBlockRequest(m Message, data []byte, req *BlockRequest) error {
+	if err := checkLength(m, data, 12); err != nil {
+		return err
+	}
+	req.Index = int(binary.BigEndian.Uint32(data[1:5]))
+	req.Begin = int(binary.BigEndian.Uint32(data[5:9]))
+	req.Length = int(binary.BigEndian.Uint32(data[9:13]))
+	return nil
+}
@@ -0,0 +1,190 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// sampleMessages has one message of every type ParseMessage knows.
+var sampleMessages = []Message{
+	&Choke{},
+	&Unchoke{},
+	&Interested{},
+	&NotInterested{},
+	&Have{Index: 7},
+	&Bitfield{Bits: []byte{0xf0, 0x01}},
+	&Request{BlockRequest{Index: 3, Begin: BlockSize, Length: BlockSize}},
+	&Cancel{BlockRequest{Index: 3, Begin: 0, Length: 100}},
+	&Piece{Index: 2, Begin: BlockSize, Block: []byte("block data")},
+	&Extended{ExtID: 3, Payload: []byte("d1:ai1ee")},
+}
+
+func TestMessage_RoundTrip(t *testing.T) {
+	for _, msg := range sampleMessages {
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: MarshalBinary: %v", msgName(msg.ID()), err)
+		}
+		got, err := ParseMessage(data)
+		if err != nil {
+			t.Fatalf("%s: ParseMessage: %v", msgName(msg.ID()), err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%s: got %+v, want %+v", msgName(msg.ID()), got, msg)
+		}
+	}
+}
+
+func TestMessage_EmptyPayloads(t *testing.T) {
+	for _, msg := range []Message{&Bitfield{}, &Piece{Index: 1}, &Extended{ExtID: 1}} {
+		data, _ := msg.MarshalBinary()
+		got, err := ParseMessage(data)
+		if err != nil {
+			t.Fatalf("%s: ParseMessage: %v", msgName(msg.ID()), err)
+		}
+		if got.ID() != msg.ID() {
+			t.Errorf("got %s, want %s", msgName(got.ID()), msgName(msg.ID()))
+		}
+	}
+}
+
+func TestMessage_KeepAlive(t *testing.T) {
+	msg, err := ParseMessage(nil)
+	if msg != nil || err != nil {
+		t.Errorf("ParseMessage(nil) = %v, %v; want a nil keep-alive", msg, err)
+	}
+}
+
+func TestMessage_WrongLength(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"choke with payload", []byte{MsgChoke, 0}},
+		{"unchoke with payload", []byte{MsgUnchoke, 0}},
+		{"interested with payload", []byte{MsgInterested, 0}},
+		{"not interested with payload", []byte{MsgNotInterested, 0, 0, 0, 0}},
+		{"have short", []byte{MsgHave, 0, 0, 1}},
+		{"have long", []byte{MsgHave, 0, 0, 0, 1, 0}},
+		{"have empty", []byte{MsgHave}},
+		{"request short", append([]byte{MsgRequest}, make([]byte, 11)...)},
+		{"request long", append([]byte{MsgRequest}, make([]byte, 13)...)},
+		{"request empty", []byte{MsgRequest}},
+		{"cancel short", append([]byte{MsgCancel}, make([]byte, 8)...)},
+		{"cancel long", append([]byte{MsgCancel}, make([]byte, 16)...)},
+		{"piece without begin", []byte{MsgPiece, 0, 0, 0, 1, 0, 0}},
+		{"piece empty", []byte{MsgPiece}},
+		{"extended without ID", []byte{MsgExtended}},
+		{"unknown ID", []byte{99, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg, err := ParseMessage(tt.data); err == nil {
+				t.Errorf("ParseMessage(%x) = %+v, want an error", tt.data, msg)
+			}
+		})
+	}
+}
+
+func TestMessage_UnknownID(t *testing.T) {
+	_, err := ParseMessage([]byte{99})
+	if !errors.Is(err, ErrUnknownMessage) {
+		t.Errorf("got %v, want ErrUnknownMessage", err)
+	}
+}
+
+func TestMessage_WrongID(t *testing.T) {
+	// every type refuses the bytes of every other type
+	for _, msg := range sampleMessages {
+		for _, other := range sampleMessages {
+			if other.ID() == msg.ID() {
+				continue
+			}
+			data, _ := other.MarshalBinary()
+			target := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(Message)
+			if err := target.UnmarshalBinary(data); err == nil {
+				t.Errorf("%s decoded the bytes of %s", msgName(msg.ID()), msgName(other.ID()))
+			}
+		}
+		target := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(Message)
+		if err := target.UnmarshalBinary(nil); err == nil {
+			t.Errorf("%s decoded an empty slice", msgName(msg.ID()))
+		}
+	}
+}
+
+func TestMessage_TruncatedNeverPanics(t *testing.T) {
+	// every prefix of every message, and every message with bytes added,
+	// either decodes or fails; none panics
+	for _, msg := range sampleMessages {
+		data, _ := msg.MarshalBinary()
+		for n := 0; n <= len(data); n++ {
+			ParseMessage(data[:n])
+		}
+		for extra := 1; extra <= 16; extra++ {
+			ParseMessage(append(bytes.Clone(data), make([]byte, extra)...))
+		}
+	}
+}
+
+func TestMessage_MarshalOutOfRange(t *testing.T) {
+	for _, msg := range []Message{
+		&Have{Index: -1},
+		&Request{BlockRequest{Index: 0, Begin: -1, Length: 1}},
+		&Cancel{BlockRequest{Index: 1 << 40}},
+		&Piece{Index: -5},
+	} {
+		if _, err := msg.MarshalBinary(); err == nil {
+			t.Errorf("%s: marshalled %+v", msgName(msg.ID()), msg)
+		}
+	}
+}
+
+func frame(payload []byte) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func TestBinaryDecoder(t *testing.T) {
+	have, _ := (&Have{Index: 4}).MarshalBinary()
+	stream := append(frame(have), frame(nil)...)
+
+	d := &BinaryDecoder{}
+	r := bytes.NewReader(stream)
+	var rpc RPC
+	if err := d.Decode(r, &rpc); err != nil || !bytes.Equal(rpc.Payload, have) {
+		t.Fatalf("first frame = %x, %v; want %x", rpc.Payload, err, have)
+	}
+	if err := d.Decode(r, &rpc); err != nil || rpc.Payload != nil {
+		t.Fatalf("keep-alive = %x, %v", rpc.Payload, err)
+	}
+	if err := d.Decode(r, &rpc); err != io.EOF {
+		t.Errorf("at end of stream got %v, want io.EOF", err)
+	}
+}
+
+func TestBinaryDecoder_Oversized(t *testing.T) {
+	head := binary.BigEndian.AppendUint32(nil, MaxMessageLength+1)
+	d := &BinaryDecoder{}
+	var rpc RPC
+	err := d.Decode(bytes.NewReader(head), &rpc)
+	if err == nil || err == io.EOF {
+		t.Errorf("got %v, want an error for a frame over MaxMessageLength", err)
+	}
+}
+
+func TestBinaryDecoder_Truncated(t *testing.T) {
+	have, _ := (&Have{Index: 4}).MarshalBinary()
+	data := frame(have)
+	for n := 1; n < len(data); n++ {
+		d := &BinaryDecoder{}
+		var rpc RPC
+		if err := d.Decode(bytes.NewReader(data[:n]), &rpc); err == nil {
+			t.Errorf("decoded %d of %d bytes of a frame", n, len(data))
+		}
+	}
+}
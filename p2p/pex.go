@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+// Flags of a peer exchange (BEP 11) entry, one byte per added peer.
+const (
+	PexEncryption byte = 0x01 // prefers encrypted connections
+	PexSeed       byte = 0x02 // has everything, or only uploads
+	PexUTP        byte = 0x04 // supports uTP
+	PexHolepunch  byte = 0x08 // supports ut_holepunch
+	PexReachable  byte = 0x10 // the sender could connect to it
+)
+
+// PexPeer is a peer listed in a peer exchange message.
+type PexPeer struct {
+	Addr  netip.AddrPort
+	Flags byte
+}
+
+// PexMessage is a ut_pex message: the peers the sender connected to and
+// dropped since its last message, in compact form (BEP 23), with IPv6
+// peers kept apart.
+type PexMessage struct {
+	Added    []byte `bencode:"added,omitempty"`
+	AddedF   []byte `bencode:"added.f,omitempty"`
+	Dropped  []byte `bencode:"dropped,omitempty"`
+	Added6   []byte `bencode:"added6,omitempty"`
+	Added6F  []byte `bencode:"added6.f,omitempty"`
+	Dropped6 []byte `bencode:"dropped6,omitempty"`
+}
+
+// NewPexMessage encodes the given changes.
+func NewPexMessage(added []PexPeer, dropped []netip.AddrPort) *PexMessage {
+	m := &PexMessage{}
+	for _, p := range added {
+		if p.Addr.Addr().Unmap().Is4() {
+			m.Added = appendCompact(m.Added, p.Addr)
+			m.AddedF = append(m.AddedF, p.Flags)
+		} else {
+			m.Added6 = appendCompact(m.Added6, p.Addr)
+			m.Added6F = append(m.Added6F, p.Flags)
+		}
+	}
+	for _, addr := range dropped {
+		if addr.Addr().Unmap().Is4() {
+			m.Dropped = appendCompact(m.Dropped, addr)
+		} else {
+			m.Dropped6 = appendCompact(m.Dropped6, addr)
+		}
+	}
+	return m
+}
+
+// ParsePexMessage decodes a ut_pex payload within BencodeLimits.
+func ParsePexMessage(payload []byte) (*PexMessage, error) {
+	m := &PexMessage{}
+	if err := meta.UnmarshalWithOptions(payload, m, BencodeLimits); err != nil {
+		return nil, fmt.Errorf("bad pex message: %w", err)
+	}
+	return m, nil
+}
+
+// AddedPeers lists the added peers with their flags. Peers without a
+// flags byte get 0, and a trailing partial entry is ignored.
+func (m *PexMessage) AddedPeers() []PexPeer {
+	var peers []PexPeer
+	for i, addr := range parseCompact(m.Added, 4) {
+		peers = append(peers, PexPeer{Addr: addr, Flags: flagAt(m.AddedF, i)})
+	}
+	for i, addr := range parseCompact(m.Added6, 16) {
+		peers = append(peers, PexPeer{Addr: addr, Flags: flagAt(m.Added6F, i)})
+	}
+	return peers
+}
+
+// DroppedPeers lists the dropped peers.
+func (m *PexMessage) DroppedPeers() []netip.AddrPort {
+	return append(parseCompact(m.Dropped, 4), parseCompact(m.Dropped6, 16)...)
+}
+
+func flagAt(flags []byte, i int) byte {
+	if i < len(flags) {
+		return flags[i]
+	}
+	return 0
+}
+
+// appendCompact appends the 6 or 18 byte form of addr: the IP followed by
+// the port, big-endian.
+func appendCompact(buf []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	buf = append(buf, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(buf, addr.Port())
+}
+
+func parseCompact(data []byte, ipLen int) []netip.AddrPort {
+	var addrs []netip.AddrPort
+	size := ipLen + 2
+	for i := 0; i+size <= len(data); i += size {
+		ip, _ := netip.AddrFromSlice(data[i : i+ipLen])
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+size])
+		addrs = append(addrs, netip.AddrPortFrom(ip, port))
+	}
+	return addrs
+}
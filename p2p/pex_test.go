@@ -0,0 +1,83 @@
+package p2p
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+func TestPexMessage_RoundTrip(t *testing.T) {
+	added := []PexPeer{
+		{Addr: netip.MustParseAddrPort("10.0.0.1:6881"), Flags: PexSeed | PexReachable},
+		{Addr: netip.MustParseAddrPort("192.168.1.2:51413"), Flags: PexEncryption},
+		{Addr: netip.MustParseAddrPort("[2001:db8::1]:6881"), Flags: PexUTP | PexHolepunch},
+	}
+	dropped := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.9:1"),
+		netip.MustParseAddrPort("[2001:db8::2]:65535"),
+	}
+
+	payload, err := meta.Marshal(NewPexMessage(added, dropped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParsePexMessage(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Added) != 12 || len(m.AddedF) != 2 || len(m.Added6) != 18 || len(m.Added6F) != 1 {
+		t.Errorf("IPv4 and IPv6 peers not kept apart: %+v", m)
+	}
+	if got := m.AddedPeers(); !reflect.DeepEqual(got, added) {
+		t.Errorf("AddedPeers = %v, want %v", got, added)
+	}
+	if got := m.DroppedPeers(); !reflect.DeepEqual(got, dropped) {
+		t.Errorf("DroppedPeers = %v, want %v", got, dropped)
+	}
+}
+
+func TestPexMessage_MappedIPv4IsCompact(t *testing.T) {
+	mapped := netip.MustParseAddrPort("[::ffff:10.0.0.1]:6881")
+	m := NewPexMessage([]PexPeer{{Addr: mapped}}, nil)
+	if len(m.Added) != 6 || len(m.Added6) != 0 {
+		t.Fatalf("IPv4-mapped peer encoded as %d IPv4 and %d IPv6 bytes", len(m.Added), len(m.Added6))
+	}
+	if got := m.AddedPeers()[0].Addr; got != netip.MustParseAddrPort("10.0.0.1:6881") {
+		t.Errorf("decoded %v", got)
+	}
+}
+
+func TestPexMessage_Lenient(t *testing.T) {
+	// the second flag is missing and a partial third entry trails
+	m := &PexMessage{
+		Added:  []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2, 10, 0},
+		AddedF: []byte{PexSeed},
+	}
+	want := []PexPeer{
+		{Addr: netip.MustParseAddrPort("10.0.0.1:6881"), Flags: PexSeed},
+		{Addr: netip.MustParseAddrPort("10.0.0.2:6882")},
+	}
+	if got := m.AddedPeers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AddedPeers = %v, want %v", got, want)
+	}
+	if got := (&PexMessage{}).DroppedPeers(); len(got) != 0 {
+		t.Errorf("DroppedPeers of an empty message = %v", got)
+	}
+}
+
+func TestParsePexMessage_Malformed(t *testing.T) {
+	for _, payload := range []string{
+		"",
+		"l5:addede",
+		"d5:added",
+		"d5:addedi1ee",
+		"d5:added" + strings.Repeat("x", 10) + "e",
+	} {
+		if _, err := ParsePexMessage([]byte(payload)); err == nil {
+			t.Errorf("ParsePexMessage(%q) succeeded", payload)
+		}
+	}
+}
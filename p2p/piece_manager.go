@@ -4,31 +4,87 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 type PieceManager struct {
 	mu          sync.RWMutex
 	numPieces   int
-	pieces      map[int][]byte
+	storage     PieceStorage
+	have        []byte // completion bitset, MSB first like the wire bitfield
+	received    int
 	pieceHashes []byte
+
+	// layout, when known, lets pieces be fetched block by block
+	pieceLength int64
+	totalLength int64
+
+	added    chan struct{} // closed when the next piece completes
+	rechecks int           // bumped when Recheck may have cleared pieces
 }
 
 func NewPieceManager(numPieces int) *PieceManager {
-	return &PieceManager{
-		numPieces: numPieces,
-		pieces:    make(map[int][]byte),
-	}
+	return NewPieceManagerWithStorage(numPieces, nil, NewMemoryStorage())
 }
 
 func NewPieceManagerWithHashes(numPieces int, pieceHashes []byte) *PieceManager {
+	return NewPieceManagerWithStorage(numPieces, pieceHashes, NewMemoryStorage())
+}
+
+// NewPieceManagerWithStorage keeps piece data in storage, e.g. the torrent's
+// files on disk, so only the completion bitset lives in memory.
+func NewPieceManagerWithStorage(numPieces int, pieceHashes []byte, storage PieceStorage) *PieceManager {
 	return &PieceManager{
 		numPieces:   numPieces,
-		pieces:      make(map[int][]byte),
+		storage:     storage,
+		have:        make([]byte, (numPieces+7)/8),
 		pieceHashes: pieceHashes,
 	}
 }
 
+func (pm *PieceManager) Storage() PieceStorage {
+	return pm.storage
+}
+
+// SetLayout records the piece length and total content length. Without
+// them pieces cannot be requested, only served.
+func (pm *PieceManager) SetLayout(pieceLength, totalLength int64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.pieceLength = pieceLength
+	pm.totalLength = totalLength
+}
+
+func (pm *PieceManager) PieceLength() int64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.pieceLength
+}
+
+func (pm *PieceManager) TotalLength() int64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.totalLength
+}
+
+// PieceSize is the length of piece idx, or 0 when the layout is unknown or
+// idx is out of range.
+func (pm *PieceManager) PieceSize(idx int) int64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if pm.pieceLength <= 0 || idx < 0 || idx >= pm.numPieces {
+		return 0
+	}
+	start := int64(idx) * pm.pieceLength
+	if start+pm.pieceLength > pm.totalLength {
+		return pm.totalLength - start
+	}
+	return pm.pieceLength
+}
+
 func (pm *PieceManager) SetPieceHashes(hashes []byte) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
@@ -59,12 +115,92 @@ func (pm *PieceManager) VerifyPiece(idx int, data []byte) bool {
 	return bytes.Equal(expectedHash, actualHash[:])
 }
 
-func (pm *PieceManager) GetPiece(idx int) ([]byte, bool) {
+func (pm *PieceManager) hasPiece(idx int) bool {
+	return pm.have[idx/8]&(1<<(7-idx%8)) != 0
+}
+
+func (pm *PieceManager) setPiece(idx int) {
+	pm.have[idx/8] |= 1 << (7 - idx%8)
+	pm.received++
+	if pm.added != nil {
+		close(pm.added)
+		pm.added = nil
+	}
+}
+
+// PieceAdded returns a channel that is closed once another piece
+// completes, for callers waiting on a piece: check HasPiece after taking
+// the channel, then wait on it.
+func (pm *PieceManager) PieceAdded() <-chan struct{} {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.added == nil {
+		pm.added = make(chan struct{})
+	}
+	return pm.added
+}
+
+func (pm *PieceManager) HasPiece(idx int) bool {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
+	return idx >= 0 && idx < pm.numPieces && pm.hasPiece(idx)
+}
+
+func (pm *PieceManager) GetPiece(idx int) ([]byte, bool) {
+	if !pm.HasPiece(idx) {
+		return nil, false
+	}
+
+	data, err := pm.storage.ReadPiece(idx)
+	if err != nil {
+		fmt.Printf("failed to read piece %d: %v\n", idx, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// ReadBlock returns length bytes of a piece we have, starting at begin.
+func (pm *PieceManager) ReadBlock(idx, begin, length int) ([]byte, error) {
+	if !pm.HasPiece(idx) {
+		return nil, fmt.Errorf("piece %d not available", idx)
+	}
+	block := make([]byte, length)
+	if err := pm.storage.ReadBlock(idx, int64(begin), block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// BlockMessage returns the piece message answering req. Blocks held in
+// memory are shared rather than copied, and blocks of storage backed by
+// files are left on disk as regions for the sender to stream.
+func (pm *PieceManager) BlockMessage(req BlockRequest) (*Piece, error) {
+	if !pm.HasPiece(req.Index) {
+		return nil, fmt.Errorf("piece %d not available", req.Index)
+	}
+	msg := &Piece{Index: req.Index, Begin: req.Begin}
 
-	data, exists := pm.pieces[idx]
-	return data, exists
+	switch s := pm.storage.(type) {
+	case RegionStorage:
+		regions, err := s.BlockRegions(req.Index, int64(req.Begin), int64(req.Length))
+		if err != nil {
+			return nil, err
+		}
+		msg.Regions = regions
+	case *MemoryStorage:
+		block, err := s.blockView(req.Index, int64(req.Begin), req.Length)
+		if err != nil {
+			return nil, err
+		}
+		msg.Block = block
+	default:
+		block, err := pm.ReadBlock(req.Index, req.Begin, req.Length)
+		if err != nil {
+			return nil, err
+		}
+		msg.Block = block
+	}
+	return msg, nil
 }
 
 func (pm *PieceManager) AddPiece(idx int, data []byte) error {
@@ -74,10 +210,28 @@ func (pm *PieceManager) AddPiece(idx int, data []byte) error {
 	if idx < 0 || idx >= pm.numPieces {
 		return fmt.Errorf("piece index out of range")
 	}
-	if _, exists := pm.pieces[idx]; exists {
+	if pm.hasPiece(idx) {
 		return fmt.Errorf("piece %d already exists", idx)
 	}
-	pm.pieces[idx] = data
+	if err := pm.storage.WritePiece(idx, data); err != nil {
+		return err
+	}
+	pm.setPiece(idx)
+	return nil
+}
+
+// MarkPiece records a piece as complete without writing it, for data that
+// is already in storage and has been verified.
+func (pm *PieceManager) MarkPiece(idx int) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if idx < 0 || idx >= pm.numPieces {
+		return fmt.Errorf("piece index out of range")
+	}
+	if !pm.hasPiece(idx) {
+		pm.setPiece(idx)
+	}
 	return nil
 }
 
@@ -85,16 +239,8 @@ func (pm *PieceManager) Bitfield() []byte {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	size := (pm.numPieces + 7) / 8
-	bitfield := make([]byte, size)
-
-	for i := 0; i < pm.numPieces; i++ {
-		if _, ok := pm.pieces[i]; ok {
-			byteIndex := i / 8
-			bitIndex := 7 - (i % 8) // MSB first, like BitTorrent spec
-			bitfield[byteIndex] |= 1 << bitIndex
-		}
-	}
+	bitfield := make([]byte, len(pm.have))
+	copy(bitfield, pm.have)
 	return bitfield
 }
 
@@ -111,19 +257,44 @@ func (pm *PieceManager) MissingPieces(bitfield []byte) []int {
 		}
 
 		peerHas := (bitfield[byteIndex] & (1 << bitIndex)) != 0
-		if peerHas {
-			if _, ok := pm.pieces[i]; !ok {
-				missing = append(missing, i)
-			}
+		if peerHas && !pm.hasPiece(i) {
+			missing = append(missing, i)
 		}
 	}
 	return missing
 }
 
+// rechecked counts the rechecks so far; pieces only go missing again in
+// one.
+func (pm *PieceManager) rechecked() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.rechecks
+}
+
 func (pm *PieceManager) ReceivedCount() int {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
-	return len(pm.pieces)
+	return pm.received
+}
+
+// BytesLeft is the length of the pieces not received yet, counting the
+// last piece at its real size. Without a layout only the number of
+// missing pieces is known, and that is returned instead.
+func (pm *PieceManager) BytesLeft() int64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	missing := int64(pm.numPieces - pm.received)
+	if pm.pieceLength <= 0 || missing == 0 {
+		return missing
+	}
+	left := missing * pm.pieceLength
+	last := pm.numPieces - 1
+	if !pm.hasPiece(last) {
+		left -= pm.pieceLength - (pm.totalLength - int64(last)*pm.pieceLength)
+	}
+	return left
 }
 
 func (pm *PieceManager) NumPieces() int {
@@ -133,5 +304,63 @@ func (pm *PieceManager) NumPieces() int {
 func (pm *PieceManager) AllPiecesReceived() bool {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
-	return len(pm.pieces) == pm.numPieces
+	return pm.received == pm.numPieces
+}
+
+// Recheck hashes every piece in storage with VerifyPiece on the given
+// number of goroutines (0 means one per CPU) and rebuilds the completion
+// bitset from the result, so pieces that are missing or corrupt are left
+// to download. progress, if set, is called after each piece from any
+// goroutine. It returns the number of valid pieces.
+func (pm *PieceManager) Recheck(workers int, progress func(done, total int)) int {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > pm.numPieces {
+		workers = pm.numPieces
+	}
+
+	valid := make([]bool, pm.numPieces)
+	indices := make(chan int)
+	var done atomic.Int64
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				// a missing or short file is just an invalid piece
+				data, err := pm.storage.ReadPiece(idx)
+				valid[idx] = err == nil && pm.VerifyPiece(idx, data)
+				if progress != nil {
+					progress(int(done.Add(1)), pm.numPieces)
+				}
+			}
+		}()
+	}
+	for idx := 0; idx < pm.numPieces; idx++ {
+		indices <- idx
+	}
+	close(indices)
+	wg.Wait()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for i := range pm.have {
+		pm.have[i] = 0
+	}
+	pm.received = 0
+	pm.rechecks++
+	for idx, ok := range valid {
+		if ok {
+			pm.setPiece(idx)
+		}
+	}
+	return pm.received
+}
+
+func (pm *PieceManager) Close() error {
+	return pm.storage.Close()
 }
@@ -0,0 +1,38 @@
+package p2p
+
+import "testing"
+
+func TestPieceManager_BytesLeft(t *testing.T) {
+	// four pieces of 100 bytes, the last one 50
+	pm := NewPieceManager(4)
+	pm.SetLayout(100, 350)
+
+	steps := []struct {
+		add  int
+		want int64
+	}{
+		{-1, 350},
+		{3, 300},
+		{0, 200},
+		{2, 100},
+		{1, 0},
+	}
+	for _, step := range steps {
+		if step.add >= 0 {
+			if err := pm.AddPiece(step.add, make([]byte, pm.PieceSize(step.add))); err != nil {
+				t.Fatalf("AddPiece(%d): %v", step.add, err)
+			}
+		}
+		if got := pm.BytesLeft(); got != step.want {
+			t.Errorf("after piece %d: BytesLeft = %d, want %d", step.add, got, step.want)
+		}
+	}
+}
+
+func TestPieceManager_BytesLeftWithoutLayout(t *testing.T) {
+	pm := NewPieceManager(3)
+	pm.AddPiece(1, []byte("x"))
+	if got := pm.BytesLeft(); got != 2 {
+		t.Errorf("BytesLeft = %d, want the 2 missing pieces", got)
+	}
+}
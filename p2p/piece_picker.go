@@ -0,0 +1,507 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Priority says how much a piece is wanted. Higher priorities are picked
+// first; PrioritySkip pieces are not downloaded at all.
+type Priority int8
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high"}
+
+func (p Priority) String() string {
+	if p < 0 || int(p) >= len(priorityNames) {
+		return fmt.Sprintf("Priority(%d)", int8(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority reads a priority by name, as printed by String.
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames {
+		if s == name {
+			return Priority(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q (want skip, low, normal or high)", s)
+}
+
+// PiecePicker decides which pieces to fetch next. It keeps every peer's
+// bitfield and, for each piece, how many peers have it. The counts are
+// adjusted as bitfield and have messages arrive and peers leave, so a pick
+// never rescans the whole swarm.
+//
+// Picks go by priority, then rarest first: pieces few peers have are
+// fetched while those peers are still around. Pieces sit in buckets by
+// priority and availability, so a pick visits the rarest buckets and
+// stops once it has enough. Ties are broken randomly so peers starting at
+// the same time spread out over different pieces.
+//
+// For streaming, readers place read heads: the window of pieces from each
+// head on comes before everything else, in order, and urgent pieces that
+// a reader is blocked on come before that. In sequential mode the rest is
+// picked in order too instead of rarest first.
+type PiecePicker struct {
+	mu           sync.Mutex
+	pieces       *PieceManager
+	availability []int
+	priorities   []Priority
+	bitfields    map[[20]byte][]byte
+
+	// buckets[prio][count] holds the pieces of that priority that count
+	// peers have. slot is each piece's position in its bucket, or -1 once
+	// a pick found we have it; rechecks tells when a recheck may have lost
+	// such pieces again.
+	buckets  [][][]int
+	slot     []int
+	rechecks int
+	first    int // no piece before it is missing, for sequential picks
+
+	sequential bool
+	heads      map[int]int // piece -> readers whose head is there
+	window     int
+	urgent     map[int]int // piece -> readers waiting for it
+}
+
+// DefaultReadaheadWindow is how many pieces from the read head are
+// fetched ahead of everything else.
+const DefaultReadaheadWindow = 8
+
+func NewPiecePicker(pieces *PieceManager) *PiecePicker {
+	priorities := make([]Priority, pieces.NumPieces())
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+	pp := &PiecePicker{
+		pieces:       pieces,
+		availability: make([]int, pieces.NumPieces()),
+		priorities:   priorities,
+		bitfields:    make(map[[20]byte][]byte),
+		buckets:      make([][][]int, PriorityHigh+1),
+		slot:         make([]int, pieces.NumPieces()),
+		rechecks:     pieces.rechecked(),
+		heads:        make(map[int]int),
+		window:       DefaultReadaheadWindow,
+		urgent:       make(map[int]int),
+	}
+	for i := range priorities {
+		pp.link(i)
+	}
+	return pp
+}
+
+// link puts a piece in the bucket of its priority and availability.
+func (pp *PiecePicker) link(idx int) {
+	prio, count := pp.priorities[idx], pp.availability[idx]
+	for len(pp.buckets[prio]) <= count {
+		pp.buckets[prio] = append(pp.buckets[prio], nil)
+	}
+	bucket := pp.buckets[prio][count]
+	pp.slot[idx] = len(bucket)
+	pp.buckets[prio][count] = append(bucket, idx)
+}
+
+// unlink takes a piece out of its bucket. It reports whether the piece was
+// in one.
+func (pp *PiecePicker) unlink(idx int) bool {
+	s := pp.slot[idx]
+	if s < 0 {
+		return false
+	}
+	prio, count := pp.priorities[idx], pp.availability[idx]
+	bucket := pp.buckets[prio][count]
+	last := bucket[len(bucket)-1]
+	bucket[s] = last
+	pp.slot[last] = s
+	pp.buckets[prio][count] = bucket[:len(bucket)-1]
+	pp.slot[idx] = -1
+	return true
+}
+
+// addAvailability moves a piece to the bucket of its new count.
+func (pp *PiecePicker) addAvailability(idx, delta int) {
+	linked := pp.unlink(idx)
+	pp.availability[idx] += delta
+	if linked {
+		pp.link(idx)
+	}
+}
+
+// relinkLost puts back the pieces a recheck found missing after a pick
+// had taken them out as done.
+func (pp *PiecePicker) relinkLost() {
+	rechecks := pp.pieces.rechecked()
+	if rechecks == pp.rechecks {
+		return
+	}
+	pp.rechecks = rechecks
+	pp.first = 0
+	for i, s := range pp.slot {
+		if s < 0 && !pp.pieces.HasPiece(i) {
+			pp.link(i)
+		}
+	}
+}
+
+// SetSequential switches between in-order and rarest-first picking.
+func (pp *PiecePicker) SetSequential(on bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.sequential = on
+}
+
+func (pp *PiecePicker) Sequential() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.sequential
+}
+
+// SetWindow sets how many pieces from the read head are fetched first.
+func (pp *PiecePicker) SetWindow(n int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	pp.window = n
+}
+
+// MoveReadHead moves one reader's read head from piece from to piece to.
+// -1 stands for no head, so a reader starts with MoveReadHead(-1, idx)
+// and lets go with MoveReadHead(idx, -1); the heads of other readers stay
+// where they are.
+func (pp *PiecePicker) MoveReadHead(from, to int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if from >= 0 {
+		if pp.heads[from]--; pp.heads[from] <= 0 {
+			delete(pp.heads, from)
+		}
+	}
+	if to >= 0 {
+		pp.heads[to]++
+	}
+}
+
+// SetUrgent puts a piece in front of all others, even a skipped one, until
+// as many ClearUrgent calls undo it.
+func (pp *PiecePicker) SetUrgent(idx int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.urgent[idx]++
+}
+
+func (pp *PiecePicker) ClearUrgent(idx int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.urgent[idx]--; pp.urgent[idx] <= 0 {
+		delete(pp.urgent, idx)
+	}
+}
+
+// wanted must be called with pp.mu held.
+func (pp *PiecePicker) wanted(idx int) bool {
+	return pp.priorities[idx] != PrioritySkip || pp.urgent[idx] > 0
+}
+
+func (pp *PiecePicker) SetPriority(idx int, prio Priority) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if idx < 0 || idx >= len(pp.priorities) {
+		return fmt.Errorf("piece %d out of range", idx)
+	}
+	if prio < PrioritySkip || prio > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", prio)
+	}
+	linked := pp.unlink(idx)
+	pp.priorities[idx] = prio
+	if linked {
+		pp.link(idx)
+	}
+	return nil
+}
+
+func (pp *PiecePicker) Priority(idx int) Priority {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if idx < 0 || idx >= len(pp.priorities) {
+		return PrioritySkip
+	}
+	return pp.priorities[idx]
+}
+
+// Wanted reports whether the piece is to be downloaded: it is not
+// skipped, or a reader is waiting for it.
+func (pp *PiecePicker) Wanted(idx int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return idx >= 0 && idx < len(pp.priorities) && pp.wanted(idx)
+}
+
+// WantedMissing counts the pieces still to be downloaded. When it reaches
+// zero the download is complete, even if skipped pieces are missing.
+func (pp *PiecePicker) WantedMissing() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	missing := 0
+	for i, prio := range pp.priorities {
+		if prio != PrioritySkip && !pp.pieces.HasPiece(i) {
+			missing++
+		}
+	}
+	return missing
+}
+
+func hasBit(bf []byte, idx int) bool {
+	return idx >= 0 && idx/8 < len(bf) && bf[idx/8]&(1<<(7-idx%8)) != 0
+}
+
+// PeerBitfield replaces what a peer is known to have.
+func (pp *PiecePicker) PeerBitfield(id [20]byte, bitfield []byte) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	old := pp.bitfields[id]
+	bf := make([]byte, len(bitfield))
+	copy(bf, bitfield)
+	pp.bitfields[id] = bf
+
+	for i := range pp.availability {
+		had, has := hasBit(old, i), hasBit(bf, i)
+		if has && !had {
+			pp.addAvailability(i, 1)
+		} else if had && !has {
+			pp.addAvailability(i, -1)
+		}
+	}
+}
+
+// PeerHave records a have message. It reports whether the piece is new
+// for that peer and counted, which it is not before the number of pieces
+// is known.
+func (pp *PiecePicker) PeerHave(id [20]byte, idx int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	// without metadata the bit is kept for SetPieceManager, up to what a
+	// bitfield message could hold
+	known := len(pp.availability) > 0
+	if idx < 0 || known && idx >= len(pp.availability) || idx/8 >= MaxMessageLength {
+		return false
+	}
+	bf, exists := pp.bitfields[id]
+	if !exists || len(bf) <= idx/8 {
+		grown := make([]byte, max((len(pp.availability)+7)/8, idx/8+1))
+		copy(grown, bf)
+		bf = grown
+		pp.bitfields[id] = bf
+	}
+	if hasBit(bf, idx) {
+		return false
+	}
+	bf[idx/8] |= 1 << (7 - idx%8)
+	if !known {
+		return false
+	}
+	pp.addAvailability(idx, 1)
+	return true
+}
+
+// peerBitfields returns a copy of every peer's bitfield.
+func (pp *PiecePicker) peerBitfields() map[[20]byte][]byte {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	out := make(map[[20]byte][]byte, len(pp.bitfields))
+	for id, bf := range pp.bitfields {
+		out[id] = bytes.Clone(bf)
+	}
+	return out
+}
+
+// PeerLeft drops a peer's pieces from the counts.
+func (pp *PiecePicker) PeerLeft(id [20]byte) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	bf := pp.bitfields[id]
+	for i := range pp.availability {
+		if hasBit(bf, i) {
+			pp.addAvailability(i, -1)
+		}
+	}
+	delete(pp.bitfields, id)
+}
+
+// Bitfield returns a copy of the pieces a peer has announced.
+func (pp *PiecePicker) Bitfield(id [20]byte) []byte {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	bf := pp.bitfields[id]
+	out := make([]byte, len(bf))
+	copy(out, bf)
+	return out
+}
+
+// PeerIsSeed reports whether the peer has announced every piece. Nobody
+// is a seed while the number of pieces is unknown.
+func (pp *PiecePicker) PeerIsSeed(id [20]byte) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if len(pp.availability) == 0 {
+		return false
+	}
+	bf := pp.bitfields[id]
+	for i := range pp.availability {
+		if !hasBit(bf, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pp *PiecePicker) PeerHas(id [20]byte, idx int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return hasBit(pp.bitfields[id], idx)
+}
+
+// Availability is how many connected peers have the piece.
+func (pp *PiecePicker) Availability(idx int) int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if idx < 0 || idx >= len(pp.availability) {
+		return 0
+	}
+	return pp.availability[idx]
+}
+
+// Interesting reports whether the peer has any wanted piece we are
+// missing.
+func (pp *PiecePicker) Interesting(id [20]byte) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	bf := pp.bitfields[id]
+	for i := range pp.availability {
+		if hasBit(bf, i) && pp.wanted(i) && !pp.pieces.HasPiece(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick returns up to n pieces to start fetching from a peer: urgent
+// pieces, then the read-ahead window, then by priority and rarity (or
+// order, in sequential mode). Pieces we have, skipped pieces and pieces
+// skip rejects are left out; n <= 0 means no limit.
+func (pp *PiecePicker) Pick(id [20]byte, n int, skip func(idx int) bool) []int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.pick(pp.bitfields[id], n, skip)
+}
+
+func (pp *PiecePicker) pick(bf []byte, n int, skip func(idx int) bool) []int {
+	pp.relinkLost()
+
+	var result []int
+	taken := make(map[int]bool)
+	full := func() bool { return n > 0 && len(result) >= n }
+	take := func(idx int) {
+		if taken[idx] || !hasBit(bf, idx) || pp.pieces.HasPiece(idx) || skip != nil && skip(idx) {
+			return
+		}
+		taken[idx] = true
+		result = append(result, idx)
+	}
+
+	urgent := make([]int, 0, len(pp.urgent))
+	for idx := range pp.urgent {
+		urgent = append(urgent, idx)
+	}
+	sort.Ints(urgent)
+	for _, idx := range urgent {
+		if full() {
+			return result
+		}
+		take(idx)
+	}
+
+	heads := make([]int, 0, len(pp.heads))
+	for idx := range pp.heads {
+		heads = append(heads, idx)
+	}
+	sort.Ints(heads)
+	for _, head := range heads {
+		for idx := head; idx < head+pp.window && idx < len(pp.priorities); idx++ {
+			if full() {
+				return result
+			}
+			if pp.wanted(idx) {
+				take(idx)
+			}
+		}
+	}
+
+	for prio := PriorityHigh; prio > PrioritySkip && !full(); prio-- {
+		if pp.sequential {
+			for pp.first < len(pp.priorities) && pp.pieces.HasPiece(pp.first) {
+				pp.first++
+			}
+			for idx := pp.first; idx < len(pp.priorities) && !full(); idx++ {
+				if pp.priorities[idx] == prio {
+					take(idx)
+				}
+			}
+			continue
+		}
+
+		// nobody has the pieces of bucket 0, bf included
+		for count := 1; count < len(pp.buckets[prio]) && !full(); count++ {
+			bucket := pp.buckets[prio][count]
+			var done []int
+			// a partial Fisher-Yates shuffle, only as far as the pick goes;
+			// moved holds the swapped entries so the bucket keeps its order
+			moved := make(map[int]int)
+			at := func(i int) int {
+				if idx, ok := moved[i]; ok {
+					return idx
+				}
+				return bucket[i]
+			}
+			for k := 0; k < len(bucket) && !full(); k++ {
+				j := k + rand.Intn(len(bucket)-k)
+				idx := at(j)
+				moved[j] = at(k)
+				if pp.pieces.HasPiece(idx) {
+					done = append(done, idx)
+					continue
+				}
+				take(idx)
+			}
+			// pieces we have are not visited again
+			for _, idx := range done {
+				pp.unlink(idx)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,239 @@
+package p2p
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// bits builds a bitfield of n pieces with the given ones set.
+func bits(n int, set ...int) []byte {
+	bf := make([]byte, (n+7)/8)
+	for _, i := range set {
+		bf[i/8] |= 1 << (7 - i%8)
+	}
+	return bf
+}
+
+func allPieces(n int) []int {
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
+
+var (
+	peerA = [20]byte{1}
+	peerB = [20]byte{2}
+	peerC = [20]byte{3}
+)
+
+// newRarityPicker has six pieces: 0 and 1 held by three peers, 2 and 3 by
+// two, 4 and 5 by peerA alone.
+func newRarityPicker() (*PiecePicker, *PieceManager) {
+	pm := NewPieceManager(6)
+	pp := NewPiecePicker(pm)
+	pp.PeerBitfield(peerA, bits(6, allPieces(6)...))
+	pp.PeerBitfield(peerB, bits(6, 0, 1, 2, 3))
+	pp.PeerBitfield(peerC, bits(6, 0, 1))
+	return pp, pm
+}
+
+// sorted sorts each group of a pick, whose order within a group is random.
+func sorted(pick []int, groups ...int) []int {
+	out := append([]int(nil), pick...)
+	start := 0
+	for _, n := range groups {
+		if start+n > len(out) {
+			break
+		}
+		sort.Ints(out[start : start+n])
+		start += n
+	}
+	return out
+}
+
+func TestPiecePicker_RarestFirst(t *testing.T) {
+	pp, _ := newRarityPicker()
+
+	got := sorted(pp.Pick(peerA, 0, nil), 2, 2, 2)
+	if want := []int{4, 5, 2, 3, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pick = %v, want %v", got, want)
+	}
+	// a peer is only given pieces it has
+	if got := sorted(pp.Pick(peerC, 0, nil), 2); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("Pick for peerC = %v, want [0 1]", got)
+	}
+	if got := pp.Pick([20]byte{9}, 0, nil); len(got) != 0 {
+		t.Errorf("Pick for an unknown peer = %v", got)
+	}
+}
+
+func TestPiecePicker_PriorityBeforeRarity(t *testing.T) {
+	pp, _ := newRarityPicker()
+	pp.SetPriority(0, PriorityHigh)
+	pp.SetPriority(4, PriorityLow)
+	pp.SetPriority(3, PrioritySkip)
+
+	got := sorted(pp.Pick(peerA, 0, nil), 1, 1, 1)
+	if want := []int{0, 5, 2, 1, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pick = %v, want %v", got, want)
+	}
+	if pp.Wanted(3) || pp.WantedMissing() != 5 {
+		t.Errorf("skipped piece still wanted: Wanted(3) = %v, WantedMissing = %d", pp.Wanted(3), pp.WantedMissing())
+	}
+	if err := pp.SetPriority(6, PriorityHigh); err == nil {
+		t.Error("SetPriority accepted a piece out of range")
+	}
+}
+
+func TestPiecePicker_LeavesOutPieces(t *testing.T) {
+	pp, pm := newRarityPicker()
+	pm.MarkPiece(5)
+
+	got := sorted(pp.Pick(peerA, 0, func(idx int) bool { return idx == 2 }), 1, 1, 2)
+	if want := []int{4, 3, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pick = %v, want %v without the piece we have and the one skip rejects", got, want)
+	}
+	if got := pp.Pick(peerA, 2, nil); len(got) != 2 {
+		t.Errorf("Pick(n=2) returned %d pieces", len(got))
+	}
+}
+
+func TestPiecePicker_Availability(t *testing.T) {
+	pp, _ := newRarityPicker()
+
+	if !pp.PeerHave(peerC, 4) || pp.PeerHave(peerC, 4) {
+		t.Error("PeerHave should report a piece new only once")
+	}
+	if pp.PeerHave(peerC, 6) {
+		t.Error("PeerHave accepted a piece out of range")
+	}
+	if got := pp.Availability(4); got != 2 {
+		t.Errorf("Availability(4) = %d, want 2", got)
+	}
+	if got := pp.Pick(peerA, 1, nil); !reflect.DeepEqual(got, []int{5}) {
+		t.Errorf("Pick = %v, want the now rarest piece 5", got)
+	}
+
+	pp.PeerLeft(peerB)
+	for idx, want := range []int{2, 2, 1, 1, 2, 1} {
+		if got := pp.Availability(idx); got != want {
+			t.Errorf("after PeerLeft: Availability(%d) = %d, want %d", idx, got, want)
+		}
+	}
+	// a new bitfield replaces the old one
+	pp.PeerBitfield(peerC, bits(6, 5))
+	if got := pp.Availability(0); got != 1 {
+		t.Errorf("Availability(0) = %d after peerC dropped it, want 1", got)
+	}
+	if !pp.PeerIsSeed(peerA) || pp.PeerIsSeed(peerC) {
+		t.Error("PeerIsSeed wrong")
+	}
+	if !pp.Interesting(peerC) || pp.Interesting([20]byte{9}) {
+		t.Error("Interesting wrong")
+	}
+}
+
+func TestPiecePicker_UrgentAndWindow(t *testing.T) {
+	pm := NewPieceManager(10)
+	pp := NewPiecePicker(pm)
+	pp.PeerBitfield(peerA, bits(10, allPieces(10)...))
+	pp.SetWindow(3)
+	pp.MoveReadHead(-1, 4)
+	pp.SetPriority(8, PrioritySkip)
+	pp.SetUrgent(8)
+	pp.SetUrgent(1)
+
+	got := pp.Pick(peerA, 5, nil)
+	if want := []int{1, 8, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pick = %v, want urgent pieces then the window, %v", got, want)
+	}
+
+	pp.ClearUrgent(8)
+	pp.ClearUrgent(1)
+	pp.MoveReadHead(4, -1)
+	got = pp.Pick(peerA, 0, nil)
+	if len(got) != 9 {
+		t.Errorf("Pick = %v, want every piece but the skipped 8", got)
+	}
+}
+
+func TestPiecePicker_Sequential(t *testing.T) {
+	pp, _ := newRarityPicker()
+	pp.SetSequential(true)
+	pp.SetPriority(3, PriorityHigh)
+
+	if got, want := pp.Pick(peerA, 0, nil), []int{3, 0, 1, 2, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pick = %v, want %v", got, want)
+	}
+}
+
+func TestPiecePicker_RandomTies(t *testing.T) {
+	pm := NewPieceManager(64)
+	pp := NewPiecePicker(pm)
+	pp.PeerBitfield(peerA, bits(64, allPieces(64)...))
+
+	// peers starting together should not all go for the same piece
+	first := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		first[pp.Pick(peerA, 1, nil)[0]] = true
+	}
+	if len(first) < 2 {
+		t.Errorf("20 picks among 64 equally rare pieces all began with %v", first)
+	}
+}
+
+func TestPiecePicker_RandomTiesNotAdjacent(t *testing.T) {
+	pm := NewPieceManager(64)
+	pp := NewPiecePicker(pm)
+	pp.PeerBitfield(peerA, bits(64, allPieces(64)...))
+
+	// ties are drawn one by one, not taken as a run from a random start
+	for i := 0; i < 20; i++ {
+		got := pp.Pick(peerA, 2, nil)
+		if d := (got[1] - got[0] + 64) % 64; d != 1 {
+			return
+		}
+	}
+	t.Error("20 picks of two equally rare pieces were all neighbours")
+}
+
+func TestPiecePicker_RecheckBringsPiecesBack(t *testing.T) {
+	pp, pm := newRarityPicker()
+	pm.MarkPiece(4)
+	if got := sorted(pp.Pick(peerA, 0, nil), 1, 2, 2); !reflect.DeepEqual(got, []int{5, 2, 3, 0, 1}) {
+		t.Fatalf("Pick = %v, want every piece but 4", got)
+	}
+
+	// nothing is in storage, so the recheck finds piece 4 missing again
+	pm.Recheck(1, nil)
+	if got := sorted(pp.Pick(peerA, 2, nil), 2); !reflect.DeepEqual(got, []int{4, 5}) {
+		t.Errorf("Pick after recheck = %v, want [4 5]", got)
+	}
+}
+
+func TestPiecePicker_ReadHeadsPerReader(t *testing.T) {
+	pm := NewPieceManager(20)
+	pp := NewPiecePicker(pm)
+	pp.PeerBitfield(peerA, bits(20, allPieces(20)...))
+	pp.SetWindow(2)
+
+	// two readers, one of them moving on
+	pp.MoveReadHead(-1, 10)
+	pp.MoveReadHead(-1, 3)
+	pp.MoveReadHead(3, 4)
+	if got := pp.Pick(peerA, 4, nil); !reflect.DeepEqual(got, []int{4, 5, 10, 11}) {
+		t.Errorf("Pick = %v, want both readers' windows [4 5 10 11]", got)
+	}
+
+	// a second reader at the same piece keeps the head there when the
+	// first lets go
+	pp.MoveReadHead(-1, 10)
+	pp.MoveReadHead(10, -1)
+	pp.MoveReadHead(4, -1)
+	if got := pp.Pick(peerA, 2, nil); !reflect.DeepEqual(got, []int{10, 11}) {
+		t.Errorf("Pick = %v, want the remaining reader's window [10 11]", got)
+	}
+}
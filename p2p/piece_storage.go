@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+// PieceStorage holds the data behind a PieceManager. The manager decides
+// which pieces are complete; storage only keeps the bytes. Close flushes
+// anything buffered before releasing resources.
+type PieceStorage interface {
+	ReadPiece(idx int) ([]byte, error)
+	ReadBlock(idx int, begin int64, p []byte) error
+	WritePiece(idx int, data []byte) error
+	Sync() error
+	Close() error
+}
+
+// RegionStorage is storage that keeps pieces in files, so blocks can be
+// sent from disk without being read into memory first.
+type RegionStorage interface {
+	BlockRegions(idx int, begin, length int64) ([]storage.Region, error)
+}
+
+// MemoryStorage keeps every piece in RAM. It suits small transfers and
+// downloads whose piece sizes are not known up front.
+type MemoryStorage struct {
+	mu     sync.RWMutex
+	pieces map[int][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		pieces: make(map[int][]byte),
+	}
+}
+
+func (ms *MemoryStorage) ReadPiece(idx int) ([]byte, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	data, ok := ms.pieces[idx]
+	if !ok {
+		return nil, fmt.Errorf("piece %d not stored", idx)
+	}
+	return data, nil
+}
+
+func (ms *MemoryStorage) ReadBlock(idx int, begin int64, p []byte) error {
+	block, err := ms.blockView(idx, begin, len(p))
+	if err != nil {
+		return err
+	}
+	copy(p, block)
+	return nil
+}
+
+// blockView returns a block without copying it. Stored pieces are never
+// modified, only replaced, so the slice stays valid.
+func (ms *MemoryStorage) blockView(idx int, begin int64, length int) ([]byte, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	data, ok := ms.pieces[idx]
+	if !ok {
+		return nil, fmt.Errorf("piece %d not stored", idx)
+	}
+	if begin < 0 || length < 0 || begin+int64(length) > int64(len(data)) {
+		return nil, fmt.Errorf("block at %d+%d is outside piece %d", begin, length, idx)
+	}
+	return data[begin : begin+int64(length) : begin+int64(length)], nil
+}
+
+func (ms *MemoryStorage) WritePiece(idx int, data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.pieces[idx] = data
+	return nil
+}
+
+func (ms *MemoryStorage) Sync() error {
+	return nil
+}
+
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Protocol is a wire dialect: the handshake string, the IDs messages
+// carry on the wire and how idle connections are kept alive. Message
+// layouts are the same in every dialect, and the rest of the code always
+// uses the Msg* constants; a TCPPeer translates IDs as messages go out and
+// come in.
+type Protocol struct {
+	Name string // pstr sent in the handshake
+
+	// KeepAlive is how long a connection may go without us writing before
+	// an empty keep-alive message is sent; 0 sends none. Peers we hear
+	// nothing from for IdleTimeout are dropped; 0 never drops them.
+	KeepAlive   time.Duration
+	IdleTimeout time.Duration
+
+	toWire   map[byte]byte // nil when IDs are sent as they are
+	fromWire map[byte]byte
+}
+
+var (
+	// PixTorrentProtocol is the original protocol, spoken only by other
+	// pixtorrent nodes.
+	PixTorrentProtocol = &Protocol{Name: "piXTorrent protocol"}
+
+	// BitTorrentProtocol is the standard protocol of BEP 3, understood by
+	// other BitTorrent clients.
+	BitTorrentProtocol = newProtocol("BitTorrent protocol", 2*time.Minute, 3*time.Minute, map[byte]byte{
+		MsgChoke:         0,
+		MsgUnchoke:       1,
+		MsgInterested:    2,
+		MsgNotInterested: 3,
+		MsgHave:          4,
+		MsgBitfield:      5,
+		MsgRequest:       6,
+		MsgPiece:         7,
+		MsgCancel:        8,
+		MsgExtended:      20,
+	})
+)
+
+func newProtocol(name string, keepAlive, idle time.Duration, toWire map[byte]byte) *Protocol {
+	fromWire := make(map[byte]byte, len(toWire))
+	for msg, id := range toWire {
+		fromWire[id] = msg
+	}
+	return &Protocol{
+		Name:        name,
+		KeepAlive:   keepAlive,
+		IdleTimeout: idle,
+		toWire:      toWire,
+		fromWire:    fromWire,
+	}
+}
+
+// ParseProtocol looks a protocol up by the names used on the command
+// line: "bittorrent" or "pixtorrent".
+func ParseProtocol(name string) (*Protocol, error) {
+	switch strings.ToLower(name) {
+	case "bittorrent":
+		return BitTorrentProtocol, nil
+	case "pixtorrent":
+		return PixTorrentProtocol, nil
+	}
+	return nil, fmt.Errorf("unknown protocol %q (want bittorrent or pixtorrent)", name)
+}
+
+func (p *Protocol) String() string {
+	return p.Name
+}
+
+// wireID is the ID msg goes out with.
+func (p *Protocol) wireID(msg byte) byte {
+	if id, ok := p.toWire[msg]; ok {
+		return id
+	}
+	return msg
+}
+
+// messageID maps an ID read off the wire to a Msg* constant. It reports
+// false for IDs of the dialect that we do not handle and that would be
+// mistaken for one of ours.
+func (p *Protocol) messageID(id byte) (byte, bool) {
+	if p.fromWire == nil {
+		return id, true
+	}
+	if msg, ok := p.fromWire[id]; ok {
+		return msg, true
+	}
+	if _, ours := p.toWire[id]; ours {
+		return 0, false
+	}
+	return id, true
+}
+
+// protocolOf returns the protocol a peer speaks.
+func protocolOf(peer Peer) *Protocol {
+	if p, ok := peer.(interface{ Protocol() *Protocol }); ok && p.Protocol() != nil {
+		return p.Protocol()
+	}
+	return PixTorrentProtocol
+}
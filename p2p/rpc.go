@@ -3,14 +3,32 @@ package p2p
 const (
 	MsgInterested    = 0x01
 	MsgNotInterested = 0x02
-	MsgRequestPiece  = 0x03
-	MsgSendPiece     = 0x04
+	MsgRequest       = 0x03 // <index><begin><length>
+	MsgPiece         = 0x04 // <index><begin><block>
 	MsgHave          = 0x05
 	MsgBitfield      = 0x06
 	MsgUnchoke       = 0x07
 	MsgChoke         = 0x08
+	MsgCancel        = 0x09 // <index><begin><length>
+	MsgExtended      = 0x14 // <extended id><payload>, BEP 10
 )
 
+const (
+	// BlockSize is how much of a piece is asked for in one request.
+	BlockSize = 16 * 1024
+
+	// MaxBlockLength is the largest request we serve; bigger ones are
+	// dropped, as other clients do.
+	MaxBlockLength = 128 * 1024
+)
+
+// BlockRequest names Length bytes at offset Begin within piece Index.
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
 type From struct {
 	PeerID [20]byte
 	Addr   string
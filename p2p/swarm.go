@@ -16,7 +16,7 @@ const (
 type Swarm struct {
 	peers        map[[20]byte]Peer
 	peerStates   map[[20]byte]*PeerState
-	peerBitfields map[[20]byte][]byte
+	picker       *PiecePicker
 	mu           sync.Mutex
 	infoHash     [20]byte
 	pieces       *PieceManager
@@ -24,13 +24,16 @@ type Swarm struct {
 
 	optimisticPeer  [20]byte
 	unchokeRound    int
+
+	uploaded   int64 // totals across all peers, including ones that left
+	downloaded int64
 }
 
 func NewSwarm(localPeerId [20]byte, infoHash [20]byte, pieceMgr *PieceManager) *Swarm {
 	return &Swarm{
 		peers:         make(map[[20]byte]Peer),
 		peerStates:    make(map[[20]byte]*PeerState),
-		peerBitfields: make(map[[20]byte][]byte),
+		picker:        NewPiecePicker(pieceMgr),
 		infoHash:      infoHash,
 		pieces:        pieceMgr,
 		localPeerID:   localPeerId,
@@ -57,7 +60,7 @@ func (s *Swarm) RemovePeer(id [20]byte) {
 		_ = p.Close()
 		delete(s.peers, id)
 		delete(s.peerStates, id)
-		delete(s.peerBitfields, id)
+		s.picker.PeerLeft(id)
 		fmt.Printf("peer %s removed from swarm\n", id)
 	}
 }
@@ -83,9 +86,11 @@ func (s *Swarm) OnPeer(p Peer) error {
 	s.peers[p.ID()] = p
 	s.peerStates[p.ID()] = NewPeerState()
 
-	bitfield := s.pieces.Bitfield()
-	msg := append([]byte{MsgBitfield}, bitfield...)
-	if err := p.Send(msg); err != nil {
+	// without metadata there are no pieces to announce
+	if s.pieces.NumPieces() == 0 {
+		return nil
+	}
+	if err := p.Send(&Bitfield{Bits: s.pieces.Bitfield()}); err != nil {
 		fmt.Printf("failed to send bitfield to %s: %v\n", p.ID(), err)
 		_ = p.Close()
 		delete(s.peers, p.ID())
@@ -118,45 +123,86 @@ func (s *Swarm) Close() {
 }
 
 func (s *Swarm) MissingPieces(bitfield []byte) []int {
-	return s.pieces.MissingPieces(bitfield)
+	return s.PieceManager().MissingPieces(bitfield)
 }
 
 func (s *Swarm) GetPiece(idx int) ([]byte, bool) {
-	return s.pieces.GetPiece(idx)
+	return s.PieceManager().GetPiece(idx)
+}
+
+func (s *Swarm) HasPiece(idx int) bool {
+	return s.PieceManager().HasPiece(idx)
+}
+
+func (s *Swarm) PieceSize(idx int) int64 {
+	return s.PieceManager().PieceSize(idx)
+}
+
+func (s *Swarm) ReadBlock(idx, begin, length int) ([]byte, error) {
+	return s.PieceManager().ReadBlock(idx, begin, length)
+}
+
+// BlockMessage builds the piece message answering req without copying
+// the block where the storage allows.
+func (s *Swarm) BlockMessage(req BlockRequest) (*Piece, error) {
+	return s.PieceManager().BlockMessage(req)
+}
+
+func (s *Swarm) PieceManager() *PieceManager {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pieces
+}
+
+// SetPieceManager switches the swarm over to new pieces, e.g. once the
+// torrent's metadata has been fetched. Peers stay connected, and the
+// bitfields and haves they sent are counted again against the new pieces.
+func (s *Swarm) SetPieceManager(pm *PieceManager) {
+	picker := NewPiecePicker(pm)
+	for id, bf := range s.Picker().peerBitfields() {
+		picker.PeerBitfield(id, bf)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pieces = pm
+	s.picker = picker
 }
 
 func (s *Swarm) NumPieces() int {
-	return s.pieces.NumPieces()
+	return s.PieceManager().NumPieces()
 }
 
 func (s *Swarm) AddPiece(idx int, data []byte) error {
-	if err := s.pieces.AddPiece(idx, data); err != nil {
+	if err := s.PieceManager().AddPiece(idx, data); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (s *Swarm) AllPiecesReceived() bool {
-	received := s.pieces.ReceivedCount()
-	total := s.pieces.NumPieces()
+	pm := s.PieceManager()
+	received := pm.ReceivedCount()
+	total := pm.NumPieces()
 	fmt.Printf("pieces received: %d / %d\n", received, total)
-	return s.pieces.AllPiecesReceived()
+	return pm.AllPiecesReceived()
 }
 
 func (s *Swarm) Bitfield() []byte {
-	return s.pieces.Bitfield()
+	return s.PieceManager().Bitfield()
 }
 
 func (s *Swarm) MissingPiecesCount() int {
-	return s.pieces.NumPieces() - s.pieces.ReceivedCount()
+	pm := s.PieceManager()
+	return pm.NumPieces() - pm.ReceivedCount()
 }
 
 func (s *Swarm) VerifyPiece(idx int, data []byte) bool {
-	return s.pieces.VerifyPiece(idx, data)
+	return s.PieceManager().VerifyPiece(idx, data)
 }
 
 func (s *Swarm) SetPieceHashes(hashes []byte) {
-	s.pieces.SetPieceHashes(hashes)
+	s.PieceManager().SetPieceHashes(hashes)
 }
 
 func (s *Swarm) GetPeerState(id [20]byte) (*PeerState, bool) {
@@ -182,9 +228,37 @@ func (s *Swarm) SetPeerChoking(id [20]byte, choking bool) {
 	}
 }
 
+func (s *Swarm) SetAmInterested(id [20]byte, interested bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, exists := s.peerStates[id]; exists {
+		state.SetAmInterested(interested)
+	}
+}
+
+func (s *Swarm) IsAmInterested(id [20]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, exists := s.peerStates[id]; exists {
+		return state.IsAmInterested()
+	}
+	return false
+}
+
+// IsPeerChoking reports whether the peer is refusing our requests.
+func (s *Swarm) IsPeerChoking(id [20]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, exists := s.peerStates[id]; exists {
+		return state.IsPeerChoking()
+	}
+	return true
+}
+
 func (s *Swarm) RecordUpload(id [20]byte, bytes int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.uploaded += bytes
 	if state, exists := s.peerStates[id]; exists {
 		state.AddUploaded(bytes)
 	}
@@ -193,11 +267,27 @@ func (s *Swarm) RecordUpload(id [20]byte, bytes int64) {
 func (s *Swarm) RecordDownload(id [20]byte, bytes int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.downloaded += bytes
 	if state, exists := s.peerStates[id]; exists {
 		state.AddDownloaded(bytes)
 	}
 }
 
+// Stats returns the bytes uploaded and downloaded over the swarm's lifetime.
+func (s *Swarm) Stats() (uploaded, downloaded int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploaded, s.downloaded
+}
+
+// RestoreStats adds totals carried over from an earlier session.
+func (s *Swarm) RestoreStats(uploaded, downloaded int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploaded += uploaded
+	s.downloaded += downloaded
+}
+
 type peerRanking struct {
 	id   [20]byte
 	rate float64
@@ -290,85 +380,47 @@ func (s *Swarm) IsChoking(id [20]byte) bool {
 }
 
 func (s *Swarm) UpdatePeerBitfield(id [20]byte, bitfield []byte) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	bf := make([]byte, len(bitfield))
-	copy(bf, bitfield)
-	s.peerBitfields[id] = bf
+	if _, ok := s.GetPeer(id); !ok {
+		return
+	}
+	s.Picker().PeerBitfield(id, bitfield)
 }
 
-func (s *Swarm) SetPeerHasPiece(id [20]byte, pieceIdx int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// PeerBitfield returns a copy of the pieces a peer has announced.
+func (s *Swarm) PeerBitfield(id [20]byte) []byte {
+	return s.Picker().Bitfield(id)
+}
 
-	bf, exists := s.peerBitfields[id]
-	if !exists {
-		size := (s.pieces.NumPieces() + 7) / 8
-		bf = make([]byte, size)
-		s.peerBitfields[id] = bf
-	}
+func (s *Swarm) PeerHasPiece(id [20]byte, pieceIdx int) bool {
+	return s.Picker().PeerHas(id, pieceIdx)
+}
 
-	byteIndex := pieceIdx / 8
-	bitIndex := 7 - (pieceIdx % 8)
-	if byteIndex < len(bf) {
-		bf[byteIndex] |= 1 << bitIndex
-	}
+// PeerIsSeed reports whether the peer has every piece.
+func (s *Swarm) PeerIsSeed(id [20]byte) bool {
+	return s.Picker().PeerIsSeed(id)
 }
 
-type pieceRarity struct {
-	index int
-	count int
+// SetPeerHasPiece records a have message and reports whether the piece
+// is new for that peer.
+func (s *Swarm) SetPeerHasPiece(id [20]byte, pieceIdx int) bool {
+	if _, ok := s.GetPeer(id); !ok {
+		return false
+	}
+	return s.Picker().PeerHave(id, pieceIdx)
 }
 
-func (s *Swarm) GetRarestMissingPieces(peerBitfield []byte) []int {
+// Picker is the swarm's piece picker, which tracks who has what.
+func (s *Swarm) Picker() *PiecePicker {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.picker
+}
 
-	numPieces := s.pieces.NumPieces()
-	availability := make([]int, numPieces)
-
-	for _, bf := range s.peerBitfields {
-		for i := 0; i < numPieces; i++ {
-			byteIndex := i / 8
-			bitIndex := 7 - (i % 8)
-			if byteIndex < len(bf) && (bf[byteIndex]&(1<<bitIndex)) != 0 {
-				availability[i]++
-			}
-		}
-	}
-
-	var candidates []pieceRarity
-	for i := 0; i < numPieces; i++ {
-		if _, exists := s.pieces.pieces[i]; exists {
-			continue
-		}
-
-		byteIndex := i / 8
-		bitIndex := 7 - (i % 8)
-		if byteIndex >= len(peerBitfield) {
-			continue
-		}
-
-		peerHas := (peerBitfield[byteIndex] & (1 << bitIndex)) != 0
-		if peerHas {
-			candidates = append(candidates, pieceRarity{
-				index: i,
-				count: availability[i],
-			})
-		}
-	}
-
-	sort.Slice(candidates, func(i, j int) bool {
-		if candidates[i].count == candidates[j].count {
-			n, _ := rand.Int(rand.Reader, big.NewInt(2))
-			return n.Int64() == 0
-		}
-		return candidates[i].count < candidates[j].count
-	})
-
-	result := make([]int, len(candidates))
-	for i, c := range candidates {
-		result[i] = c.index
-	}
-	return result
+// GetRarestMissingPieces lists the pieces we miss that the bitfield has,
+// rarest first.
+func (s *Swarm) GetRarestMissingPieces(peerBitfield []byte) []int {
+	picker := s.Picker()
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	return picker.pick(peerBitfield, 0, nil)
 }
@@ -6,47 +6,152 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
+	"os"
 	"sync"
+	"time"
+
+	"github.com/pixperk/pixtorrent/storage"
 )
 
 type TCPPeer struct {
 	net.Conn
-	id [20]byte
+	id       [20]byte
+	reserved [8]byte // from the peer's handshake
 
 	mu       sync.Mutex
 	outbound bool
+	protocol *Protocol
 
-	outbox chan []byte
+	outbox chan *outMsg
 	closed bool
+
+	// blocks queued for sending that a cancel can still withdraw
+	pending map[BlockRequest]*outMsg
+}
+
+// outMsg is a length-prefixed message waiting in a peer's outbox. The
+// buffers are written with one vectored write, followed by any file
+// regions, which are streamed with sendfile.
+type outMsg struct {
+	bufs      net.Buffers
+	regions   []storage.Region
+	block     *BlockRequest
+	cancelled bool
 }
 
+// maxRegionFiles bounds the file handles a peer's writer keeps open for
+// sending blocks from disk.
+const maxRegionFiles = 16
+
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
+	return NewTCPPeerWithProtocol(conn, outbound, PixTorrentProtocol)
+}
+
+// NewTCPPeerWithProtocol returns a peer speaking the given wire protocol.
+func NewTCPPeerWithProtocol(conn net.Conn, outbound bool, protocol *Protocol) *TCPPeer {
 	p := &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		outbox:   make(chan []byte, 2048),
+		protocol: protocol,
+		outbox:   make(chan *outMsg, 2048),
+		pending:  make(map[BlockRequest]*outMsg),
 	}
 
 	go p.writeLoop()
 	return p
 }
 
-func (p *TCPPeer) Send(data []byte) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+// Protocol is the wire protocol the peer speaks.
+func (p *TCPPeer) Protocol() *Protocol {
+	return p.protocol
+}
 
-	if p.closed {
-		return errors.New("peer is closed")
+// Send queues a message, with its ID as the peer's protocol spells it.
+// Pieces stay cancellable with CancelBlock until the writer picks them up.
+// A piece whose block is already queued is dropped with ErrDuplicateBlock.
+func (p *TCPPeer) Send(msg Message) error {
+	if piece, ok := msg.(*Piece); ok {
+		return p.sendPiece(piece)
 	}
 
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
 	buf := make([]byte, 4+len(data))
 	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
 	copy(buf[4:], data)
+	buf[4] = p.protocol.wireID(data[0])
+	return p.enqueue(&outMsg{bufs: net.Buffers{buf}})
+}
+
+// sendPiece queues a piece without copying its block: the header and the
+// block go out together with writev, or the block is sent from disk when
+// the piece names regions. The block must not change until it is written.
+func (p *TCPPeer) sendPiece(m *Piece) error {
+	if m.Index < 0 || m.Begin < 0 || int64(m.Index) > math.MaxUint32 || int64(m.Begin) > math.MaxUint32 {
+		return fmt.Errorf("piece: block %d:%d out of range", m.Index, m.Begin)
+	}
+	length := m.Len()
+	head := make([]byte, 13)
+	binary.BigEndian.PutUint32(head[0:4], uint32(9+length))
+	head[4] = p.protocol.wireID(MsgPiece)
+	binary.BigEndian.PutUint32(head[5:9], uint32(m.Index))
+	binary.BigEndian.PutUint32(head[9:13], uint32(m.Begin))
+
+	out := &outMsg{
+		bufs:    net.Buffers{head},
+		regions: m.Regions,
+		block:   &BlockRequest{Index: m.Index, Begin: m.Begin, Length: length},
+	}
+	if m.Regions == nil {
+		out.bufs = append(out.bufs, m.Block)
+	}
+	return p.enqueue(out)
+}
+
+// CancelBlock drops a piece queued by Send that has not been written
+// yet. It reports whether there was one.
+func (p *TCPPeer) CancelBlock(req BlockRequest) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := p.pending[req]
+	if !ok {
+		return false
+	}
+	m.cancelled = true
+	delete(p.pending, req)
+	return true
+}
+
+// ErrDuplicateBlock is returned by Send for a piece whose block is still
+// queued from an earlier request. Nothing is queued for it.
+var ErrDuplicateBlock = errors.New("block already queued")
+
+func (p *TCPPeer) enqueue(m *outMsg) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New("peer is closed")
+	}
+	if m.block != nil {
+		if _, dup := p.pending[*m.block]; dup {
+			// asked twice before we got to it, one answer is enough
+			return ErrDuplicateBlock
+		}
+	}
 
 	select {
-	case p.outbox <- buf:
+	case p.outbox <- m:
+		if m.block != nil {
+			p.pending[*m.block] = m
+		}
 		return nil
 	default:
 		return errors.New("outbox full, cannot send message")
@@ -54,18 +159,119 @@ func (p *TCPPeer) Send(data []byte) error {
 }
 
 func (p *TCPPeer) writeLoop() {
-	for buf := range p.outbox {
-		tot := 0
-		for tot < len(buf) {
-			n, err := p.Write(buf[tot:])
-			if err != nil {
-				log.Printf("[PEER_WRITE_ERROR] failed to write to %s: %v", p.RemoteAddr(), err)
+	// a nil channel never fires, so without keep-alives this is idle
+	var keepAlive <-chan time.Time
+	if p.protocol.KeepAlive > 0 {
+		ticker := time.NewTicker(p.protocol.KeepAlive / 4)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+	lastWrite := time.Now()
+
+	files := make(regionFiles)
+	defer files.closeAll()
+
+	for {
+		var m *outMsg
+		select {
+		case msg, ok := <-p.outbox:
+			if !ok {
 				return
 			}
-			tot += n
+			p.mu.Lock()
+			skip := msg.cancelled
+			if msg.block != nil && !skip {
+				delete(p.pending, *msg.block)
+			}
+			p.mu.Unlock()
+			if skip {
+				continue
+			}
+			m = msg
+		case <-keepAlive:
+			if time.Since(lastWrite) < p.protocol.KeepAlive {
+				continue
+			}
+			m = &outMsg{bufs: net.Buffers{make([]byte, 4)}}
 		}
 
-		log.Printf("[SENT] sent %d bytes to %s", len(buf), p.RemoteAddr())
+		n, err := p.write(m, files)
+		if err != nil {
+			log.Printf("[PEER_WRITE_ERROR] failed to write to %s: %v", p.RemoteAddr(), err)
+			if n == 0 && errors.Is(err, errRegionUnavailable) {
+				// nothing went out, the stream is still in step
+				continue
+			}
+			p.Close()
+			return
+		}
+		lastWrite = time.Now()
+
+		log.Printf("[SENT] sent %d bytes to %s", n, p.RemoteAddr())
+	}
+}
+
+var errRegionUnavailable = errors.New("block unavailable on disk")
+
+// write sends one message. Region files are opened before anything is
+// written, so a block that cannot be read is skipped rather than leaving
+// a truncated frame on the wire.
+func (p *TCPPeer) write(m *outMsg, files regionFiles) (int64, error) {
+	sources := make([]*os.File, len(m.regions))
+	for i, r := range m.regions {
+		f, err := files.open(r.Path)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", errRegionUnavailable, err)
+		}
+		sources[i] = f
+	}
+
+	// writes to a *net.TCPConn become a single writev
+	n, err := m.bufs.WriteTo(p.Conn)
+	if err != nil {
+		return n, err
+	}
+
+	for i, r := range m.regions {
+		if _, err := sources[i].Seek(r.Offset, io.SeekStart); err != nil {
+			return n, err
+		}
+		// a *net.TCPConn reading from a limited *os.File uses sendfile
+		sent, err := io.Copy(p.Conn, io.LimitReader(sources[i], r.Length))
+		n += sent
+		if err != nil {
+			return n, err
+		}
+		if sent != r.Length {
+			return n, fmt.Errorf("%s: short read at %d", r.Path, r.Offset+sent)
+		}
+	}
+	return n, nil
+}
+
+// regionFiles caches the files a writer streams blocks from. Each writer
+// has its own, as sendfile moves the file offset.
+type regionFiles map[string]*os.File
+
+func (rf regionFiles) open(path string) (*os.File, error) {
+	if f, ok := rf[path]; ok {
+		return f, nil
+	}
+	if len(rf) >= maxRegionFiles {
+		rf.closeAll()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	rf[path] = f
+	return f, nil
+}
+
+func (rf regionFiles) closeAll() {
+	for path, f := range rf {
+		f.Close()
+		delete(rf, path)
 	}
 }
 
@@ -91,6 +297,22 @@ func (p *TCPPeer) ID() [20]byte {
 	return p.id
 }
 
+func (p *TCPPeer) SetReserved(reserved [8]byte) {
+	p.reserved = reserved
+}
+
+// Reserved returns the reserved bytes of the peer's handshake, where it
+// flags the extensions it supports.
+func (p *TCPPeer) Reserved() [8]byte {
+	return p.reserved
+}
+
+// Outbound reports whether we dialed the peer, in which case its remote
+// address is one it accepts connections on.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
 type OnPeerFunc func(Peer) error
 
 type TCPTransportOpts struct {
@@ -99,6 +321,13 @@ type TCPTransportOpts struct {
 	Decoder    Decoder
 	OnPeer     OnPeerFunc
 	InfoHash   [20]byte
+
+	// Protocol is the wire protocol spoken on every connection; nil means
+	// PixTorrentProtocol.
+	Protocol *Protocol
+
+	// OnPeerClose is called once a peer accepted by OnPeer disconnects.
+	OnPeerClose func(Peer)
 }
 
 type TCPTransport struct {
@@ -175,7 +404,11 @@ func (t *TCPTransport) acceptLoop() {
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
 
-	peer := NewTCPPeer(conn, outbound)
+	protocol := t.Protocol
+	if protocol == nil {
+		protocol = PixTorrentProtocol
+	}
+	peer := NewTCPPeerWithProtocol(conn, outbound, protocol)
 
 	defer func() {
 		if err != nil {
@@ -207,12 +440,19 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	if t.OnPeerClose != nil {
+		defer t.OnPeerClose(peer)
+	}
 
 	// Create a per-connection decoder with its own buffered reader
 	decoder := &BinaryDecoder{}
 
 	// Read loop
 	for {
+		if protocol.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(protocol.IdleTimeout))
+		}
+
 		rpc := RPC{}
 		err = decoder.Decode(conn, &rpc)
 		if err != nil {
@@ -220,6 +460,15 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 
+		if len(rpc.Payload) > 0 {
+			msg, ok := protocol.messageID(rpc.Payload[0])
+			if !ok {
+				fmt.Printf("[%s] ignoring unsupported message %d\n", conn.RemoteAddr(), rpc.Payload[0])
+				continue
+			}
+			rpc.Payload[0] = msg
+		}
+
 		rpc.From = From{PeerID: peer.ID(), Addr: peer.RemoteAddr().String()}
 
 		select {
@@ -5,7 +5,10 @@ import "net"
 type Peer interface {
 	net.Conn
 	SetID([20]byte)
-	Send([]byte) error
+	SetReserved([8]byte)
+	Reserved() [8]byte
+	Send(Message) error
+	CancelBlock(req BlockRequest) bool
 	ID() [20]byte
 }
 
@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+// File is one file of a torrent's content, positioned within the
+// contiguous byte range that pieces are cut from.
+type File struct {
+	Path   string // on-disk path
+	Length int64
+	Offset int64 // start of the file within the torrent content
+}
+
+// Storage maps piece offsets onto a torrent's files. A piece may span any
+// number of files; reads and writes are split at the file boundaries.
+// Files and their directories are created on first write, except skipped
+// files, whose part of a piece goes to a part file instead.
+type Storage struct {
+	mu          sync.Mutex
+	path        string
+	files       []File
+	pieceLength int64
+	totalLength int64
+
+	handles  map[int]*os.File
+	writable map[int]bool
+	skipped  map[int]bool
+}
+
+// ContentPath returns where a torrent's content lives under dir: the file
+// itself for a single-file torrent, the top-level folder otherwise.
+func ContentPath(dir string, info *meta.InfoDict) (string, error) {
+	name, err := pathElement(info.Name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// New lays info's files out at path, which is the content itself: the file
+// of a single-file torrent or the folder holding a multi-file torrent's
+// paths. Use ContentPath to put it under a download directory.
+func New(path string, info *meta.InfoDict) (*Storage, error) {
+	if info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+
+	s := &Storage{
+		path:        path,
+		pieceLength: info.PieceLength,
+		handles:     make(map[int]*os.File),
+		writable:    make(map[int]bool),
+		skipped:     make(map[int]bool),
+	}
+
+	if len(info.Files) == 0 {
+		s.files = []File{{Path: path, Length: info.Length}}
+		s.totalLength = info.Length
+		return s, nil
+	}
+
+	for _, f := range info.Files {
+		if f.Length < 0 {
+			return nil, fmt.Errorf("file %v has negative length", f.Path)
+		}
+		filePath, err := joinPath(path, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, File{Path: filePath, Length: f.Length, Offset: s.totalLength})
+		s.totalLength += f.Length
+	}
+	return s, nil
+}
+
+// joinPath joins a torrent file path onto dir, refusing elements that would
+// escape it.
+func joinPath(dir string, elements []string) (string, error) {
+	if len(elements) == 0 {
+		return "", fmt.Errorf("torrent file has an empty path")
+	}
+	path := dir
+	for _, elem := range elements {
+		elem, err := pathElement(elem)
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(path, elem)
+	}
+	return path, nil
+}
+
+func pathElement(elem string) (string, error) {
+	if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, "/\\") || strings.ContainsRune(elem, 0) {
+		return "", fmt.Errorf("unsafe path element %q in torrent", elem)
+	}
+	return elem, nil
+}
+
+// Path is the location of the content as passed to New.
+func (s *Storage) Path() string {
+	return s.path
+}
+
+func (s *Storage) Files() []File {
+	return s.files
+}
+
+func (s *Storage) TotalLength() int64 {
+	return s.totalLength
+}
+
+func (s *Storage) NumPieces() int {
+	return int((s.totalLength + s.pieceLength - 1) / s.pieceLength)
+}
+
+// PieceSize is the length of piece idx; only the last piece may be short.
+func (s *Storage) PieceSize(idx int) int64 {
+	start := int64(idx) * s.pieceLength
+	if start+s.pieceLength > s.totalLength {
+		return s.totalLength - start
+	}
+	return s.pieceLength
+}
+
+func (s *Storage) ReadPiece(idx int) ([]byte, error) {
+	if idx < 0 || idx >= s.NumPieces() {
+		return nil, fmt.Errorf("piece index %d out of range", idx)
+	}
+	buf := make([]byte, s.PieceSize(idx))
+	if _, err := s.ReadAt(buf, int64(idx)*s.pieceLength); err != nil {
+		return nil, fmt.Errorf("failed to read piece %d: %w", idx, err)
+	}
+	return buf, nil
+}
+
+// ReadBlock fills p from piece idx starting begin bytes into the piece.
+func (s *Storage) ReadBlock(idx int, begin int64, p []byte) error {
+	if idx < 0 || idx >= s.NumPieces() {
+		return fmt.Errorf("piece index %d out of range", idx)
+	}
+	if begin < 0 || begin+int64(len(p)) > s.PieceSize(idx) {
+		return fmt.Errorf("block at %d+%d is outside piece %d", begin, len(p), idx)
+	}
+	if _, err := s.ReadAt(p, int64(idx)*s.pieceLength+begin); err != nil {
+		return fmt.Errorf("failed to read piece %d: %w", idx, err)
+	}
+	return nil
+}
+
+// Region is a byte range of one file on disk.
+type Region struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+// BlockRegions returns where a block of piece idx lies on disk, one region
+// per file it covers, so it can be sent without reading it into memory.
+func (s *Storage) BlockRegions(idx int, begin, length int64) ([]Region, error) {
+	if idx < 0 || idx >= s.NumPieces() {
+		return nil, fmt.Errorf("piece index %d out of range", idx)
+	}
+	if begin < 0 || length < 0 || begin+length > s.PieceSize(idx) {
+		return nil, fmt.Errorf("block at %d+%d is outside piece %d", begin, length, idx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	off := int64(idx)*s.pieceLength + begin
+	i := sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].Offset+s.files[i].Length > off
+	})
+
+	var regions []Region
+	for done := int64(0); i < len(s.files) && done < length; i++ {
+		file := s.files[i]
+		if file.Length == 0 {
+			continue
+		}
+		fileOff := off + done - file.Offset
+		n := min(file.Length-fileOff, length-done)
+		if s.skipped[i] {
+			regions = append(regions, Region{Path: s.partPath(idx), Offset: begin + done, Length: n})
+		} else {
+			regions = append(regions, Region{Path: file.Path, Offset: fileOff, Length: n})
+		}
+		done += n
+	}
+	return regions, nil
+}
+
+func (s *Storage) WritePiece(idx int, data []byte) error {
+	if idx < 0 || idx >= s.NumPieces() {
+		return fmt.Errorf("piece index %d out of range", idx)
+	}
+	if int64(len(data)) != s.PieceSize(idx) {
+		return fmt.Errorf("piece %d is %d bytes, expected %d", idx, len(data), s.PieceSize(idx))
+	}
+	if _, err := s.WriteAt(data, int64(idx)*s.pieceLength); err != nil {
+		return fmt.Errorf("failed to write piece %d: %w", idx, err)
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes of content starting at off.
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.totalLength {
+		return 0, fmt.Errorf("read of %d bytes at %d is outside the content", len(p), off)
+	}
+	return s.span(p, off, false)
+}
+
+// WriteAt writes p at content offset off.
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.totalLength {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the content", len(p), off)
+	}
+	return s.span(p, off, true)
+}
+
+// span walks the files covered by [off, off+len(p)) and reads or writes
+// the matching slice of p in each.
+func (s *Storage) span(p []byte, off int64, write bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// first file whose range ends after off; zero-length files never match
+	i := sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].Offset+s.files[i].Length > off
+	})
+
+	done := 0
+	for ; i < len(s.files) && done < len(p); i++ {
+		file := s.files[i]
+		if file.Length == 0 {
+			continue
+		}
+		fileOff := off + int64(done) - file.Offset
+		n := file.Length - fileOff
+		if n > int64(len(p)-done) {
+			n = int64(len(p) - done)
+		}
+
+		chunk := p[done : done+int(n)]
+		if s.skipped[i] {
+			m, err := s.partSpan(chunk, off+int64(done), write)
+			done += m
+			if err != nil {
+				return done, fmt.Errorf("%s: %w", file.Path, err)
+			}
+			continue
+		}
+
+		f, err := s.open(i, write)
+		if err != nil {
+			return done, err
+		}
+
+		var m int
+		if write {
+			m, err = f.WriteAt(chunk, fileOff)
+		} else {
+			m, err = f.ReadAt(chunk, fileOff)
+			if err == io.EOF && m == len(chunk) {
+				err = nil
+			}
+		}
+		done += m
+		if err != nil {
+			return done, fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
+	return done, nil
+}
+
+// open returns a cached handle for file i, reopening it read-write the
+// first time it is written to. Must be called with s.mu held.
+func (s *Storage) open(i int, write bool) (*os.File, error) {
+	if f, ok := s.handles[i]; ok && (!write || s.writable[i]) {
+		return f, nil
+	}
+
+	path := s.files[i].Path
+	var f *os.File
+	var err error
+	if write {
+		if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if old, ok := s.handles[i]; ok {
+		old.Close()
+	}
+	s.handles[i] = f
+	s.writable[i] = write
+	return f, nil
+}
+
+// partsDir holds the part files, next to the content as a hidden folder.
+func (s *Storage) partsDir() string {
+	return filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".parts")
+}
+
+// partPath is the part file of piece idx: the piece's bytes at their
+// offsets in the piece, of which only those of skipped files are written.
+func (s *Storage) partPath(idx int) string {
+	return filepath.Join(s.partsDir(), strconv.Itoa(idx))
+}
+
+// partSpan reads or writes p at content offset off, which lies in a
+// skipped file, through the part files of the pieces it covers. Must be
+// called with s.mu held.
+func (s *Storage) partSpan(p []byte, off int64, write bool) (int, error) {
+	done := 0
+	for done < len(p) {
+		pos := off + int64(done)
+		idx := int(pos / s.pieceLength)
+		pieceOff := pos - int64(idx)*s.pieceLength
+		chunk := p[done : done+int(min(s.pieceLength-pieceOff, int64(len(p)-done)))]
+
+		m, err := s.partIO(chunk, idx, pieceOff, write)
+		done += m
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (s *Storage) partIO(p []byte, idx int, off int64, write bool) (int, error) {
+	path := s.partPath(idx)
+	var f *os.File
+	var err error
+	if write {
+		if err = os.MkdirAll(s.partsDir(), os.ModePerm); err != nil {
+			return 0, fmt.Errorf("failed to create part directory: %w", err)
+		}
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if write {
+		return f.WriteAt(p, off)
+	}
+	m, err := f.ReadAt(p, off)
+	if err == io.EOF && m == len(p) {
+		err = nil
+	}
+	return m, err
+}
+
+// SetFileSkipped marks file i as unwanted or wanted again. Data of a
+// skipped file that shares a piece with wanted files is written to a part
+// file instead, so the file is not created. When it becomes wanted, what
+// was kept for it is moved into the file. A file already on disk is left
+// in use.
+func (s *Storage) SetFileSkipped(i int, skip bool) error {
+	if i < 0 || i >= len(s.files) {
+		return fmt.Errorf("file %d out of range", i)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if skip {
+		if _, err := os.Stat(s.files[i].Path); errors.Is(err, os.ErrNotExist) {
+			s.skipped[i] = true
+		}
+		return nil
+	}
+	if !s.skipped[i] {
+		return nil
+	}
+	delete(s.skipped, i)
+
+	file := s.files[i]
+	first, last := s.FilePieces(i)
+	for idx := first; idx <= last; idx++ {
+		pieceStart := int64(idx) * s.pieceLength
+		start := max(file.Offset, pieceStart)
+		end := min(file.Offset+file.Length, pieceStart+s.PieceSize(idx))
+
+		buf := make([]byte, end-start)
+		if _, err := s.partIO(buf, idx, start-pieceStart, false); err != nil {
+			continue // nothing was kept for this piece
+		}
+		f, err := s.open(i, true)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf, start-file.Offset); err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
+		}
+		if !s.pieceSkipped(idx) {
+			os.Remove(s.partPath(idx))
+		}
+	}
+	os.Remove(s.partsDir()) // only goes once empty
+	return nil
+}
+
+// pieceSkipped reports whether a skipped file has data in piece idx. Must
+// be called with s.mu held.
+func (s *Storage) pieceSkipped(idx int) bool {
+	for i := range s.skipped {
+		if first, last := s.FilePieces(i); first <= idx && idx <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// FileState is what a file looked like on disk, used to notice files that
+// changed while the client was not running.
+type FileState struct {
+	Path    string `bencode:"path"`
+	Size    int64  `bencode:"size"`
+	ModTime int64  `bencode:"mtime"` // unix nanoseconds
+}
+
+// FileStates stats every file. Missing files get a size of -1.
+func (s *Storage) FileStates() []FileState {
+	states := make([]FileState, len(s.files))
+	for i, file := range s.files {
+		states[i] = FileState{Path: file.Path, Size: -1}
+		if stat, err := os.Stat(file.Path); err == nil {
+			states[i].Size = stat.Size()
+			states[i].ModTime = stat.ModTime().UnixNano()
+		}
+	}
+	return states
+}
+
+// ChangedPieces compares saved file states with the files on disk and
+// returns every piece that touches a file whose size or mtime differs. If
+// the saved list does not match the layout at all, every piece is changed.
+func (s *Storage) ChangedPieces(saved []FileState) map[int]bool {
+	changed := make(map[int]bool)
+	current := s.FileStates()
+
+	if len(saved) != len(current) {
+		for i := 0; i < s.NumPieces(); i++ {
+			changed[i] = true
+		}
+		return changed
+	}
+
+	for i, state := range current {
+		if state == saved[i] {
+			continue
+		}
+		first, last := s.FilePieces(i)
+		for idx := first; idx <= last; idx++ {
+			changed[idx] = true
+		}
+	}
+	return changed
+}
+
+// FilePieces returns the first and last piece holding data of file i.
+// For an empty file last is below first.
+func (s *Storage) FilePieces(i int) (first, last int) {
+	file := s.files[i]
+	first = int(file.Offset / s.pieceLength)
+	last = int((file.Offset+file.Length+s.pieceLength-1)/s.pieceLength) - 1
+	if file.Length == 0 {
+		last = first - 1
+	}
+	return first, last
+}
+
+// Create makes the directory tree and every file, including empty ones,
+// without touching data already present.
+func (s *Storage) Create() error {
+	for i := range s.files {
+		if err := s.CreateFile(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateFile makes file i and its directories if they do not exist yet.
+func (s *Storage) CreateFile(i int) error {
+	if i < 0 || i >= len(s.files) {
+		return fmt.Errorf("file %d out of range", i)
+	}
+	file := s.files[i]
+	if err := os.MkdirAll(filepath.Dir(file.Path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", file.Path, err)
+	}
+	f, err := os.OpenFile(file.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Sync flushes every file written so far to disk.
+func (s *Storage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.handles {
+		if !s.writable[i] {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", s.files[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes all open files. The storage may be used again
+// afterwards; files are reopened on demand.
+func (s *Storage) Close() error {
+	err := s.Sync()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.handles {
+		f.Close()
+		delete(s.handles, i)
+		delete(s.writable, i)
+	}
+	return err
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+func testContent(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestStorage_MultiFile(t *testing.T) {
+	info := &meta.InfoDict{
+		Name:        "album",
+		PieceLength: 10,
+		Files: []meta.FileInfo{
+			{Length: 7, Path: []string{"a.txt"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 25, Path: []string{"sub", "b.txt"}},
+			{Length: 3, Path: []string{"sub", "deep", "c.txt"}},
+		},
+	}
+	content := testContent(35)
+
+	dir := t.TempDir()
+	path, err := ContentPath(dir, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(path, info)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer s.Close()
+
+	if s.NumPieces() != 4 || s.PieceSize(3) != 5 {
+		t.Fatalf("Expected 4 pieces with a 5 byte tail, got %d and %d", s.NumPieces(), s.PieceSize(3))
+	}
+	if err := s.Create(); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// out of order, every piece but the last crosses a file boundary
+	for _, idx := range []int{2, 0, 3, 1} {
+		start := idx * 10
+		end := start + int(s.PieceSize(idx))
+		if err := s.WritePiece(idx, content[start:end]); err != nil {
+			t.Fatalf("WritePiece(%d) failed: %v", idx, err)
+		}
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	expected := map[string][]byte{
+		"a.txt":          content[0:7],
+		"empty":          {},
+		"sub/b.txt":      content[7:32],
+		"sub/deep/c.txt": content[32:35],
+	}
+	for name, want := range expected {
+		got, err := os.ReadFile(filepath.Join(dir, "album", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Reading %s failed: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s mismatch: got %v, want %v", name, got, want)
+		}
+	}
+
+	for idx := 0; idx < s.NumPieces(); idx++ {
+		piece, err := s.ReadPiece(idx)
+		if err != nil {
+			t.Fatalf("ReadPiece(%d) failed: %v", idx, err)
+		}
+		start := idx * 10
+		if !bytes.Equal(piece, content[start:start+len(piece)]) {
+			t.Errorf("Piece %d mismatch", idx)
+		}
+	}
+
+	// a fresh storage over the same files reads them back read-only
+	reopened, err := New(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	buf := make([]byte, 20)
+	if _, err := reopened.ReadAt(buf, 5); err != nil || !bytes.Equal(buf, content[5:25]) {
+		t.Errorf("ReadAt across files: %v %v", err, buf)
+	}
+}
+
+func TestStorage_SingleFile(t *testing.T) {
+	info := &meta.InfoDict{Name: "file.bin", Length: 25, PieceLength: 16}
+	content := testContent(25)
+
+	path := filepath.Join(t.TempDir(), "file.bin")
+	s, err := New(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WritePiece(1, content[16:]); err != nil {
+		t.Fatalf("WritePiece failed: %v", err)
+	}
+	if err := s.WritePiece(0, content[:16]); err != nil {
+		t.Fatalf("WritePiece failed: %v", err)
+	}
+	s.Close()
+
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("File content mismatch: %v", err)
+	}
+
+	if err := s.WritePiece(0, content[:10]); err == nil {
+		t.Error("Expected error for a short piece")
+	}
+	if err := s.WritePiece(2, content[:9]); err == nil {
+		t.Error("Expected error for an out of range piece")
+	}
+}
+
+func TestStorage_MissingData(t *testing.T) {
+	info := &meta.InfoDict{Name: "file.bin", Length: 25, PieceLength: 16}
+	path := filepath.Join(t.TempDir(), "file.bin")
+	os.WriteFile(path, testContent(20), 0644)
+
+	s, err := New(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.ReadPiece(0); err != nil {
+		t.Errorf("Piece 0 is complete on disk: %v", err)
+	}
+	if _, err := s.ReadPiece(1); err == nil {
+		t.Error("Expected error reading past the end of a truncated file")
+	}
+}
+
+func TestStorage_UnsafePaths(t *testing.T) {
+	dir := t.TempDir()
+	tests := []*meta.InfoDict{
+		{Name: "x", PieceLength: 16, Files: []meta.FileInfo{{Length: 1, Path: []string{"..", "escape"}}}},
+		{Name: "x", PieceLength: 16, Files: []meta.FileInfo{{Length: 1, Path: []string{"a/b"}}}},
+		{Name: "x", PieceLength: 16, Files: []meta.FileInfo{{Length: 1, Path: nil}}},
+	}
+	for _, info := range tests {
+		if _, err := New(dir, info); err == nil {
+			t.Errorf("Expected error for path %q", info.Files[0].Path)
+		}
+	}
+
+	if _, err := ContentPath(dir, &meta.InfoDict{Name: ".."}); err == nil {
+		t.Error("Expected error for name \"..\"")
+	}
+}
+
+func TestStorage_ChangedPieces(t *testing.T) {
+	info := &meta.InfoDict{
+		Name:        "album",
+		PieceLength: 10,
+		Files: []meta.FileInfo{
+			{Length: 15, Path: []string{"a"}},
+			{Length: 10, Path: []string{"b"}},
+			{Length: 10, Path: []string{"c"}},
+		},
+	}
+	content := testContent(35)
+
+	s, err := New(t.TempDir(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.Sync()
+
+	saved := s.FileStates()
+	if changed := s.ChangedPieces(saved); len(changed) != 0 {
+		t.Errorf("Expected no changes, got %v", changed)
+	}
+
+	// b spans bytes 15..24, i.e. pieces 1 and 2
+	modified := saved[1]
+	modified.ModTime--
+	saved[1] = modified
+	changed := s.ChangedPieces(saved)
+	if len(changed) != 2 || !changed[1] || !changed[2] {
+		t.Errorf("Expected pieces 1 and 2 changed, got %v", changed)
+	}
+
+	if changed := s.ChangedPieces(saved[:2]); len(changed) != s.NumPieces() {
+		t.Errorf("Expected every piece changed for a different layout, got %v", changed)
+	}
+}
+
+func TestStorage_FilePieces(t *testing.T) {
+	info := &meta.InfoDict{
+		Name:        "album",
+		PieceLength: 10,
+		Files: []meta.FileInfo{
+			{Length: 7, Path: []string{"a"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 23, Path: []string{"b"}},
+			{Length: 5, Path: []string{"c"}},
+		},
+	}
+	dir := t.TempDir()
+	s, err := New(dir, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]int{{0, 0}, {0, -1}, {0, 2}, {3, 3}}
+	for i, want := range expected {
+		if first, last := s.FilePieces(i); first != want[0] || last != want[1] {
+			t.Errorf("File %d: got pieces %d..%d, want %d..%d", i, first, last, want[0], want[1])
+		}
+	}
+
+	if err := s.CreateFile(3); err != nil {
+		t.Fatalf("CreateFile failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c")); err != nil {
+		t.Errorf("Expected c to exist: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("Expected a not to be created, got %v", err)
+	}
+}
+
+func TestStorage_BlockRegions(t *testing.T) {
+	info := &meta.InfoDict{
+		Name:        "album",
+		PieceLength: 10,
+		Files: []meta.FileInfo{
+			{Length: 7, Path: []string{"a.txt"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 25, Path: []string{"b.txt"}},
+		},
+	}
+	dir := t.TempDir()
+	s, err := New(dir, info)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer s.Close()
+
+	// piece 0 bytes 5..9 cross from a.txt into b.txt, skipping the empty file
+	regions, err := s.BlockRegions(0, 5, 5)
+	if err != nil {
+		t.Fatalf("BlockRegions failed: %v", err)
+	}
+	want := []Region{
+		{Path: filepath.Join(dir, "a.txt"), Offset: 5, Length: 2},
+		{Path: filepath.Join(dir, "b.txt"), Offset: 0, Length: 3},
+	}
+	if len(regions) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, regions)
+	}
+	for i := range want {
+		if regions[i] != want[i] {
+			t.Errorf("Region %d: expected %v, got %v", i, want[i], regions[i])
+		}
+	}
+
+	regions, err = s.BlockRegions(3, 0, 2)
+	if err != nil || len(regions) != 1 || regions[0].Offset != 23 || regions[0].Length != 2 {
+		t.Errorf("Expected b.txt at 23+2 for the last piece, got %v, %v", regions, err)
+	}
+
+	if _, err := s.BlockRegions(3, 0, 3); err == nil {
+		t.Error("Expected an error for a block past the short last piece")
+	}
+	if _, err := s.BlockRegions(4, 0, 1); err == nil {
+		t.Error("Expected an error for a piece out of range")
+	}
+}
+
+func TestStorage_SkippedFile(t *testing.T) {
+	info := &meta.InfoDict{
+		Name:        "album",
+		PieceLength: 10,
+		Files: []meta.FileInfo{
+			{Length: 7, Path: []string{"a"}},
+			{Length: 8, Path: []string{"b"}},
+			{Length: 5, Path: []string{"c"}},
+		},
+	}
+	content := testContent(20)
+
+	dir := t.TempDir()
+	path, _ := ContentPath(dir, info)
+	s, err := New(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SetFileSkipped(1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// b lies in both pieces, alongside a and c
+	for idx := 0; idx < 2; idx++ {
+		if err := s.WritePiece(idx, content[idx*10:idx*10+10]); err != nil {
+			t.Fatalf("WritePiece(%d) failed: %v", idx, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, "b")); !os.IsNotExist(err) {
+		t.Fatalf("skipped file b was created: %v", err)
+	}
+	for idx := 0; idx < 2; idx++ {
+		if piece, err := s.ReadPiece(idx); err != nil || !bytes.Equal(piece, content[idx*10:idx*10+10]) {
+			t.Errorf("ReadPiece(%d) = %v, %v", idx, piece, err)
+		}
+	}
+	regions, err := s.BlockRegions(0, 5, 5)
+	if err != nil || len(regions) != 2 || regions[1].Path != s.partPath(0) || regions[1].Offset != 7 {
+		t.Errorf("BlockRegions = %+v, %v; want b's bytes from the part file", regions, err)
+	}
+
+	if err := s.SetFileSkipped(1, false); err != nil {
+		t.Fatal(err)
+	}
+	s.Sync()
+	if got, err := os.ReadFile(filepath.Join(path, "b")); err != nil || !bytes.Equal(got, content[7:15]) {
+		t.Errorf("b = %v, %v after it became wanted", got, err)
+	}
+	if _, err := os.Stat(s.partsDir()); !os.IsNotExist(err) {
+		t.Errorf("part files left behind: %v", err)
+	}
+
+	// a file already on disk keeps being used
+	s.SetFileSkipped(1, true)
+	if piece, err := s.ReadPiece(1); err != nil || !bytes.Equal(piece, content[10:20]) {
+		t.Errorf("ReadPiece(1) = %v, %v after skipping a file on disk", piece, err)
+	}
+}
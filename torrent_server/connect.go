@@ -0,0 +1,114 @@
+package torrentserver
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// maxConnections is how many peers we connect to, counting dials in
+	// progress, before discovered addresses are left alone.
+	maxConnections = 50
+
+	// redialInterval is how long an address is left alone after we
+	// dialed it, whether or not that worked.
+	redialInterval = 5 * time.Minute
+
+	// maxDialHistory bounds how many dialed addresses are remembered.
+	maxDialHistory = 1000
+)
+
+// connector dials the peers we hear about, whether from the tracker,
+// resume data or peer exchange. It skips peers we are already connected
+// to and addresses dialed recently, so the same address handed to it by
+// several sources is only dialed once.
+type connector struct {
+	mu      sync.Mutex
+	dialing map[string]bool
+	dialed  map[string]time.Time
+	listen  map[[20]byte]string // listen addresses of connected peers, where known
+}
+
+func newConnector() *connector {
+	return &connector{
+		dialing: make(map[string]bool),
+		dialed:  make(map[string]time.Time),
+		listen:  make(map[[20]byte]string),
+	}
+}
+
+// setListenAddr records where a connected peer accepts connections, which
+// for peers that dialed us differs from the address they came from.
+func (c *connector) setListenAddr(peerID [20]byte, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listen[peerID] = addr
+}
+
+func (c *connector) removePeer(peerID [20]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.listen, peerID)
+}
+
+// prune forgets the oldest dials once there are too many to remember.
+func (c *connector) prune(now time.Time) {
+	if len(c.dialed) <= maxDialHistory {
+		return
+	}
+	for addr, at := range c.dialed {
+		if now.Sub(at) >= redialInterval {
+			delete(c.dialed, addr)
+		}
+	}
+}
+
+// connectPeers dials the addresses worth dialing, as long as there is
+// room for more connections, and returns how many it dialed. source names
+// where the addresses came from, for the log.
+func (ts *TorrentServer) connectPeers(addrs []string, source string) int {
+	c := ts.connector
+	peers := ts.swarm.Peers()
+
+	c.mu.Lock()
+	connected := make(map[string]bool)
+	for _, p := range peers {
+		connected[p.RemoteAddr().String()] = true
+	}
+	for _, addr := range c.listen {
+		connected[addr] = true
+	}
+
+	now := time.Now()
+	room := maxConnections - len(peers) - len(c.dialing)
+	var dial []string
+	for _, addr := range addrs {
+		if len(dial) >= room {
+			break
+		}
+		if addr == "" || addr == ts.Transport.Addr() || connected[addr] || c.dialing[addr] {
+			continue
+		}
+		if at, ok := c.dialed[addr]; ok && now.Sub(at) < redialInterval {
+			continue
+		}
+		c.dialing[addr] = true
+		c.dialed[addr] = now
+		dial = append(dial, addr)
+	}
+	c.prune(now)
+	c.mu.Unlock()
+
+	for _, addr := range dial {
+		go func(addr string) {
+			if err := ts.Transport.Dial(addr); err != nil {
+				log.Printf("Failed to dial %s node %s: %v", source, addr, err)
+			}
+			c.mu.Lock()
+			delete(c.dialing, addr)
+			c.mu.Unlock()
+		}(addr)
+	}
+	return len(dial)
+}
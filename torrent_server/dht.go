@@ -0,0 +1,58 @@
+package torrentserver
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// dhtAnnounceInterval is how often we announce ourselves on the DHT
+	// and look for new peers there.
+	dhtAnnounceInterval = 15 * time.Minute
+
+	// dhtRetryInterval replaces it while the DHT has given us no peers.
+	dhtRetryInterval = time.Minute
+)
+
+// dhtLoop announces the torrent on the DHT and dials the peers found
+// there until the server stops, or until a torrent fetched by magnet link
+// turns out to be private.
+func (ts *TorrentServer) dhtLoop() {
+	for {
+		if ts.private() {
+			fmt.Printf("[DHT] torrent is private, not using the DHT\n")
+			return
+		}
+		wait := dhtAnnounceInterval
+		if ts.announceDHT() == 0 {
+			wait = dhtRetryInterval
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ts.quitch:
+			return
+		}
+	}
+}
+
+// announceDHT announces us for the torrent on the DHT and dials the peers
+// the lookup turned up. It returns how many peers were found.
+func (ts *TorrentServer) announceDHT() int {
+	peers, err := ts.DHT.Announce(ts.TCPTransportOpts.InfoHash, ts.Transport.Port())
+	if err != nil {
+		fmt.Printf("[DHT] announce failed: %v\n", err)
+	}
+	if len(peers) == 0 {
+		return 0
+	}
+	dialed := ts.connectPeers(peers, "dht")
+	fmt.Printf("[DHT] found %d peers, dialing %d\n", len(peers), dialed)
+	return len(peers)
+}
+
+// useDHT reports whether peers are looked for on the DHT: a node was
+// given and the torrent is not private, as BEP 27 forbids it.
+func (ts *TorrentServer) useDHT() bool {
+	return ts.DHT != nil && !ts.private()
+}
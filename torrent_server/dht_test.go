@@ -0,0 +1,46 @@
+package torrentserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pixperk/pixtorrent/dht"
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+func TestDHT_OffForPrivateTorrent(t *testing.T) {
+	node, err := dht.New(dht.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, private := range []int64{0, 1} {
+		ts := NewTorrentServer(TorrentServerOpts{Torrent: testTorrent(t, private), DHT: node}, p2p.NewPieceManager(1))
+		if got := ts.useDHT(); got != (private == 0) {
+			t.Errorf("private=%d: useDHT = %v", private, got)
+		}
+	}
+}
+
+func TestDHT_StopsOnceFetchedTorrentIsPrivate(t *testing.T) {
+	node, err := dht.New(dht.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTorrentServer(TorrentServerOpts{FetchMetadata: true, DHT: node}, p2p.NewPieceManager(1))
+	if !ts.useDHT() {
+		t.Fatal("DHT off while the torrent is not known yet")
+	}
+
+	ts.metadata.torrent = testTorrent(t, 1)
+	done := make(chan struct{})
+	go func() {
+		ts.dhtLoop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		close(ts.quitch)
+		t.Fatal("dhtLoop kept running for a private torrent")
+	}
+}
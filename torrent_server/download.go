@@ -0,0 +1,446 @@
+package torrentserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+// DefaultRequestQueueSize is how many block requests are kept outstanding
+// per peer when TorrentServerOpts.RequestQueueSize is zero. 32 blocks is
+// 512 KiB in flight, enough to keep a fast link busy.
+const DefaultRequestQueueSize = 32
+
+const (
+	// defaultRequestTimeout applies to a peer until it has sent enough
+	// blocks for its rate to be known.
+	defaultRequestTimeout = 30 * time.Second
+
+	// Rate based timeouts allow timeoutFactor times the expected time
+	// for the peer's queue to drain, within these bounds.
+	minRequestTimeout = 5 * time.Second
+	maxRequestTimeout = 60 * time.Second
+	timeoutFactor     = 3
+
+	// snubTimeout is how long a peer may leave requests unanswered before
+	// it is snubbed: its requests go to other peers and it is only given
+	// one at a time until it delivers again.
+	snubTimeout = 60 * time.Second
+
+	// requestCheckInterval is how often deadlines are checked.
+	requestCheckInterval = 2 * time.Second
+)
+
+type blockState uint8
+
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// pieceBuffer collects the blocks of one piece until it can be verified.
+type pieceBuffer struct {
+	index    int
+	data     []byte
+	blocks   []blockState
+	received int
+}
+
+func newPieceBuffer(index int, size int64) *pieceBuffer {
+	numBlocks := int((size + p2p.BlockSize - 1) / p2p.BlockSize)
+	return &pieceBuffer{
+		index:  index,
+		data:   make([]byte, size),
+		blocks: make([]blockState, numBlocks),
+	}
+}
+
+func (pb *pieceBuffer) block(i int) p2p.BlockRequest {
+	begin := i * p2p.BlockSize
+	length := p2p.BlockSize
+	if begin+length > len(pb.data) {
+		length = len(pb.data) - begin
+	}
+	return p2p.BlockRequest{Index: pb.index, Begin: begin, Length: length}
+}
+
+func (pb *pieceBuffer) complete() bool {
+	return pb.received == len(pb.blocks)
+}
+
+// peerRequests tracks the requests in flight to one peer and how quickly
+// it has been answering them.
+type peerRequests struct {
+	sent      map[p2p.BlockRequest]time.Time
+	timedOut  map[p2p.BlockRequest]bool // not asked of this peer again
+	rate      float64                   // bytes per second, smoothed
+	lastBlock time.Time
+	waiting   time.Time // since when requests have gone unanswered
+	snubbed   bool
+	maxQueue  int // most requests the peer queues, 0 if it did not say
+}
+
+func newPeerRequests() *peerRequests {
+	return &peerRequests{
+		sent:     make(map[p2p.BlockRequest]time.Time),
+		timedOut: make(map[p2p.BlockRequest]bool),
+	}
+}
+
+// timeout is how long a request to this peer may stay unanswered: a few
+// times what the peer needs to work through its queue at the rate it has
+// shown so far.
+func (pr *peerRequests) timeout() time.Duration {
+	if pr.rate <= 0 {
+		return defaultRequestTimeout
+	}
+
+	var queued int
+	for req := range pr.sent {
+		queued += req.Length
+	}
+	t := time.Duration(timeoutFactor * float64(queued) / pr.rate * float64(time.Second))
+	if t < minRequestTimeout {
+		return minRequestTimeout
+	}
+	if t > maxRequestTimeout {
+		return maxRequestTimeout
+	}
+	return t
+}
+
+// observe folds a delivered block into the peer's rate estimate.
+func (pr *peerRequests) observe(length int, sentAt, now time.Time) {
+	since := sentAt
+	if pr.lastBlock.After(since) {
+		since = pr.lastBlock
+	}
+	if elapsed := now.Sub(since).Seconds(); elapsed > 0 {
+		sample := float64(length) / elapsed
+		if pr.rate == 0 {
+			pr.rate = sample
+		} else {
+			pr.rate = 0.8*pr.rate + 0.2*sample
+		}
+	}
+}
+
+// downloader decides which blocks to ask which peer for. It keeps up to
+// queueSize requests outstanding per peer and assembles pieces from the
+// blocks that come back. It is only used from the server loop.
+//
+// Normally each block is asked of one peer. Once every block still needed
+// has been requested, the downloader enters endgame: the remaining blocks
+// are asked of every peer that has them, and the extra requests are
+// cancelled when the first copy arrives, so one slow peer cannot hold up
+// the end of the download.
+//
+// Requests that are not answered in time are handed back so other peers
+// can be asked; see expireRequests.
+type downloader struct {
+	swarm     *p2p.Swarm
+	queueSize int
+	endgame   bool
+
+	pieces      map[int]*pieceBuffer       // pieces being downloaded
+	outstanding map[[20]byte]*peerRequests // requests in flight per peer
+}
+
+func newDownloader(swarm *p2p.Swarm, queueSize int) *downloader {
+	if queueSize <= 0 {
+		queueSize = DefaultRequestQueueSize
+	}
+	return &downloader{
+		swarm:       swarm,
+		queueSize:   queueSize,
+		pieces:      make(map[int]*pieceBuffer),
+		outstanding: make(map[[20]byte]*peerRequests),
+	}
+}
+
+func (d *downloader) peer(peerID [20]byte) *peerRequests {
+	pr := d.outstanding[peerID]
+	if pr == nil {
+		pr = newPeerRequests()
+		d.outstanding[peerID] = pr
+	}
+	return pr
+}
+
+// nextRequests picks blocks for a peer until its queue is full. Blocks of
+// pieces already under way come first so partial pieces finish and free
+// their buffers; after that a new piece is started, rarest first.
+func (d *downloader) nextRequests(peerID [20]byte) []p2p.BlockRequest {
+	pr := d.peer(peerID)
+	limit := d.queueSize
+	if pr.maxQueue > 0 && pr.maxQueue < limit {
+		limit = pr.maxQueue
+	}
+	if pr.snubbed {
+		limit = 1
+	}
+	now := time.Now()
+
+	var reqs []p2p.BlockRequest
+	take := func(pb *pieceBuffer) {
+		avoid := len(pr.timedOut) > 0 && d.othersHave(peerID, pb.index)
+		for i, state := range pb.blocks {
+			if len(pr.sent) >= limit {
+				return
+			}
+			req := pb.block(i)
+			if state != blockMissing || avoid && pr.timedOut[req] {
+				continue
+			}
+			pb.blocks[i] = blockRequested
+			pr.sent[req] = now
+			reqs = append(reqs, req)
+		}
+	}
+
+	picker := d.swarm.Picker()
+	for _, pb := range d.pieces {
+		if len(pr.sent) >= limit {
+			break
+		}
+		// a piece skipped while under way is left to its in-flight blocks
+		if d.swarm.PeerHasPiece(peerID, pb.index) && picker.Wanted(pb.index) {
+			take(pb)
+		}
+	}
+
+	if len(pr.sent) < limit {
+		// every piece yields at least one block, so this is enough to fill
+		// the queue
+		skip := func(idx int) bool {
+			_, busy := d.pieces[idx]
+			return busy || d.swarm.PieceSize(idx) <= 0
+		}
+		for _, idx := range picker.Pick(peerID, limit-len(pr.sent), skip) {
+			if len(pr.sent) >= limit {
+				break
+			}
+			pb := newPieceBuffer(idx, d.swarm.PieceSize(idx))
+			d.pieces[idx] = pb
+			take(pb)
+		}
+	}
+
+	if len(pr.sent) < limit && d.inEndgame() {
+		for _, pb := range d.pieces {
+			if !d.swarm.PeerHasPiece(peerID, pb.index) || !picker.Wanted(pb.index) {
+				continue
+			}
+			for i, state := range pb.blocks {
+				if len(pr.sent) >= limit {
+					break
+				}
+				req := pb.block(i)
+				if _, queued := pr.sent[req]; state == blockRequested && !queued {
+					pr.sent[req] = now
+					reqs = append(reqs, req)
+				}
+			}
+		}
+	}
+	if len(reqs) > 0 && pr.waiting.IsZero() {
+		pr.waiting = now
+	}
+	return reqs
+}
+
+// othersHave reports whether a peer other than peerID could serve the
+// piece right now, so blocks peerID let time out can go there instead.
+func (d *downloader) othersHave(peerID [20]byte, index int) bool {
+	for id, pr := range d.outstanding {
+		if id != peerID && !pr.snubbed && !d.swarm.IsPeerChoking(id) && d.swarm.PeerHasPiece(id, index) {
+			return true
+		}
+	}
+	return false
+}
+
+// inEndgame reports whether every block still needed has been requested.
+func (d *downloader) inEndgame() bool {
+	picker := d.swarm.Picker()
+	active := 0
+	for idx := range d.pieces {
+		if picker.Wanted(idx) {
+			active++
+		}
+	}
+
+	endgame := active > 0 && picker.WantedMissing() <= active
+	for _, pb := range d.pieces {
+		if !endgame {
+			break
+		}
+		if !picker.Wanted(pb.index) {
+			continue
+		}
+		for _, state := range pb.blocks {
+			if state == blockMissing {
+				endgame = false
+				break
+			}
+		}
+	}
+
+	if endgame && !d.endgame {
+		fmt.Printf("[ENDGAME] all remaining blocks requested, asking every peer for %d pieces\n", active)
+	}
+	d.endgame = endgame
+	return endgame
+}
+
+// received stores a block from a peer. It returns the piece buffer when
+// this block completed it; the caller verifies and stores the piece. It
+// also returns the other peers the same block was requested from, whose
+// requests should now be cancelled.
+func (d *downloader) received(peerID [20]byte, index, begin int, block []byte) (*pieceBuffer, [][20]byte) {
+	req := p2p.BlockRequest{Index: index, Begin: begin, Length: len(block)}
+	now := time.Now()
+
+	pr := d.peer(peerID)
+	if sentAt, ok := pr.sent[req]; ok {
+		pr.observe(len(block), sentAt, now)
+		delete(pr.sent, req)
+	}
+	pr.lastBlock = now
+	pr.waiting = time.Time{}
+	if len(pr.sent) > 0 {
+		pr.waiting = now
+	}
+	if pr.snubbed {
+		pr.snubbed = false
+		fmt.Printf("[UNSNUBBED] peer %x is sending again\n", peerID)
+	}
+
+	var others [][20]byte
+	for id, other := range d.outstanding {
+		if _, ok := other.sent[req]; ok {
+			delete(other.sent, req)
+			others = append(others, id)
+		}
+	}
+
+	pb, ok := d.pieces[index]
+	if !ok || begin%p2p.BlockSize != 0 {
+		return nil, others
+	}
+	i := begin / p2p.BlockSize
+	if i >= len(pb.blocks) || pb.block(i) != req || pb.blocks[i] == blockReceived {
+		return nil, others
+	}
+
+	copy(pb.data[begin:], block)
+	pb.blocks[i] = blockReceived
+	pb.received++
+	if !pb.complete() {
+		return nil, others
+	}
+
+	delete(d.pieces, index)
+	return pb, others
+}
+
+// expireRequests takes back requests that are past their deadline so
+// they can go to other peers; the peer that sat on one is not asked for
+// that block again while others can serve it. A peer that has not
+// delivered anything for snubTimeout is snubbed and loses all of its
+// requests. It reports whether any request was taken back.
+func (d *downloader) expireRequests(now time.Time) bool {
+	expired := false
+	for id, pr := range d.outstanding {
+		if len(pr.sent) == 0 {
+			continue
+		}
+
+		snubbedNow := !pr.snubbed && now.Sub(pr.waiting) >= snubTimeout
+		if snubbedNow {
+			pr.snubbed = true
+			fmt.Printf("[SNUBBED] peer %x sent nothing for %s, moving its %d requests elsewhere\n", id, now.Sub(pr.waiting).Round(time.Second), len(pr.sent))
+		}
+
+		timeout := pr.timeout()
+		var timedOut []p2p.BlockRequest
+		for req, sentAt := range pr.sent {
+			if snubbedNow || now.Sub(sentAt) >= timeout {
+				timedOut = append(timedOut, req)
+			}
+		}
+		for _, req := range timedOut {
+			delete(pr.sent, req)
+			pr.timedOut[req] = true
+			d.unrequest(req)
+		}
+		if len(timedOut) > 0 {
+			expired = true
+			if !snubbedNow {
+				fmt.Printf("[TIMEOUT] %d requests to %x unanswered after %s\n", len(timedOut), id, timeout.Round(time.Millisecond))
+			}
+		}
+
+		for req := range pr.timedOut {
+			if _, ok := d.pieces[req.Index]; !ok {
+				delete(pr.timedOut, req)
+			}
+		}
+	}
+	return expired
+}
+
+// releasePeer forgets a peer's outstanding requests, e.g. after it choked
+// us, so other peers can be asked for those blocks. In endgame a block
+// stays requested while another peer still has it queued.
+func (d *downloader) releasePeer(peerID [20]byte) {
+	pr := d.outstanding[peerID]
+	if pr == nil {
+		return
+	}
+	sent := pr.sent
+	pr.sent = make(map[p2p.BlockRequest]time.Time)
+	pr.waiting = time.Time{}
+	for req := range sent {
+		d.unrequest(req)
+	}
+}
+
+// setPeerQueueLimit caps the requests kept outstanding with a peer at
+// what it says it can queue.
+func (d *downloader) setPeerQueueLimit(peerID [20]byte, n int) {
+	d.peer(peerID).maxQueue = n
+}
+
+// removePeer releases a peer that went away and drops what we learned
+// about it.
+func (d *downloader) removePeer(peerID [20]byte) {
+	d.releasePeer(peerID)
+	delete(d.outstanding, peerID)
+}
+
+// unrequest marks a block missing again unless another peer still has it
+// outstanding.
+func (d *downloader) unrequest(req p2p.BlockRequest) {
+	pb, ok := d.pieces[req.Index]
+	if !ok {
+		return
+	}
+	i := req.Begin / p2p.BlockSize
+	if pb.blocks[i] != blockRequested {
+		return
+	}
+	for _, pr := range d.outstanding {
+		if _, ok := pr.sent[req]; ok {
+			return
+		}
+	}
+	pb.blocks[i] = blockMissing
+}
+
+// wantsFrom reports whether the peer has any piece we still need.
+func (d *downloader) wantsFrom(peerID [20]byte) bool {
+	return d.swarm.Picker().Interesting(peerID)
+}
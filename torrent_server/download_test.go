@@ -0,0 +1,212 @@
+package torrentserver
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+const testPieceLength = 4 * p2p.BlockSize
+
+// newTestDownloader sets up numPieces pieces of four blocks, the last one
+// a block and a bit shorter.
+func newTestDownloader(t *testing.T, numPieces, queueSize int) (*p2p.Swarm, *downloader) {
+	t.Helper()
+	pm := p2p.NewPieceManager(numPieces)
+	pm.SetLayout(testPieceLength, int64(numPieces)*testPieceLength-p2p.BlockSize-100)
+	swarm := p2p.NewSwarm([20]byte{0xff}, [20]byte{}, pm)
+	return swarm, newDownloader(swarm, queueSize)
+}
+
+// addSeed connects an unchoking peer that has every piece.
+func addSeed(t *testing.T, swarm *p2p.Swarm, id byte) [20]byte {
+	t.Helper()
+	p := newTestPeer(t, id)
+	if err := swarm.AddPeer(p); err != nil {
+		t.Fatal(err)
+	}
+	swarm.UpdatePeerBitfield(p.id, bytes.Repeat([]byte{0xff}, (swarm.NumPieces()+7)/8))
+	swarm.SetPeerChoking(p.id, false)
+	return p.id
+}
+
+func piecesOf(reqs []p2p.BlockRequest) map[int]int {
+	blocks := make(map[int]int)
+	for _, req := range reqs {
+		blocks[req.Index]++
+	}
+	return blocks
+}
+
+func TestDownloader_FillsQueueFinishingPiecesFirst(t *testing.T) {
+	swarm, d := newTestDownloader(t, 8, 6)
+	a, b := addSeed(t, swarm, 1), addSeed(t, swarm, 2)
+
+	reqsA := d.nextRequests(a)
+	if len(reqsA) != 6 {
+		t.Fatalf("got %d requests, want a full queue of 6", len(reqsA))
+	}
+	seen := make(map[p2p.BlockRequest]bool)
+	for _, req := range reqsA {
+		if seen[req] {
+			t.Fatalf("block %+v requested twice", req)
+		}
+		seen[req] = true
+	}
+	if blocks := piecesOf(reqsA); len(blocks) != 2 {
+		t.Fatalf("requests span pieces %v, want one whole piece and part of another", blocks)
+	}
+	if more := d.nextRequests(a); len(more) != 0 {
+		t.Errorf("got %d more requests with the queue full", len(more))
+	}
+
+	// the piece a started but could not finish comes before a new one
+	partial, left := -1, 0
+	for idx, n := range piecesOf(reqsA) {
+		if blocks := int((swarm.PieceSize(idx) + p2p.BlockSize - 1) / p2p.BlockSize); n < blocks {
+			partial, left = idx, blocks-n
+		}
+	}
+	if partial < 0 {
+		t.Fatalf("a finished every piece it started: %v", reqsA)
+	}
+	reqsB := d.nextRequests(b)
+	if piecesOf(reqsB)[partial] != left {
+		t.Errorf("b was given %v, want the %d blocks left of piece %d among them", reqsB, left, partial)
+	}
+	for _, req := range reqsB {
+		if seen[req] {
+			t.Errorf("block %+v requested of a and b outside endgame", req)
+		}
+	}
+}
+
+func TestDownloader_PeerQueueLimit(t *testing.T) {
+	swarm, d := newTestDownloader(t, 4, 32)
+	a := addSeed(t, swarm, 1)
+
+	d.setPeerQueueLimit(a, 3)
+	if reqs := d.nextRequests(a); len(reqs) != 3 {
+		t.Errorf("got %d requests, want the 3 the peer queues", len(reqs))
+	}
+}
+
+func TestDownloader_ReceivedAssemblesPiece(t *testing.T) {
+	swarm, d := newTestDownloader(t, 2, 32)
+	a := addSeed(t, swarm, 1)
+	last := swarm.NumPieces() - 1
+	size := swarm.PieceSize(last)
+
+	var lastReqs []p2p.BlockRequest
+	for _, req := range d.nextRequests(a) {
+		if req.Index == last {
+			lastReqs = append(lastReqs, req)
+		}
+	}
+	if len(lastReqs) != 3 || lastReqs[2].Length != int(size)-2*p2p.BlockSize {
+		t.Fatalf("last piece requested as %v, want 3 blocks ending in a short one", lastReqs)
+	}
+
+	data := bytes.Repeat([]byte{7}, int(size))
+	for i, req := range lastReqs {
+		pb, others := d.received(a, req.Index, req.Begin, data[req.Begin:req.Begin+req.Length])
+		if len(others) != 0 {
+			t.Errorf("block %d also cancelled at %v", i, others)
+		}
+		if (pb != nil) != (i == len(lastReqs)-1) {
+			t.Fatalf("block %d: complete = %v", i, pb != nil)
+		}
+		if pb != nil && !bytes.Equal(pb.data, data) {
+			t.Errorf("piece assembled wrong")
+		}
+	}
+
+	// a block nobody asked for, or one of the wrong length, is dropped
+	if pb, _ := d.received(a, 0, 0, []byte("short")); pb != nil {
+		t.Error("piece completed by a short block")
+	}
+}
+
+func TestDownloader_Endgame(t *testing.T) {
+	swarm, d := newTestDownloader(t, 1, 32)
+	a, b := addSeed(t, swarm, 1), addSeed(t, swarm, 2)
+
+	reqsA := d.nextRequests(a)
+	if !d.inEndgame() {
+		t.Fatal("not in endgame with every block requested")
+	}
+	reqsB := d.nextRequests(b)
+	if len(reqsB) != len(reqsA) {
+		t.Fatalf("b asked for %d blocks in endgame, want the %d a has", len(reqsB), len(reqsA))
+	}
+
+	req := reqsA[0]
+	_, others := d.received(a, req.Index, req.Begin, make([]byte, req.Length))
+	if len(others) != 1 || others[0] != b {
+		t.Errorf("cancel went to %v, want b", others)
+	}
+	if _, ok := d.outstanding[b].sent[req]; ok {
+		t.Error("b still has the delivered block outstanding")
+	}
+}
+
+func TestDownloader_ExpiredRequestsGoElsewhere(t *testing.T) {
+	swarm, d := newTestDownloader(t, 1, 32)
+	a := addSeed(t, swarm, 1)
+
+	reqs := d.nextRequests(a)
+	if d.expireRequests(time.Now()) {
+		t.Fatal("fresh requests expired")
+	}
+	if !d.expireRequests(time.Now().Add(defaultRequestTimeout)) {
+		t.Fatal("nothing expired after the default timeout")
+	}
+	if n := len(d.outstanding[a].sent); n != 0 {
+		t.Fatalf("a still has %d requests", n)
+	}
+
+	// b, known from its extended handshake, can serve the piece, so the
+	// blocks a sat on go to b and not back to a
+	b := addSeed(t, swarm, 2)
+	d.setPeerQueueLimit(b, maxPeerRequests)
+	if again := d.nextRequests(a); len(again) != 0 {
+		t.Errorf("a asked again for %v while b has the piece", again)
+	}
+	if got := d.nextRequests(b); len(got) != len(reqs) {
+		t.Errorf("b given %d blocks, want the %d a let time out", len(got), len(reqs))
+	}
+}
+
+func TestDownloader_SnubbedPeerGetsOneRequest(t *testing.T) {
+	swarm, d := newTestDownloader(t, 4, 32)
+	a := addSeed(t, swarm, 1)
+
+	d.nextRequests(a)
+	d.expireRequests(time.Now().Add(snubTimeout))
+	if !d.outstanding[a].snubbed {
+		t.Fatal("peer silent for snubTimeout not snubbed")
+	}
+	reqs := d.nextRequests(a)
+	if len(reqs) != 1 {
+		t.Fatalf("snubbed peer given %d requests, want 1", len(reqs))
+	}
+
+	req := reqs[0]
+	d.received(a, req.Index, req.Begin, make([]byte, req.Length))
+	if d.outstanding[a].snubbed {
+		t.Error("peer still snubbed after delivering")
+	}
+}
+
+func TestDownloader_ReleasePeer(t *testing.T) {
+	swarm, d := newTestDownloader(t, 1, 32)
+	a, b := addSeed(t, swarm, 1), addSeed(t, swarm, 2)
+
+	reqs := d.nextRequests(a)
+	d.releasePeer(a)
+	if got := d.nextRequests(b); len(got) != len(reqs) {
+		t.Errorf("b given %d blocks after a choked, want %d", len(got), len(reqs))
+	}
+}
@@ -0,0 +1,242 @@
+package torrentserver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+const (
+	// clientVersion is sent as "v" in the extended handshake.
+	clientVersion = "pixtorrent"
+
+	// maxPeerRequests is the "reqq" we advertise, well below the 2048
+	// messages a peer's outbox holds.
+	maxPeerRequests = 250
+)
+
+// Extension is a feature spoken over the extension protocol (BEP 10), such
+// as metadata or peer exchange. Register it with the server's
+// ExtensionRegistry before Start. PeerHandshake and HandleMessage are
+// called on the server loop.
+type Extension interface {
+	// Name is the key the extension is known by in the handshake's "m"
+	// dictionary, e.g. "ut_pex".
+	Name() string
+
+	// ExtendHandshake adds the extension's own fields to the handshake we
+	// send. It may be called from any goroutine.
+	ExtendHandshake(hs *p2p.ExtendedHandshake)
+
+	// PeerHandshake is called with every handshake a peer sends, merged
+	// with the ones before it, whether or not the peer supports the
+	// extension.
+	PeerHandshake(peer p2p.Peer, hs *p2p.ExtendedHandshake)
+
+	// HandleMessage is called with the payload of each of the
+	// extension's messages.
+	HandleMessage(peer p2p.Peer, payload []byte)
+}
+
+// ExtensionRegistry holds the extensions a server speaks and what each
+// connected peer announced in its extended handshake. Our message IDs are
+// given out in registration order, starting at 1.
+type ExtensionRegistry struct {
+	mu         sync.Mutex
+	extensions []Extension
+	peers      map[[20]byte]*p2p.ExtendedHandshake
+}
+
+func newExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		peers: make(map[[20]byte]*p2p.ExtendedHandshake),
+	}
+}
+
+// Register adds an extension; names must be unique.
+func (r *ExtensionRegistry) Register(ext Extension) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.extensions {
+		if e.Name() == ext.Name() {
+			return fmt.Errorf("extension %q already registered", ext.Name())
+		}
+	}
+	if len(r.extensions) == 255 {
+		return fmt.Errorf("too many extensions")
+	}
+	r.extensions = append(r.extensions, ext)
+	return nil
+}
+
+func (r *ExtensionRegistry) list() []Extension {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Extension(nil), r.extensions...)
+}
+
+// byID returns the extension we gave message ID id.
+func (r *ExtensionRegistry) byID(id byte) Extension {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == p2p.ExtendedHandshakeID || int(id) > len(r.extensions) {
+		return nil
+	}
+	return r.extensions[id-1]
+}
+
+// handshake builds the extended handshake we send.
+func (r *ExtensionRegistry) handshake() *p2p.ExtendedHandshake {
+	hs := &p2p.ExtendedHandshake{
+		M:    make(map[string]int),
+		V:    clientVersion,
+		Reqq: maxPeerRequests,
+	}
+	for i, ext := range r.list() {
+		hs.M[ext.Name()] = i + 1
+		ext.ExtendHandshake(hs)
+	}
+	return hs
+}
+
+// peerHandshake records a peer's handshake. Later handshakes only update
+// what they carry, and an ID of 0 withdraws an extension.
+func (r *ExtensionRegistry) peerHandshake(peerID [20]byte, hs *p2p.ExtendedHandshake) *p2p.ExtendedHandshake {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	known := r.peers[peerID]
+	if known == nil {
+		known = &p2p.ExtendedHandshake{M: make(map[string]int)}
+		r.peers[peerID] = known
+	}
+	for name, id := range hs.M {
+		if id <= 0 || id > 255 {
+			delete(known.M, name)
+		} else {
+			known.M[name] = id
+		}
+	}
+	if hs.V != "" {
+		known.V = hs.V
+	}
+	if hs.P != 0 {
+		known.P = hs.P
+	}
+	if hs.Reqq != 0 {
+		known.Reqq = hs.Reqq
+	}
+	if hs.YourIP != nil {
+		known.YourIP = hs.YourIP
+	}
+	if hs.MetadataSize != 0 {
+		known.MetadataSize = hs.MetadataSize
+	}
+
+	merged := *known
+	merged.M = make(map[string]int, len(known.M))
+	for name, id := range known.M {
+		merged.M[name] = id
+	}
+	return &merged
+}
+
+func (r *ExtensionRegistry) removePeer(peerID [20]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.peers, peerID)
+}
+
+// PeerID returns the message ID a peer wants the named extension's
+// messages sent with, and whether it supports the extension at all.
+func (r *ExtensionRegistry) PeerID(peerID [20]byte, name string) (byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hs := r.peers[peerID]
+	if hs == nil {
+		return 0, false
+	}
+	id, ok := hs.M[name]
+	return byte(id), ok
+}
+
+// Extensions is the registry extensions are added to.
+func (ts *TorrentServer) Extensions() *ExtensionRegistry {
+	return ts.extensions
+}
+
+// SendExtended sends a message of the named extension to a peer that
+// supports it.
+func (ts *TorrentServer) SendExtended(peer p2p.Peer, name string, payload []byte) error {
+	id, ok := ts.extensions.PeerID(peer.ID(), name)
+	if !ok {
+		return fmt.Errorf("peer %x does not support %s", peer.ID(), name)
+	}
+	return peer.Send(&p2p.Extended{ExtID: id, Payload: payload})
+}
+
+// onPeer registers a connected peer and, if it speaks the extension
+// protocol, sends it our extended handshake. It runs on the connection's
+// goroutine.
+func (ts *TorrentServer) onPeer(peer p2p.Peer) error {
+	if err := ts.swarm.OnPeer(peer); err != nil {
+		return err
+	}
+	if !p2p.SupportsExtensions(peer) {
+		return nil
+	}
+
+	hs := ts.extensions.handshake()
+	hs.P = ts.Transport.Port()
+	if addr, ok := peer.RemoteAddr().(*net.TCPAddr); ok {
+		hs.YourIP = p2p.CompactIP(addr.IP)
+	}
+	msg, err := hs.Message()
+	if err != nil {
+		return err
+	}
+	if err := peer.Send(msg); err != nil {
+		fmt.Printf("failed to send extended handshake to %x: %v\n", peer.ID(), err)
+	}
+	return nil
+}
+
+// handleExtended routes an extended message to the extension it belongs
+// to.
+func (ts *TorrentServer) handleExtended(msg p2p.RPC, ext *p2p.Extended) {
+	fromaddr, fromid := msg.From.Addr, msg.From.PeerID
+	peer, exists := ts.swarm.GetPeer(fromid)
+	if !exists {
+		return
+	}
+
+	if ext.ExtID == p2p.ExtendedHandshakeID {
+		hs, err := p2p.ParseExtendedHandshake(ext.Payload)
+		if err != nil {
+			fmt.Printf("[EXTENDED] from [Peer -> ID %x ; Addr %s]: %v\n", fromid, fromaddr, err)
+			return
+		}
+		merged := ts.extensions.peerHandshake(fromid, hs)
+		fmt.Printf("[EXTENDED HANDSHAKE] from [Peer -> ID %x ; Addr %s], client %q, extensions %v\n", fromid, fromaddr, merged.V, merged.M)
+
+		if merged.Reqq > 0 {
+			ts.downloader.setPeerQueueLimit(fromid, merged.Reqq)
+		}
+		for _, e := range ts.extensions.list() {
+			e.PeerHandshake(peer, merged)
+		}
+		return
+	}
+
+	e := ts.extensions.byID(ext.ExtID)
+	if e == nil {
+		fmt.Printf("[EXTENDED] from [Peer -> ID %x ; Addr %s], unknown extended message %d\n", fromid, fromaddr, ext.ExtID)
+		return
+	}
+	e.HandleMessage(peer, ext.Payload)
+}
@@ -0,0 +1,127 @@
+package torrentserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+// echoExtension records what the server hands it.
+type echoExtension struct {
+	name       string
+	handshakes []*p2p.ExtendedHandshake
+	payloads   [][]byte
+}
+
+func (e *echoExtension) Name() string                              { return e.name }
+func (e *echoExtension) ExtendHandshake(hs *p2p.ExtendedHandshake) {}
+
+func (e *echoExtension) PeerHandshake(peer p2p.Peer, hs *p2p.ExtendedHandshake) {
+	e.handshakes = append(e.handshakes, hs)
+}
+
+func (e *echoExtension) HandleMessage(peer p2p.Peer, payload []byte) {
+	e.payloads = append(e.payloads, payload)
+}
+
+func TestExtensionRegistry_IDsInRegistrationOrder(t *testing.T) {
+	r := newExtensionRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := r.Register(&echoExtension{name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Register(&echoExtension{name: "b"}); err == nil {
+		t.Error("registered a second extension named b")
+	}
+
+	hs := r.handshake()
+	if want := map[string]int{"a": 1, "b": 2, "c": 3}; !reflect.DeepEqual(hs.M, want) {
+		t.Errorf("handshake m = %v, want %v", hs.M, want)
+	}
+	if hs.Reqq != maxPeerRequests || hs.V != clientVersion {
+		t.Errorf("handshake reqq = %d, v = %q", hs.Reqq, hs.V)
+	}
+	if e := r.byID(2); e == nil || e.Name() != "b" {
+		t.Errorf("byID(2) = %v, want b", e)
+	}
+	if r.byID(p2p.ExtendedHandshakeID) != nil || r.byID(4) != nil {
+		t.Error("byID found an extension for an ID never given out")
+	}
+}
+
+func TestExtensionRegistry_PeerHandshakesMerge(t *testing.T) {
+	r := newExtensionRegistry()
+	peer := [20]byte{1}
+
+	r.peerHandshake(peer, &p2p.ExtendedHandshake{M: map[string]int{"ut_pex": 4, "ut_metadata": 2}, V: "other", Reqq: 100})
+	merged := r.peerHandshake(peer, &p2p.ExtendedHandshake{M: map[string]int{"ut_pex": 0, "ut_holepunch": 7}, P: 6881})
+
+	if want := map[string]int{"ut_metadata": 2, "ut_holepunch": 7}; !reflect.DeepEqual(merged.M, want) {
+		t.Errorf("merged m = %v, want %v with ut_pex withdrawn", merged.M, want)
+	}
+	if merged.V != "other" || merged.Reqq != 100 || merged.P != 6881 {
+		t.Errorf("merged = %+v, want fields of both handshakes", merged)
+	}
+	if id, ok := r.PeerID(peer, "ut_metadata"); !ok || id != 2 {
+		t.Errorf("PeerID(ut_metadata) = %d, %v", id, ok)
+	}
+	if _, ok := r.PeerID(peer, "ut_pex"); ok {
+		t.Error("PeerID found the withdrawn ut_pex")
+	}
+
+	// the copy handed out does not change with later handshakes
+	r.peerHandshake(peer, &p2p.ExtendedHandshake{M: map[string]int{"ut_metadata": 9}})
+	if merged.M["ut_metadata"] != 2 {
+		t.Error("an earlier merged handshake changed")
+	}
+	r.removePeer(peer)
+	if _, ok := r.PeerID(peer, "ut_metadata"); ok {
+		t.Error("PeerID found an extension of a removed peer")
+	}
+}
+
+func TestExtensionRegistry_RoutesMessages(t *testing.T) {
+	ts := NewTorrentServer(TorrentServerOpts{}, p2p.NewPieceManager(1))
+	echo := &echoExtension{name: "echo"}
+	if err := ts.Extensions().Register(echo); err != nil {
+		t.Fatal(err)
+	}
+	ourID := ts.extensions.handshake().M["echo"]
+	p := addTestPeer(t, ts, 1)
+
+	if err := ts.SendExtended(p, "echo", []byte("hi")); err == nil {
+		t.Error("SendExtended to a peer that never announced echo succeeded")
+	}
+
+	hs, err := (&p2p.ExtendedHandshake{M: map[string]int{"echo": 9}, Reqq: 40}).Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extendedFrom(ts, p, hs)
+	if len(echo.handshakes) != 1 || echo.handshakes[0].M["echo"] != 9 {
+		t.Fatalf("extension saw handshakes %v", echo.handshakes)
+	}
+	if limit := ts.downloader.outstanding[p.id].maxQueue; limit != 40 {
+		t.Errorf("peer queue limit = %d, want the 40 from reqq", limit)
+	}
+
+	extendedFrom(ts, p, &p2p.Extended{ExtID: byte(ourID), Payload: []byte("ping")})
+	extendedFrom(ts, p, &p2p.Extended{ExtID: 200, Payload: []byte("lost")})
+	if len(echo.payloads) != 1 || string(echo.payloads[0]) != "ping" {
+		t.Errorf("extension got %q, want only ping", echo.payloads)
+	}
+
+	// replies use the ID the peer gave out, not ours
+	if err := ts.SendExtended(p, "echo", []byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	sent := p.take()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	if ext, ok := sent[0].(*p2p.Extended); !ok || ext.ExtID != 9 || string(ext.Payload) != "pong" {
+		t.Errorf("sent %+v, want pong with ID 9", sent[0])
+	}
+}
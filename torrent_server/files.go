@@ -0,0 +1,40 @@
+package torrentserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+// writeBlob stores the whole download as <infohash>.<FileFormat> in RootDir.
+func (ts *TorrentServer) writeBlob(data []byte) (string, error) {
+	if err := os.MkdirAll(ts.RootDir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %v", ts.RootDir, err)
+	}
+
+	filePath := filepath.Join(ts.RootDir, fmt.Sprintf("%x.%s", ts.TCPTransportOpts.InfoHash, ts.FileFormat))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write file %s: %v", filePath, err)
+	}
+	return filePath, nil
+}
+
+// storeCompleted persists a finished download. Torrent content is already
+// in its files piece by piece, so it only needs flushing; otherwise the
+// pieces are joined into a blob.
+func (ts *TorrentServer) storeCompleted() (string, error) {
+	if torrent := ts.Metadata(); torrent != nil {
+		if err := ts.swarm.PieceManager().Storage().Sync(); err != nil {
+			return "", err
+		}
+		return storage.ContentPath(ts.RootDir, &torrent.Info)
+	}
+
+	fullData := ts.ReconstructData()
+	if fullData == nil {
+		return "", fmt.Errorf("pieces missing")
+	}
+	return ts.writeBlob(fullData)
+}
@@ -1,11 +1,11 @@
 package torrentserver
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"time"
 
+	"github.com/pixperk/pixtorrent/client"
 	"github.com/pixperk/pixtorrent/p2p"
 )
 
@@ -14,104 +14,124 @@ func (ts *TorrentServer) handleBitfieldAnnouncement(msg p2p.RPC, bitfield []byte
 	fmt.Printf("[BITFIELD] from [Peer -> ID %x ; Addr %s], data: %x\n", fromid, fromaddr, bitfield)
 
 	ts.swarm.UpdatePeerBitfield(fromid, bitfield)
+	ts.updateInterest(fromid)
+	ts.requestBlocks(fromid)
+}
 
-	rarestPieces := ts.swarm.GetRarestMissingPieces(bitfield)
-	fmt.Printf("[RAREST PIECES] from [Peer -> ID %x ; Addr %s]: %v\n", fromid, fromaddr, rarestPieces)
-
-	if len(rarestPieces) > 0 {
-		peer, exists := ts.swarm.GetPeer(fromid)
-		if !exists {
-			return
-		}
+// updateInterest tells a peer whether we want anything it has, sending
+// INTERESTED or NOT INTERESTED only when that changes.
+func (ts *TorrentServer) updateInterest(peerID [20]byte) {
+	wanted := ts.canDownload() && ts.downloader.wantsFrom(peerID)
+	if wanted == ts.swarm.IsAmInterested(peerID) {
+		return
+	}
 
-		// Send INTERESTED message to let peer know we want pieces
-		if err := peer.Send([]byte{p2p.MsgInterested}); err != nil {
-			fmt.Printf("failed to send interested to %x: %v\n", fromid, err)
-			return
-		}
-		fmt.Printf("[SENT INTERESTED] to [Peer -> ID %x ; Addr %s]\n", fromid, fromaddr)
+	peer, exists := ts.swarm.GetPeer(peerID)
+	if !exists {
+		return
+	}
 
-		// Store pending requests - will be sent when we receive UNCHOKE
-		ts.storePendingRequests(fromid, rarestPieces)
+	var msg p2p.Message = &p2p.NotInterested{}
+	label := "NOT INTERESTED"
+	if wanted {
+		msg, label = &p2p.Interested{}, "INTERESTED"
 	}
+	if err := peer.Send(msg); err != nil {
+		fmt.Printf("failed to send %s to %x: %v\n", label, peerID, err)
+		return
+	}
+	ts.swarm.SetAmInterested(peerID, wanted)
+	fmt.Printf("[SENT %s] to [Peer -> ID %x]\n", label, peerID)
 }
 
-func (ts *TorrentServer) requestPiece(pieceIndex int) error {
-	idxBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(idxBytes, uint32(pieceIndex))
-	payload := append([]byte{p2p.MsgRequestPiece}, idxBytes...)
-	for _, peer := range ts.swarm.Peers() {
-		if err := peer.Send(payload); err != nil {
-			fmt.Printf("failed to request piece from %s: %v\n", peer.ID(), err)
+// canDownload is false when piece sizes are unknown, e.g. when joining a
+// swarm by info hash alone, since blocks cannot be requested then.
+func (ts *TorrentServer) canDownload() bool {
+	return ts.swarm.PieceSize(0) > 0
+}
+
+// requestBlocks tops up the peer's queue of outstanding block requests if
+// it is not choking us.
+func (ts *TorrentServer) requestBlocks(peerID [20]byte) {
+	if !ts.canDownload() || ts.swarm.IsPeerChoking(peerID) {
+		return
+	}
+
+	peer, exists := ts.swarm.GetPeer(peerID)
+	if !exists {
+		return
+	}
+
+	for _, req := range ts.downloader.nextRequests(peerID) {
+		if err := ts.sendRequest(peer, req); err != nil {
+			fmt.Printf("failed to request block %d:%d from %x: %v\n", req.Index, req.Begin, peerID, err)
+			ts.downloader.releasePeer(peerID)
+			return
 		}
 	}
-	return nil
 }
 
-func (ts *TorrentServer) requestPieceFromPeer(peer p2p.Peer, pieceIndex int) error {
-	idxBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(idxBytes, uint32(pieceIndex))
-	payload := append([]byte{p2p.MsgRequestPiece}, idxBytes...)
-	return peer.Send(payload)
+func (ts *TorrentServer) sendRequest(peer p2p.Peer, req p2p.BlockRequest) error {
+	return peer.Send(&p2p.Request{BlockRequest: req})
+}
+
+func (ts *TorrentServer) sendCancel(peer p2p.Peer, req p2p.BlockRequest) error {
+	return peer.Send(&p2p.Cancel{BlockRequest: req})
 }
 
-func (ts *TorrentServer) handlePieceRequest(msg p2p.RPC, pieceIdx int) {
+func (ts *TorrentServer) handleRequest(msg p2p.RPC, req p2p.BlockRequest) {
 	fromaddr, fromid := msg.From.Addr, msg.From.PeerID
-	fmt.Printf("[REQUEST PIECE] from [Peer -> ID %x ; Addr %s], piece index: %d\n", fromid, fromaddr, pieceIdx)
+	fmt.Printf("[REQUEST] from [Peer -> ID %x ; Addr %s], piece %d, begin %d, length %d\n", fromid, fromaddr, req.Index, req.Begin, req.Length)
 
 	if ts.swarm.IsChoking(fromid) {
-		fmt.Printf("[REJECTED] peer %x is choked, ignoring request for piece %d\n", fromid, pieceIdx)
+		fmt.Printf("[REJECTED] peer %x is choked, ignoring request for piece %d\n", fromid, req.Index)
+		return
+	}
+	if req.Length <= 0 || req.Length > p2p.MaxBlockLength {
+		fmt.Printf("[REJECTED] peer %x requested %d bytes, limit is %d\n", fromid, req.Length, p2p.MaxBlockLength)
 		return
 	}
 
-	data, ok := ts.swarm.GetPiece(pieceIdx)
-	if !ok {
-		fmt.Printf("piece %d not found to send to %x\n", pieceIdx, fromid)
+	piece, err := ts.swarm.BlockMessage(req)
+	if err != nil {
+		fmt.Printf("cannot serve piece %d:%d to %x: %v\n", req.Index, req.Begin, fromid, err)
 		return
 	}
 
-	idxBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(idxBytes, uint32(pieceIdx))
-	payload := append([]byte{p2p.MsgSendPiece}, idxBytes...)
-	payload = append(payload, data...)
 	peer, exists := ts.swarm.GetPeer(fromid)
 	if !exists {
-		fmt.Printf("peer %x not found to send piece %d\n", fromid, pieceIdx)
+		fmt.Printf("peer %x not found to send piece %d\n", fromid, req.Index)
 		return
 	}
-	if err := peer.Send(payload); err != nil {
-		fmt.Printf("failed to send piece %d to %x: %v\n", pieceIdx, fromid, err)
+
+	if err := peer.Send(piece); errors.Is(err, p2p.ErrDuplicateBlock) {
+		fmt.Printf("[DUPLICATE REQUEST] piece %d, begin %d from [Peer -> ID %x ; Addr %s] already queued\n", req.Index, req.Begin, fromid, fromaddr)
+		return
+	} else if err != nil {
+		fmt.Printf("failed to send piece %d:%d to %x: %v\n", req.Index, req.Begin, fromid, err)
 		return
 	}
-	ts.swarm.RecordUpload(fromid, int64(len(data)))
-	fmt.Printf("[SENT PIECE] piece index %d to [Peer -> ID %x ; Addr %s]\n", pieceIdx, fromid, fromaddr)
+	ts.swarm.RecordUpload(fromid, int64(req.Length))
+	fmt.Printf("[SENT BLOCK] piece %d, begin %d, length %d to [Peer -> ID %x ; Addr %s]\n", req.Index, req.Begin, req.Length, fromid, fromaddr)
 }
 
-/* func (ts *TorrentServer) sendPiece(pieceIndex int, peerID [20]byte) error {
-	data, ok := ts.swarm.GetPiece(pieceIndex)
-	if !ok {
-		return fmt.Errorf("piece %d not found", pieceIndex)
-	}
-
-	// Encode piece index as 4 bytes
-	idxBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(idxBytes, uint32(pieceIndex))
-
-	payload := append([]byte{p2p.MsgSendPiece}, idxBytes...)
-	payload = append(payload, data...)
+// handleCancel withdraws a block we queued for the peer but have not sent
+// yet. Blocks already on the wire cannot be recalled.
+func (ts *TorrentServer) handleCancel(msg p2p.RPC, req p2p.BlockRequest) {
+	fromaddr, fromid := msg.From.Addr, msg.From.PeerID
 
-	peer, exists := ts.swarm.GetPeer(peerID)
+	peer, exists := ts.swarm.GetPeer(fromid)
 	if !exists {
-		return fmt.Errorf("peer %x not found", peerID)
+		return
 	}
-
-	if err := peer.Send(payload); err != nil {
-		return fmt.Errorf("failed to send piece to %x: %v", peerID, err)
+	if peer.CancelBlock(req) {
+		// it was counted as uploaded when it was queued
+		ts.swarm.RecordUpload(fromid, -int64(req.Length))
+		fmt.Printf("[CANCEL] from [Peer -> ID %x ; Addr %s], dropped piece %d, begin %d\n", fromid, fromaddr, req.Index, req.Begin)
+	} else {
+		fmt.Printf("[CANCEL] from [Peer -> ID %x ; Addr %s], piece %d, begin %d already sent\n", fromid, fromaddr, req.Index, req.Begin)
 	}
-
-	fmt.Printf("[SENT PIECE] piece index %d to [Peer -> ID %x]\n", pieceIndex, peerID)
-	return nil
-} */
+}
 
 func (ts *TorrentServer) ReconstructData() []byte {
 	numPieces := ts.swarm.NumPieces()
@@ -127,24 +147,54 @@ func (ts *TorrentServer) ReconstructData() []byte {
 	return data
 }
 
-func (ts *TorrentServer) handlePiece(msg p2p.RPC, data []byte) {
-	if len(data) < 4 {
-		fmt.Printf("[ERROR] piece data too short: %d bytes\n", len(data))
-		return
+// handleBlock files a received block and, once its piece is complete,
+// verifies and stores the piece.
+func (ts *TorrentServer) handleBlock(msg p2p.RPC, piece *p2p.Piece) {
+	fromid := msg.From.PeerID
+
+	ts.swarm.RecordDownload(fromid, int64(len(piece.Block)))
+	pb, others := ts.downloader.received(fromid, piece.Index, piece.Begin, piece.Block)
+	ts.cancelDuplicates(p2p.BlockRequest{Index: piece.Index, Begin: piece.Begin, Length: len(piece.Block)}, others)
+	if pb != nil {
+		ts.completePiece(fromid, pb)
 	}
-	index := int(binary.BigEndian.Uint32(data[:4]))
-	pieceData := data[4:]
 
-	if !ts.swarm.VerifyPiece(index, pieceData) {
-		fmt.Printf("[REJECTED] piece %d failed hash verification from %x\n", index, msg.From.PeerID)
+	// keep the pipeline full
+	ts.requestBlocks(fromid)
+}
+
+// cancelDuplicates tells the other peers asked for an endgame block that
+// it is no longer needed.
+func (ts *TorrentServer) cancelDuplicates(req p2p.BlockRequest, peerIDs [][20]byte) {
+	for _, id := range peerIDs {
+		peer, exists := ts.swarm.GetPeer(id)
+		if !exists {
+			continue
+		}
+		if err := ts.sendCancel(peer, req); err != nil {
+			fmt.Printf("failed to cancel block %d:%d with %x: %v\n", req.Index, req.Begin, id, err)
+			continue
+		}
+		fmt.Printf("[SENT CANCEL] piece %d, begin %d to [Peer -> ID %x]\n", req.Index, req.Begin, id)
+	}
+}
+
+func (ts *TorrentServer) completePiece(from [20]byte, pb *pieceBuffer) {
+	index := pb.index
+	// whether it verifies or not, what is worth asking for has changed
+	defer ts.redistributeRequests()
+
+	if !ts.swarm.VerifyPiece(index, pb.data) {
+		fmt.Printf("[REJECTED] piece %d failed hash verification, last block from %x\n", index, from)
 		return
 	}
 
-	ts.swarm.RecordDownload(msg.From.PeerID, int64(len(pieceData)))
-	fmt.Printf("[RECEIVED PIECE] piece index %d with data %x from %x\n", index, pieceData, msg.From.PeerID)
-	ts.swarm.AddPiece(index, pieceData)
-	pieceIndex := index
-	ts.announceHave(pieceIndex)
+	if err := ts.swarm.AddPiece(index, pb.data); err != nil {
+		fmt.Printf("[ERROR] failed to store piece %d: %v\n", index, err)
+		return
+	}
+	fmt.Printf("[RECEIVED PIECE] piece index %d (%d bytes), last block from %x\n", index, len(pb.data), from)
+	ts.announceHave(index)
 
 	go func() {
 		if err := ts.UpdateTrackerStats(); err != nil {
@@ -152,48 +202,51 @@ func (ts *TorrentServer) handlePiece(msg p2p.RPC, data []byte) {
 		}
 	}()
 
-	if ts.swarm.AllPiecesReceived() {
-		fmt.Println("All pieces received!")
-		fullData := ts.ReconstructData()
-		if fullData != nil {
+	ts.checkComplete()
 
-			if err := os.MkdirAll(ts.RootDir, os.ModePerm); err != nil {
-				fmt.Printf("Failed to create directory %s: %v\n", ts.RootDir, err)
-				return
-			}
+	// peers that only had this piece are no longer interesting
+	for _, peer := range ts.swarm.Peers() {
+		ts.updateInterest(peer.ID())
+	}
+}
 
-			filePath := filepath.Join(ts.RootDir, fmt.Sprintf("%x.%s", ts.TCPTransportOpts.InfoHash, ts.FileFormat))
+// checkComplete finishes the download once every wanted piece is in. The
+// tracker only hears "completed" when nothing was skipped.
+func (ts *TorrentServer) checkComplete() {
+	if ts.completed || ts.swarm.Picker().WantedMissing() > 0 {
+		return
+	}
+	ts.completed = true
 
-			if err := os.WriteFile(filePath, fullData, 0644); err != nil {
-				fmt.Printf("Failed to write file %s: %v\n", filePath, err)
-				return
-			}
+	if !ts.swarm.AllPiecesReceived() {
+		if err := ts.swarm.PieceManager().Storage().Sync(); err != nil {
+			fmt.Printf("Failed to store data: %v\n", err)
+			return
+		}
+		fmt.Printf("All wanted pieces received (%d skipped)\n", ts.swarm.MissingPiecesCount())
+		return
+	}
 
-			fmt.Printf("Data successfully stored at %s\n", filePath)
+	fmt.Println("All pieces received!")
 
-			go func() {
-				if err := ts.AnnounceToTracker("completed"); err != nil {
-					fmt.Printf("Failed to announce completion to tracker: %v\n", err)
-				}
-			}()
-		}
-	} else {
-		bitfield := ts.swarm.Bitfield()
-		payload := append([]byte{p2p.MsgBitfield}, bitfield...)
-		for _, peer := range ts.swarm.Peers() {
-			if err := peer.Send(payload); err != nil {
-				fmt.Printf("failed to send bitfield to %s: %v\n", peer.ID(), err)
-			}
-		}
+	filePath, err := ts.storeCompleted()
+	if err != nil {
+		fmt.Printf("Failed to store data: %v\n", err)
+		return
 	}
+	fmt.Printf("Data successfully stored at %s\n", filePath)
+
+	go func() {
+		if err := ts.AnnounceToTracker("completed"); err != nil {
+			fmt.Printf("Failed to announce completion to tracker: %v\n", err)
+		}
+	}()
 }
 
 func (ts *TorrentServer) announceHave(pieceIndex int) error {
-	idxBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(idxBytes, uint32(pieceIndex))
-	payload := append([]byte{p2p.MsgHave}, idxBytes...)
+	have := &p2p.Have{Index: pieceIndex}
 	for _, peer := range ts.swarm.Peers() {
-		if err := peer.Send(payload); err != nil {
+		if err := peer.Send(have); err != nil {
 			fmt.Printf("failed to announce have to %s: %v\n", peer.ID(), err)
 		}
 	}
@@ -201,33 +254,39 @@ func (ts *TorrentServer) announceHave(pieceIndex int) error {
 	return nil
 }
 
-func (ts *TorrentServer) storePendingRequests(peerID [20]byte, pieces []int) {
-	ts.pendingMu.Lock()
-	defer ts.pendingMu.Unlock()
-	ts.pendingRequests[peerID] = pieces
-}
-
-func (ts *TorrentServer) sendPendingRequests(peerID [20]byte) {
-	ts.pendingMu.Lock()
-	pieces, exists := ts.pendingRequests[peerID]
-	if exists {
-		delete(ts.pendingRequests, peerID)
+// onPeerClose runs on the connection's goroutine; the loop does the
+// bookkeeping.
+func (ts *TorrentServer) onPeerClose(p p2p.Peer) {
+	select {
+	case ts.peerClosed <- p.ID():
+	case <-ts.quitch:
 	}
-	ts.pendingMu.Unlock()
+}
 
-	if !exists || len(pieces) == 0 {
-		return
-	}
+func (ts *TorrentServer) handlePeerClosed(peerID [20]byte) {
+	ts.downloader.removePeer(peerID)
+	ts.extensions.removePeer(peerID)
+	ts.metadata.removePeer(peerID)
+	ts.pex.removePeer(peerID)
+	ts.connector.removePeer(peerID)
+	ts.swarm.RemovePeer(peerID)
+	ts.redistributeRequests()
+}
 
-	peer, exists := ts.swarm.GetPeer(peerID)
-	if !exists {
-		return
+// checkRequestTimeouts re-dispatches blocks and metadata pieces whose
+// requests went unanswered for too long.
+func (ts *TorrentServer) checkRequestTimeouts() {
+	if ts.downloader.expireRequests(time.Now()) {
+		ts.redistributeRequests()
 	}
+	ts.metadata.requestPieces()
+}
 
-	for _, pieceIdx := range pieces {
-		if err := ts.requestPieceFromPeer(peer, pieceIdx); err != nil {
-			fmt.Printf("failed to request piece %d from %x: %v\n", pieceIdx, peerID, err)
-		}
+// redistributeRequests hands blocks released by one peer to whoever else
+// has room in their queue.
+func (ts *TorrentServer) redistributeRequests() {
+	for _, peer := range ts.swarm.Peers() {
+		ts.requestBlocks(peer.ID())
 	}
 }
 
@@ -236,9 +295,7 @@ func (ts *TorrentServer) AnnounceToTracker(event string) error {
 		return fmt.Errorf("tracker client not initialized")
 	}
 
-	left := int64(ts.swarm.MissingPiecesCount())
-
-	resp, err := ts.trackerClient.Announce(ts.TrackerUrl, ts.TCPTransportOpts.InfoHash, left, event)
+	resp, err := ts.announce(ts.left(), event)
 	if err != nil {
 		return fmt.Errorf("failed to announce to tracker: %v", err)
 	}
@@ -249,12 +306,59 @@ func (ts *TorrentServer) AnnounceToTracker(event string) error {
 	return nil
 }
 
+// left is how many bytes we still need, as trackers expect it. Without
+// metadata the amount is unknown but we are certainly not a seed.
+func (ts *TorrentServer) left() int64 {
+	if ts.metadata.fetching() {
+		return 1
+	}
+	return ts.swarm.PieceManager().BytesLeft()
+}
+
+// announce tries each tracker in order and sticks with the first one that
+// answers, so later announces go straight to a tracker known to work.
+func (ts *TorrentServer) announce(left int64, event string) (*client.AnnounceResponse, error) {
+	ts.trackerMu.Lock()
+	trackers := append([]string{ts.TrackerUrl}, ts.TrackerUrls...)
+	ts.trackerMu.Unlock()
+
+	var lastErr error
+	tried := make(map[string]bool)
+	for _, url := range trackers {
+		if url == "" || tried[url] {
+			continue
+		}
+		tried[url] = true
+
+		resp, err := ts.trackerClient.Announce(url, ts.TCPTransportOpts.InfoHash, left, event)
+		if err != nil {
+			fmt.Printf("[TRACKER] %s failed: %v\n", url, err)
+			lastErr = err
+			continue
+		}
+
+		ts.trackerMu.Lock()
+		ts.TrackerUrl = url
+		ts.trackerMu.Unlock()
+		return resp, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no trackers configured")
+	}
+	return nil, lastErr
+}
+
 func (ts *TorrentServer) ScrapeTracker() error {
 	if ts.trackerClient == nil {
 		return fmt.Errorf("tracker client not initialized")
 	}
 
-	resp, err := ts.trackerClient.Scrape(ts.TrackerUrl, ts.TCPTransportOpts.InfoHash)
+	ts.trackerMu.Lock()
+	trackerUrl := ts.TrackerUrl
+	ts.trackerMu.Unlock()
+
+	resp, err := ts.trackerClient.Scrape(trackerUrl, ts.TCPTransportOpts.InfoHash)
 	if err != nil {
 		return fmt.Errorf("failed to scrape tracker: %v", err)
 	}
@@ -270,14 +374,7 @@ func (ts *TorrentServer) UpdateTrackerStats() error {
 		return fmt.Errorf("tracker client not initialized")
 	}
 
-	uploaded := int64(len(ts.swarm.Peers()) * 1024)
-	downloaded := int64(0)
-
-	for i := 0; i < ts.swarm.NumPieces(); i++ {
-		if _, ok := ts.swarm.GetPiece(i); ok {
-			downloaded += 1024
-		}
-	}
+	uploaded, downloaded := ts.swarm.Stats()
 
 	ts.trackerClient.UpdateStats(uploaded, downloaded)
 	return ts.AnnounceToTracker("")
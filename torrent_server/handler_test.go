@@ -0,0 +1,38 @@
+package torrentserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+func TestHandleRequest_DuplicateCountedOnce(t *testing.T) {
+	ts, _ := newReaderServer(t, 0)
+
+	// nobody reads the other end, so the writer stalls on the bitfield and
+	// the blocks stay queued
+	conn, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+	peer := p2p.NewTCPPeer(conn, false)
+	peer.SetID([20]byte{2})
+	t.Cleanup(func() { peer.Close() })
+	if err := ts.swarm.AddPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	ts.swarm.SetPeerInterested(peer.ID(), true)
+	ts.swarm.RunUnchokeAlgorithm()
+
+	msg := p2p.RPC{From: p2p.From{PeerID: peer.ID(), Addr: "test"}}
+	req := p2p.BlockRequest{Index: 0, Begin: 0, Length: 50}
+	ts.handleRequest(msg, req)
+	ts.handleRequest(msg, req)
+	if uploaded, _ := ts.swarm.Stats(); uploaded != 50 {
+		t.Errorf("uploaded = %d after a repeated request, want 50", uploaded)
+	}
+
+	ts.handleCancel(msg, req)
+	if uploaded, _ := ts.swarm.Stats(); uploaded != 0 {
+		t.Errorf("uploaded = %d after the cancel, want 0", uploaded)
+	}
+}
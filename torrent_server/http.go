@@ -0,0 +1,125 @@
+package torrentserver
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pixperk/pixtorrent/meta"
+)
+
+// ServeHTTP exposes the torrent's files at /<infohash>/<path>, where path
+// is the file's path inside the torrent (its name for a single file).
+// Files are read through a Reader, so bytes can be fetched while they
+// download: a request for data that is not there yet waits for it, and
+// Range requests let players seek. Each request has its own Reader, and
+// so its own read head. /<infohash>/ lists the files.
+func (ts *TorrentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := fmt.Sprintf("/%x/", ts.TCPTransportOpts.InfoHash)
+	torrent := ts.Metadata()
+	if torrent == nil || !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if name == "" {
+		serveIndex(w, torrent, prefix)
+		return
+	}
+
+	file := -1
+	for i, p := range filePaths(torrent) {
+		if p == name {
+			file = i
+			break
+		}
+	}
+	if file < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	reader, err := ts.NewFileReader(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	// a client going away must not leave a read blocked on a piece
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			reader.Close()
+		case <-done:
+		}
+	}()
+
+	// with a type set ServeContent does not sniff one from the first bytes,
+	// which would wait for piece 0 whatever range was asked for
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	fmt.Printf("[HTTP] %s %s range %q from %s\n", r.Method, r.URL.Path, r.Header.Get("Range"), r.RemoteAddr)
+	http.ServeContent(w, r, path.Base(name), time.Time{}, reader)
+}
+
+// filePaths lists the torrent's files as they appear in URLs.
+func filePaths(torrent *meta.Torrent) []string {
+	info := torrent.Info
+	if len(info.Files) == 0 {
+		return []string{info.Name}
+	}
+	paths := make([]string, len(info.Files))
+	for i, f := range info.Files {
+		paths[i] = strings.Join(f.Path, "/")
+	}
+	return paths
+}
+
+// FileURLs returns the address of every file under base, e.g.
+// http://127.0.0.1:8090.
+func (ts *TorrentServer) FileURLs(base string) []string {
+	torrent := ts.Metadata()
+	if torrent == nil {
+		return nil
+	}
+	var urls []string
+	for _, p := range filePaths(torrent) {
+		urls = append(urls, fmt.Sprintf("%s/%x/%s", base, ts.TCPTransportOpts.InfoHash, escapePath(p)))
+	}
+	return urls
+}
+
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func serveIndex(w http.ResponseWriter, torrent *meta.Torrent, prefix string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!doctype html>\n<title>%s</title>\n<ul>\n", html.EscapeString(torrent.Info.Name))
+	for _, p := range filePaths(torrent) {
+		fmt.Fprintf(w, "<li><a href=\"%s%s\">%s</a></li>\n", prefix, escapePath(p), html.EscapeString(p))
+	}
+	fmt.Fprintln(w, "</ul>")
+}
@@ -0,0 +1,176 @@
+package torrentserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+// newHTTPServer shares a folder holding notes.txt (100 bytes) and
+// video.qqq (40000 bytes) in three pieces, of which the ones listed are
+// in. It returns the server, the URL prefix of the files and the video.
+func newHTTPServer(t *testing.T, have ...int) (*httptest.Server, string, []byte) {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "content")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	notes := bytes.Repeat([]byte("notes\n"), 17)[:100]
+	video := make([]byte, 40000)
+	for i := range video {
+		video[i] = byte(i * 7)
+	}
+	for name, data := range map[string][]byte{"notes.txt": notes, "video.qqq": video} {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	torrent, err := meta.CreateTorrent(root, meta.CreateOptions{PieceLength: meta.MinPieceLength, Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &torrent.Info
+	store, err := storage.New(root, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := p2p.NewPieceManagerWithStorage(info.NumPieces(), info.Pieces, store)
+	pm.SetLayout(info.PieceLength, info.TotalLength())
+	for _, idx := range have {
+		pm.MarkPiece(idx)
+	}
+	hash, err := torrent.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := NewTorrentServer(TorrentServerOpts{
+		Torrent:          torrent,
+		TCPTransportOpts: p2p.TCPTransportOpts{InfoHash: hash},
+	}, pm)
+	srv := httptest.NewServer(ts)
+	t.Cleanup(srv.Close)
+	return srv, fmt.Sprintf("%s/%x/", srv.URL, hash), video
+}
+
+func get(t *testing.T, method, url, rangeHeader string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestHTTP_ServesFilesAndRanges(t *testing.T) {
+	_, prefix, video := newHTTPServer(t, 0, 1, 2)
+
+	resp, body := get(t, http.MethodGet, prefix+"notes.txt", "")
+	if resp.StatusCode != http.StatusOK || len(body) != 100 || !strings.HasPrefix(string(body), "notes\n") {
+		t.Errorf("GET notes.txt = %s, %q", resp.Status, body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("notes.txt Content-Type = %q", got)
+	}
+
+	resp, body = get(t, http.MethodGet, prefix+"video.qqq", "bytes=16000-16999")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, video[16000:17000]) {
+		t.Errorf("range across pieces = %s, %d bytes", resp.Status, len(body))
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 16000-16999/40000" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type of an unknown extension = %q", got)
+	}
+
+	resp, body = get(t, http.MethodGet, prefix+"video.qqq", "bytes=-10")
+	if !bytes.Equal(body, video[len(video)-10:]) {
+		t.Errorf("suffix range = %s, %v", resp.Status, body)
+	}
+
+	resp, body = get(t, http.MethodHead, prefix+"video.qqq", "")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 40000 || len(body) != 0 {
+		t.Errorf("HEAD = %s, length %d, %d bytes of body", resp.Status, resp.ContentLength, len(body))
+	}
+}
+
+func TestHTTP_RangeDoesNotWaitForFirstPiece(t *testing.T) {
+	// piece 0 is missing; a seek into the video must not sniff the file's
+	// start for a content type
+	_, prefix, video := newHTTPServer(t, 1, 2)
+
+	resp, body := get(t, http.MethodGet, prefix+"video.qqq", "bytes=30000-30099")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, video[30000:30100]) {
+		t.Errorf("range = %s, %d bytes", resp.Status, len(body))
+	}
+}
+
+func TestHTTP_ConcurrentRanges(t *testing.T) {
+	_, prefix, video := newHTTPServer(t, 0, 1, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		begin := i * 4900
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, prefix+"video.qqq", nil)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", begin, begin+999))
+			resp, err := (&http.Client{Timeout: 2 * time.Second}).Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if body, err := io.ReadAll(resp.Body); err != nil || !bytes.Equal(body, video[begin:begin+1000]) {
+				t.Errorf("range at %d: %d bytes, %v", begin, len(body), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHTTP_IndexAndErrors(t *testing.T) {
+	srv, prefix, _ := newHTTPServer(t, 0, 1, 2)
+
+	resp, body := get(t, http.MethodGet, prefix, "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "notes.txt") || !strings.Contains(string(body), "video.qqq") {
+		t.Errorf("index = %s, %q", resp.Status, body)
+	}
+
+	for _, url := range []string{prefix + "missing.txt", srv.URL + "/0000/notes.txt", srv.URL + "/"} {
+		if resp, _ := get(t, http.MethodGet, url, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %s, want 404", url, resp.Status)
+		}
+	}
+	if resp, _ := get(t, http.MethodPost, prefix+"notes.txt", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %s, want 405", resp.Status)
+	}
+}
@@ -0,0 +1,39 @@
+package torrentserver
+
+import "fmt"
+
+// lsdLoop announces the torrent on the LAN and dials the peers announcing
+// it there until the server stops, or until a torrent fetched by magnet
+// link turns out to be private.
+func (ts *TorrentServer) lsdLoop() {
+	infoHash := ts.TCPTransportOpts.InfoHash
+	peers := ts.LSD.Add(infoHash, ts.Transport.Port())
+	defer ts.LSD.Remove(infoHash)
+
+	fetched := ts.MetadataReady()
+	for {
+		select {
+		case <-fetched:
+			if ts.private() {
+				fmt.Printf("[LSD] torrent is private, no longer announcing it\n")
+				return
+			}
+			fetched = nil
+		case addr, ok := <-peers:
+			if !ok {
+				return
+			}
+			if ts.connectPeers([]string{addr}, "lsd") > 0 {
+				fmt.Printf("[LSD] found peer %s\n", addr)
+			}
+		case <-ts.quitch:
+			return
+		}
+	}
+}
+
+// useLSD reports whether the torrent is announced on the LAN: a service
+// was given and the torrent is not private, as BEP 27 forbids it.
+func (ts *TorrentServer) useLSD() bool {
+	return ts.LSD != nil && !ts.private()
+}
@@ -0,0 +1,54 @@
+package torrentserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pixperk/pixtorrent/lsd"
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+func TestLSD_OffForPrivateTorrent(t *testing.T) {
+	local := lsd.New(lsd.Config{})
+	for _, private := range []int64{0, 1} {
+		ts := NewTorrentServer(TorrentServerOpts{Torrent: testTorrent(t, private), LSD: local}, p2p.NewPieceManager(1))
+		if got := ts.useLSD(); got != (private == 0) {
+			t.Errorf("private=%d: useLSD = %v", private, got)
+		}
+	}
+}
+
+func TestLSD_StopsOnceFetchedTorrentIsPrivate(t *testing.T) {
+	local := lsd.New(lsd.Config{})
+	t.Cleanup(func() { local.Close() })
+	ts := NewTorrentServer(TorrentServerOpts{
+		FetchMetadata:    true,
+		LSD:              local,
+		TCPTransportOpts: p2p.TCPTransportOpts{ListenAddr: "127.0.0.1:0"},
+	}, p2p.NewPieceManager(1))
+	if err := ts.Transport.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.Transport.Close() })
+	if !ts.useLSD() {
+		t.Fatal("LSD off while the torrent is not known yet")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ts.lsdLoop()
+		close(done)
+	}()
+
+	ts.metadata.mu.Lock()
+	ts.metadata.torrent = testTorrent(t, 1)
+	close(ts.metadata.done)
+	ts.metadata.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		close(ts.quitch)
+		t.Fatal("lsdLoop kept announcing a private torrent")
+	}
+}
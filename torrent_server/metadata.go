@@ -0,0 +1,399 @@
+package torrentserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+const (
+	metadataExtension = "ut_metadata"
+
+	// metadataPieceSize is the size of every metadata piece but the last.
+	metadataPieceSize = 16 * 1024
+
+	// maxMetadataSize bounds the info dict we agree to fetch.
+	maxMetadataSize = p2p.MaxMessageLength
+
+	// metadataRequestTimeout is how long a metadata request may go
+	// unanswered before the piece is asked of another peer.
+	metadataRequestTimeout = 10 * time.Second
+)
+
+// ut_metadata message types.
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataMessage is the bencoded header of a ut_metadata message. A data
+// message carries the piece's bytes right after it.
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// metadataExchange is the ut_metadata extension (BEP 9). It serves the
+// info dict of the torrent being shared and, on a server joining by
+// magnet link, fetches the info dict from peers, checking it against the
+// info hash. Except for ExtendHandshake and the accessors, it runs on the
+// server loop.
+type metadataExchange struct {
+	ts *TorrentServer
+
+	mu      sync.Mutex
+	info    []byte        // the bencoded info dict, nil until known
+	torrent *meta.Torrent // built from info once fetched
+	done    chan struct{} // closed once fetched; nil when not fetching
+
+	size      int         // length being fetched, 0 until a peer tells
+	pieces    [][]byte    // pieces received so far
+	from      [][20]byte  // who sent each piece
+	requested []time.Time // when each missing piece was last asked for
+	sizes     map[[20]byte]int
+	refused   map[[20]byte]bool // peers that rejected us or sent bad pieces
+	next      int               // round robin over the peers that can serve
+}
+
+func newMetadataExchange(ts *TorrentServer) *metadataExchange {
+	m := &metadataExchange{
+		ts:      ts,
+		sizes:   make(map[[20]byte]int),
+		refused: make(map[[20]byte]bool),
+	}
+	if ts.Torrent != nil {
+		if info, err := ts.Torrent.RawInfo(); err == nil {
+			m.info = info
+		}
+	}
+	if ts.FetchMetadata && m.info == nil {
+		m.done = make(chan struct{})
+	}
+	return m
+}
+
+func (m *metadataExchange) Name() string { return metadataExtension }
+
+func (m *metadataExchange) ExtendHandshake(hs *p2p.ExtendedHandshake) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.info != nil {
+		hs.MetadataSize = len(m.info)
+	}
+}
+
+// fetching reports whether the info dict is still wanted.
+func (m *metadataExchange) fetching() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done != nil && m.info == nil
+}
+
+func (m *metadataExchange) PeerHandshake(peer p2p.Peer, hs *p2p.ExtendedHandshake) {
+	if !m.fetching() {
+		return
+	}
+	if _, ok := hs.M[metadataExtension]; !ok || hs.MetadataSize <= 0 {
+		return
+	}
+	if hs.MetadataSize > maxMetadataSize {
+		fmt.Printf("[METADATA] peer %x announced %d bytes of metadata, ignoring\n", peer.ID(), hs.MetadataSize)
+		return
+	}
+
+	m.sizes[peer.ID()] = hs.MetadataSize
+	m.requestPieces()
+}
+
+// pickSize settles on the length to fetch. The one being fetched is kept
+// while a peer we trust still announces it; otherwise the length announced
+// by the most trusted peers is fetched from scratch, so a peer lying about
+// the size cannot hold up the others.
+func (m *metadataExchange) pickSize() {
+	votes := make(map[int]int)
+	best := 0
+	for id, size := range m.sizes {
+		if m.refused[id] {
+			continue
+		}
+		votes[size]++
+		if n := votes[size]; n > votes[best] || (n == votes[best] && size < best) {
+			best = size
+		}
+	}
+	if best == 0 || votes[m.size] > 0 {
+		return
+	}
+	m.reset(best)
+	fmt.Printf("[METADATA] fetching %d bytes of metadata in %d pieces\n", m.size, len(m.pieces))
+}
+
+// reset starts fetching size bytes from scratch.
+func (m *metadataExchange) reset(size int) {
+	n := (size + metadataPieceSize - 1) / metadataPieceSize
+	m.size = size
+	m.pieces = make([][]byte, n)
+	m.from = make([][20]byte, n)
+	m.requested = make([]time.Time, n)
+}
+
+// servingPeers returns the peers that announced the size being fetched
+// and have not refused us.
+func (m *metadataExchange) servingPeers() []p2p.Peer {
+	var peers []p2p.Peer
+	for _, peer := range m.ts.swarm.Peers() {
+		id := peer.ID()
+		if m.sizes[id] == m.size && !m.refused[id] {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// requestPieces asks for every missing piece not already requested
+// recently, spreading the requests over the peers that can serve them.
+func (m *metadataExchange) requestPieces() {
+	if !m.fetching() {
+		return
+	}
+	m.pickSize()
+	if m.size == 0 {
+		return
+	}
+	peers := m.servingPeers()
+	if len(peers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for i := range m.pieces {
+		if m.pieces[i] != nil || now.Sub(m.requested[i]) < metadataRequestTimeout {
+			continue
+		}
+		peer := peers[m.next%len(peers)]
+		m.next++
+
+		payload, err := meta.Marshal(&metadataMessage{MsgType: metadataRequest, Piece: i})
+		if err != nil {
+			return
+		}
+		if err := m.ts.SendExtended(peer, metadataExtension, payload); err != nil {
+			fmt.Printf("failed to request metadata piece %d from %x: %v\n", i, peer.ID(), err)
+			continue
+		}
+		m.requested[i] = now
+	}
+}
+
+func (m *metadataExchange) HandleMessage(peer p2p.Peer, payload []byte) {
+	var msg metadataMessage
+	n, err := meta.UnmarshalPrefix(payload, &msg, p2p.BencodeLimits)
+	if err != nil {
+		fmt.Printf("[METADATA] bad message from %x: %v\n", peer.ID(), err)
+		return
+	}
+
+	switch msg.MsgType {
+	case metadataRequest:
+		m.serve(peer, msg.Piece)
+	case metadataData:
+		m.receive(peer, msg, payload[n:])
+	case metadataReject:
+		fmt.Printf("[METADATA] peer %x rejected our request for piece %d\n", peer.ID(), msg.Piece)
+		if !m.fetching() {
+			return
+		}
+		m.refused[peer.ID()] = true
+		if msg.Piece >= 0 && msg.Piece < len(m.requested) {
+			m.requested[msg.Piece] = time.Time{}
+		}
+		m.requestPieces()
+	default:
+		// unknown types are ignored, as BEP 9 asks
+	}
+}
+
+// serve answers a request with the piece, or with a reject when we do not
+// have the info dict.
+func (m *metadataExchange) serve(peer p2p.Peer, piece int) {
+	m.mu.Lock()
+	info := m.info
+	m.mu.Unlock()
+
+	begin := piece * metadataPieceSize
+	if info == nil || piece < 0 || begin >= len(info) {
+		payload, err := meta.Marshal(&metadataMessage{MsgType: metadataReject, Piece: piece})
+		if err == nil {
+			err = m.ts.SendExtended(peer, metadataExtension, payload)
+		}
+		if err != nil {
+			fmt.Printf("failed to reject metadata request from %x: %v\n", peer.ID(), err)
+		}
+		return
+	}
+
+	end := min(begin+metadataPieceSize, len(info))
+	head, err := meta.Marshal(&metadataMessage{MsgType: metadataData, Piece: piece, TotalSize: len(info)})
+	if err != nil {
+		return
+	}
+	if err := m.ts.SendExtended(peer, metadataExtension, append(head, info[begin:end]...)); err != nil {
+		fmt.Printf("failed to send metadata piece %d to %x: %v\n", piece, peer.ID(), err)
+		return
+	}
+	fmt.Printf("[METADATA] sent piece %d to %x\n", piece, peer.ID())
+}
+
+// receive stores a piece and, once all are in, checks the info dict
+// against the info hash.
+func (m *metadataExchange) receive(peer p2p.Peer, msg metadataMessage, data []byte) {
+	if !m.fetching() || m.size == 0 || msg.Piece < 0 || msg.Piece >= len(m.pieces) || m.pieces[msg.Piece] != nil {
+		return
+	}
+	want := min(metadataPieceSize, m.size-msg.Piece*metadataPieceSize)
+	if len(data) != want || (msg.TotalSize != 0 && msg.TotalSize != m.size) {
+		fmt.Printf("[METADATA] piece %d from %x has %d bytes, want %d\n", msg.Piece, peer.ID(), len(data), want)
+		m.refused[peer.ID()] = true
+		m.requested[msg.Piece] = time.Time{}
+		m.requestPieces()
+		return
+	}
+
+	m.pieces[msg.Piece] = bytes.Clone(data)
+	m.from[msg.Piece] = peer.ID()
+	for _, p := range m.pieces {
+		if p == nil {
+			return
+		}
+	}
+
+	info := bytes.Join(m.pieces, nil)
+	if sha1.Sum(info) != m.ts.TCPTransportOpts.InfoHash {
+		fmt.Printf("[METADATA] info dict does not match the info hash, fetching it again\n")
+		m.distrust()
+		return
+	}
+	torrent, err := meta.NewTorrentFromInfo(info, m.ts.TrackerUrls)
+	if err != nil {
+		fmt.Printf("[METADATA] invalid info dict, fetching it again: %v\n", err)
+		m.distrust()
+		return
+	}
+
+	m.mu.Lock()
+	m.info = info
+	m.torrent = torrent
+	m.mu.Unlock()
+	fmt.Printf("[METADATA] received info dict for %q (%d bytes)\n", torrent.Info.Name, len(info))
+
+	if err := m.ts.downloadFetched(torrent); err != nil {
+		fmt.Printf("[METADATA] cannot download %q: %v\n", torrent.Info.Name, err)
+		m.ts.loopErr = err
+		m.ts.Stop()
+		return
+	}
+	close(m.done)
+}
+
+// distrust drops a bad info dict and every peer that sent part of it, then
+// starts over with whoever is left, at the size they announce.
+func (m *metadataExchange) distrust() {
+	for _, id := range m.from {
+		m.refused[id] = true
+	}
+	m.size = 0
+	m.requestPieces()
+}
+
+func (m *metadataExchange) removePeer(peerID [20]byte) {
+	delete(m.sizes, peerID)
+	delete(m.refused, peerID)
+}
+
+// downloadFetched switches a server that fetched its metadata over to
+// downloading the content into RootDir, keeping the peers it has. It runs
+// on the loop.
+func (ts *TorrentServer) downloadFetched(torrent *meta.Torrent) error {
+	info := &torrent.Info
+	path, err := storage.ContentPath(ts.RootDir, info)
+	if err != nil {
+		return err
+	}
+	store, err := storage.New(path, info)
+	if err != nil {
+		return err
+	}
+	pm := p2p.NewPieceManagerWithStorage(info.NumPieces(), info.Pieces, store)
+	pm.SetLayout(info.PieceLength, info.TotalLength())
+	ts.swarm.SetPieceManager(pm)
+	ts.configurePicker()
+
+	if ts.OnMetadata != nil {
+		if err := ts.OnMetadata(torrent); err != nil {
+			return err
+		}
+	}
+	if err := ts.createWantedFiles(); err != nil {
+		return err
+	}
+	if err := ts.loadResume(); err != nil {
+		return err
+	}
+	if ts.Recheck {
+		ts.recheck()
+	}
+
+	peers := ts.swarm.Peers()
+	fmt.Printf("[METADATA] downloading %q from the %d peers connected\n", info.Name, len(peers))
+	for _, peer := range peers {
+		// a bitfield may only open a connection, so pieces found on disk
+		// are announced one by one
+		for idx := 0; idx < pm.NumPieces(); idx++ {
+			if !pm.HasPiece(idx) {
+				continue
+			}
+			if err := peer.Send(&p2p.Have{Index: idx}); err != nil {
+				fmt.Printf("failed to send have to %x: %v\n", peer.ID(), err)
+				break
+			}
+		}
+		ts.updateInterest(peer.ID())
+		ts.requestBlocks(peer.ID())
+	}
+	ts.checkComplete()
+	return nil
+}
+
+// MetadataReady is closed once a server started with FetchMetadata has
+// the info dict and is downloading the content. It is nil, and so never
+// ready, for other servers.
+func (ts *TorrentServer) MetadataReady() <-chan struct{} {
+	return ts.metadata.done
+}
+
+// Metadata returns the torrent the server shares: the one it was given or
+// the one fetched from peers, or nil while it is still being fetched.
+func (ts *TorrentServer) Metadata() *meta.Torrent {
+	if ts.Torrent != nil {
+		return ts.Torrent
+	}
+	ts.metadata.mu.Lock()
+	defer ts.metadata.mu.Unlock()
+	return ts.metadata.torrent
+}
+
+// private reports whether the torrent is private (BEP 27): its peers may
+// come from its trackers only. A torrent still being fetched is not known
+// to be private.
+func (ts *TorrentServer) private() bool {
+	t := ts.Metadata()
+	return t != nil && t.Info.Private == 1
+}
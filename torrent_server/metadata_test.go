@@ -0,0 +1,253 @@
+package torrentserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+// testPeer is a connected peer that records what is sent to it instead of
+// writing it to the wire.
+type testPeer struct {
+	net.Conn
+	id       [20]byte
+	reserved [8]byte
+
+	mu   sync.Mutex
+	sent []p2p.Message
+}
+
+func newTestPeer(t *testing.T, id byte) *testPeer {
+	t.Helper()
+	conn, other := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	p := &testPeer{Conn: conn, id: [20]byte{id}}
+	p.reserved[5] = 0x10 // extension protocol
+	return p
+}
+
+func (p *testPeer) SetID(id [20]byte)                 { p.id = id }
+func (p *testPeer) ID() [20]byte                      { return p.id }
+func (p *testPeer) SetReserved(reserved [8]byte)      { p.reserved = reserved }
+func (p *testPeer) Reserved() [8]byte                 { return p.reserved }
+func (p *testPeer) CancelBlock(p2p.BlockRequest) bool { return false }
+
+func (p *testPeer) Send(msg p2p.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, msg)
+	return nil
+}
+
+// take returns the messages sent so far and forgets them.
+func (p *testPeer) take() []p2p.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent := p.sent
+	p.sent = nil
+	return sent
+}
+
+// addTestPeer connects a test peer to the server's swarm.
+func addTestPeer(t *testing.T, ts *TorrentServer, id byte) *testPeer {
+	t.Helper()
+	p := newTestPeer(t, id)
+	if err := ts.swarm.AddPeer(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// extendedFrom hands the server an extended message as if the peer had
+// sent it.
+func extendedFrom(ts *TorrentServer, p *testPeer, ext *p2p.Extended) {
+	ts.handleExtended(p2p.RPC{From: p2p.From{PeerID: p.id, Addr: "test"}}, ext)
+}
+
+// metadataRequests returns the pieces the peer was asked for.
+func metadataRequests(t *testing.T, p *testPeer) []int {
+	t.Helper()
+	var pieces []int
+	for _, msg := range p.take() {
+		ext, ok := msg.(*p2p.Extended)
+		if !ok || ext.ExtID != 3 {
+			continue
+		}
+		var m metadataMessage
+		if err := meta.Unmarshal(ext.Payload, &m); err != nil {
+			t.Fatalf("bad metadata message: %v", err)
+		}
+		if m.MsgType == metadataRequest {
+			pieces = append(pieces, m.Piece)
+		}
+	}
+	return pieces
+}
+
+func TestMetadata_LyingPeerDoesNotBlockHonestOne(t *testing.T) {
+	info, err := meta.Marshal(&meta.InfoDict{
+		Name:        "file.bin",
+		Length:      100,
+		PieceLength: 16384,
+		Pieces:      make([]byte, 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTorrentServer(TorrentServerOpts{
+		FetchMetadata:    true,
+		RootDir:          t.TempDir(),
+		TCPTransportOpts: p2p.TCPTransportOpts{InfoHash: sha1.Sum(info)},
+	}, p2p.NewPieceManager(1))
+	ourID := ts.extensions.handshake().M[metadataExtension]
+
+	liar := addTestPeer(t, ts, 1)
+	honest := addTestPeer(t, ts, 2)
+	handshake := func(p *testPeer, size int) {
+		hs := &p2p.ExtendedHandshake{M: map[string]int{metadataExtension: 3}, MetadataSize: size}
+		msg, err := hs.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		extendedFrom(ts, p, msg)
+	}
+
+	// the liar answers first with a size of its own; the honest peer is
+	// not asked while that size is fetched
+	handshake(liar, len(info)+50)
+	handshake(honest, len(info))
+	if got := metadataRequests(t, liar); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("liar asked for %v, want [0]", got)
+	}
+	if got := metadataRequests(t, honest); len(got) != 0 {
+		t.Fatalf("honest peer asked for %v before the liar answered", got)
+	}
+
+	// the liar's info dict does not hash to the info hash
+	head, _ := meta.Marshal(&metadataMessage{MsgType: metadataData, Piece: 0, TotalSize: len(info) + 50})
+	extendedFrom(ts, liar, &p2p.Extended{ExtID: byte(ourID), Payload: append(head, bytes.Repeat([]byte{'x'}, len(info)+50)...)})
+
+	if got := metadataRequests(t, honest); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("honest peer asked for %v after the liar was caught, want [0]", got)
+	}
+	if got := metadataRequests(t, liar); len(got) != 0 {
+		t.Fatalf("liar asked again for %v", got)
+	}
+
+	head, _ = meta.Marshal(&metadataMessage{MsgType: metadataData, Piece: 0, TotalSize: len(info)})
+	extendedFrom(ts, honest, &p2p.Extended{ExtID: byte(ourID), Payload: append(head, info...)})
+
+	select {
+	case <-ts.MetadataReady():
+	case <-time.After(time.Second):
+		t.Fatal("metadata not ready after the honest peer sent it")
+	}
+	if torrent := ts.Metadata(); torrent == nil || torrent.Info.Name != "file.bin" {
+		t.Errorf("Metadata() = %+v", torrent)
+	}
+}
+
+func TestMetadata_PicksSizeMostPeersAnnounce(t *testing.T) {
+	ts := NewTorrentServer(TorrentServerOpts{FetchMetadata: true}, p2p.NewPieceManager(1))
+	m := ts.metadata
+
+	m.sizes[[20]byte{1}] = 500
+	m.sizes[[20]byte{2}] = 300
+	m.sizes[[20]byte{3}] = 300
+	m.pickSize()
+	if m.size != 300 {
+		t.Fatalf("size = %d, want the 300 announced by two peers", m.size)
+	}
+
+	// the size being fetched is kept while anyone trusted announces it
+	m.refused[[20]byte{2}] = true
+	m.pickSize()
+	if m.size != 300 {
+		t.Fatalf("size = %d after one peer was refused, want 300 kept", m.size)
+	}
+
+	m.refused[[20]byte{3}] = true
+	m.pickSize()
+	if m.size != 500 || len(m.pieces) != 1 {
+		t.Errorf("size = %d in %d pieces, want 500 in 1", m.size, len(m.pieces))
+	}
+}
+
+func TestMetadata_DownloadsWithPeersItHas(t *testing.T) {
+	info, err := meta.Marshal(&meta.InfoDict{
+		Name:        "file.bin",
+		Length:      40000,
+		PieceLength: 16384,
+		Pieces:      make([]byte, 60),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hooked []*meta.Torrent
+	ts := NewTorrentServer(TorrentServerOpts{
+		FetchMetadata:    true,
+		RootDir:          t.TempDir(),
+		TCPTransportOpts: p2p.TCPTransportOpts{InfoHash: sha1.Sum(info)},
+		OnMetadata: func(torrent *meta.Torrent) error {
+			hooked = append(hooked, torrent)
+			return nil
+		},
+	}, p2p.NewPieceManager(0))
+	ourID := ts.extensions.handshake().M[metadataExtension]
+
+	// the seed says what it has before we know how many pieces there are
+	seed := addTestPeer(t, ts, 1)
+	from := p2p.RPC{From: p2p.From{PeerID: seed.id, Addr: "test"}}
+	ts.handleBitfieldAnnouncement(from, []byte{0xc0})
+	ts.swarm.SetPeerHasPiece(seed.id, 2)
+	ts.swarm.SetPeerChoking(seed.id, false)
+
+	hs, err := (&p2p.ExtendedHandshake{M: map[string]int{metadataExtension: 3}, MetadataSize: len(info)}).Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extendedFrom(ts, seed, hs)
+	seed.take()
+	head, _ := meta.Marshal(&metadataMessage{MsgType: metadataData, Piece: 0, TotalSize: len(info)})
+	extendedFrom(ts, seed, &p2p.Extended{ExtID: byte(ourID), Payload: append(head, info...)})
+
+	select {
+	case <-ts.MetadataReady():
+	default:
+		t.Fatal("metadata not ready")
+	}
+	if len(hooked) != 1 || hooked[0].Info.Name != "file.bin" {
+		t.Fatalf("OnMetadata called with %v", hooked)
+	}
+	if _, ok := ts.swarm.GetPeer(seed.id); !ok || ts.swarm.NumPieces() != 3 {
+		t.Fatalf("after the switch: peer kept = %v, %d pieces", ok, ts.swarm.NumPieces())
+	}
+	for idx := 0; idx < 3; idx++ {
+		if got := ts.swarm.Picker().Availability(idx); got != 1 {
+			t.Errorf("Availability(%d) = %d, want the seed's bitfield and have counted", idx, got)
+		}
+	}
+
+	var interested bool
+	requested := make(map[int]bool)
+	for _, msg := range seed.take() {
+		switch m := msg.(type) {
+		case *p2p.Interested:
+			interested = true
+		case *p2p.Request:
+			requested[m.Index] = true
+		}
+	}
+	if !interested || len(requested) != 3 {
+		t.Errorf("seed sent interested = %v and requests for pieces %v, want all 3", interested, requested)
+	}
+}
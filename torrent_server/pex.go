@@ -0,0 +1,206 @@
+package torrentserver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+const (
+	pexExtension = "ut_pex"
+
+	// pexInterval is how often connected peers are told about changes.
+	pexInterval = time.Minute
+
+	// pexMinInterval is the least time between two messages from one
+	// peer; sooner ones are dropped as flooding.
+	pexMinInterval = 45 * time.Second
+
+	// maxPexPeers caps the added and the dropped peers of one message,
+	// both those we send and those we take from others.
+	maxPexPeers = 50
+)
+
+// pexState is what peer exchange knows about one connected peer.
+type pexState struct {
+	addr     netip.AddrPort          // where it listens, if known
+	sent     map[netip.AddrPort]bool // peers we last told it we are connected to
+	received time.Time               // when its last message came in
+}
+
+// peerExchange is the ut_pex extension (BEP 11). Every pexInterval it
+// tells each peer that supports it which peers of the swarm it has not
+// heard about yet and which have gone, and it hands the addresses other
+// peers send to the connector. It runs on the server loop. It is not
+// registered for a private torrent, and stays quiet if the info dict
+// fetched for a magnet link turns out to be private.
+//
+// We speak neither encryption nor uTP, so the flags we send only ever
+// carry PexSeed and PexReachable. Received peers are dialed over TCP
+// whatever their flags say, except that seeds are not dialed once we
+// have everything we want.
+type peerExchange struct {
+	ts    *TorrentServer
+	peers map[[20]byte]*pexState
+}
+
+func newPeerExchange(ts *TorrentServer) *peerExchange {
+	return &peerExchange{
+		ts:    ts,
+		peers: make(map[[20]byte]*pexState),
+	}
+}
+
+func (x *peerExchange) Name() string { return pexExtension }
+
+func (x *peerExchange) ExtendHandshake(hs *p2p.ExtendedHandshake) {}
+
+func (x *peerExchange) state(peer p2p.Peer) *pexState {
+	st := x.peers[peer.ID()]
+	if st == nil {
+		st = &pexState{sent: make(map[netip.AddrPort]bool)}
+		if isOutbound(peer) {
+			st.addr = remoteAddrPort(peer)
+		}
+		x.peers[peer.ID()] = st
+	}
+	return st
+}
+
+// PeerHandshake learns where peers that dialed us listen, from "p".
+func (x *peerExchange) PeerHandshake(peer p2p.Peer, hs *p2p.ExtendedHandshake) {
+	st := x.state(peer)
+	if st.addr.IsValid() || hs.P <= 0 || hs.P > 65535 {
+		return
+	}
+	if remote := remoteAddrPort(peer); remote.IsValid() {
+		st.addr = netip.AddrPortFrom(remote.Addr(), uint16(hs.P))
+		x.ts.connector.setListenAddr(peer.ID(), st.addr.String())
+	}
+}
+
+func (x *peerExchange) HandleMessage(peer p2p.Peer, payload []byte) {
+	if x.ts.private() {
+		return
+	}
+	st := x.state(peer)
+	now := time.Now()
+	if !st.received.IsZero() && now.Sub(st.received) < pexMinInterval {
+		fmt.Printf("[PEX] dropping message from %x, %s after its last one\n", peer.ID(), now.Sub(st.received).Round(time.Second))
+		return
+	}
+	st.received = now
+
+	msg, err := p2p.ParsePexMessage(payload)
+	if err != nil {
+		fmt.Printf("[PEX] from %x: %v\n", peer.ID(), err)
+		return
+	}
+	added, dropped := msg.AddedPeers(), msg.DroppedPeers()
+	if len(added) > maxPexPeers {
+		added = added[:maxPexPeers]
+	}
+
+	skipSeeds := x.ts.haveWanted()
+	var addrs []string
+	for _, p := range added {
+		if !p.Addr.IsValid() || p.Addr.Port() == 0 || (skipSeeds && p.Flags&p2p.PexSeed != 0) {
+			continue
+		}
+		addrs = append(addrs, p.Addr.String())
+	}
+	dialed := x.ts.connectPeers(addrs, "pex")
+	fmt.Printf("[PEX] from %x: %d added, %d dropped, dialing %d\n", peer.ID(), len(added), len(dropped), dialed)
+}
+
+// sendUpdates tells every peer that supports ut_pex what changed since
+// its last message.
+func (x *peerExchange) sendUpdates() {
+	if x.ts.private() {
+		return
+	}
+	peers := x.ts.swarm.Peers()
+
+	current := make(map[netip.AddrPort]byte)
+	for _, peer := range peers {
+		st := x.state(peer)
+		if !st.addr.IsValid() {
+			continue
+		}
+		var flags byte
+		if x.ts.swarm.PeerIsSeed(peer.ID()) {
+			flags |= p2p.PexSeed
+		}
+		if isOutbound(peer) {
+			flags |= p2p.PexReachable
+		}
+		current[st.addr] = flags
+	}
+
+	for _, peer := range peers {
+		if _, ok := x.ts.extensions.PeerID(peer.ID(), pexExtension); !ok {
+			continue
+		}
+		st := x.state(peer)
+
+		var added []p2p.PexPeer
+		for addr, flags := range current {
+			if addr != st.addr && !st.sent[addr] && len(added) < maxPexPeers {
+				added = append(added, p2p.PexPeer{Addr: addr, Flags: flags})
+			}
+		}
+		var dropped []netip.AddrPort
+		for addr := range st.sent {
+			if _, ok := current[addr]; !ok && len(dropped) < maxPexPeers {
+				dropped = append(dropped, addr)
+			}
+		}
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		payload, err := meta.Marshal(p2p.NewPexMessage(added, dropped))
+		if err != nil {
+			continue
+		}
+		if err := x.ts.SendExtended(peer, pexExtension, payload); err != nil {
+			fmt.Printf("failed to send pex to %x: %v\n", peer.ID(), err)
+			continue
+		}
+		for _, p := range added {
+			st.sent[p.Addr] = true
+		}
+		for _, addr := range dropped {
+			delete(st.sent, addr)
+		}
+		fmt.Printf("[PEX] sent %d added, %d dropped to %x\n", len(added), len(dropped), peer.ID())
+	}
+}
+
+func (x *peerExchange) removePeer(peerID [20]byte) {
+	delete(x.peers, peerID)
+}
+
+// haveWanted reports whether every wanted piece is in, so that seeds are
+// of no use to us.
+func (ts *TorrentServer) haveWanted() bool {
+	return ts.swarm.NumPieces() > 0 && ts.swarm.Picker().WantedMissing() == 0
+}
+
+func isOutbound(peer p2p.Peer) bool {
+	op, ok := peer.(interface{ Outbound() bool })
+	return ok && op.Outbound()
+}
+
+func remoteAddrPort(peer p2p.Peer) netip.AddrPort {
+	addr, ok := peer.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
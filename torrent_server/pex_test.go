@@ -0,0 +1,58 @@
+package torrentserver
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+func testTorrent(t *testing.T, private int64) *meta.Torrent {
+	t.Helper()
+	info, err := meta.Marshal(&meta.InfoDict{
+		Name:        "file.bin",
+		Length:      100,
+		PieceLength: 16384,
+		Pieces:      make([]byte, 20),
+		Private:     private,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := meta.NewTorrentFromInfo(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+func TestPex_NotAdvertisedForPrivateTorrent(t *testing.T) {
+	for _, private := range []int64{0, 1} {
+		ts := NewTorrentServer(TorrentServerOpts{Torrent: testTorrent(t, private)}, p2p.NewPieceManager(1))
+		_, advertised := ts.extensions.handshake().M[pexExtension]
+		if advertised != (private == 0) {
+			t.Errorf("private=%d: ut_pex advertised = %v", private, advertised)
+		}
+	}
+}
+
+func TestPex_QuietOnceFetchedTorrentIsPrivate(t *testing.T) {
+	ts := NewTorrentServer(TorrentServerOpts{FetchMetadata: true}, p2p.NewPieceManager(1))
+	known := addTestPeer(t, ts, 1)
+	ts.pex.state(known).addr = netip.MustParseAddrPort("10.0.0.1:6881")
+	listener := addTestPeer(t, ts, 2)
+	ts.extensions.peerHandshake(listener.id, &p2p.ExtendedHandshake{M: map[string]int{pexExtension: 5}})
+
+	ts.metadata.torrent = testTorrent(t, 1)
+	ts.pex.sendUpdates()
+	if sent := listener.take(); len(sent) != 0 {
+		t.Fatalf("sent %d pex messages for a private torrent", len(sent))
+	}
+
+	ts.metadata.torrent = testTorrent(t, 0)
+	ts.pex.sendUpdates()
+	if sent := listener.take(); len(sent) != 1 {
+		t.Errorf("sent %d pex messages for a public torrent, want 1", len(sent))
+	}
+}
@@ -0,0 +1,168 @@
+package torrentserver
+
+import (
+	"fmt"
+
+	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+// contentStorage returns the file layout behind the piece manager, or nil
+// when pieces are only held in memory.
+func (ts *TorrentServer) contentStorage() *storage.Storage {
+	store, _ := ts.swarm.PieceManager().Storage().(*storage.Storage)
+	return store
+}
+
+// SetFilePriority sets the priority of one file of the torrent. Each piece
+// takes the highest priority of the files it holds data for, so a piece
+// shared with a wanted file is still downloaded; this replaces any piece
+// priority set on those pieces before. A skipped file is not created; its
+// share of such a piece is kept aside until the file becomes wanted, when
+// it is created on disk. It is safe to call while the download is running.
+func (ts *TorrentServer) SetFilePriority(file int, prio p2p.Priority) error {
+	store := ts.contentStorage()
+	if store == nil {
+		return fmt.Errorf("no file layout to set priorities on")
+	}
+	if file < 0 || file >= len(store.Files()) {
+		return fmt.Errorf("file %d out of range", file)
+	}
+	if prio < p2p.PrioritySkip || prio > p2p.PriorityHigh {
+		return fmt.Errorf("invalid priority %d", prio)
+	}
+
+	ts.priorityMu.Lock()
+	defer ts.priorityMu.Unlock()
+
+	if ts.filePriorities == nil {
+		ts.filePriorities = make([]p2p.Priority, len(store.Files()))
+		for i := range ts.filePriorities {
+			ts.filePriorities[i] = p2p.PriorityNormal
+		}
+	}
+	ts.filePriorities[file] = prio
+
+	if err := store.SetFileSkipped(file, prio == p2p.PrioritySkip); err != nil {
+		return err
+	}
+	if prio != p2p.PrioritySkip && ts.started {
+		if err := store.CreateFile(file); err != nil {
+			return err
+		}
+	}
+
+	first, last := store.FilePieces(file)
+	for idx := first; idx <= last; idx++ {
+		if err := ts.swarm.Picker().SetPriority(idx, ts.piecePriorityFromFiles(store, file, idx)); err != nil {
+			return err
+		}
+	}
+	ts.prioritiesChanged()
+	return nil
+}
+
+// piecePriorityFromFiles is the highest priority among the files with data
+// in piece idx. Files are in content order, so those are file and the
+// neighbours on either side reaching into the piece. Must be called with
+// priorityMu held.
+func (ts *TorrentServer) piecePriorityFromFiles(store *storage.Storage, file, idx int) p2p.Priority {
+	prio := p2p.PrioritySkip
+	consider := func(i int) bool {
+		first, last := store.FilePieces(i)
+		if last < first {
+			return true // empty, look further
+		}
+		if first > idx || last < idx {
+			return false
+		}
+		if ts.filePriorities[i] > prio {
+			prio = ts.filePriorities[i]
+		}
+		return true
+	}
+
+	for i := file; i >= 0; i-- {
+		if !consider(i) {
+			break
+		}
+	}
+	for i := file + 1; i < len(ts.filePriorities); i++ {
+		if !consider(i) {
+			break
+		}
+	}
+	return prio
+}
+
+// FilePriority returns the priority of a file; files start out normal.
+func (ts *TorrentServer) FilePriority(file int) p2p.Priority {
+	ts.priorityMu.Lock()
+	defer ts.priorityMu.Unlock()
+
+	if file < 0 || (ts.filePriorities != nil && file >= len(ts.filePriorities)) {
+		return p2p.PrioritySkip
+	}
+	if ts.filePriorities == nil {
+		return p2p.PriorityNormal
+	}
+	return ts.filePriorities[file]
+}
+
+// SetPiecePriority sets the priority of a single piece. It is safe to call
+// while the download is running.
+func (ts *TorrentServer) SetPiecePriority(idx int, prio p2p.Priority) error {
+	if err := ts.swarm.Picker().SetPriority(idx, prio); err != nil {
+		return err
+	}
+	ts.prioritiesChanged()
+	return nil
+}
+
+func (ts *TorrentServer) PiecePriority(idx int) p2p.Priority {
+	return ts.swarm.Picker().Priority(idx)
+}
+
+// prioritiesChanged asks the loop to revisit interest and requests.
+func (ts *TorrentServer) prioritiesChanged() {
+	select {
+	case ts.priorityChanged <- struct{}{}:
+	default:
+	}
+}
+
+// handlePrioritiesChanged runs on the loop after priorities change: peers
+// may have become (un)interesting, newly wanted pieces need requesting,
+// and the download may already be complete.
+func (ts *TorrentServer) handlePrioritiesChanged() {
+	if ts.swarm.Picker().WantedMissing() > 0 {
+		ts.completed = false
+	}
+	for _, peer := range ts.swarm.Peers() {
+		ts.updateInterest(peer.ID())
+	}
+	ts.redistributeRequests()
+	ts.checkComplete()
+}
+
+// createWantedFiles allocates the files that are not skipped.
+func (ts *TorrentServer) createWantedFiles() error {
+	store := ts.contentStorage()
+	if store == nil || ts.Metadata() == nil {
+		return nil
+	}
+
+	ts.priorityMu.Lock()
+	defer ts.priorityMu.Unlock()
+	ts.started = true
+
+	for i := range store.Files() {
+		if ts.filePriorities != nil && ts.filePriorities[i] == p2p.PrioritySkip {
+			continue
+		}
+		if err := store.CreateFile(i); err != nil {
+			return fmt.Errorf("failed to create files: %w", err)
+		}
+	}
+	return nil
+}
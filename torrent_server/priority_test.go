@@ -0,0 +1,100 @@
+package torrentserver
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+func TestSetFilePriority_SkippedFileNotCreated(t *testing.T) {
+	// b.bin fills piece 2 and shares pieces 1 and 3 with its neighbours
+	src := filepath.Join(t.TempDir(), "album")
+	os.Mkdir(src, 0o755)
+	content := make(map[string][]byte)
+	for name, size := range map[string]int{"a.bin": 20000, "b.bin": 40000, "c.bin": 10000} {
+		content[name] = bytes.Repeat([]byte(name[:1]), size)
+		if err := os.WriteFile(filepath.Join(src, name), content[name], 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	torrent, err := meta.CreateTorrent(src, meta.CreateOptions{PieceLength: meta.MinPieceLength, Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &torrent.Info
+	source, err := storage.New(src, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path, _ := storage.ContentPath(dir, info)
+	store, err := storage.New(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := p2p.NewPieceManagerWithStorage(info.NumPieces(), info.Pieces, store)
+	pm.SetLayout(info.PieceLength, info.TotalLength())
+	ts := NewTorrentServer(TorrentServerOpts{Torrent: torrent, RootDir: dir}, pm)
+
+	if err := ts.SetFilePriority(1, p2p.PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.createWantedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < info.NumPieces(); idx++ {
+		if !ts.swarm.Picker().Wanted(idx) {
+			continue
+		}
+		data, err := source.ReadPiece(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pm.AddPiece(idx, data); err != nil {
+			t.Fatalf("AddPiece(%d): %v", idx, err)
+		}
+	}
+	if _, err := ts.storeCompleted(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "b.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("skipped b.bin exists after the download: %v", err)
+	}
+	for _, name := range []string{"a.bin", "c.bin"} {
+		if got, _ := os.ReadFile(filepath.Join(path, name)); !bytes.Equal(got, content[name]) {
+			t.Errorf("%s has %d bytes, want its %d", name, len(got), len(content[name]))
+		}
+	}
+	// the shared pieces still read back whole, to seed them
+	for _, idx := range []int{1, 3} {
+		if data, err := store.ReadPiece(idx); err != nil || !pm.VerifyPiece(idx, data) {
+			t.Errorf("piece %d unreadable with b.bin skipped: %v", idx, err)
+		}
+	}
+
+	// wanting b.bin again brings in what was kept of it
+	if err := ts.SetFilePriority(1, p2p.PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(path, "b.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 40000-10000 || !bytes.Equal(got[:32768-20000], content["b.bin"][:32768-20000]) {
+		t.Fatalf("b.bin has %d bytes without its start from piece 1", len(got))
+	}
+	if !bytes.Equal(got[49152-20000:], content["b.bin"][49152-20000:]) {
+		t.Error("b.bin is missing its end from piece 3")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("download dir holds %d entries, want the part files gone", len(entries))
+	}
+}
@@ -0,0 +1,190 @@
+package torrentserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	errReaderClosed  = errors.New("reader closed")
+	errServerStopped = errors.New("torrent server stopped")
+)
+
+// Reader reads a torrent's content, or one of its files, while it is
+// still downloading. A read of a piece that has not arrived blocks until
+// it has, and that piece is fetched before any other. Each reader has its
+// own read head in the picker, moved by its reads, so the pieces just
+// after each reader's position come next.
+//
+// A Reader is not safe for concurrent use, except that Close may be called
+// at any time to abort a blocked read.
+type Reader struct {
+	ts     *TorrentServer
+	offset int64 // start of the reader's range within the content
+	length int64
+	pos    int64
+
+	mu     sync.Mutex // guards head against a concurrent Close
+	head   int        // piece of our read head in the picker, -1 for none
+	closed chan struct{}
+}
+
+// NewReader returns a reader over the whole content.
+func (ts *TorrentServer) NewReader() *Reader {
+	return ts.newReader(0, ts.swarm.PieceManager().TotalLength())
+}
+
+// NewFileReader returns a reader over file i of the torrent.
+func (ts *TorrentServer) NewFileReader(i int) (*Reader, error) {
+	store := ts.contentStorage()
+	if store == nil {
+		return nil, fmt.Errorf("no file layout to read files from")
+	}
+	files := store.Files()
+	if i < 0 || i >= len(files) {
+		return nil, fmt.Errorf("file %d out of range", i)
+	}
+	return ts.newReader(files[i].Offset, files[i].Length), nil
+}
+
+func (ts *TorrentServer) newReader(offset, length int64) *Reader {
+	return &Reader{
+		ts:     ts,
+		offset: offset,
+		length: length,
+		head:   -1,
+		closed: make(chan struct{}),
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+
+	pm := r.ts.swarm.PieceManager()
+	pieceLength := pm.PieceLength()
+	if pieceLength <= 0 {
+		return 0, fmt.Errorf("piece layout unknown")
+	}
+
+	off := r.offset + r.pos
+	idx := int(off / pieceLength)
+	begin := off - int64(idx)*pieceLength
+	n := int64(len(p))
+	if rest := r.length - r.pos; n > rest {
+		n = rest
+	}
+	if rest := pm.PieceSize(idx) - begin; n > rest {
+		n = rest
+	}
+
+	if err := r.moveHead(idx); err != nil {
+		return 0, err
+	}
+	if err := r.ts.waitPiece(idx, r.closed); err != nil {
+		return 0, err
+	}
+
+	block, err := pm.ReadBlock(idx, int(begin), int(n))
+	if err != nil {
+		return 0, err
+	}
+	copy(p, block)
+	r.pos += n
+	return int(n), nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Size is the length of the reader's range.
+func (r *Reader) Size() int64 {
+	return r.length
+}
+
+// moveHead puts the reader's read head on piece idx, unless the reader
+// has been closed.
+func (r *Reader) moveHead(idx int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return errReaderClosed
+	default:
+	}
+	if idx != r.head {
+		r.ts.swarm.Picker().MoveReadHead(r.head, idx)
+		r.head = idx
+		r.ts.prioritiesChanged()
+	}
+	return nil
+}
+
+// Close aborts a blocked read and lets go of the reader's read head.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+	r.ts.swarm.Picker().MoveReadHead(r.head, -1)
+	r.head = -1
+	return nil
+}
+
+// waitPiece blocks until piece idx is complete, marking it urgent in the
+// meantime so it is requested before anything else.
+func (ts *TorrentServer) waitPiece(idx int, cancel <-chan struct{}) error {
+	pm := ts.swarm.PieceManager()
+	if pm.HasPiece(idx) {
+		return nil
+	}
+
+	picker := ts.swarm.Picker()
+	picker.SetUrgent(idx)
+	defer picker.ClearUrgent(idx)
+	ts.prioritiesChanged()
+
+	for {
+		added := pm.PieceAdded()
+		if pm.HasPiece(idx) {
+			return nil
+		}
+		select {
+		case <-added:
+		case <-cancel:
+			return errReaderClosed
+		case <-ts.quitch:
+			return errServerStopped
+		}
+	}
+}
+
+// SetSequential switches the download between fetching pieces in order
+// and rarest first. It is safe to call while the download is running.
+func (ts *TorrentServer) SetSequential(on bool) {
+	ts.swarm.Picker().SetSequential(on)
+	ts.prioritiesChanged()
+}
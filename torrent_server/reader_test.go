@@ -0,0 +1,160 @@
+package torrentserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pixperk/pixtorrent/p2p"
+)
+
+// newReaderServer shares 350 bytes in four pieces of 100, of which the
+// ones listed are already in.
+func newReaderServer(t *testing.T, have ...int) (*TorrentServer, []byte) {
+	t.Helper()
+	content := make([]byte, 350)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	pm := p2p.NewPieceManager(4)
+	pm.SetLayout(100, int64(len(content)))
+	for _, idx := range have {
+		addContentPiece(t, pm, content, idx)
+	}
+	ts := NewTorrentServer(TorrentServerOpts{ReadaheadWindow: 1}, pm)
+	ts.swarm.Picker().PeerBitfield([20]byte{1}, []byte{0xf0})
+	return ts, content
+}
+
+func addContentPiece(t *testing.T, pm *p2p.PieceManager, content []byte, idx int) {
+	t.Helper()
+	begin := int64(idx) * pm.PieceLength()
+	if err := pm.AddPiece(idx, content[begin:begin+pm.PieceSize(idx)]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReader_ReadsAcrossPieces(t *testing.T) {
+	ts, content := newReaderServer(t, 0, 1, 2, 3)
+	r := ts.NewReader()
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("ReadAll = %d bytes, %v; want the %d bytes of content", len(got), err, len(content))
+	}
+
+	if pos, err := r.Seek(-60, io.SeekEnd); err != nil || pos != 290 {
+		t.Fatalf("Seek = %d, %v", pos, err)
+	}
+	buf := make([]byte, 30)
+	if n, err := io.ReadFull(r, buf); err != nil || !bytes.Equal(buf[:n], content[290:320]) {
+		t.Errorf("read after Seek = %v, %v", buf[:n], err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+}
+
+func TestReader_BlocksUntilPieceArrives(t *testing.T) {
+	ts, content := newReaderServer(t, 0)
+	r := ts.NewReader()
+	defer r.Close()
+	r.Seek(250, io.SeekStart)
+
+	done := make(chan []byte)
+	go func() {
+		buf := make([]byte, 10)
+		n, _ := r.Read(buf)
+		done <- buf[:n]
+	}()
+
+	// the piece the read waits on comes first, then the one after it
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := ts.swarm.Picker().Pick([20]byte{1}, 2, nil)
+		if reflect.DeepEqual(got, []int{2, 3}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Pick = %v while a read waits on piece 2, want [2 3]", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("read returned before the piece arrived")
+	case <-time.After(20 * time.Millisecond):
+	}
+	addContentPiece(t, ts.swarm.PieceManager(), content, 2)
+	select {
+	case got := <-done:
+		if !bytes.Equal(got, content[250:260]) {
+			t.Errorf("read %v, want %v", got, content[250:260])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read still blocked after the piece arrived")
+	}
+}
+
+func TestReader_CloseAbortsRead(t *testing.T) {
+	ts, _ := newReaderServer(t)
+	r := ts.NewReader()
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	r.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errReaderClosed) {
+			t.Errorf("read returned %v, want errReaderClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not abort the blocked read")
+	}
+	if _, err := r.Read(make([]byte, 10)); !errors.Is(err, errReaderClosed) {
+		t.Errorf("read after Close returned %v", err)
+	}
+}
+
+func TestReader_CloseKeepsOtherReadersHeads(t *testing.T) {
+	ts, _ := newReaderServer(t)
+	picker := ts.swarm.Picker()
+	picker.SetWindow(2)
+	waitPick := func(n int, want []int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			got := picker.Pick([20]byte{1}, n, nil)
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Pick = %v, want %v", got, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	a, b := ts.NewReader(), ts.NewReader()
+	defer b.Close()
+	b.Seek(200, io.SeekStart)
+	for _, r := range []*Reader{a, b} {
+		go r.Read(make([]byte, 1))
+	}
+	// each blocked read makes its piece urgent, then come both windows
+	waitPick(4, []int{0, 2, 1, 3})
+
+	a.Close()
+	a.Close()
+	waitPick(2, []int{2, 3})
+}
@@ -0,0 +1,164 @@
+package torrentserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+// maxResumePeers bounds how many peer addresses are remembered.
+const maxResumePeers = 200
+
+// resumeData is the state kept in a torrent's resume file so an interrupted
+// download picks up where it left off instead of starting from zero.
+type resumeData struct {
+	InfoHash   []byte              `bencode:"info-hash,required"`
+	Bitfield   []byte              `bencode:"bitfield,required"`
+	Files      []storage.FileState `bencode:"files"`
+	Uploaded   int64               `bencode:"uploaded"`
+	Downloaded int64               `bencode:"downloaded"`
+	Peers      []string            `bencode:"peers,omitempty"`
+	SavedAt    int64               `bencode:"saved-at"`
+}
+
+// DefaultResumeFile is where a torrent's resume data lives under dir.
+func DefaultResumeFile(dir string, infoHash [20]byte) string {
+	return filepath.Join(dir, ".pixtorrent", fmt.Sprintf("%x.resume", infoHash))
+}
+
+// fileStorage returns the on-disk storage behind the piece manager, or nil
+// when pieces are only held in memory and there is nothing to resume.
+func (ts *TorrentServer) fileStorage() *storage.Storage {
+	if ts.ResumeFile == "" {
+		return nil
+	}
+	return ts.contentStorage()
+}
+
+// saveResume writes the current bitfield, file states, stats and peers.
+// The file is replaced atomically so a crash mid-write keeps the old one.
+func (ts *TorrentServer) saveResume() error {
+	store := ts.fileStorage()
+	if store == nil {
+		return nil
+	}
+
+	// snapshot the bitfield before the file states: a piece written in
+	// between only makes its file look changed, which is safe
+	bitfield := ts.swarm.Bitfield()
+	if err := store.Sync(); err != nil {
+		return err
+	}
+	uploaded, downloaded := ts.swarm.Stats()
+
+	data, err := meta.Marshal(resumeData{
+		InfoHash:   ts.TCPTransportOpts.InfoHash[:],
+		Bitfield:   bitfield,
+		Files:      store.FileStates(),
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Peers:      ts.knownPeers(),
+		SavedAt:    time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode resume data: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ts.ResumeFile), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create resume directory: %v", err)
+	}
+	tmp := ts.ResumeFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write resume file: %v", err)
+	}
+	if err := os.Rename(tmp, ts.ResumeFile); err != nil {
+		return fmt.Errorf("failed to write resume file: %v", err)
+	}
+	return nil
+}
+
+// loadResume rebuilds the piece manager from the resume file. Pieces are
+// trusted as long as the files they live in still have the size and mtime
+// recorded at save time; pieces in changed files are hashed again.
+func (ts *TorrentServer) loadResume() error {
+	store := ts.fileStorage()
+	if store == nil {
+		return nil
+	}
+
+	raw, err := os.ReadFile(ts.ResumeFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read resume file: %v", err)
+	}
+
+	var saved resumeData
+	if err := meta.Unmarshal(raw, &saved); err != nil {
+		fmt.Printf("[RESUME] ignoring corrupt resume file %s: %v\n", ts.ResumeFile, err)
+		return nil
+	}
+	if !bytes.Equal(saved.InfoHash, ts.TCPTransportOpts.InfoHash[:]) {
+		fmt.Printf("[RESUME] ignoring resume file %s for another torrent\n", ts.ResumeFile)
+		return nil
+	}
+
+	pm := ts.swarm.PieceManager()
+	changed := store.ChangedPieces(saved.Files)
+	restored, rechecked := 0, 0
+
+	for i := 0; i < pm.NumPieces(); i++ {
+		if i/8 >= len(saved.Bitfield) || saved.Bitfield[i/8]&(1<<(7-i%8)) == 0 {
+			continue
+		}
+		if changed[i] {
+			rechecked++
+			data, err := store.ReadPiece(i)
+			if err != nil || !pm.VerifyPiece(i, data) {
+				continue
+			}
+		}
+		if err := pm.MarkPiece(i); err == nil {
+			restored++
+		}
+	}
+
+	ts.swarm.RestoreStats(saved.Uploaded, saved.Downloaded)
+	ts.resumePeers = saved.Peers
+
+	fmt.Printf("[RESUME] restored %d/%d pieces (%d re-verified), %d known peers\n",
+		restored, pm.NumPieces(), rechecked, len(saved.Peers))
+	return nil
+}
+
+// knownPeers lists addresses worth dialing next time: the ones we got from
+// the tracker or resume file and every peer we connected out to.
+func (ts *TorrentServer) knownPeers() []string {
+	seen := make(map[string]bool)
+	var peers []string
+	add := func(addr string) {
+		if addr != "" && !seen[addr] && len(peers) < maxResumePeers {
+			seen[addr] = true
+			peers = append(peers, addr)
+		}
+	}
+
+	for _, p := range ts.swarm.Peers() {
+		if op, ok := p.(interface{ Outbound() bool }); ok && op.Outbound() {
+			add(p.RemoteAddr().String())
+		}
+	}
+	ts.bootstrapMu.Lock()
+	for _, addr := range ts.bootstrapNodes {
+		add(addr)
+	}
+	ts.bootstrapMu.Unlock()
+	return peers
+}
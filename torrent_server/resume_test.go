@@ -0,0 +1,62 @@
+package torrentserver
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pixperk/pixtorrent/meta"
+	"github.com/pixperk/pixtorrent/p2p"
+	"github.com/pixperk/pixtorrent/storage"
+)
+
+// outboundPeer is a test peer we dialed at addr.
+type outboundPeer struct {
+	*testPeer
+	addr net.Addr
+}
+
+func (p *outboundPeer) Outbound() bool       { return true }
+func (p *outboundPeer) RemoteAddr() net.Addr { return p.addr }
+
+func TestStop_SavesConnectedPeers(t *testing.T) {
+	torrent := testTorrent(t, 0)
+	dir := t.TempDir()
+	path, _ := storage.ContentPath(dir, &torrent.Info)
+	store, err := storage.New(path, &torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := p2p.NewPieceManagerWithStorage(1, torrent.Info.Pieces, store)
+	pm.SetLayout(torrent.Info.PieceLength, torrent.Info.TotalLength())
+
+	resumeFile := filepath.Join(dir, "test.resume")
+	ts := NewTorrentServer(TorrentServerOpts{
+		Torrent:          torrent,
+		ResumeFile:       resumeFile,
+		TCPTransportOpts: p2p.TCPTransportOpts{ListenAddr: "127.0.0.1:0"},
+	}, pm)
+	if err := ts.Transport.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a peer found through the DHT or PEX, not among the bootstrap nodes
+	peer := &outboundPeer{testPeer: newTestPeer(t, 1), addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 6881}}
+	if err := ts.swarm.AddPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	ts.Stop()
+
+	raw, err := os.ReadFile(resumeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved resumeData
+	if err := meta.Unmarshal(raw, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Peers) != 1 || saved.Peers[0] != "10.0.0.5:6881" {
+		t.Errorf("saved peers = %v, want the connected 10.0.0.5:6881", saved.Peers)
+	}
+}
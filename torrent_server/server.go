@@ -2,7 +2,6 @@ package torrentserver
 
 import (
 	"crypto/rand"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"math/big"
@@ -11,6 +10,9 @@ import (
 	"time"
 
 	"github.com/pixperk/pixtorrent/client"
+	"github.com/pixperk/pixtorrent/dht"
+	"github.com/pixperk/pixtorrent/lsd"
+	"github.com/pixperk/pixtorrent/meta"
 	"github.com/pixperk/pixtorrent/p2p"
 )
 
@@ -18,8 +20,54 @@ type TorrentServerOpts struct {
 	Transport        p2p.Transport
 	TCPTransportOpts p2p.TCPTransportOpts
 	TrackerUrl       string
+	TrackerUrls      []string // tried in order; TrackerUrl alone is used when empty
 	RootDir          string
 	FileFormat       string
+
+	// Torrent, when set, describes the content being shared. Its pieces
+	// live in RootDir/<name> through the PieceManager's storage instead of
+	// a single <infohash>.<FileFormat> blob.
+	Torrent *meta.Torrent
+
+	// ResumeFile keeps download progress across restarts when pieces are
+	// stored in files. Empty disables resuming.
+	ResumeFile string
+
+	// Recheck hashes all existing data at startup and trusts only what
+	// verifies, e.g. for content copied in from elsewhere.
+	Recheck bool
+
+	// RequestQueueSize is how many block requests may be outstanding per
+	// peer; 0 means DefaultRequestQueueSize.
+	RequestQueueSize int
+
+	// Sequential fetches pieces in order rather than rarest first, for
+	// content consumed while it downloads. See also NewReader.
+	Sequential bool
+
+	// ReadaheadWindow is how many pieces after a reader's position are
+	// fetched before anything else; 0 means p2p.DefaultReadaheadWindow.
+	ReadaheadWindow int
+
+	// FetchMetadata fetches the info dict from peers over ut_metadata,
+	// for a server joining by magnet link without a Torrent. Once it
+	// checks out, the server downloads the content into RootDir/<name>
+	// with the peers it already has; see MetadataReady.
+	FetchMetadata bool
+
+	// OnMetadata, when set, is called on the server loop with the
+	// fetched torrent before any of it is downloaded, e.g. to skip files.
+	// An error stops the server and is returned by Start.
+	OnMetadata func(*meta.Torrent) error
+
+	// DHT, when set, is searched for peers alongside the trackers and we
+	// announce ourselves on it, so the swarm can be joined while every
+	// tracker is down.
+	DHT *dht.Server
+
+	// LSD, when set, announces the torrent on the LAN and hands us the
+	// peers there that share it.
+	LSD *lsd.Service
 }
 
 type TorrentServer struct {
@@ -28,12 +76,28 @@ type TorrentServer struct {
 
 	peerID [20]byte
 
-	quitch chan struct{}
-
-	bootstrapNodes  []string
-	trackerClient   *client.TrackerClient
-	pendingRequests map[[20]byte][]int
-	pendingMu       sync.Mutex
+	quitch   chan struct{}
+	stopOnce sync.Once
+
+	bootstrapNodes []string
+	bootstrapMu    sync.Mutex
+	resumePeers    []string
+	trackerClient  *client.TrackerClient
+	trackerMu      sync.Mutex
+	downloader     *downloader
+	peerClosed     chan [20]byte
+	completed      bool  // every wanted piece is in; loop only
+	loopErr        error // why the loop stopped, if not Stop
+
+	priorityMu      sync.Mutex
+	filePriorities  []p2p.Priority // nil until one is set: all normal
+	started         bool           // wanted files have been created
+	priorityChanged chan struct{}
+
+	extensions *ExtensionRegistry
+	metadata   *metadataExchange
+	pex        *peerExchange
+	connector  *connector
 }
 
 func NewTorrentServer(opts TorrentServerOpts, pieceMgr *p2p.PieceManager) *TorrentServer {
@@ -41,10 +105,34 @@ func NewTorrentServer(opts TorrentServerOpts, pieceMgr *p2p.PieceManager) *Torre
 		TorrentServerOpts: opts,
 		peerID:            newPeerId(),
 		quitch:            make(chan struct{}),
-		pendingRequests:   make(map[[20]byte][]int),
+		peerClosed:        make(chan [20]byte, 64),
+		priorityChanged:   make(chan struct{}, 1),
+		extensions:        newExtensionRegistry(),
+		connector:         newConnector(),
+	}
+
+	if len(ts.TrackerUrls) == 0 && ts.TrackerUrl != "" {
+		ts.TrackerUrls = []string{ts.TrackerUrl}
+	}
+	if ts.TrackerUrl == "" && len(ts.TrackerUrls) > 0 {
+		ts.TrackerUrl = ts.TrackerUrls[0]
+	}
+
+	ts.metadata = newMetadataExchange(ts)
+	ts.pex = newPeerExchange(ts)
+	exts := []Extension{ts.metadata}
+	if !ts.private() {
+		exts = append(exts, ts.pex)
+	}
+	for _, ext := range exts {
+		if err := ts.extensions.Register(ext); err != nil {
+			panic(err)
+		}
 	}
 
 	ts.swarm = p2p.NewSwarm(ts.peerID, opts.TCPTransportOpts.InfoHash, pieceMgr)
+	ts.downloader = newDownloader(ts.swarm, opts.RequestQueueSize)
+	ts.configurePicker()
 
 	// Initialize tracker client
 	hexEncodedID := fmt.Sprintf("%x", ts.peerID)
@@ -53,17 +141,27 @@ func NewTorrentServer(opts TorrentServerOpts, pieceMgr *p2p.PieceManager) *Torre
 	if opts.Transport != nil {
 		ts.Transport = opts.Transport
 		if tt, ok := ts.Transport.(*p2p.TCPTransport); ok {
-			tt.OnPeer = ts.swarm.OnPeer
+			tt.OnPeer = ts.onPeer
+			tt.OnPeerClose = ts.onPeerClose
 		}
 	} else {
 		tcpTransport := p2p.NewTCPTransport(opts.TCPTransportOpts)
-		tcpTransport.OnPeer = ts.swarm.OnPeer
+		tcpTransport.OnPeer = ts.onPeer
+		tcpTransport.OnPeerClose = ts.onPeerClose
 		ts.Transport = tcpTransport
 	}
 
 	return ts
 }
 
+// configurePicker applies the options to the swarm's piece picker.
+func (ts *TorrentServer) configurePicker() {
+	ts.swarm.Picker().SetSequential(ts.Sequential)
+	if ts.ReadaheadWindow > 0 {
+		ts.swarm.Picker().SetWindow(ts.ReadaheadWindow)
+	}
+}
+
 func (ts *TorrentServer) Swarm() *p2p.Swarm {
 	return ts.swarm
 }
@@ -73,6 +171,16 @@ func (ts *TorrentServer) PeerID() [20]byte {
 }
 
 func (ts *TorrentServer) Start() error {
+	if err := ts.createWantedFiles(); err != nil {
+		return err
+	}
+	if err := ts.loadResume(); err != nil {
+		return err
+	}
+	if ts.Recheck {
+		ts.recheck()
+	}
+
 	if err := ts.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
@@ -90,12 +198,44 @@ func (ts *TorrentServer) Start() error {
 	time.Sleep(500 * time.Millisecond)
 
 	ts.loop()
-	return nil
+	return ts.loopErr
 }
 
 func (ts *TorrentServer) Stop() {
-	close(ts.quitch)
-	ts.Transport.Close()
+	ts.stopOnce.Do(func() {
+		close(ts.quitch)
+		ts.Transport.Close()
+		// saved while the peers are still in the swarm, so they are
+		// remembered
+		if err := ts.saveResume(); err != nil {
+			fmt.Printf("failed to save resume data: %v\n", err)
+		}
+		ts.swarm.Close()
+		if err := ts.swarm.PieceManager().Close(); err != nil {
+			fmt.Printf("failed to close piece storage: %v\n", err)
+		}
+	})
+}
+
+// recheck verifies every piece already in storage, logging progress in
+// roughly 5% steps.
+func (ts *TorrentServer) recheck() {
+	pm := ts.swarm.PieceManager()
+	total := pm.NumPieces()
+	step := total / 20
+	if step == 0 {
+		step = 1
+	}
+
+	fmt.Printf("[RECHECK] hashing %d pieces\n", total)
+	start := time.Now()
+	valid := pm.Recheck(0, func(done, total int) {
+		if done%step == 0 || done == total {
+			fmt.Printf("[RECHECK] %d/%d pieces checked\n", done, total)
+		}
+	})
+	fmt.Printf("[RECHECK] %d/%d pieces valid, %d to download (%s)\n",
+		valid, total, total-valid, time.Since(start).Round(time.Millisecond))
 }
 
 func (ts *TorrentServer) loop() {
@@ -110,59 +250,85 @@ func (ts *TorrentServer) loop() {
 	unchokeTicker := time.NewTicker(10 * time.Second)
 	defer unchokeTicker.Stop()
 
+	resumeTicker := time.NewTicker(30 * time.Second)
+	defer resumeTicker.Stop()
+
+	requestTicker := time.NewTicker(requestCheckInterval)
+	defer requestTicker.Stop()
+
+	pexTicker := time.NewTicker(pexInterval)
+	defer pexTicker.Stop()
+
 	for {
 		select {
 		case rpc := <-ts.Transport.Consume():
-			if len(rpc.Payload) == 0 {
-				fmt.Printf("[KEEP-ALIVE] from %s\n", rpc.From)
+			fromaddr, fromid := rpc.From.Addr, rpc.From.PeerID
+			msg, err := p2p.ParseMessage(rpc.Payload)
+			if err != nil {
+				fmt.Printf("[BAD MSG] from [Peer -> ID %x ; Addr %s]: %v\n", fromid, fromaddr, err)
 				continue
 			}
 
-			msgType := rpc.Payload[0]
-			payloadData := rpc.Payload[1:]
-			fromaddr, fromid := rpc.From.Addr, rpc.From.PeerID
-			switch msgType {
-			case p2p.MsgInterested:
+			switch m := msg.(type) {
+			case nil:
+				fmt.Printf("[KEEP-ALIVE] from %s\n", rpc.From)
+			case *p2p.Interested:
 				fmt.Printf("[INTERESTED] from [Peer -> ID %x ; Addr %s]\n", fromid, fromaddr)
 				ts.swarm.SetPeerInterested(fromid, true)
-			case p2p.MsgNotInterested:
+			case *p2p.NotInterested:
 				fmt.Printf("[NOT INTERESTED] from [Peer -> ID %x ; Addr %s]\n", fromid, fromaddr)
 				ts.swarm.SetPeerInterested(fromid, false)
-			case p2p.MsgRequestPiece:
-				if len(payloadData) < 4 {
-					fmt.Printf("[ERROR] MsgRequestPiece payload too short: %d bytes\n", len(payloadData))
-					continue
-				}
-				pieceIdx := int(binary.BigEndian.Uint32(payloadData[:4]))
-				ts.handlePieceRequest(rpc, pieceIdx)
-			case p2p.MsgSendPiece:
-				ts.handlePiece(rpc, payloadData)
-
-			case p2p.MsgHave:
-				if len(payloadData) < 4 {
-					fmt.Printf("[ERROR] MsgHave payload too short: %d bytes\n", len(payloadData))
-					continue
+			case *p2p.Request:
+				ts.handleRequest(rpc, m.BlockRequest)
+			case *p2p.Piece:
+				ts.handleBlock(rpc, m)
+			case *p2p.Cancel:
+				ts.handleCancel(rpc, m.BlockRequest)
+
+			case *p2p.Have:
+				fmt.Printf("[HAVE] from [Peer -> ID %x ; Addr %s], piece index: %d\n", fromid, fromaddr, m.Index)
+				if ts.swarm.SetPeerHasPiece(fromid, m.Index) {
+					ts.updateInterest(fromid)
+					ts.requestBlocks(fromid)
 				}
-				pieceIdx := int(binary.BigEndian.Uint32(payloadData[:4]))
-				fmt.Printf("[HAVE] from [Peer -> ID %x ; Addr %s], piece index: %d\n", fromid, fromaddr, pieceIdx)
-				ts.swarm.SetPeerHasPiece(fromid, pieceIdx)
-			case p2p.MsgBitfield:
-				ts.handleBitfieldAnnouncement(rpc, payloadData)
-			case p2p.MsgChoke:
+			case *p2p.Bitfield:
+				ts.handleBitfieldAnnouncement(rpc, m.Bits)
+			case *p2p.Choke:
 				fmt.Printf("[CHOKE] from [Peer -> ID %x ; Addr %s]\n", fromid, fromaddr)
 				ts.swarm.SetPeerChoking(fromid, true)
-			case p2p.MsgUnchoke:
+				// a choke discards everything we had asked for
+				ts.downloader.releasePeer(fromid)
+				ts.redistributeRequests()
+			case *p2p.Unchoke:
 				fmt.Printf("[UNCHOKE] from [Peer -> ID %x ; Addr %s]\n", fromid, fromaddr)
 				ts.swarm.SetPeerChoking(fromid, false)
-				// Now we can send pending piece requests
-				ts.sendPendingRequests(fromid)
+				ts.requestBlocks(fromid)
+			case *p2p.Extended:
+				ts.handleExtended(rpc, m)
 			default:
-				fmt.Printf("[UNKNOWN MSG %d] from [Peer -> ID %x ; Addr %s], data: %x\n", msgType, fromid, fromaddr, payloadData)
+				fmt.Printf("[UNKNOWN MSG %d] from [Peer -> ID %x ; Addr %s]\n", msg.ID(), fromid, fromaddr)
 			}
 
+		case peerID := <-ts.peerClosed:
+			ts.handlePeerClosed(peerID)
+
+		case <-ts.priorityChanged:
+			ts.handlePrioritiesChanged()
+
 		case <-unchokeTicker.C:
 			ts.runUnchokeRound()
 
+		case <-requestTicker.C:
+			ts.checkRequestTimeouts()
+
+		case <-pexTicker.C:
+			ts.pex.sendUpdates()
+
+		case <-resumeTicker.C:
+			if err := ts.saveResume(); err != nil {
+				fmt.Printf("Failed to save resume data: %v\n", err)
+			}
+
 		case <-announceTicker.C:
 			go func() {
 				if err := ts.AnnounceToTracker(""); err != nil {
@@ -188,12 +354,12 @@ func (ts *TorrentServer) runUnchokeRound() {
 			continue
 		}
 
-		var msg []byte
+		var msg p2p.Message
 		if action.Unchoke {
-			msg = []byte{p2p.MsgUnchoke}
+			msg = &p2p.Unchoke{}
 			fmt.Printf("[UNCHOKING] peer %x\n", action.PeerID)
 		} else {
-			msg = []byte{p2p.MsgChoke}
+			msg = &p2p.Choke{}
 			fmt.Printf("[CHOKING] peer %x\n", action.PeerID)
 		}
 
@@ -205,42 +371,64 @@ func (ts *TorrentServer) runUnchokeRound() {
 
 func (ts *TorrentServer) bootstrapNetwork() error {
 	if err := ts.populateBootstrapNodes(); err != nil {
-		return err
+		// peers remembered from the last run or found on the DHT or the
+		// LAN can stand in for the tracker
+		if len(ts.resumePeers) == 0 && !ts.useDHT() && !ts.useLSD() {
+			return err
+		}
+		fmt.Printf("[TRACKER] announce failed, using %d peers from resume data: %v\n", len(ts.resumePeers), err)
 	}
-
-	for _, addr := range ts.bootstrapNodes {
-
-		go func(addr string) {
-			if err := ts.Transport.Dial(addr); err != nil {
-				log.Printf("Failed to dial bootstrap node %s: %v", addr, err)
-			}
-		}(addr)
+	if ts.useDHT() {
+		go ts.dhtLoop()
 	}
+	if ts.useLSD() {
+		go ts.lsdLoop()
+	}
+	ts.addBootstrapNodes(ts.resumePeers)
+
+	ts.bootstrapMu.Lock()
+	nodes := append([]string(nil), ts.bootstrapNodes...)
+	ts.bootstrapMu.Unlock()
 
+	ts.connectPeers(nodes, "bootstrap")
 	return nil
 }
 
 func (ts *TorrentServer) populateBootstrapNodes() error {
-	resp, err := ts.trackerClient.Announce(ts.TrackerUrl, ts.TCPTransportOpts.InfoHash, 0, "started")
+	resp, err := ts.announce(ts.left(), "started")
 	if err != nil {
 		return err
 	}
 
-	unique := make(map[string]struct{})
+	var addrs []string
 	for _, p := range resp.Peers {
-		addr := formatAddr(p.IP, p.Port)
+		addrs = append(addrs, formatAddr(p.IP, p.Port))
+	}
+	ts.addBootstrapNodes(addrs)
+	fmt.Printf("[TRACKER] Found %d peers to connect to\n", len(ts.bootstrapNodes))
+
+	return nil
+}
+
+// addBootstrapNodes appends peer addresses to dial, skipping our own and
+// ones already known.
+func (ts *TorrentServer) addBootstrapNodes(addrs []string) {
+	ts.bootstrapMu.Lock()
+	defer ts.bootstrapMu.Unlock()
+
+	unique := make(map[string]struct{})
+	for _, addr := range ts.bootstrapNodes {
+		unique[addr] = struct{}{}
+	}
+	for _, addr := range addrs {
 		if addr == ts.Transport.Addr() {
 			continue
 		}
-
 		if _, exists := unique[addr]; !exists {
 			unique[addr] = struct{}{}
 			ts.bootstrapNodes = append(ts.bootstrapNodes, addr)
 		}
 	}
-	fmt.Printf("[TRACKER] Found %d peers to connect to\n", len(ts.bootstrapNodes))
-
-	return nil
 }
 
 func formatAddr(ip string, port int) string {
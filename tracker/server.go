@@ -1,7 +1,6 @@
 package tracker
 
 import (
-	"bytes"
 	"fmt"
 	"net"
 	"net/http"
@@ -10,7 +9,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/pixperk/pixtorrent/meta"
 )
 
 type Tracker struct {
@@ -159,13 +158,38 @@ func getClientIP(r *http.Request) string {
 	return ip
 }
 
+type announceResponse struct {
+	Interval int         `bencode:"interval"`
+	Peers    []peerEntry `bencode:"peers"`
+}
+
+type peerEntry struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+type scrapeStats struct {
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+	Downloaded int `bencode:"downloaded"`
+}
+
+type scrapeResponse struct {
+	Files map[string]scrapeStats `bencode:"files"`
+}
+
+type errorResponse struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
 func sendAnnounceResponse(w http.ResponseWriter, peers []*Peer, interval int) {
-	response := map[string]interface{}{
-		"interval": interval,
-		"peers":    convertPeersToList(peers),
+	response := announceResponse{
+		Interval: interval,
+		Peers:    convertPeersToList(peers),
 	}
 
-	data, err := encodeToBencode(response)
+	data, err := meta.Marshal(response)
 	if err != nil {
 		http.Error(w, "Encoding error", 500)
 		return
@@ -175,42 +199,29 @@ func sendAnnounceResponse(w http.ResponseWriter, peers []*Peer, interval int) {
 	w.Write(data)
 }
 
-func convertPeersToList(peers []*Peer) []map[string]interface{} {
-	result := make([]map[string]interface{}, len(peers))
+func convertPeersToList(peers []*Peer) []peerEntry {
+	result := make([]peerEntry, len(peers))
 	for i, peer := range peers {
-		result[i] = map[string]interface{}{
-			"peer id": peer.ID,
-			"ip":      peer.IP,
-			"port":    peer.Port,
+		result[i] = peerEntry{
+			PeerID: peer.ID,
+			IP:     peer.IP,
+			Port:   peer.Port,
 		}
 	}
 	return result
 }
 
 func sendErrorResponse(w http.ResponseWriter, reason string) {
-	response := map[string]interface{}{
-		"failure reason": reason,
-	}
-
-	data, _ := encodeToBencode(response)
+	data, _ := meta.Marshal(errorResponse{FailureReason: reason})
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write(data)
 }
 
-func encodeToBencode(data interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, data)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
 func (t *Tracker) handleScrape(w http.ResponseWriter, r *http.Request) {
 	// URL: GET /scrape?info_hash=%12%34%56%78%9a%bc%de%f0%12%34%56%78%9a%bc%de%f0%12%34%56%78
 	infoHashParams := r.URL.Query()["info_hash"]
 
-	files := make(map[string]interface{})
+	files := make(map[string]scrapeStats)
 
 	if len(infoHashParams) == 0 {
 		// TODO: Implement fetching stats for all torrents
@@ -225,27 +236,19 @@ func (t *Tracker) handleScrape(w http.ResponseWriter, r *http.Request) {
 			torrentStats, err := t.Store.GetTorrentStats(infoHash)
 			if err != nil {
 				// If torrent not found, set zeros
-				files[infoHashStr] = map[string]interface{}{
-					"complete":   0,
-					"incomplete": 0,
-					"downloaded": 0,
-				}
+				files[infoHashStr] = scrapeStats{}
 				continue
 			}
 
-			files[infoHashStr] = map[string]interface{}{
-				"complete":   len(torrentStats.Seeders),
-				"incomplete": len(torrentStats.Leechers),
-				"downloaded": torrentStats.Completed,
+			files[infoHashStr] = scrapeStats{
+				Complete:   len(torrentStats.Seeders),
+				Incomplete: len(torrentStats.Leechers),
+				Downloaded: torrentStats.Completed,
 			}
 		}
 	}
 
-	response := map[string]interface{}{
-		"files": files,
-	}
-
-	data, err := encodeToBencode(response)
+	data, err := meta.Marshal(scrapeResponse{Files: files})
 	if err != nil {
 		http.Error(w, "Encoding error", 500)
 		return